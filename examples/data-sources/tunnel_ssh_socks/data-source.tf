@@ -0,0 +1,15 @@
+# One proxy for every private endpoint the bastion can reach.
+data "tunnel_ssh_socks" "vpc" {
+  ssh_host = "bastion.example.com"
+  ssh_user = "ec2-user"
+
+  allowed_destinations = ["10.0.0.0/16", "*.eks.amazonaws.com"]
+}
+
+provider "kubernetes" {
+  host      = "https://ABCDEF0123456789.gr7.eu-west-1.eks.amazonaws.com"
+  proxy_url = format("socks5://%s:%s", data.tunnel_ssh_socks.vpc.local_host, data.tunnel_ssh_socks.vpc.local_port)
+
+  cluster_ca_certificate = file("~/.kube/cluster-ca-cert.pem")
+  token                  = var.eks_token
+}
@@ -0,0 +1,23 @@
+# Read the database password the bastion generated, then tunnel to the database.
+ephemeral "tunnel_ssh_command" "db_password" {
+  ssh_host = "bastion.example.com"
+  ssh_user = "ec2-user"
+
+  command = "sudo cat /run/secrets/db-password"
+  timeout = 30
+}
+
+ephemeral "tunnel_ssh" "db" {
+  ssh_host = "bastion.example.com"
+  ssh_user = "ec2-user"
+
+  target_host = "db.internal"
+  target_port = 5432
+}
+
+provider "postgresql" {
+  host     = ephemeral.tunnel_ssh.db.local_host
+  port     = ephemeral.tunnel_ssh.db.local_port
+  username = "admin"
+  password = trimspace(ephemeral.tunnel_ssh_command.db_password.stdout)
+}
@@ -0,0 +1,19 @@
+# Serve the artifacts next to Terraform to a host that cannot reach them.
+ephemeral "tunnel_ssh_reverse" "artifacts" {
+  local_port = 8080
+  ssh_host   = "build-host.example.com"
+  ssh_user   = "ec2-user"
+}
+
+resource "terraform_data" "agent" {
+  provisioner "remote-exec" {
+    connection {
+      host = "build-host.example.com"
+      user = "ec2-user"
+    }
+
+    inline = [
+      "curl -fsSL http://localhost:${ephemeral.tunnel_ssh_reverse.artifacts.remote_port}/agent.tar.gz | sudo tar -xz -C /opt",
+    ]
+  }
+}
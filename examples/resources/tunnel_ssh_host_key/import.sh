@@ -0,0 +1,2 @@
+# The host keys offered at import time are recorded.
+terraform import tunnel_ssh_host_key.bastion bastion.example.com:22
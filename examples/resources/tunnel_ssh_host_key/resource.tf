@@ -0,0 +1,13 @@
+# Trust the bastion's host key the first time it is seen, then pin it.
+resource "tunnel_ssh_host_key" "bastion" {
+  ssh_host = aws_instance.bastion.public_ip
+}
+
+ephemeral "tunnel_ssh" "db" {
+  ssh_host     = aws_instance.bastion.public_ip
+  ssh_user     = "ec2-user"
+  ssh_host_key = tunnel_ssh_host_key.bastion.host_keys
+
+  target_host = "db.internal"
+  target_port = 5432
+}
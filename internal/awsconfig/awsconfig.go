@@ -0,0 +1,39 @@
+// Package awsconfig resolves the AWS credentials every AWS call of the
+// provider is made with.
+package awsconfig
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// Load builds the SDK config from the default credential chain, for the
+// profile and region when they are set, assuming roleARN when it is set.
+func Load(ctx context.Context, region, profile, roleARN string) (aws.Config, error) {
+	loadOptions := []func(*config.LoadOptions) error{}
+	if region != "" {
+		loadOptions = append(loadOptions, config.WithRegion(region))
+	}
+	if profile != "" {
+		loadOptions = append(loadOptions, config.WithSharedConfigProfile(profile))
+	}
+
+	// Load base config first
+	awsCfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	// If role assumption is required, create STS client and configure assume role
+	if roleARN != "" {
+		stsClient := sts.NewFromConfig(awsCfg)
+		assumeRoleProvider := stscreds.NewAssumeRoleProvider(stsClient, roleARN)
+		awsCfg.Credentials = aws.NewCredentialsCache(assumeRoleProvider)
+	}
+
+	return awsCfg, nil
+}
@@ -1,33 +1,50 @@
 package libs
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // ForkTunnel starts a background tunnel and waits for its listener to be ready.
 func ForkTunnel(ctx context.Context, tunnelType, logName string, cfg any) (*exec.Cmd, error) {
+	cmd, _, err := ForkTunnelWithResult(ctx, tunnelType, logName, cfg)
+	return cmd, err
+}
+
+// ForkTunnelWithResult is ForkTunnel for tunnels that only learn something the
+// caller needs once they are ready, such as the port a remote listener was
+// given. The child reports it with SignalReadyWithResult.
+func ForkTunnelWithResult(ctx context.Context, tunnelType, logName string, cfg any) (*exec.Cmd, []byte, error) {
 	cfgJSON, err := json.Marshal(cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	logPath := TunnelLogPath(logName)
 	logFile, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer logFile.Close()
+	// Only what this child appends can explain why it failed.
+	logStart, err := logFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// A per-fork marker prevents concurrent tunnels acknowledging each other.
 	readyDir, err := os.MkdirTemp("", "terraform-provider-tunnel-ready-*")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer os.RemoveAll(readyDir)
 	readyPath := filepath.Join(readyDir, "ready")
@@ -43,16 +60,54 @@ func ForkTunnel(ctx context.Context, tunnelType, logName string, cfg any) (*exec
 	cmd.Stderr = logFile
 
 	if err := ctx.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := WaitForReadyFile(ctx, cmd.Process.Pid, readyPath); err != nil {
+		exited := CheckProcessExists(cmd.Process.Pid) != nil
 		// Failed startup must not leave a child that can bind the port later.
 		_ = cmd.Process.Kill()
 		_ = cmd.Wait()
-		return nil, fmt.Errorf("%w. check %s for more information", err, logPath)
+		if reason := lastLogLine(logPath, logStart); exited && reason != "" {
+			return nil, nil, fmt.Errorf("%w: %s. check %s for more information", err, reason, logPath)
+		}
+		return nil, nil, fmt.Errorf("%w. check %s for more information", err, logPath)
+	}
+	result, err := os.ReadFile(readyPath)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, nil, fmt.Errorf("read tunnel readiness: %w", err)
+	}
+	return cmd, result, nil
+}
+
+// lastLogLine returns the final message logged after offset, which for a child
+// that exited during startup is the error it exited with.
+func lastLogLine(path string, offset int64) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return ""
+	}
+	var last string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			last = line
+		}
+	}
+	// Drop the standard logger's "2006/01/02 15:04:05 " prefix.
+	const stamp = "2006/01/02 15:04:05 "
+	if len(last) > len(stamp) {
+		if _, err := time.Parse(stamp, last[:len(stamp)]); err == nil {
+			last = last[len(stamp):]
+		}
 	}
-	return cmd, nil
+	return last
 }
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -19,6 +21,8 @@ type forkTestConfig struct {
 	PIDPath       string
 	ReadyPathPath string
 	SignalReady   bool
+	Result        string
+	FailWith      string
 }
 
 func runForkTestChild() {
@@ -36,11 +40,19 @@ func runForkTestChild() {
 			os.Exit(2)
 		}
 	}
+	if cfg.FailWith != "" {
+		log.Fatal(cfg.FailWith)
+	}
 	if cfg.SignalReady {
 		if err := SignalReadyIfRequested(); err != nil {
 			os.Exit(2)
 		}
 	}
+	if cfg.Result != "" {
+		if err := SignalReadyWithResult([]byte(cfg.Result)); err != nil {
+			os.Exit(2)
+		}
+	}
 	for {
 		time.Sleep(time.Hour)
 	}
@@ -109,6 +121,24 @@ func TestForkTunnelUsesInvocationUniqueReadinessPaths(t *testing.T) {
 	}
 }
 
+func TestForkTunnelWithResultReturnsChildResult(t *testing.T) {
+	t.Setenv(TunnelLogDirEnv, t.TempDir())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmd, result, err := ForkTunnelWithResult(ctx, forkTestTunnelType, "result-fork.log", forkTestConfig{Result: "41022"})
+	if err != nil {
+		t.Fatalf("ForkTunnelWithResult() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	if string(result) != "41022" {
+		t.Fatalf("ForkTunnelWithResult() result = %q, want the child's 41022", result)
+	}
+}
+
 func TestForkTunnelCancellationKillsAndReapsChild(t *testing.T) {
 	t.Setenv(TunnelLogDirEnv, t.TempDir())
 	pidPath := filepath.Join(t.TempDir(), "pid")
@@ -154,3 +184,30 @@ func TestForkTunnelCancellationKillsAndReapsChild(t *testing.T) {
 		t.Fatalf("cancelled tunnel child %d is still running", pid)
 	}
 }
+
+// TestForkTunnelReportsChildStartupError keeps a failing child's reason in the
+// error Terraform shows, rather than only a pointer to the log file.
+func TestForkTunnelReportsChildStartupError(t *testing.T) {
+	logDir := t.TempDir()
+	t.Setenv(TunnelLogDirEnv, logDir)
+	// An earlier run's failure in the same log must not be reported again.
+	if err := os.WriteFile(filepath.Join(logDir, "failing-fork.log"), []byte("2000/01/01 00:00:00 stale failure\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := ForkTunnel(
+		ctx,
+		forkTestTunnelType,
+		"failing-fork.log",
+		forkTestConfig{FailWith: "host key verification failed"},
+	)
+	if err == nil {
+		t.Fatal("ForkTunnel() = nil, want the child's startup error")
+	}
+	if !strings.Contains(err.Error(), ": host key verification failed. check ") ||
+		strings.Contains(err.Error(), "stale failure") {
+		t.Fatalf("ForkTunnel() error = %v, want it to carry only this child's last log line", err)
+	}
+}
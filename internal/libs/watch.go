@@ -133,6 +133,23 @@ func SignalReadyIfRequested() error {
 	return nil
 }
 
+// SignalReadyWithResult is SignalReadyIfRequested for ForkTunnelWithResult.
+// The file appears whole, so the parent never reads a partial result.
+func SignalReadyWithResult(result []byte) error {
+	path := os.Getenv(TunnelReadyEnv)
+	if path == "" {
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, result, 0644); err != nil {
+		return fmt.Errorf("signal tunnel readiness: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("signal tunnel readiness: %w", err)
+	}
+	return nil
+}
+
 func WaitForReadyFile(ctx context.Context, pid int, path string) error {
 	timeout := 30 * time.Second
 	waitCtx, cancel := context.WithTimeout(ctx, timeout)
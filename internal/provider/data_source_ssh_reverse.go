@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ datasource.DataSource                   = &SSHReverseDataSource{}
+	_ datasource.DataSourceWithValidateConfig = &SSHReverseDataSource{}
+)
+
+func NewSSHReverseDataSource() datasource.DataSource {
+	return &SSHReverseDataSource{}
+}
+
+// SSHReverseDataSource defines the data source implementation.
+type SSHReverseDataSource struct{}
+
+func (d *SSHReverseDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_ssh_reverse"
+}
+
+func (d *SSHReverseDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Create a reverse SSH tunnel that exposes a local service on the SSH bastion",
+
+		Attributes: sshConnectionDataSourceAttributes(map[string]schema.Attribute{
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the local service the bastion's connections are relayed to. Defaults to `localhost`; ignored when `local_socket` is set.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The TCP port of the local service. Mutually exclusive with `local_socket`.",
+				Optional:            true,
+			},
+			"local_socket": schema.StringAttribute{
+				MarkdownDescription: "Path of the unix domain socket of the local service. Mutually exclusive with `local_port`.",
+				Optional:            true,
+			},
+			"remote_host": schema.StringAttribute{
+				MarkdownDescription: "The address the SSH bastion listens on. Defaults to `localhost`; other addresses need `GatewayPorts` enabled on the bastion.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"remote_port": schema.Int64Attribute{
+				MarkdownDescription: "The port the SSH bastion listens on. If not set, the bastion chooses a free port, which this attribute reports.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"remote_socket": schema.StringAttribute{
+				MarkdownDescription: "Path of a unix domain socket for the SSH bastion to listen on instead of a TCP port. Mutually exclusive with `remote_host` and `remote_port`.",
+				Optional:            true,
+			},
+		}),
+	}
+}
+
+func (d *SSHReverseDataSource) ValidateConfig(ctx context.Context, req datasource.ValidateConfigRequest, resp *datasource.ValidateConfigResponse) {
+	resp.Diagnostics.Append(validateSSHAlgorithms(ctx, req.Config)...)
+}
+
+func (d *SSHReverseDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data SSHReverseModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	cfg, diags := sshReverseConfig(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	_, port, err := ssh.ForkReverseTunnel(ctx, cfg)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to fork tunnel process", fmt.Sprintf("Error: %s", err))
+		return
+	}
+	setSSHReverseListener(&data, port)
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ datasource.DataSource                   = &SSHSOCKSDataSource{}
+	_ datasource.DataSourceWithValidateConfig = &SSHSOCKSDataSource{}
+)
+
+func NewSSHSOCKSDataSource() datasource.DataSource {
+	return &SSHSOCKSDataSource{}
+}
+
+// SSHSOCKSDataSource defines the data source implementation.
+type SSHSOCKSDataSource struct{}
+
+func (d *SSHSOCKSDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_ssh_socks"
+}
+
+func (d *SSHSOCKSDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Create a local SOCKS5 proxy that connects to any host the SSH bastion can reach",
+
+		Attributes: sshConnectionDataSourceAttributes(map[string]schema.Attribute{
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The local address the SOCKS5 proxy listens on. Defaults to `localhost`.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The local port the SOCKS5 proxy listens on. If not set, a random free port is chosen.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"max_connections": schema.Int64Attribute{
+				MarkdownDescription: "The most SSH connections to the bastion that forwarded connections are spread over. Another one is opened when every open one is in use, or when the bastion refuses a channel for lack of resources. Defaults to `1`.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"socks_username": schema.StringAttribute{
+				MarkdownDescription: "The username SOCKS5 clients must authenticate with. Requires `socks_password`; without both, the proxy accepts any local client.",
+				Optional:            true,
+			},
+			"socks_password": schema.StringAttribute{
+				MarkdownDescription: "The password SOCKS5 clients must authenticate with",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"allowed_destinations": schema.ListAttribute{
+				MarkdownDescription: "Destinations the proxy may connect to, as CIDRs, IP addresses or host name globs with `*` and `?` (for example `10.0.0.0/16` or `*.rds.amazonaws.com`). Host names are resolved by the bastion, so CIDRs only match destinations requested by address. If not set, every destination is allowed.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+		}),
+	}
+}
+
+func (d *SSHSOCKSDataSource) ValidateConfig(ctx context.Context, req datasource.ValidateConfigRequest, resp *datasource.ValidateConfigResponse) {
+	resp.Diagnostics.Append(validateSSHAlgorithms(ctx, req.Config)...)
+}
+
+func (d *SSHSOCKSDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data SSHSOCKSModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	cfg, diags := sshSOCKSConfig(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	_, err := ssh.ForkSOCKSTunnel(ctx, cfg)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to fork tunnel process", fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
@@ -9,10 +9,14 @@ import (
 	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
 	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
 	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 // Ensure provider defined types fully satisfy framework interfaces.
-var _ ephemeral.EphemeralResource = &SSHEphemeral{}
+var (
+	_ ephemeral.EphemeralResource                   = &SSHEphemeral{}
+	_ ephemeral.EphemeralResourceWithValidateConfig = &SSHEphemeral{}
+)
 
 func NewSSHEphemeral() ephemeral.EphemeralResource {
 	return &SSHEphemeral{}
@@ -29,47 +33,31 @@ func (d *SSHEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest,
 	resp.Schema = schema.Schema{
 		MarkdownDescription: "Create a local SSH tunnel to a remote host",
 
-		Attributes: map[string]schema.Attribute{
+		Attributes: sshConnectionEphemeralAttributes(map[string]schema.Attribute{
 			"target_host": schema.StringAttribute{
 				MarkdownDescription: "The DNS name or IP address of the remote host. Required when `target_port` is set; ignored when `target_socket` is set.",
 				Optional:            true,
 			},
 			"target_port": schema.Int64Attribute{
-				MarkdownDescription: "The TCP port of the remote host. Mutually exclusive with `target_socket`.",
+				MarkdownDescription: "The TCP port of the remote host. Mutually exclusive with `target_socket` and `target_hosts`.",
 				Optional:            true,
 			},
 			"target_socket": schema.StringAttribute{
-				MarkdownDescription: "Path of a unix domain socket on the SSH bastion to forward to. Mutually exclusive with `target_port`.",
-				Optional:            true,
-			},
-			"ssh_host": schema.StringAttribute{
-				MarkdownDescription: "The DNS name or IP address of the SSH bastion host",
-				Required:            true,
-			},
-			"ssh_port": schema.Int64Attribute{
-				MarkdownDescription: "The port number of the SSH bastion host",
+				MarkdownDescription: "Path of a unix domain socket on the SSH bastion to forward to. Mutually exclusive with `target_port` and `target_hosts`.",
 				Optional:            true,
-				Computed:            true,
-			},
-			"ssh_user": schema.StringAttribute{
-				MarkdownDescription: "The username to use for the SSH connection",
-				Optional:            true,
-				Computed:            true,
 			},
-			"ssh_password": schema.StringAttribute{
-				MarkdownDescription: "The password to use for the SSH connection",
+			"target_hosts": schema.ListAttribute{
+				MarkdownDescription: "Remote hosts to forward to instead of `target_host` and `target_port`, each as `host:port`, such as a database primary and its replicas. A connection that the bastion cannot open to a target within 10 seconds moves on to the next; the target that failed is tried last until `target_hosts_cooldown` has passed.",
+				ElementType:         types.StringType,
 				Optional:            true,
-				Sensitive:           true,
 			},
-			"ssh_key": schema.StringAttribute{
-				MarkdownDescription: "The path to the private key file or the private key content to use for the SSH connection",
+			"target_hosts_strategy": schema.StringAttribute{
+				MarkdownDescription: "How connections are spread over `target_hosts`: `failover` sends every connection to the first target that works, `round_robin` starts each connection at the next target in turn. Defaults to `failover`.",
 				Optional:            true,
-				Sensitive:           true,
 			},
-			"ssh_key_passphrase": schema.StringAttribute{
-				MarkdownDescription: "The passphrase for the private key file",
+			"target_hosts_cooldown": schema.Int64Attribute{
+				MarkdownDescription: "Seconds a target in `target_hosts` that failed is tried last. Defaults to `60`.",
 				Optional:            true,
-				Sensitive:           true,
 			},
 			"local_host": schema.StringAttribute{
 				MarkdownDescription: "The local address to listen on. Defaults to `localhost`.",
@@ -81,10 +69,19 @@ func (d *SSHEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest,
 				Optional:            true,
 				Computed:            true,
 			},
-		},
+			"max_connections": schema.Int64Attribute{
+				MarkdownDescription: "The most SSH connections to the bastion that forwarded connections are spread over. Another one is opened when every open one is in use, or when the bastion refuses a channel for lack of resources. Defaults to `1`.",
+				Optional:            true,
+				Computed:            true,
+			},
+		}),
 	}
 }
 
+func (d *SSHEphemeral) ValidateConfig(ctx context.Context, req ephemeral.ValidateConfigRequest, resp *ephemeral.ValidateConfigResponse) {
+	resp.Diagnostics.Append(validateSSHAlgorithms(ctx, req.Config)...)
+}
+
 func (d *SSHEphemeral) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
 	var data SSHModel
 
@@ -95,7 +92,7 @@ func (d *SSHEphemeral) Open(ctx context.Context, req ephemeral.OpenRequest, resp
 		return
 	}
 
-	cfg, diags := sshConfig(&data)
+	cfg, diags := sshConfig(ctx, &data)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
@@ -124,3 +121,265 @@ func (d *SSHEphemeral) Close(ctx context.Context, req ephemeral.CloseRequest, re
 		return
 	}
 }
+
+// sshConnectionEphemeralAttributes adds the attributes that reach the SSH bastion,
+// which every SSH tunnel shares, to attributes.
+func sshConnectionEphemeralAttributes(attributes map[string]schema.Attribute) map[string]schema.Attribute {
+	attributes["ssh_config_file"] = schema.StringAttribute{
+		MarkdownDescription: "Path of an OpenSSH client config file whose `Host` and `Match` sections apply to `ssh_host` and the jump hosts. `HostName`, `User`, `Port`, `IdentityFile`, `IdentitiesOnly`, `UserKnownHostsFile`, `ProxyJump`, `ServerAliveInterval` and `ServerAliveCountMax` fill in the attributes that are not set. Defaults to `~/.ssh/config` when it exists; set to `none` to ignore it. Does not apply to `ssh_hosts`.",
+		Optional:            true,
+	}
+	attributes["ssh_host"] = schema.StringAttribute{
+		MarkdownDescription: "The DNS name or IP address of the SSH bastion host, or a `Host` alias from the SSH config file. Exactly one of `ssh_host` and `ssh_hosts` must be set.",
+		Optional:            true,
+	}
+	attributes["ssh_hosts"] = schema.ListAttribute{
+		MarkdownDescription: "Equivalent SSH bastion hosts, as `host` or `host:port`, to fail over between. Each connection, reconnects included, goes to the first one that accepts it; a bastion that failed is tried last until `ssh_hosts_cooldown` has passed. The SSH config file is not consulted for them.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_hosts_order"] = schema.StringAttribute{
+		MarkdownDescription: "The order `ssh_hosts` are tried in: `sequential`, the default, or `random` to spread tunnels across them.",
+		Optional:            true,
+	}
+	attributes["ssh_hosts_cooldown"] = schema.Int64Attribute{
+		MarkdownDescription: "Seconds a bastion from `ssh_hosts` is tried last after it failed. Defaults to `60`.",
+		Optional:            true,
+	}
+	attributes["ssh_port"] = schema.Int64Attribute{
+		MarkdownDescription: "The port number of the SSH bastion host. Defaults to the SSH config file's `Port`, then `22`.",
+		Optional:            true,
+		Computed:            true,
+	}
+	attributes["keepalive_interval"] = schema.Int64Attribute{
+		MarkdownDescription: "Seconds between the keepalive requests sent to the SSH bastion host, like OpenSSH's `ServerAliveInterval`. Each request waits as long for its reply. The same interval drives TCP keepalive on the connection. Defaults to the SSH config file's `ServerAliveInterval`, then `30`.",
+		Optional:            true,
+		Computed:            true,
+	}
+	attributes["keepalive_count_max"] = schema.Int64Attribute{
+		MarkdownDescription: "Number of keepalive requests in a row that may go unanswered before the connection is considered dead and re-established, like OpenSSH's `ServerAliveCountMax`. Defaults to the SSH config file's `ServerAliveCountMax`, then `3`.",
+		Optional:            true,
+		Computed:            true,
+	}
+	attributes["ssh_proxy_url"] = schema.StringAttribute{
+		MarkdownDescription: "URL of an HTTP CONNECT or SOCKS5 proxy to reach the SSH bastion host, or the first jump host, through: `http://`, `https://`, `socks5://` (names resolved locally) or `socks5h://` (names resolved by the proxy), with optional `user:password@` credentials. Defaults to the `ALL_PROXY` environment variable unless `NO_PROXY` matches the host.",
+		Optional:            true,
+		Sensitive:           true,
+	}
+	attributes["ssh_algorithm_preset"] = schema.StringAttribute{
+		MarkdownDescription: "A set of SSH algorithms to negotiate with the bastion and jump hosts: `modern` drops SHA-1 and small Diffie-Hellman groups, `fips` keeps to FIPS 140 approved algorithms, `legacy` adds the SHA-1, CBC and DSA algorithms old appliances need. Defaults to the SSH library's own selection.",
+		Optional:            true,
+	}
+	attributes["ssh_ciphers"] = schema.ListAttribute{
+		MarkdownDescription: "The ciphers to offer, in order of preference, such as `aes256-gcm@openssh.com`. Overrides `ssh_algorithm_preset`.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_host_key_algorithms"] = schema.ListAttribute{
+		MarkdownDescription: "The host key algorithms to accept, in order of preference, such as `ssh-ed25519` or `rsa-sha2-512`. Overrides `ssh_algorithm_preset`.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_kex_algorithms"] = schema.ListAttribute{
+		MarkdownDescription: "The key exchange algorithms to offer, in order of preference, such as `curve25519-sha256`. Overrides `ssh_algorithm_preset`.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_macs"] = schema.ListAttribute{
+		MarkdownDescription: "The MAC algorithms to offer, in order of preference, such as `hmac-sha2-256-etm@openssh.com`. Overrides `ssh_algorithm_preset`.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_user"] = schema.StringAttribute{
+		MarkdownDescription: "The username to use for the SSH connection. Defaults to the SSH config file's `User`, then the local username.",
+		Optional:            true,
+		Computed:            true,
+	}
+	attributes["ssh_password"] = schema.StringAttribute{
+		MarkdownDescription: "The password to use for the SSH connection",
+		Optional:            true,
+		Sensitive:           true,
+	}
+	attributes["ssh_key"] = schema.StringAttribute{
+		MarkdownDescription: "The path to the private key file or the private key content to use for the SSH connection",
+		Optional:            true,
+		Sensitive:           true,
+	}
+	attributes["ssh_certificate"] = schema.StringAttribute{
+		MarkdownDescription: "The path to an OpenSSH user certificate or the certificate content, signed for `ssh_key`. Without it, a certificate named after the key with a `-cert.pub` suffix is used when present, as are certificates held by the ssh-agent.",
+		Optional:            true,
+	}
+	attributes["ssh_key_passphrase"] = schema.StringAttribute{
+		MarkdownDescription: "The passphrase for the private key file. Also decrypts the default keys in `~/.ssh` and the SSH config file's identity files when no credential is set.",
+		Optional:            true,
+		Sensitive:           true,
+	}
+	attributes["ssh_use_agent"] = schema.BoolAttribute{
+		MarkdownDescription: "Whether to authenticate with the keys of the ssh-agent. `true` offers the agent's keys alone, leaving out the keys in `~/.ssh`; `false` never contacts the agent. By default both are offered when no other credential is set, unless the SSH config file sets `IdentitiesOnly`.",
+		Optional:            true,
+	}
+	attributes["ssh_agent_identity"] = schema.ListAttribute{
+		MarkdownDescription: "The ssh-agent keys to offer, each given as a public key in `authorized_keys` format, a `SHA256:` or `MD5:` fingerprint, or the key's comment. The other agent keys and the keys in `~/.ssh` are not offered, so a bastion's `MaxAuthTries` is not spent on them.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_agent_socket"] = schema.StringAttribute{
+		MarkdownDescription: "Path of the ssh-agent socket. Defaults to the `SSH_AUTH_SOCK` environment variable.",
+		Optional:            true,
+	}
+	attributes["keyboard_interactive"] = schema.ListNestedAttribute{
+		MarkdownDescription: "Answers to the bastion's keyboard-interactive prompts, such as a one-time code required after the key (`AuthenticationMethods publickey,keyboard-interactive`). Each prompt is answered by the first entry whose `prompt` matches it.",
+		Optional:            true,
+		NestedObject: schema.NestedAttributeObject{
+			Attributes: map[string]schema.Attribute{
+				"prompt": schema.StringAttribute{
+					MarkdownDescription: "Regular expression matched against the prompt text",
+					Required:            true,
+				},
+				"answer": schema.StringAttribute{
+					MarkdownDescription: "The static answer to the prompt. Mutually exclusive with `totp_secret`.",
+					Optional:            true,
+					Sensitive:           true,
+				},
+				"totp_secret": schema.StringAttribute{
+					MarkdownDescription: "Base32 TOTP secret; the prompt is answered with the current 6-digit, 30-second code. Mutually exclusive with `answer`.",
+					Optional:            true,
+					Sensitive:           true,
+				},
+			},
+		},
+	}
+	attributes["ssh_known_hosts_file"] = schema.StringAttribute{
+		MarkdownDescription: "Path of an OpenSSH `known_hosts` file to verify the SSH bastion's host key against, including `@cert-authority` entries. When no host key setting is given, `~/.ssh/known_hosts` is used if it exists.",
+		Optional:            true,
+	}
+	attributes["ssh_host_key"] = schema.ListAttribute{
+		MarkdownDescription: "Public keys the SSH bastion may present, in `authorized_keys` format (for example the contents of `/etc/ssh/ssh_host_ed25519_key.pub`).",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_host_ca_key"] = schema.ListAttribute{
+		MarkdownDescription: "Public keys of SSH certificate authorities, in `authorized_keys` format. A host certificate signed by one of them and naming `ssh_host` as a principal is trusted.",
+		ElementType:         types.StringType,
+		Optional:            true,
+	}
+	attributes["ssh_insecure_ignore_host_key"] = schema.BoolAttribute{
+		MarkdownDescription: "Skip verification of the SSH bastion's host key. This exposes the tunnel to man-in-the-middle attacks; prefer `ssh_host_key`. Cannot be combined with the other host key settings.",
+		Optional:            true,
+	}
+	attributes["ec2_instance_connect"] = schema.SingleNestedAttribute{
+		MarkdownDescription: "Authenticate to the bastion, an EC2 instance, with a key generated for the tunnel and pushed with EC2 Instance Connect for `ssh_user`, instead of `ssh_key`. The key is pushed again whenever the tunnel reconnects after the previous push expired. AWS credentials come from the same chain as `tunnel_ssm`.",
+		Optional:            true,
+		Attributes: map[string]schema.Attribute{
+			"instance_id": schema.StringAttribute{
+				MarkdownDescription: "The ID of the bastion instance",
+				Required:            true,
+			},
+			"availability_zone": schema.StringAttribute{
+				MarkdownDescription: "The Availability Zone of the bastion instance",
+				Optional:            true,
+			},
+			"region": schema.StringAttribute{
+				MarkdownDescription: "AWS Region of the bastion instance. Can also be set using either the environment variables `AWS_REGION` or `AWS_DEFAULT_REGION`.",
+				Optional:            true,
+			},
+			"profile": schema.StringAttribute{
+				MarkdownDescription: "AWS profile name as set in credentials files. Can also be set using either the environment variables `AWS_PROFILE` or `AWS_DEFAULT_PROFILE`.",
+				Optional:            true,
+			},
+			"role_arn": schema.StringAttribute{
+				MarkdownDescription: "ARN of an IAM role to assume.",
+				Optional:            true,
+			},
+			"endpoint_url": schema.StringAttribute{
+				MarkdownDescription: "URL of the EC2 Instance Connect API, to use a VPC endpoint or a local stand-in.",
+				Optional:            true,
+			},
+		},
+	}
+	attributes["vault_ssh_signer"] = schema.SingleNestedAttribute{
+		MarkdownDescription: "Authenticate to the bastion with a key generated for the tunnel and a short-lived certificate signed by a Vault SSH secrets engine, instead of `ssh_key`. The key is signed again whenever the tunnel reconnects after the certificate expired. The role must grant the `permit-port-forwarding` extension.",
+		Optional:            true,
+		Attributes: map[string]schema.Attribute{
+			"address": schema.StringAttribute{
+				MarkdownDescription: "The address of the Vault server. Can also be set using the environment variable `VAULT_ADDR`.",
+				Optional:            true,
+			},
+			"namespace": schema.StringAttribute{
+				MarkdownDescription: "The Vault Enterprise namespace of the secrets engine",
+				Optional:            true,
+			},
+			"mount": schema.StringAttribute{
+				MarkdownDescription: "The path the SSH secrets engine is mounted at. Defaults to `ssh`.",
+				Optional:            true,
+			},
+			"role": schema.StringAttribute{
+				MarkdownDescription: "The SSH secrets engine role to sign the key with",
+				Required:            true,
+			},
+			"token": schema.StringAttribute{
+				MarkdownDescription: "The Vault token to sign with. Can also be set using the environment variable `VAULT_TOKEN`.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"approle_role_id": schema.StringAttribute{
+				MarkdownDescription: "The AppRole role ID to log in with instead of `token`",
+				Optional:            true,
+			},
+			"approle_secret_id": schema.StringAttribute{
+				MarkdownDescription: "The AppRole secret ID to log in with instead of `token`",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"approle_mount": schema.StringAttribute{
+				MarkdownDescription: "The path the AppRole auth method is mounted at. Defaults to `approle`.",
+				Optional:            true,
+			},
+			"valid_principals": schema.ListAttribute{
+				MarkdownDescription: "The principals to request in the certificate. Defaults to the role's default principals.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+			"ttl": schema.StringAttribute{
+				MarkdownDescription: "The validity to request for each certificate, as a Vault duration such as `30m`, `3600` seconds or `1d`. Defaults to the role's TTL.",
+				Optional:            true,
+			},
+		},
+	}
+	attributes["jump_hosts"] = schema.ListNestedAttribute{
+		MarkdownDescription: "SSH servers to relay the connection to the bastion through, in order, like OpenSSH's `ProxyJump`. Each hop is reached through the one before it.",
+		Optional:            true,
+		NestedObject: schema.NestedAttributeObject{
+			Attributes: map[string]schema.Attribute{
+				"host": schema.StringAttribute{
+					MarkdownDescription: "The DNS name or IP address of the jump host",
+					Required:            true,
+				},
+				"port": schema.Int64Attribute{
+					MarkdownDescription: "The port number of the jump host. Defaults to `22`.",
+					Optional:            true,
+				},
+				"user": schema.StringAttribute{
+					MarkdownDescription: "The username on the jump host. Defaults to `ssh_user`.",
+					Optional:            true,
+				},
+				"key": schema.StringAttribute{
+					MarkdownDescription: "The path to the private key file or the private key content for the jump host. When neither `key` nor `password` is set, the bastion's credentials are used, except the key `ec2_instance_connect` pushes to the bastion only.",
+					Optional:            true,
+					Sensitive:           true,
+				},
+				"password": schema.StringAttribute{
+					MarkdownDescription: "The password for the jump host",
+					Optional:            true,
+					Sensitive:           true,
+				},
+				"host_key": schema.ListAttribute{
+					MarkdownDescription: "Public keys the jump host may present, in `authorized_keys` format. `ssh_known_hosts_file`, `ssh_host_ca_key` and `ssh_insecure_ignore_host_key` apply to jump hosts too.",
+					ElementType:         types.StringType,
+					Optional:            true,
+				},
+			},
+		},
+	}
+	return attributes
+}
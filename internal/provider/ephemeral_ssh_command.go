@@ -0,0 +1,98 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ ephemeral.EphemeralResource                   = &SSHCommandEphemeral{}
+	_ ephemeral.EphemeralResourceWithValidateConfig = &SSHCommandEphemeral{}
+)
+
+func NewSSHCommandEphemeral() ephemeral.EphemeralResource {
+	return &SSHCommandEphemeral{}
+}
+
+// SSHCommandEphemeral defines the ephemeral resource implementation.
+type SSHCommandEphemeral struct{}
+
+func (d *SSHCommandEphemeral) Metadata(ctx context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_ssh_command"
+}
+
+func (d *SSHCommandEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Run a command on the SSH bastion host",
+
+		Attributes: sshConnectionEphemeralAttributes(map[string]schema.Attribute{
+			"command": schema.StringAttribute{
+				MarkdownDescription: "The command to run, interpreted by the bastion user's login shell",
+				Required:            true,
+			},
+			"stdin": schema.StringAttribute{
+				MarkdownDescription: "Input written to the command's standard input",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"timeout": schema.Int64Attribute{
+				MarkdownDescription: "Seconds to wait for the connection and the command to finish before the command is killed; `0` waits without a limit. Defaults to `60`.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"stdout": schema.StringAttribute{
+				MarkdownDescription: "The command's standard output",
+				Computed:            true,
+				Sensitive:           true,
+			},
+			"stderr": schema.StringAttribute{
+				MarkdownDescription: "The command's standard error",
+				Computed:            true,
+				Sensitive:           true,
+			},
+			"exit_status": schema.Int64Attribute{
+				MarkdownDescription: "The command's exit status. A non-zero status does not fail the resource; check it where the output is used.",
+				Computed:            true,
+				Sensitive:           true,
+			},
+		}),
+	}
+}
+
+func (d *SSHCommandEphemeral) ValidateConfig(ctx context.Context, req ephemeral.ValidateConfigRequest, resp *ephemeral.ValidateConfigResponse) {
+	resp.Diagnostics.Append(validateSSHAlgorithms(ctx, req.Config)...)
+}
+
+func (d *SSHCommandEphemeral) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	var data SSHCommandModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	cfg, diags := sshCommandConfig(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	result, err := ssh.RunCommand(ctx, cfg)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to run SSH command", fmt.Sprintf("Error: %s", err))
+		return
+	}
+	data.ExitStatus = types.Int64Value(int64(result.ExitStatus))
+	data.Stderr = types.StringValue(result.Stderr)
+	data.Stdout = types.StringValue(result.Stdout)
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.Result.Set(ctx, &data)...)
+}
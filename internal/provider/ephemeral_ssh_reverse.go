@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ ephemeral.EphemeralResource                   = &SSHReverseEphemeral{}
+	_ ephemeral.EphemeralResourceWithValidateConfig = &SSHReverseEphemeral{}
+)
+
+func NewSSHReverseEphemeral() ephemeral.EphemeralResource {
+	return &SSHReverseEphemeral{}
+}
+
+// SSHReverseEphemeral defines the ephemeral resource implementation.
+type SSHReverseEphemeral struct{}
+
+func (d *SSHReverseEphemeral) Metadata(ctx context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_ssh_reverse"
+}
+
+func (d *SSHReverseEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Create a reverse SSH tunnel that exposes a local service on the SSH bastion",
+
+		Attributes: sshConnectionEphemeralAttributes(map[string]schema.Attribute{
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the local service the bastion's connections are relayed to. Defaults to `localhost`; ignored when `local_socket` is set.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The TCP port of the local service. Mutually exclusive with `local_socket`.",
+				Optional:            true,
+			},
+			"local_socket": schema.StringAttribute{
+				MarkdownDescription: "Path of the unix domain socket of the local service. Mutually exclusive with `local_port`.",
+				Optional:            true,
+			},
+			"remote_host": schema.StringAttribute{
+				MarkdownDescription: "The address the SSH bastion listens on. Defaults to `localhost`; other addresses need `GatewayPorts` enabled on the bastion.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"remote_port": schema.Int64Attribute{
+				MarkdownDescription: "The port the SSH bastion listens on. If not set, the bastion chooses a free port, which this attribute reports.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"remote_socket": schema.StringAttribute{
+				MarkdownDescription: "Path of a unix domain socket for the SSH bastion to listen on instead of a TCP port. Mutually exclusive with `remote_host` and `remote_port`.",
+				Optional:            true,
+			},
+		}),
+	}
+}
+
+func (d *SSHReverseEphemeral) ValidateConfig(ctx context.Context, req ephemeral.ValidateConfigRequest, resp *ephemeral.ValidateConfigResponse) {
+	resp.Diagnostics.Append(validateSSHAlgorithms(ctx, req.Config)...)
+}
+
+func (d *SSHReverseEphemeral) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	var data SSHReverseModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	cfg, diags := sshReverseConfig(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	cmd, port, err := ssh.ForkReverseTunnel(ctx, cfg)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to fork tunnel process", fmt.Sprintf("Error: %s", err))
+		return
+	}
+	setSSHReverseListener(&data, port)
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.Result.Set(ctx, &data)...)
+	resp.Private.SetKey(ctx, "tunnel_pid", []byte(strconv.Itoa(cmd.Process.Pid)))
+}
+
+func (d *SSHReverseEphemeral) Close(ctx context.Context, req ephemeral.CloseRequest, resp *ephemeral.CloseResponse) {
+	tunnelBytes, _ := req.Private.GetKey(ctx, "tunnel_pid")
+	tunnelPID, err := strconv.Atoi(string(tunnelBytes))
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to parse tunnel PID", fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	if err := libs.Interrupt(tunnelPID); err != nil {
+		resp.Diagnostics.AddError("Failed to terminate tunnel process", fmt.Sprintf("Error: %s", err))
+		return
+	}
+}
@@ -0,0 +1,112 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
+	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ ephemeral.EphemeralResource                   = &SSHSOCKSEphemeral{}
+	_ ephemeral.EphemeralResourceWithValidateConfig = &SSHSOCKSEphemeral{}
+)
+
+func NewSSHSOCKSEphemeral() ephemeral.EphemeralResource {
+	return &SSHSOCKSEphemeral{}
+}
+
+// SSHSOCKSEphemeral defines the ephemeral resource implementation.
+type SSHSOCKSEphemeral struct{}
+
+func (d *SSHSOCKSEphemeral) Metadata(ctx context.Context, req ephemeral.MetadataRequest, resp *ephemeral.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_ssh_socks"
+}
+
+func (d *SSHSOCKSEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest, resp *ephemeral.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Create a local SOCKS5 proxy that connects to any host the SSH bastion can reach",
+
+		Attributes: sshConnectionEphemeralAttributes(map[string]schema.Attribute{
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The local address the SOCKS5 proxy listens on. Defaults to `localhost`.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"local_port": schema.Int64Attribute{
+				MarkdownDescription: "The local port the SOCKS5 proxy listens on. If not set, a random free port is chosen.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"max_connections": schema.Int64Attribute{
+				MarkdownDescription: "The most SSH connections to the bastion that forwarded connections are spread over. Another one is opened when every open one is in use, or when the bastion refuses a channel for lack of resources. Defaults to `1`.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"socks_username": schema.StringAttribute{
+				MarkdownDescription: "The username SOCKS5 clients must authenticate with. Requires `socks_password`; without both, the proxy accepts any local client.",
+				Optional:            true,
+			},
+			"socks_password": schema.StringAttribute{
+				MarkdownDescription: "The password SOCKS5 clients must authenticate with",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"allowed_destinations": schema.ListAttribute{
+				MarkdownDescription: "Destinations the proxy may connect to, as CIDRs, IP addresses or host name globs with `*` and `?` (for example `10.0.0.0/16` or `*.rds.amazonaws.com`). Host names are resolved by the bastion, so CIDRs only match destinations requested by address. If not set, every destination is allowed.",
+				ElementType:         types.StringType,
+				Optional:            true,
+			},
+		}),
+	}
+}
+
+func (d *SSHSOCKSEphemeral) ValidateConfig(ctx context.Context, req ephemeral.ValidateConfigRequest, resp *ephemeral.ValidateConfigResponse) {
+	resp.Diagnostics.Append(validateSSHAlgorithms(ctx, req.Config)...)
+}
+
+func (d *SSHSOCKSEphemeral) Open(ctx context.Context, req ephemeral.OpenRequest, resp *ephemeral.OpenResponse) {
+	var data SSHSOCKSModel
+
+	// Read Terraform configuration data into the model
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	cfg, diags := sshSOCKSConfig(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	cmd, err := ssh.ForkSOCKSTunnel(ctx, cfg)
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to fork tunnel process", fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.Result.Set(ctx, &data)...)
+	resp.Private.SetKey(ctx, "tunnel_pid", []byte(strconv.Itoa(cmd.Process.Pid)))
+}
+
+func (d *SSHSOCKSEphemeral) Close(ctx context.Context, req ephemeral.CloseRequest, resp *ephemeral.CloseResponse) {
+	tunnelBytes, _ := req.Private.GetKey(ctx, "tunnel_pid")
+	tunnelPID, err := strconv.Atoi(string(tunnelBytes))
+	if err != nil {
+		resp.Diagnostics.AddError("Failed to parse tunnel PID", fmt.Sprintf("Error: %s", err))
+		return
+	}
+
+	if err := libs.Interrupt(tunnelPID); err != nil {
+		resp.Diagnostics.AddError("Failed to terminate tunnel process", fmt.Sprintf("Error: %s", err))
+		return
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/dfns/terraform-provider-tunnel/internal/ssm"
 	"github.com/hashicorp/terraform-plugin-framework/ephemeral"
 	"github.com/hashicorp/terraform-plugin-framework/ephemeral/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 // Ensure provider defined types fully satisfy framework interfaces.
@@ -31,19 +32,68 @@ func (d *SSMEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest,
 
 		Attributes: map[string]schema.Attribute{
 			"target_host": schema.StringAttribute{
-				MarkdownDescription: "The DNS name or IP address of the remote host. Required when `ssm_document` is unset or set to `AWS-StartPortForwardingSessionToRemoteHost`; omit when using a custom document that defines a fixed host.",
+				MarkdownDescription: "The DNS name or IP address of the remote host. Required when `ssm_document` is unset or set to `AWS-StartPortForwardingSessionToRemoteHost`; omit with `AWS-StartPortForwardingSession` or a custom document that defines a fixed host.",
 				Optional:            true,
 			},
 			"target_port": schema.Int64Attribute{
-				MarkdownDescription: "The port number of the remote host. Required when `ssm_document` is unset or set to `AWS-StartPortForwardingSessionToRemoteHost`; omit when using a custom document that defines a fixed port.",
+				MarkdownDescription: "The port number of the remote host. Required when `ssm_document` is unset or set to `AWS-StartPortForwardingSessionToRemoteHost` or `AWS-StartPortForwardingSession`; omit when using a custom document that defines a fixed port.",
 				Optional:            true,
 			},
 			"ssm_instance": schema.StringAttribute{
-				MarkdownDescription: "Specify the exact Instance ID of the managed node to connect to for the session",
-				Required:            true,
+				MarkdownDescription: "Specify the exact Instance ID of the managed node to connect to for the session. Mutually exclusive with `ssm_instance_filters` and `ecs_cluster`, and set to the managed node or ECS Exec target they picked when they are used.",
+				Optional:            true,
+				Computed:            true,
+			},
+			"ssm_instance_filters": schema.SingleNestedAttribute{
+				MarkdownDescription: "Pick the managed node to connect to among the online ones these filters match, instead of `ssm_instance`, for nodes that are replaced, such as those of an Auto Scaling group. The node with the lowest ID is picked, and picked again when the tunnel starts a new session.",
+				Optional:            true,
+				Attributes: map[string]schema.Attribute{
+					"tags": schema.MapAttribute{
+						MarkdownDescription: "Tags the managed node must carry, by key",
+						ElementType:         types.StringType,
+						Optional:            true,
+					},
+					"name": schema.StringAttribute{
+						MarkdownDescription: "The `Name` tag of the managed node",
+						Optional:            true,
+					},
+					"platform": schema.StringAttribute{
+						MarkdownDescription: "The platform of the managed node: `Linux`, `Windows` or `MacOS`",
+						Optional:            true,
+					},
+				},
+			},
+			"ecs_cluster": schema.StringAttribute{
+				MarkdownDescription: "Name or ARN of the ECS cluster whose task to connect to with ECS Exec, instead of `ssm_instance`. Requires one of `ecs_service` or `ecs_task`.",
+				Optional:            true,
+			},
+			"ecs_service": schema.StringAttribute{
+				MarkdownDescription: "Name of the ECS service whose running task to connect to. The task with the lowest ID is picked, and picked again when the tunnel starts a new session, so the tunnel follows the service as it replaces its tasks.",
+				Optional:            true,
+			},
+			"ecs_task": schema.StringAttribute{
+				MarkdownDescription: "ID or ARN of the running ECS task to connect to. Mutually exclusive with `ecs_service`.",
+				Optional:            true,
+			},
+			"ecs_container": schema.StringAttribute{
+				MarkdownDescription: "Name of the container in the task to connect to. Can be omitted when the task runs a single container.",
+				Optional:            true,
+			},
+			"ecs_endpoint_url": schema.StringAttribute{
+				MarkdownDescription: "URL of the ECS API, to use a VPC endpoint or a local stand-in.",
+				Optional:            true,
 			},
 			"ssm_document": schema.StringAttribute{
-				MarkdownDescription: "Name of the SSM Session document to use for port forwarding. Defaults to `AWS-StartPortForwardingSessionToRemoteHost` when unset.",
+				MarkdownDescription: "Name of the SSM Session document to use for port forwarding. Defaults to `AWS-StartPortForwardingSessionToRemoteHost` when unset. Set to `AWS-StartPortForwardingSession` to forward to `target_port` on the managed node itself.",
+				Optional:            true,
+			},
+			"ssm_document_parameters": schema.MapAttribute{
+				MarkdownDescription: "Parameters of a custom `ssm_document`, by name, passed along with `localPortNumber`, `host` and `portNumber`, which `local_port`, `target_host` and `target_port` set.",
+				ElementType:         types.ListType{ElemType: types.StringType},
+				Optional:            true,
+			},
+			"reason": schema.StringAttribute{
+				MarkdownDescription: "Reason for the session, recorded by Session Manager, of up to 256 characters.",
 				Optional:            true,
 			},
 			"ssm_profile": schema.StringAttribute{
@@ -56,20 +106,32 @@ func (d *SSMEphemeral) Schema(ctx context.Context, req ephemeral.SchemaRequest,
 				Optional:            true,
 				Computed:            true,
 			},
+			"wait_for_target": schema.Int64Attribute{
+				MarkdownDescription: "Seconds to wait for the managed node or ECS task to come online and accept the session, for one created in the same apply. Defaults to `0`, which does not wait.",
+				Optional:            true,
+			},
+			"ssm_endpoint_url": schema.StringAttribute{
+				MarkdownDescription: "URL of the SSM API, to use a VPC endpoint or a local stand-in.",
+				Optional:            true,
+			},
 			"ssm_region": schema.StringAttribute{
 				MarkdownDescription: "AWS Region where the instance is located. The Region must be set. Can also be set using either the environment variables `AWS_REGION` or `AWS_DEFAULT_REGION`.",
 				Optional:            true,
 				Computed:            true,
 			},
+			"local_host": schema.StringAttribute{
+				MarkdownDescription: "The local address to listen on. Defaults to `localhost`. Binding a non-loopback address can expose the tunnel to other hosts.",
+				Optional:            true,
+				Computed:            true,
+			},
 			"local_port": schema.Int64Attribute{
 				MarkdownDescription: "The local port to listen on. If not set, a random free port is chosen.",
 				Optional:            true,
 				Computed:            true,
 			},
-			// Computed attributes
-			"local_host": schema.StringAttribute{
-				MarkdownDescription: "The DNS name or IP address of the local host",
-				Computed:            true,
+			"local_socket": schema.StringAttribute{
+				MarkdownDescription: "Path of a unix domain socket to listen on instead of a TCP port. Mutually exclusive with `local_host` and `local_port`, which are then null.",
+				Optional:            true,
 			},
 		},
 	}
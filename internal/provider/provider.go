@@ -35,13 +35,17 @@ func (p *TunnelProvider) Configure(ctx context.Context, req provider.ConfigureRe
 }
 
 func (p *TunnelProvider) Resources(ctx context.Context) []func() resource.Resource {
-	return nil
+	return []func() resource.Resource{
+		NewSSHHostKeyResource,
+	}
 }
 
 func (p *TunnelProvider) DataSources(ctx context.Context) []func() datasource.DataSource {
 	return []func() datasource.DataSource{
 		NewAzureBastionDataSource,
 		NewSSHDataSource,
+		NewSSHReverseDataSource,
+		NewSSHSOCKSDataSource,
 		NewSSMDataSource,
 		NewKubernetesDataSource,
 	}
@@ -51,6 +55,9 @@ func (p *TunnelProvider) EphemeralResources(ctx context.Context) []func() epheme
 	return []func() ephemeral.EphemeralResource{
 		NewAzureBastionEphemeral,
 		NewSSHEphemeral,
+		NewSSHCommandEphemeral,
+		NewSSHReverseEphemeral,
+		NewSSHSOCKSEphemeral,
 		NewSSMEphemeral,
 		NewKubernetesEphemeral,
 	}
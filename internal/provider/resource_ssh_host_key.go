@@ -0,0 +1,227 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/listplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var (
+	_ resource.Resource                = &SSHHostKeyResource{}
+	_ resource.ResourceWithImportState = &SSHHostKeyResource{}
+)
+
+func NewSSHHostKeyResource() resource.Resource {
+	return &SSHHostKeyResource{}
+}
+
+// SSHHostKeyResource records the host keys of an SSH server the first time it
+// is seen.
+type SSHHostKeyResource struct{}
+
+type SSHHostKeyModel struct {
+	Fingerprints types.List   `tfsdk:"fingerprints"`
+	HostKeys     types.List   `tfsdk:"host_keys"`
+	ID           types.String `tfsdk:"id"`
+	SSHHost      types.String `tfsdk:"ssh_host"`
+	SSHPort      types.Int64  `tfsdk:"ssh_port"`
+	SSHProxyURL  types.String `tfsdk:"ssh_proxy_url"`
+}
+
+func (r *SSHHostKeyResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_ssh_host_key"
+}
+
+func (r *SSHHostKeyResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Record the host keys of an SSH server on first use, to pin them in `ssh_host_key`. Every refresh checks the server still offers them and warns when it does not; replace the resource to accept new keys.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				MarkdownDescription: "The scanned address, `host:port`",
+				Computed:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.UseStateForUnknown()},
+			},
+			"ssh_host": schema.StringAttribute{
+				MarkdownDescription: "The DNS name or IP address of the SSH server",
+				Required:            true,
+				PlanModifiers:       []planmodifier.String{stringplanmodifier.RequiresReplace()},
+			},
+			"ssh_port": schema.Int64Attribute{
+				MarkdownDescription: "The port of the SSH server. Defaults to `22`.",
+				Optional:            true,
+				Computed:            true,
+				Default:             int64default.StaticInt64(22),
+				PlanModifiers:       []planmodifier.Int64{int64planmodifier.RequiresReplace()},
+			},
+			"ssh_proxy_url": schema.StringAttribute{
+				MarkdownDescription: "URL of an HTTP CONNECT or SOCKS5 proxy to reach the SSH server through, as for the SSH tunnels. Defaults to the `ALL_PROXY` environment variable unless `NO_PROXY` matches the host.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"host_keys": schema.ListAttribute{
+				MarkdownDescription: "The host keys the server offered when the resource was created, in `authorized_keys` format, ready for `ssh_host_key`",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.List{listplanmodifier.UseStateForUnknown()},
+			},
+			"fingerprints": schema.ListAttribute{
+				MarkdownDescription: "The SHA256 fingerprints of `host_keys`, as `ssh-keygen -l` prints them",
+				ElementType:         types.StringType,
+				Computed:            true,
+				PlanModifiers:       []planmodifier.List{listplanmodifier.UseStateForUnknown()},
+			},
+		},
+	}
+}
+
+func (r *SSHHostKeyResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data SSHHostKeyModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(recordHostKeys(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *SSHHostKeyResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data SSHHostKeyModel
+
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.HostKeys.IsNull() {
+		// Imported: the first scan is the one trusted.
+		resp.Diagnostics.Append(recordHostKeys(ctx, &data)...)
+	} else {
+		resp.Diagnostics.Append(checkHostKeys(ctx, &data)...)
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Update only sees ssh_proxy_url change, which does not change the keys.
+func (r *SSHHostKeyResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data SSHHostKeyModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *SSHHostKeyResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+}
+
+// ImportState takes the `host:port` to scan, or the host alone for port 22.
+func (r *SSHHostKeyResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	host, port := req.ID, 22
+	if h, p, err := net.SplitHostPort(req.ID); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port < 1 || port > 65535 {
+			resp.Diagnostics.AddError("Invalid import ID", fmt.Sprintf("%q is not host:port", req.ID))
+			return
+		}
+	}
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("ssh_host"), host)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("ssh_port"), int64(port))...)
+}
+
+// recordHostKeys trusts the keys the server offers now.
+func recordHostKeys(ctx context.Context, data *SSHHostKeyModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	keys, err := ssh.ScanHostKeys(ctx, data.SSHHost.ValueString(), int(data.SSHPort.ValueInt64()), data.SSHProxyURL.ValueString())
+	if err != nil {
+		diags.AddError("Failed to read SSH host keys", err.Error())
+		return diags
+	}
+	hostKeys := make([]string, len(keys))
+	fingerprints := make([]string, len(keys))
+	for i, key := range keys {
+		hostKeys[i] = key.AuthorizedKey
+		fingerprints[i] = key.Fingerprint
+	}
+	var listDiags diag.Diagnostics
+	data.HostKeys, listDiags = types.ListValueFrom(ctx, types.StringType, hostKeys)
+	diags.Append(listDiags...)
+	data.Fingerprints, listDiags = types.ListValueFrom(ctx, types.StringType, fingerprints)
+	diags.Append(listDiags...)
+	data.ID = types.StringValue(net.JoinHostPort(data.SSHHost.ValueString(), strconv.FormatInt(data.SSHPort.ValueInt64(), 10)))
+
+	return diags
+}
+
+// checkHostKeys warns when the server no longer offers the keys recorded at
+// creation. The recorded keys are kept either way: a changed key is only
+// trusted once the resource is replaced.
+func checkHostKeys(ctx context.Context, data *SSHHostKeyModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	var recorded []string
+	diags.Append(data.HostKeys.ElementsAs(ctx, &recorded, false)...)
+	if diags.HasError() {
+		return diags
+	}
+	keys, err := ssh.ScanHostKeys(ctx, data.SSHHost.ValueString(), int(data.SSHPort.ValueInt64()), data.SSHProxyURL.ValueString())
+	if err != nil {
+		diags.AddWarning("Could not check SSH host keys", fmt.Sprintf("%s. The keys recorded at creation were not compared.", err))
+		return diags
+	}
+	current := make([]string, len(keys))
+	fingerprints := make([]string, len(keys))
+	for i, key := range keys {
+		current[i] = key.AuthorizedKey
+		fingerprints[i] = key.Fingerprint
+	}
+	slices.Sort(recorded)
+	slices.Sort(current)
+	if !slices.Equal(recorded, current) {
+		var recordedFingerprints []string
+		diags.Append(data.Fingerprints.ElementsAs(ctx, &recordedFingerprints, false)...)
+		diags.AddWarning(
+			"SSH host key changed",
+			fmt.Sprintf("%s now offers %s instead of the %s recorded at creation. "+
+				"Tunnels pinning the recorded keys will refuse it; if the change is expected, replace this resource to record the new keys.",
+				data.ID.ValueString(), strings.Join(fingerprints, ", "), strings.Join(recordedFingerprints, ", ")),
+		)
+	}
+
+	return diags
+}
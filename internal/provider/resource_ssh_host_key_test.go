@@ -0,0 +1,61 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHHostKeyTrustOnFirstUse(t *testing.T) {
+	_, authorizedKey := sshtest.GenerateClientKey(t)
+	bastion := sshtest.StartServer(t, authorizedKey)
+	data := SSHHostKeyModel{SSHHost: types.StringValue("127.0.0.1"), SSHPort: types.Int64Value(int64(bastion.Port))}
+
+	if diags := recordHostKeys(context.Background(), &data); diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	var hostKeys, fingerprints []string
+	data.HostKeys.ElementsAs(context.Background(), &hostKeys, false)
+	data.Fingerprints.ElementsAs(context.Background(), &fingerprints, false)
+	if !reflect.DeepEqual(hostKeys, []string{bastion.AuthorizedHostKey()}) {
+		t.Fatalf("host_keys = %v, want %s", hostKeys, bastion.AuthorizedHostKey())
+	}
+	if !reflect.DeepEqual(fingerprints, []string{ssh.FingerprintSHA256(bastion.HostKey)}) {
+		t.Fatalf("fingerprints = %v", fingerprints)
+	}
+	if want := "127.0.0.1:" + strconv.Itoa(bastion.Port); data.ID.ValueString() != want {
+		t.Fatalf("id = %s, want %s", data.ID, want)
+	}
+
+	if diags := checkHostKeys(context.Background(), &data); len(diags) != 0 {
+		t.Fatalf("check against the same bastion = %v, want no diagnostics", diags)
+	}
+
+	// A rebuilt bastion behind the same name comes back with a new key.
+	rebuilt := sshtest.StartServer(t, authorizedKey)
+	data.SSHPort = types.Int64Value(int64(rebuilt.Port))
+	diags := checkHostKeys(context.Background(), &data)
+	if diags.HasError() || len(diags) != 1 || diags[0].Summary() != "SSH host key changed" {
+		t.Fatalf("check against a rebuilt bastion = %v, want a changed key warning", diags)
+	}
+	data.HostKeys.ElementsAs(context.Background(), &hostKeys, false)
+	if !reflect.DeepEqual(hostKeys, []string{bastion.AuthorizedHostKey()}) {
+		t.Fatalf("host_keys = %v, want the recorded key kept", hostKeys)
+	}
+
+	closed, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.SSHPort = types.Int64Value(int64(closed))
+	diags = checkHostKeys(context.Background(), &data)
+	if diags.HasError() || len(diags) != 1 || diags[0].Summary() != "Could not check SSH host keys" {
+		t.Fatalf("check against an unreachable bastion = %v, want a warning", diags)
+	}
+}
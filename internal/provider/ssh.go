@@ -1,34 +1,116 @@
 package provider
 
 import (
-	"os/user"
+	"context"
+	"fmt"
+	"strings"
 
 	"github.com/dfns/terraform-provider-tunnel/internal/libs"
 	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
+// SSHConnectionModel holds the attributes every SSH tunnel reaches the bastion
+// with.
+type SSHConnectionModel struct {
+	EC2InstanceConnect       *SSHEC2InstanceConnectModel `tfsdk:"ec2_instance_connect"`
+	JumpHosts                []SSHJumpHostModel          `tfsdk:"jump_hosts"`
+	KeepaliveCountMax        types.Int64                 `tfsdk:"keepalive_count_max"`
+	KeepaliveInterval        types.Int64                 `tfsdk:"keepalive_interval"`
+	KeyboardInteractive      []SSHPromptModel            `tfsdk:"keyboard_interactive"`
+	SSHAgentIdentity         types.List                  `tfsdk:"ssh_agent_identity"`
+	SSHAgentSocket           types.String                `tfsdk:"ssh_agent_socket"`
+	SSHAlgorithmPreset       types.String                `tfsdk:"ssh_algorithm_preset"`
+	SSHCertificate           types.String                `tfsdk:"ssh_certificate"`
+	SSHCiphers               types.List                  `tfsdk:"ssh_ciphers"`
+	SSHConfigFile            types.String                `tfsdk:"ssh_config_file"`
+	SSHHost                  types.String                `tfsdk:"ssh_host"`
+	SSHHostCAKey             types.List                  `tfsdk:"ssh_host_ca_key"`
+	SSHHostKey               types.List                  `tfsdk:"ssh_host_key"`
+	SSHHostKeyAlgorithms     types.List                  `tfsdk:"ssh_host_key_algorithms"`
+	SSHHosts                 types.List                  `tfsdk:"ssh_hosts"`
+	SSHHostsCooldown         types.Int64                 `tfsdk:"ssh_hosts_cooldown"`
+	SSHHostsOrder            types.String                `tfsdk:"ssh_hosts_order"`
+	SSHInsecureIgnoreHostKey types.Bool                  `tfsdk:"ssh_insecure_ignore_host_key"`
+	SSHKexAlgorithms         types.List                  `tfsdk:"ssh_kex_algorithms"`
+	SSHKey                   types.String                `tfsdk:"ssh_key"`
+	SSHKeyPassphrase         types.String                `tfsdk:"ssh_key_passphrase"`
+	SSHKnownHostsFile        types.String                `tfsdk:"ssh_known_hosts_file"`
+	SSHMACs                  types.List                  `tfsdk:"ssh_macs"`
+	SSHPassword              types.String                `tfsdk:"ssh_password"`
+	SSHPort                  types.Int64                 `tfsdk:"ssh_port"`
+	SSHProxyURL              types.String                `tfsdk:"ssh_proxy_url"`
+	SSHUseAgent              types.Bool                  `tfsdk:"ssh_use_agent"`
+	SSHUser                  types.String                `tfsdk:"ssh_user"`
+	VaultSSHSigner           *SSHVaultSignerModel        `tfsdk:"vault_ssh_signer"`
+}
+
 type SSHModel struct {
-	LocalHost        types.String `tfsdk:"local_host"`
-	LocalPort        types.Int64  `tfsdk:"local_port"`
-	SSHHost          types.String `tfsdk:"ssh_host"`
-	SSHKey           types.String `tfsdk:"ssh_key"`
-	SSHKeyPassphrase types.String `tfsdk:"ssh_key_passphrase"`
-	SSHPassword      types.String `tfsdk:"ssh_password"`
-	SSHPort          types.Int64  `tfsdk:"ssh_port"`
-	SSHUser          types.String `tfsdk:"ssh_user"`
-	TargetHost       types.String `tfsdk:"target_host"`
-	TargetPort       types.Int64  `tfsdk:"target_port"`
-	TargetSocket     types.String `tfsdk:"target_socket"`
+	SSHConnectionModel
+	LocalHost           types.String `tfsdk:"local_host"`
+	LocalPort           types.Int64  `tfsdk:"local_port"`
+	MaxConnections      types.Int64  `tfsdk:"max_connections"`
+	TargetHost          types.String `tfsdk:"target_host"`
+	TargetHosts         types.List   `tfsdk:"target_hosts"`
+	TargetHostsCooldown types.Int64  `tfsdk:"target_hosts_cooldown"`
+	TargetHostsStrategy types.String `tfsdk:"target_hosts_strategy"`
+	TargetPort          types.Int64  `tfsdk:"target_port"`
+	TargetSocket        types.String `tfsdk:"target_socket"`
+}
+
+type SSHJumpHostModel struct {
+	Host     types.String `tfsdk:"host"`
+	Port     types.Int64  `tfsdk:"port"`
+	User     types.String `tfsdk:"user"`
+	Key      types.String `tfsdk:"key"`
+	Password types.String `tfsdk:"password"`
+	HostKey  types.List   `tfsdk:"host_key"`
+}
+
+type SSHEC2InstanceConnectModel struct {
+	AvailabilityZone types.String `tfsdk:"availability_zone"`
+	EndpointURL      types.String `tfsdk:"endpoint_url"`
+	InstanceID       types.String `tfsdk:"instance_id"`
+	Profile          types.String `tfsdk:"profile"`
+	Region           types.String `tfsdk:"region"`
+	RoleARN          types.String `tfsdk:"role_arn"`
 }
 
-func validateSSHTarget(targetHost, targetSocket types.String, targetPort types.Int64) diag.Diagnostics {
+type SSHVaultSignerModel struct {
+	Address         types.String `tfsdk:"address"`
+	AppRoleID       types.String `tfsdk:"approle_role_id"`
+	AppRoleMount    types.String `tfsdk:"approle_mount"`
+	AppRoleSecretID types.String `tfsdk:"approle_secret_id"`
+	Mount           types.String `tfsdk:"mount"`
+	Namespace       types.String `tfsdk:"namespace"`
+	Role            types.String `tfsdk:"role"`
+	TTL             types.String `tfsdk:"ttl"`
+	Token           types.String `tfsdk:"token"`
+	ValidPrincipals types.List   `tfsdk:"valid_principals"`
+}
+
+type SSHPromptModel struct {
+	Prompt     types.String `tfsdk:"prompt"`
+	Answer     types.String `tfsdk:"answer"`
+	TOTPSecret types.String `tfsdk:"totp_secret"`
+}
+
+func validateSSHTarget(targetHost, targetSocket types.String, targetPort types.Int64, targetHosts types.List) diag.Diagnostics {
 	var diags diag.Diagnostics
 
 	hasPort := !targetPort.IsNull()
 	hasSocket := !targetSocket.IsNull() && targetSocket.ValueString() != ""
+	hasHosts := !targetHosts.IsNull()
 	switch {
+	case hasHosts && (hasPort || hasSocket || targetHost.ValueString() != ""):
+		diags.AddError(
+			"Conflicting SSH tunnel target",
+			"`target_hosts` cannot be combined with `target_host`, `target_port` or `target_socket`",
+		)
+	case hasHosts:
 	case hasPort && hasSocket:
 		diags.AddError(
 			"Conflicting SSH tunnel target",
@@ -37,7 +119,7 @@ func validateSSHTarget(targetHost, targetSocket types.String, targetPort types.I
 	case !hasPort && !hasSocket:
 		diags.AddError(
 			"Missing SSH tunnel target",
-			"one of `target_port` or `target_socket` must be set",
+			"one of `target_port`, `target_socket` or `target_hosts` must be set",
 		)
 	case hasPort && (targetHost.IsNull() || targetHost.ValueString() == ""):
 		diags.AddError(
@@ -49,8 +131,53 @@ func validateSSHTarget(targetHost, targetSocket types.String, targetPort types.I
 	return diags
 }
 
-func sshConfig(data *SSHModel) (ssh.TunnelConfig, diag.Diagnostics) {
-	diags := validateSSHTarget(data.TargetHost, data.TargetSocket, data.TargetPort)
+// validateSSHAlgorithms checks ssh_algorithm_preset and the algorithm lists
+// against what the SSH library implements, leaving values not yet known for
+// when the tunnel opens.
+func validateSSHAlgorithms(ctx context.Context, config tfsdk.Config) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	var preset types.String
+	diags.Append(config.GetAttribute(ctx, path.Root("ssh_algorithm_preset"), &preset)...)
+	if preset.ValueString() != "" {
+		if err := ssh.ValidateAlgorithmPreset(preset.ValueString()); err != nil {
+			diags.AddAttributeError(path.Root("ssh_algorithm_preset"), "Unknown SSH algorithm preset", err.Error())
+		}
+	}
+	for _, attribute := range []string{"ssh_ciphers", "ssh_host_key_algorithms", "ssh_kex_algorithms", "ssh_macs"} {
+		var list types.List
+		diags.Append(config.GetAttribute(ctx, path.Root(attribute), &list)...)
+		if list.IsNull() || list.IsUnknown() {
+			continue
+		}
+		var names []types.String
+		diags.Append(list.ElementsAs(ctx, &names, false)...)
+		for i, name := range names {
+			if name.IsNull() || name.IsUnknown() {
+				continue
+			}
+			if err := ssh.ValidateAlgorithm(attribute, name.ValueString()); err != nil {
+				diags.AddAttributeError(path.Root(attribute).AtListIndex(i), "Unsupported SSH algorithm", err.Error())
+			}
+		}
+	}
+
+	return diags
+}
+
+// maxConnections defaults max_connections to a single connection.
+func maxConnections(value *types.Int64, diags *diag.Diagnostics) int {
+	if value.IsNull() || value.IsUnknown() {
+		*value = types.Int64Value(1)
+	}
+	if value.ValueInt64() < 1 {
+		diags.AddError("Invalid SSH tunnel configuration", "max_connections must be at least 1")
+	}
+	return int(value.ValueInt64())
+}
+
+func sshConfig(ctx context.Context, data *SSHModel) (ssh.TunnelConfig, diag.Diagnostics) {
+	diags := validateSSHTarget(data.TargetHost, data.TargetSocket, data.TargetPort, data.TargetHosts)
 	if diags.HasError() {
 		return ssh.TunnelConfig{}, diags
 	}
@@ -69,29 +196,189 @@ func sshConfig(data *SSHModel) (ssh.TunnelConfig, diag.Diagnostics) {
 	if data.LocalHost.IsNull() || data.LocalHost.ValueString() == "" {
 		data.LocalHost = types.StringValue("localhost")
 	}
-	if data.SSHUser.IsNull() {
-		currentUser, err := user.Current()
+
+	cfg, connDiags := sshConnectionConfig(ctx, &data.SSHConnectionModel)
+	diags.Append(connDiags...)
+	if diags.HasError() {
+		return ssh.TunnelConfig{}, diags
+	}
+	cfg.LocalHost = data.LocalHost.ValueString()
+	cfg.LocalPort = localPort
+	cfg.MaxConnections = maxConnections(&data.MaxConnections, &diags)
+	cfg.TargetHost = data.TargetHost.ValueString()
+	cfg.TargetPort = int(data.TargetPort.ValueInt64())
+	cfg.TargetSocket = data.TargetSocket.ValueString()
+	if !data.TargetHosts.IsNull() {
+		diags.Append(data.TargetHosts.ElementsAs(ctx, &cfg.TargetHosts, false)...)
+	}
+	cfg.TargetHostsCooldown = int(data.TargetHostsCooldown.ValueInt64())
+	cfg.TargetHostsStrategy = data.TargetHostsStrategy.ValueString()
+	if diags.HasError() {
+		return ssh.TunnelConfig{}, diags
+	}
+
+	if err := cfg.Validate(); err != nil {
+		diags.AddError("Invalid SSH tunnel configuration", err.Error())
+		return ssh.TunnelConfig{}, diags
+	}
+
+	return cfg, diags
+}
+
+// sshConnectionConfig resolves how to reach the bastion, from the attributes
+// and then the SSH config file, and records the defaults it picks in data.
+func sshConnectionConfig(ctx context.Context, data *SSHConnectionModel) (ssh.TunnelConfig, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	if !data.KeepaliveInterval.IsNull() && data.KeepaliveInterval.ValueInt64() < 1 {
+		diags.AddError("Invalid SSH tunnel configuration", "keepalive_interval must be at least 1 second")
+	}
+	if !data.KeepaliveCountMax.IsNull() && data.KeepaliveCountMax.ValueInt64() < 1 {
+		diags.AddError("Invalid SSH tunnel configuration", "keepalive_count_max must be at least 1")
+	}
+
+	cfg := ssh.TunnelConfig{
+		KeepaliveCountMax:        int(data.KeepaliveCountMax.ValueInt64()),
+		KeepaliveInterval:        int(data.KeepaliveInterval.ValueInt64()),
+		SSHAgentSocket:           data.SSHAgentSocket.ValueString(),
+		SSHAlgorithmPreset:       data.SSHAlgorithmPreset.ValueString(),
+		SSHCertificate:           data.SSHCertificate.ValueString(),
+		SSHConfigFile:            data.SSHConfigFile.ValueString(),
+		SSHHost:                  data.SSHHost.ValueString(),
+		SSHHostCooldown:          int(data.SSHHostsCooldown.ValueInt64()),
+		SSHHostOrder:             data.SSHHostsOrder.ValueString(),
+		SSHInsecureIgnoreHostKey: data.SSHInsecureIgnoreHostKey.ValueBool(),
+		SSHKey:                   data.SSHKey.ValueString(),
+		SSHKeyPassphrase:         data.SSHKeyPassphrase.ValueString(),
+		SSHKnownHostsFile:        data.SSHKnownHostsFile.ValueString(),
+		SSHPassword:              data.SSHPassword.ValueString(),
+		SSHPort:                  int(data.SSHPort.ValueInt64()),
+		SSHProxyURL:              data.SSHProxyURL.ValueString(),
+		SSHUser:                  data.SSHUser.ValueString(),
+	}
+	if !data.SSHHostKey.IsNull() {
+		diags.Append(data.SSHHostKey.ElementsAs(ctx, &cfg.SSHHostKeys, false)...)
+	}
+	if !data.SSHHosts.IsNull() {
+		diags.Append(data.SSHHosts.ElementsAs(ctx, &cfg.SSHHosts, false)...)
+	}
+	if !data.SSHAgentIdentity.IsNull() {
+		diags.Append(data.SSHAgentIdentity.ElementsAs(ctx, &cfg.SSHAgentIdentities, false)...)
+	}
+	if !data.SSHUseAgent.IsNull() {
+		cfg.SSHUseAgent = data.SSHUseAgent.ValueBoolPointer()
+	}
+	for list, names := range map[*types.List]*[]string{
+		&data.SSHCiphers:           &cfg.SSHCiphers,
+		&data.SSHHostKeyAlgorithms: &cfg.SSHHostKeyAlgorithms,
+		&data.SSHKexAlgorithms:     &cfg.SSHKexAlgorithms,
+		&data.SSHMACs:              &cfg.SSHMACs,
+	} {
+		if !list.IsNull() {
+			diags.Append(list.ElementsAs(ctx, names, false)...)
+		}
+	}
+	if cfg.SSHHost == "" && len(cfg.SSHHosts) == 0 {
+		diags.AddError("Invalid SSH tunnel configuration", "one of ssh_host and ssh_hosts must be set")
+	}
+	if !data.SSHHostCAKey.IsNull() {
+		diags.Append(data.SSHHostCAKey.ElementsAs(ctx, &cfg.SSHHostCAKeys, false)...)
+	}
+	for _, jump := range data.JumpHosts {
+		jumpHost := ssh.JumpHost{
+			Host:     jump.Host.ValueString(),
+			Port:     int(jump.Port.ValueInt64()),
+			User:     jump.User.ValueString(),
+			Key:      jump.Key.ValueString(),
+			Password: jump.Password.ValueString(),
+		}
+		if !jump.HostKey.IsNull() {
+			diags.Append(jump.HostKey.ElementsAs(ctx, &jumpHost.HostKeys, false)...)
+		}
+		cfg.JumpHosts = append(cfg.JumpHosts, jumpHost)
+	}
+	if connect := data.EC2InstanceConnect; connect != nil {
+		cfg.EC2InstanceConnect = &ssh.EC2InstanceConnect{
+			AvailabilityZone: connect.AvailabilityZone.ValueString(),
+			EndpointURL:      connect.EndpointURL.ValueString(),
+			InstanceID:       connect.InstanceID.ValueString(),
+			Profile:          connect.Profile.ValueString(),
+			Region:           connect.Region.ValueString(),
+			RoleARN:          connect.RoleARN.ValueString(),
+		}
+	}
+	if signer := data.VaultSSHSigner; signer != nil {
+		cfg.VaultSSHSigner = &ssh.VaultSSHSigner{
+			Address:         signer.Address.ValueString(),
+			AppRoleID:       signer.AppRoleID.ValueString(),
+			AppRoleMount:    signer.AppRoleMount.ValueString(),
+			AppRoleSecretID: signer.AppRoleSecretID.ValueString(),
+			Mount:           signer.Mount.ValueString(),
+			Namespace:       signer.Namespace.ValueString(),
+			Role:            signer.Role.ValueString(),
+			TTL:             signer.TTL.ValueString(),
+			Token:           signer.Token.ValueString(),
+		}
+		if !signer.ValidPrincipals.IsNull() {
+			diags.Append(signer.ValidPrincipals.ElementsAs(ctx, &cfg.VaultSSHSigner.ValidPrincipals, false)...)
+		}
+	}
+	for _, prompt := range data.KeyboardInteractive {
+		cfg.KeyboardInteractive = append(cfg.KeyboardInteractive, ssh.PromptAnswer{
+			Prompt:     prompt.Prompt.ValueString(),
+			Answer:     prompt.Answer.ValueString(),
+			TOTPSecret: prompt.TOTPSecret.ValueString(),
+		})
+	}
+	if diags.HasError() {
+		return ssh.TunnelConfig{}, diags
+	}
+
+	// One Host section cannot describe several bastions, so the config file
+	// does not apply to ssh_hosts.
+	if len(cfg.SSHHosts) > 0 && cfg.SSHConfigFile != "" && cfg.SSHConfigFile != ssh.SSHConfigNone {
+		diags.AddWarning(
+			"SSH config file ignored",
+			"`ssh_config_file` does not apply to `ssh_hosts`; set their settings as attributes, or set `ssh_config_file` to `none`.",
+		)
+	}
+
+	// The config file fills in what the attributes leave unset, before defaults.
+	cfg, settings, err := cfg.ApplySSHConfig()
+	if err != nil {
+		diags.AddError("Failed to read SSH config file", err.Error())
+		return ssh.TunnelConfig{}, diags
+	}
+	if len(settings) > 0 {
+		lines := make([]string, len(settings))
+		for i, setting := range settings {
+			lines[i] = setting.String()
+		}
+		diags.AddWarning(
+			"SSH settings resolved from SSH config file",
+			fmt.Sprintf("`ssh_host` %q was resolved with:\n%s", data.SSHHost.ValueString(), strings.Join(lines, "\n")),
+		)
+	}
+	if cfg.SSHUser == "" {
+		cfg.SSHUser, err = ssh.DefaultUser()
 		if err != nil {
 			diags.AddError("Failed to determine the current user", err.Error())
 			return ssh.TunnelConfig{}, diags
 		}
-		data.SSHUser = types.StringValue(currentUser.Username)
-	}
-	if data.SSHPort.IsNull() {
-		data.SSHPort = types.Int64Value(22)
-	}
-
-	return ssh.TunnelConfig{
-		LocalHost:        data.LocalHost.ValueString(),
-		LocalPort:        localPort,
-		SSHHost:          data.SSHHost.ValueString(),
-		SSHKey:           data.SSHKey.ValueString(),
-		SSHKeyPassphrase: data.SSHKeyPassphrase.ValueString(),
-		SSHPassword:      data.SSHPassword.ValueString(),
-		SSHPort:          int(data.SSHPort.ValueInt64()),
-		SSHUser:          data.SSHUser.ValueString(),
-		TargetHost:       data.TargetHost.ValueString(),
-		TargetPort:       int(data.TargetPort.ValueInt64()),
-		TargetSocket:     data.TargetSocket.ValueString(),
-	}, diags
+	}
+	if cfg.SSHPort == 0 {
+		cfg.SSHPort = 22
+	}
+	if cfg.KeepaliveInterval == 0 {
+		cfg.KeepaliveInterval = 30
+	}
+	if cfg.KeepaliveCountMax == 0 {
+		cfg.KeepaliveCountMax = 3
+	}
+	data.SSHUser = types.StringValue(cfg.SSHUser)
+	data.SSHPort = types.Int64Value(int64(cfg.SSHPort))
+	data.KeepaliveInterval = types.Int64Value(int64(cfg.KeepaliveInterval))
+	data.KeepaliveCountMax = types.Int64Value(int64(cfg.KeepaliveCountMax))
+
+	return cfg, diags
 }
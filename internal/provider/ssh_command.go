@@ -0,0 +1,48 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+const defaultCommandTimeout = 60
+
+type SSHCommandModel struct {
+	SSHConnectionModel
+	Command    types.String `tfsdk:"command"`
+	ExitStatus types.Int64  `tfsdk:"exit_status"`
+	Stderr     types.String `tfsdk:"stderr"`
+	Stdin      types.String `tfsdk:"stdin"`
+	Stdout     types.String `tfsdk:"stdout"`
+	Timeout    types.Int64  `tfsdk:"timeout"`
+}
+
+func sshCommandConfig(ctx context.Context, data *SSHCommandModel) (ssh.CommandConfig, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	if data.Timeout.IsNull() || data.Timeout.IsUnknown() {
+		data.Timeout = types.Int64Value(defaultCommandTimeout)
+	}
+
+	connCfg, connDiags := sshConnectionConfig(ctx, &data.SSHConnectionModel)
+	diags.Append(connDiags...)
+	if diags.HasError() {
+		return ssh.CommandConfig{}, diags
+	}
+
+	cfg := ssh.CommandConfig{
+		TunnelConfig: connCfg,
+		Command:      data.Command.ValueString(),
+		Stdin:        data.Stdin.ValueString(),
+		Timeout:      int(data.Timeout.ValueInt64()),
+	}
+	if err := cfg.Validate(); err != nil {
+		diags.AddError("Invalid SSH command", err.Error())
+		return ssh.CommandConfig{}, diags
+	}
+
+	return cfg, diags
+}
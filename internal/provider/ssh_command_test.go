@@ -0,0 +1,43 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestSSHCommandConfig(t *testing.T) {
+	isolateHome(t)
+	data := SSHCommandModel{
+		SSHConnectionModel: SSHConnectionModel{SSHHost: types.StringValue("bastion.internal")},
+		Command:            types.StringValue("cat /run/db-password"),
+		Stdin:              types.StringNull(),
+	}
+	cfg, diags := sshCommandConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if cfg.Command != "cat /run/db-password" || cfg.Stdin != "" || cfg.SSHHost != "bastion.internal" {
+		t.Fatalf("config = %+v, not mapped", cfg)
+	}
+	if cfg.Timeout != defaultCommandTimeout || data.Timeout.ValueInt64() != defaultCommandTimeout {
+		t.Fatalf("timeout default not applied: %d, %v", cfg.Timeout, data.Timeout)
+	}
+
+	data.Timeout = types.Int64Value(0)
+	if cfg, diags := sshCommandConfig(context.Background(), &data); diags.HasError() || cfg.Timeout != 0 {
+		t.Fatalf("timeout = 0 gave %d, %v, want no timeout", cfg.Timeout, diags)
+	}
+	data.Timeout = types.Int64Value(-1)
+	if _, diags := sshCommandConfig(context.Background(), &data); !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), "timeout") {
+		t.Fatalf("diagnostics = %v, want a negative timeout rejected", diags)
+	}
+
+	data.Timeout = types.Int64Value(5)
+	data.Command = types.StringValue("")
+	if _, diags := sshCommandConfig(context.Background(), &data); !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), "command") {
+		t.Fatalf("diagnostics = %v, want an empty command rejected", diags)
+	}
+}
@@ -0,0 +1,95 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+type SSHReverseModel struct {
+	SSHConnectionModel
+	LocalHost    types.String `tfsdk:"local_host"`
+	LocalPort    types.Int64  `tfsdk:"local_port"`
+	LocalSocket  types.String `tfsdk:"local_socket"`
+	RemoteHost   types.String `tfsdk:"remote_host"`
+	RemotePort   types.Int64  `tfsdk:"remote_port"`
+	RemoteSocket types.String `tfsdk:"remote_socket"`
+}
+
+func validateSSHReverseEndpoints(data *SSHReverseModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	hasPort := !data.LocalPort.IsNull()
+	hasSocket := !data.LocalSocket.IsNull() && data.LocalSocket.ValueString() != ""
+	switch {
+	case hasPort && hasSocket:
+		diags.AddError(
+			"Conflicting SSH reverse tunnel target",
+			"`local_port` and `local_socket` are mutually exclusive",
+		)
+	case !hasPort && !hasSocket:
+		diags.AddError(
+			"Missing SSH reverse tunnel target",
+			"one of `local_port` or `local_socket` must be set",
+		)
+	}
+
+	hasRemoteSocket := !data.RemoteSocket.IsNull() && data.RemoteSocket.ValueString() != ""
+	if hasRemoteSocket && (!data.RemoteHost.IsNull() || !data.RemotePort.IsNull()) {
+		diags.AddError(
+			"Conflicting SSH reverse tunnel listener",
+			"`remote_socket` cannot be combined with `remote_host` or `remote_port`",
+		)
+	}
+
+	return diags
+}
+
+func sshReverseConfig(ctx context.Context, data *SSHReverseModel) (ssh.ReverseTunnelConfig, diag.Diagnostics) {
+	diags := validateSSHReverseEndpoints(data)
+	if diags.HasError() {
+		return ssh.ReverseTunnelConfig{}, diags
+	}
+
+	if data.LocalSocket.IsNull() && (data.LocalHost.IsNull() || data.LocalHost.ValueString() == "") {
+		data.LocalHost = types.StringValue("localhost")
+	}
+	if data.RemoteSocket.IsNull() && (data.RemoteHost.IsNull() || data.RemoteHost.ValueString() == "") {
+		data.RemoteHost = types.StringValue("localhost")
+	}
+
+	connCfg, connDiags := sshConnectionConfig(ctx, &data.SSHConnectionModel)
+	diags.Append(connDiags...)
+	if diags.HasError() {
+		return ssh.ReverseTunnelConfig{}, diags
+	}
+	connCfg.LocalHost = data.LocalHost.ValueString()
+	connCfg.LocalPort = int(data.LocalPort.ValueInt64())
+
+	cfg := ssh.ReverseTunnelConfig{
+		TunnelConfig: connCfg,
+		LocalSocket:  data.LocalSocket.ValueString(),
+		RemoteHost:   data.RemoteHost.ValueString(),
+		RemotePort:   int(data.RemotePort.ValueInt64()),
+		RemoteSocket: data.RemoteSocket.ValueString(),
+	}
+	if err := cfg.Validate(); err != nil {
+		diags.AddError("Invalid SSH tunnel configuration", err.Error())
+		return ssh.ReverseTunnelConfig{}, diags
+	}
+
+	return cfg, diags
+}
+
+// setSSHReverseListener records where the bastion listens once the tunnel is
+// up, including the port it chose when none was set.
+func setSSHReverseListener(data *SSHReverseModel, port int) {
+	if !data.RemoteSocket.IsNull() && data.RemoteSocket.ValueString() != "" {
+		data.RemoteHost = types.StringNull()
+		data.RemotePort = types.Int64Null()
+		return
+	}
+	data.RemotePort = types.Int64Value(int64(port))
+}
@@ -0,0 +1,121 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func newSSHReverseModel() SSHReverseModel {
+	return SSHReverseModel{
+		SSHConnectionModel: SSHConnectionModel{
+			SSHHost: types.StringValue("bastion.internal"),
+			SSHUser: types.StringValue("ec2-user"),
+			SSHPort: types.Int64Value(22),
+		},
+		LocalHost:    types.StringNull(),
+		LocalPort:    types.Int64Value(8080),
+		LocalSocket:  types.StringNull(),
+		RemoteHost:   types.StringNull(),
+		RemotePort:   types.Int64Null(),
+		RemoteSocket: types.StringNull(),
+	}
+}
+
+func TestValidateSSHReverseEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*SSHReverseModel)
+		wantErr string
+	}{
+		{name: "local port", modify: func(*SSHReverseModel) {}},
+		{
+			name: "local socket to remote socket",
+			modify: func(m *SSHReverseModel) {
+				m.LocalPort = types.Int64Null()
+				m.LocalSocket = types.StringValue("/run/app.sock")
+				m.RemoteSocket = types.StringValue("/run/exposed.sock")
+			},
+		},
+		{
+			name:    "local port and socket",
+			modify:  func(m *SSHReverseModel) { m.LocalSocket = types.StringValue("/run/app.sock") },
+			wantErr: "mutually exclusive",
+		},
+		{
+			name:    "no local service",
+			modify:  func(m *SSHReverseModel) { m.LocalPort = types.Int64Null() },
+			wantErr: "must be set",
+		},
+		{
+			name: "remote socket and port",
+			modify: func(m *SSHReverseModel) {
+				m.RemoteSocket = types.StringValue("/run/exposed.sock")
+				m.RemotePort = types.Int64Value(9000)
+			},
+			wantErr: "`remote_socket` cannot be combined",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := newSSHReverseModel()
+			tt.modify(&data)
+			diags := validateSSHReverseEndpoints(&data)
+			switch {
+			case tt.wantErr == "" && diags.HasError():
+				t.Fatalf("unexpected diagnostics: %v", diags)
+			case tt.wantErr != "" && !diags.HasError():
+				t.Fatalf("expected a diagnostic mentioning %q, got none", tt.wantErr)
+			case tt.wantErr != "":
+				if detail := diags.Errors()[0].Detail(); !strings.Contains(detail, tt.wantErr) {
+					t.Fatalf("diagnostic detail %q does not contain %q", detail, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestSSHReverseConfigDefaults(t *testing.T) {
+	isolateHome(t)
+	data := newSSHReverseModel()
+
+	cfg, diags := sshReverseConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if cfg.LocalHost != "localhost" || cfg.LocalPort != 8080 {
+		t.Fatalf("local service = %s:%d, want localhost:8080", cfg.LocalHost, cfg.LocalPort)
+	}
+	if cfg.RemoteHost != "localhost" || cfg.RemotePort != 0 {
+		t.Fatalf("remote listener = %s:%d, want localhost with a port the bastion chooses", cfg.RemoteHost, cfg.RemotePort)
+	}
+	if data.LocalHost.ValueString() != "localhost" || data.RemoteHost.ValueString() != "localhost" {
+		t.Fatalf("defaults not recorded: local_host = %s, remote_host = %s", data.LocalHost, data.RemoteHost)
+	}
+
+	setSSHReverseListener(&data, 41022)
+	if data.RemotePort.ValueInt64() != 41022 {
+		t.Fatalf("remote_port = %s, want the bound 41022", data.RemotePort)
+	}
+}
+
+func TestSSHReverseConfigSocketListener(t *testing.T) {
+	isolateHome(t)
+	data := newSSHReverseModel()
+	data.RemoteSocket = types.StringValue("/run/exposed.sock")
+
+	cfg, diags := sshReverseConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if cfg.RemoteHost != "" || cfg.RemoteSocket != "/run/exposed.sock" {
+		t.Fatalf("remote listener = %q, %q; want only the socket", cfg.RemoteHost, cfg.RemoteSocket)
+	}
+
+	setSSHReverseListener(&data, 0)
+	if !data.RemotePort.IsNull() || !data.RemoteHost.IsNull() {
+		t.Fatalf("remote_host = %s, remote_port = %s; want both null for a socket", data.RemoteHost, data.RemotePort)
+	}
+}
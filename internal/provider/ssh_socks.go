@@ -0,0 +1,69 @@
+package provider
+
+import (
+	"context"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+type SSHSOCKSModel struct {
+	SSHConnectionModel
+	AllowedDestinations types.List   `tfsdk:"allowed_destinations"`
+	LocalHost           types.String `tfsdk:"local_host"`
+	LocalPort           types.Int64  `tfsdk:"local_port"`
+	MaxConnections      types.Int64  `tfsdk:"max_connections"`
+	SOCKSPassword       types.String `tfsdk:"socks_password"`
+	SOCKSUsername       types.String `tfsdk:"socks_username"`
+}
+
+func sshSOCKSConfig(ctx context.Context, data *SSHSOCKSModel) (ssh.SOCKSTunnelConfig, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	localPort := int(data.LocalPort.ValueInt64())
+	if localPort == 0 {
+		var err error
+		localPort, err = libs.GetFreePort()
+		if err != nil {
+			diags.AddError("Failed to find open local port", err.Error())
+			return ssh.SOCKSTunnelConfig{}, diags
+		}
+		data.LocalPort = types.Int64Value(int64(localPort))
+	}
+
+	if data.LocalHost.IsNull() || data.LocalHost.ValueString() == "" {
+		data.LocalHost = types.StringValue("localhost")
+	}
+
+	connCfg, connDiags := sshConnectionConfig(ctx, &data.SSHConnectionModel)
+	diags.Append(connDiags...)
+	if diags.HasError() {
+		return ssh.SOCKSTunnelConfig{}, diags
+	}
+	connCfg.LocalHost = data.LocalHost.ValueString()
+	connCfg.LocalPort = localPort
+	connCfg.MaxConnections = maxConnections(&data.MaxConnections, &diags)
+	if diags.HasError() {
+		return ssh.SOCKSTunnelConfig{}, diags
+	}
+
+	cfg := ssh.SOCKSTunnelConfig{
+		TunnelConfig:  connCfg,
+		SOCKSPassword: data.SOCKSPassword.ValueString(),
+		SOCKSUsername: data.SOCKSUsername.ValueString(),
+	}
+	if !data.AllowedDestinations.IsNull() {
+		diags.Append(data.AllowedDestinations.ElementsAs(ctx, &cfg.AllowedDestinations, false)...)
+		if diags.HasError() {
+			return ssh.SOCKSTunnelConfig{}, diags
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		diags.AddError("Invalid SSH tunnel configuration", err.Error())
+		return ssh.SOCKSTunnelConfig{}, diags
+	}
+
+	return cfg, diags
+}
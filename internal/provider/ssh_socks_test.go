@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func newSSHSOCKSModel() SSHSOCKSModel {
+	return SSHSOCKSModel{
+		SSHConnectionModel: SSHConnectionModel{
+			SSHHost: types.StringValue("bastion.internal"),
+			SSHUser: types.StringValue("ec2-user"),
+			SSHPort: types.Int64Value(22),
+		},
+		AllowedDestinations: types.ListNull(types.StringType),
+		LocalHost:           types.StringNull(),
+		LocalPort:           types.Int64Null(),
+	}
+}
+
+func TestSSHSOCKSConfig(t *testing.T) {
+	isolateHome(t)
+	data := newSSHSOCKSModel()
+	data.SOCKSUsername = types.StringValue("ci")
+	data.SOCKSPassword = types.StringValue("hunter2")
+	data.AllowedDestinations = types.ListValueMust(types.StringType, []attr.Value{
+		types.StringValue("10.0.0.0/16"),
+		types.StringValue("*.rds.amazonaws.com"),
+	})
+
+	cfg, diags := sshSOCKSConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if cfg.LocalHost != "localhost" || cfg.LocalPort == 0 {
+		t.Fatalf("listener = %s:%d, want localhost on a free port", cfg.LocalHost, cfg.LocalPort)
+	}
+	if data.LocalPort.ValueInt64() != int64(cfg.LocalPort) || data.LocalHost.ValueString() != "localhost" {
+		t.Fatalf("defaults not recorded: local_host = %s, local_port = %s", data.LocalHost, data.LocalPort)
+	}
+	if want := []string{"10.0.0.0/16", "*.rds.amazonaws.com"}; !reflect.DeepEqual(cfg.AllowedDestinations, want) {
+		t.Fatalf("AllowedDestinations = %v, want %v", cfg.AllowedDestinations, want)
+	}
+	if cfg.SOCKSUsername != "ci" || cfg.SOCKSPassword != "hunter2" {
+		t.Fatalf("SOCKS credentials = %q, %q", cfg.SOCKSUsername, cfg.SOCKSPassword)
+	}
+}
+
+func TestSSHSOCKSConfigRejectsBadDestination(t *testing.T) {
+	isolateHome(t)
+	data := newSSHSOCKSModel()
+	data.AllowedDestinations = types.ListValueMust(types.StringType, []attr.Value{types.StringValue("10.0.0.0/40")})
+
+	_, diags := sshSOCKSConfig(context.Background(), &data)
+	if !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), "allowed_destinations[0]") {
+		t.Fatalf("diagnostics = %v, want the bad CIDR reported", diags)
+	}
+}
@@ -2,7 +2,12 @@ package provider
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
 	"strconv"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/dfns/terraform-provider-tunnel/internal/libs"
@@ -12,28 +17,83 @@ import (
 )
 
 type SSMModel struct {
-	LocalHost   types.String `tfsdk:"local_host"`
-	LocalPort   types.Int64  `tfsdk:"local_port"`
-	SSMInstance types.String `tfsdk:"ssm_instance"`
-	SSMDocument types.String `tfsdk:"ssm_document"`
-	SSMProfile  types.String `tfsdk:"ssm_profile"`
-	SSMRoleARN  types.String `tfsdk:"ssm_role_arn"`
-	SSMRegion   types.String `tfsdk:"ssm_region"`
-	TargetHost  types.String `tfsdk:"target_host"`
-	TargetPort  types.Int64  `tfsdk:"target_port"`
+	LocalHost             types.String             `tfsdk:"local_host"`
+	LocalPort             types.Int64              `tfsdk:"local_port"`
+	LocalSocket           types.String             `tfsdk:"local_socket"`
+	SSMInstance           types.String             `tfsdk:"ssm_instance"`
+	SSMInstanceFilters    *SSMInstanceFiltersModel `tfsdk:"ssm_instance_filters"`
+	ECSCluster            types.String             `tfsdk:"ecs_cluster"`
+	ECSService            types.String             `tfsdk:"ecs_service"`
+	ECSTask               types.String             `tfsdk:"ecs_task"`
+	ECSContainer          types.String             `tfsdk:"ecs_container"`
+	ECSEndpointURL        types.String             `tfsdk:"ecs_endpoint_url"`
+	SSMDocument           types.String             `tfsdk:"ssm_document"`
+	SSMDocumentParameters types.Map                `tfsdk:"ssm_document_parameters"`
+	Reason                types.String             `tfsdk:"reason"`
+	SSMEndpointURL        types.String             `tfsdk:"ssm_endpoint_url"`
+	SSMProfile            types.String             `tfsdk:"ssm_profile"`
+	SSMRoleARN            types.String             `tfsdk:"ssm_role_arn"`
+	SSMRegion             types.String             `tfsdk:"ssm_region"`
+	TargetHost            types.String             `tfsdk:"target_host"`
+	TargetPort            types.Int64              `tfsdk:"target_port"`
+	WaitForTarget         types.Int64              `tfsdk:"wait_for_target"`
 }
 
-// validateSSMTunnel rejects configurations the default port-forwarding document
-// cannot serve. Both problems are reported at once so a user missing host and
-// port does not have to fix them one apply at a time.
+// Session Manager rejects longer session reasons.
+const maxSSMReasonLength = 256
+
+type SSMInstanceFiltersModel struct {
+	Name     types.String `tfsdk:"name"`
+	Platform types.String `tfsdk:"platform"`
+	Tags     types.Map    `tfsdk:"tags"`
+}
+
+// ssmManagedParameters are the document parameters the tunnel sets itself,
+// by the attribute that sets them.
+var ssmManagedParameters = map[string]string{
+	"localPortNumber": "local_port",
+	"host":            "target_host",
+	"portNumber":      "target_port",
+}
+
+// validateSSMTunnel rejects configurations the built-in AWS port-forwarding
+// documents cannot serve, and document parameters the tunnel sets itself. All
+// problems are reported at once so a user missing host and port does not have
+// to fix them one apply at a time.
 func validateSSMTunnel(data *SSMModel) diag.Diagnostics {
 	var diags diag.Diagnostics
 
+	params := slices.Sorted(maps.Keys(data.SSMDocumentParameters.Elements()))
+	for _, name := range params {
+		if attribute, ok := ssmManagedParameters[name]; ok {
+			diags.AddError(
+				"Conflicting SSM document parameter",
+				fmt.Sprintf("`ssm_document_parameters` cannot set `%s`, which `%s` sets", name, attribute),
+			)
+		}
+	}
+	if utf8.RuneCountInString(data.Reason.ValueString()) > maxSSMReasonLength {
+		diags.AddError(
+			"Invalid SSM tunnel configuration",
+			fmt.Sprintf("`reason` cannot be longer than %d characters", maxSSMReasonLength),
+		)
+	}
+
 	doc := data.SSMDocument.ValueString()
-	if doc != "" && doc != ssm.DefaultSSMDocument {
+	switch doc {
+	case "", ssm.DefaultSSMDocument:
+	case ssm.NodeSSMDocument:
+		return append(diags, validateSSMNodeDocument(data, params)...)
+	default:
 		return diags
 	}
 
+	if len(params) > 0 {
+		diags.AddError(
+			"Unsupported SSM document parameters",
+			"`"+ssm.DefaultSSMDocument+"` takes no parameters besides `target_host`, `target_port` and `local_port`; `ssm_document_parameters` is for custom documents",
+		)
+	}
 	if data.TargetHost.IsNull() || data.TargetHost.ValueString() == "" {
 		diags.AddError(
 			"target_host is required for the default SSM port-forwarding document",
@@ -50,6 +110,50 @@ func validateSSMTunnel(data *SSMModel) diag.Diagnostics {
 	return diags
 }
 
+// validateSSMNodeDocument applies the rules of AWS-StartPortForwardingSession,
+// which forwards to a port on the managed node itself.
+func validateSSMNodeDocument(data *SSMModel, params []string) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if len(params) > 0 {
+		diags.AddError(
+			"Unsupported SSM document parameters",
+			"`"+ssm.NodeSSMDocument+"` takes no parameters besides `target_port` and `local_port`; `ssm_document_parameters` is for custom documents",
+		)
+	}
+	if !data.TargetHost.IsNull() && data.TargetHost.ValueString() != "" {
+		diags.AddError(
+			"target_host is not supported by the "+ssm.NodeSSMDocument+" document",
+			"`"+ssm.NodeSSMDocument+"` forwards to `target_port` on the managed node itself; use `"+ssm.DefaultSSMDocument+"` to reach another host",
+		)
+	}
+	if data.TargetPort.IsNull() || data.TargetPort.ValueInt64() == 0 {
+		diags.AddError(
+			"target_port is required for the "+ssm.NodeSSMDocument+" document",
+			"`target_port` is required when `ssm_document` is set to `"+ssm.NodeSSMDocument+"`",
+		)
+	}
+
+	return diags
+}
+
+// validateSSMListener rejects a unix socket combined with a TCP address.
+func validateSSMListener(data *SSMModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	hasSocket := !data.LocalSocket.IsNull() && data.LocalSocket.ValueString() != ""
+	hasAddress := (!data.LocalHost.IsNull() && data.LocalHost.ValueString() != "") ||
+		(!data.LocalPort.IsNull() && data.LocalPort.ValueInt64() != 0)
+	if hasSocket && hasAddress {
+		diags.AddError(
+			"Conflicting SSM tunnel listener",
+			"`local_socket` cannot be combined with `local_host` or `local_port`",
+		)
+	}
+
+	return diags
+}
+
 func ssmTargetPortString(port types.Int64) string {
 	if port.IsNull() || port.ValueInt64() == 0 {
 		return ""
@@ -57,14 +161,111 @@ func ssmTargetPortString(port types.Int64) string {
 	return strconv.Itoa(int(port.ValueInt64()))
 }
 
+// ssmTarget maps ssm_instance_filters or the ecs_* attributes, which are
+// mutually exclusive with each other and with ssm_instance.
+func ssmTarget(ctx context.Context, data *SSMModel) (*ssm.InstanceFilters, *ssm.ECSTask, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	hasInstance := !data.SSMInstance.IsNull() && data.SSMInstance.ValueString() != ""
+	hasECS := data.ECSCluster.ValueString() != "" || data.ECSService.ValueString() != "" ||
+		data.ECSTask.ValueString() != "" || data.ECSContainer.ValueString() != ""
+	targets := 0
+	for _, set := range []bool{hasInstance, data.SSMInstanceFilters != nil, hasECS} {
+		if set {
+			targets++
+		}
+	}
+	switch {
+	case targets > 1:
+		diags.AddError(
+			"Conflicting SSM target",
+			"`ssm_instance`, `ssm_instance_filters` and the `ecs_*` attributes are mutually exclusive",
+		)
+		return nil, nil, diags
+	case targets == 0:
+		diags.AddError(
+			"Missing SSM target",
+			"one of `ssm_instance`, `ssm_instance_filters` or `ecs_cluster` must be set",
+		)
+		return nil, nil, diags
+	case hasInstance:
+		return nil, nil, diags
+	case hasECS:
+		task := &ssm.ECSTask{
+			Cluster:   data.ECSCluster.ValueString(),
+			Service:   data.ECSService.ValueString(),
+			Task:      data.ECSTask.ValueString(),
+			Container: data.ECSContainer.ValueString(),
+		}
+		if err := task.Validate(); err != nil {
+			diags.AddError("Invalid SSM tunnel configuration", err.Error())
+			return nil, nil, diags
+		}
+		return nil, task, diags
+	}
+
+	filters := &ssm.InstanceFilters{
+		Name:     data.SSMInstanceFilters.Name.ValueString(),
+		Platform: data.SSMInstanceFilters.Platform.ValueString(),
+	}
+	if !data.SSMInstanceFilters.Tags.IsNull() {
+		diags.Append(data.SSMInstanceFilters.Tags.ElementsAs(ctx, &filters.Tags, false)...)
+		if diags.HasError() {
+			return nil, nil, diags
+		}
+	}
+	if err := filters.Validate(); err != nil {
+		diags.AddError("Invalid SSM tunnel configuration", err.Error())
+		return nil, nil, diags
+	}
+	return filters, nil, diags
+}
+
 // ssmTunnelConfig validates the model and maps it onto a tunnel config,
-// allocating a local port when the caller left it unset.
-func ssmTunnelConfig(data *SSMModel) (ssm.TunnelConfig, diag.Diagnostics) {
+// allocating a local port when the caller left it and local_socket unset.
+func ssmTunnelConfig(ctx context.Context, data *SSMModel) (ssm.TunnelConfig, diag.Diagnostics) {
 	diags := validateSSMTunnel(data)
+	diags.Append(validateSSMListener(data)...)
+	filters, ecsTask, targetDiags := ssmTarget(ctx, data)
+	diags.Append(targetDiags...)
+	var params map[string][]string
+	if !data.SSMDocumentParameters.IsNull() {
+		diags.Append(data.SSMDocumentParameters.ElementsAs(ctx, &params, false)...)
+	}
+	if data.WaitForTarget.ValueInt64() < 0 {
+		diags.AddError("Invalid SSM tunnel configuration", "`wait_for_target` cannot be negative")
+	}
 	if diags.HasError() {
 		return ssm.TunnelConfig{}, diags
 	}
 
+	cfg := ssm.TunnelConfig{
+		SSMInstance:           data.SSMInstance.ValueString(),
+		SSMInstanceFilters:    filters,
+		ECSTask:               ecsTask,
+		SSMDocument:           data.SSMDocument.ValueString(),
+		SSMDocumentParameters: params,
+		Reason:                data.Reason.ValueString(),
+		SSMEndpointURL:        data.SSMEndpointURL.ValueString(),
+		ECSEndpointURL:        data.ECSEndpointURL.ValueString(),
+		SSMProfile:            data.SSMProfile.ValueString(),
+		SSMRoleARN:            data.SSMRoleARN.ValueString(),
+		SSMRegion:             data.SSMRegion.ValueString(),
+		TargetHost:            data.TargetHost.ValueString(),
+		TargetPort:            ssmTargetPortString(data.TargetPort),
+		WaitForTarget:         int(data.WaitForTarget.ValueInt64()),
+	}
+
+	if !data.LocalSocket.IsNull() && data.LocalSocket.ValueString() != "" {
+		cfg.LocalSocket = data.LocalSocket.ValueString()
+		data.LocalHost = types.StringNull()
+		data.LocalPort = types.Int64Null()
+		return cfg, diags
+	}
+
+	if data.LocalHost.IsNull() || data.LocalHost.ValueString() == "" {
+		data.LocalHost = types.StringValue(ssm.DefaultLocalHost)
+	}
 	localPort := int(data.LocalPort.ValueInt64())
 	if localPort == 0 {
 		var err error
@@ -74,22 +275,11 @@ func ssmTunnelConfig(data *SSMModel) (ssm.TunnelConfig, diag.Diagnostics) {
 			return ssm.TunnelConfig{}, diags
 		}
 	}
-
-	// Hardcoded in session manager plugin
-	// see: https://github.com/aws/session-manager-plugin/blob/mainline/src/sessionmanagerplugin/session/portsession/muxportforwarding.go#L245
-	data.LocalHost = types.StringValue("localhost")
 	data.LocalPort = types.Int64Value(int64(localPort))
+	cfg.LocalHost = data.LocalHost.ValueString()
+	cfg.LocalPort = strconv.Itoa(localPort)
 
-	return ssm.TunnelConfig{
-		LocalPort:   strconv.Itoa(localPort),
-		SSMInstance: data.SSMInstance.ValueString(),
-		SSMDocument: data.SSMDocument.ValueString(),
-		SSMProfile:  data.SSMProfile.ValueString(),
-		SSMRoleARN:  data.SSMRoleARN.ValueString(),
-		SSMRegion:   data.SSMRegion.ValueString(),
-		TargetHost:  data.TargetHost.ValueString(),
-		TargetPort:  ssmTargetPortString(data.TargetPort),
-	}, diags
+	return cfg, diags
 }
 
 // applySSMSDKConfig records what the credential chain resolved on both the
@@ -99,14 +289,16 @@ func applySSMSDKConfig(data *SSMModel, cfg *ssm.TunnelConfig, awsCfg aws.Config)
 	cfg.SSMRegion = awsCfg.Region
 	cfg.SSMProfile = ssm.GetSDKConfigProfile(awsCfg)
 
-	// Only update SSMRoleARN if it wasn't explicitly provided
-	if cfg.SSMRoleARN == "" {
-		cfg.SSMRoleARN = ssm.GetSDKConfigRole(awsCfg)
+	// The profile's own role only goes to state: the child loading the
+	// profile assumes it already, and assuming it again on top is refused.
+	roleARN := cfg.SSMRoleARN
+	if roleARN == "" {
+		roleARN = ssm.GetSDKConfigRole(awsCfg)
 	}
 
 	data.SSMRegion = types.StringValue(cfg.SSMRegion)
 	data.SSMProfile = types.StringValue(cfg.SSMProfile)
-	data.SSMRoleARN = types.StringValue(cfg.SSMRoleARN)
+	data.SSMRoleARN = types.StringValue(roleARN)
 }
 
 // resolveSSMSDKConfig loads the AWS SDK config for the tunnel.
@@ -123,9 +315,38 @@ func resolveSSMSDKConfig(ctx context.Context, data *SSMModel, cfg *ssm.TunnelCon
 	return awsCfg, diags
 }
 
-// ssmConfig prepares everything ForkRemoteTunnel needs from the model.
+// ssmTargetDiagnostic tells a managed node that never registered with Systems
+// Manager, whose agent or instance profile is missing, from one that did but
+// is offline, and an ECS task that is not running.
+func ssmTargetDiagnostic(err error) diag.Diagnostic {
+	var notOnline *ssm.TargetNotOnlineError
+	var notRunning *ssm.TaskNotRunningError
+	switch {
+	case errors.As(err, &notRunning):
+		return diag.NewErrorDiagnostic(
+			"ECS task is not running",
+			err.Error()+". Check that the task is running with `enableExecuteCommand`, or raise `wait_for_target` for a task that is still starting.",
+		)
+	case !errors.As(err, &notOnline):
+		return diag.NewErrorDiagnostic("Failed to resolve SSM managed node", err.Error())
+	case notOnline.Registered():
+		return diag.NewErrorDiagnostic(
+			"SSM managed node is offline",
+			err.Error()+". The SSM Agent stopped reporting; check that the node is running and can reach Systems Manager.",
+		)
+	default:
+		return diag.NewErrorDiagnostic(
+			"SSM managed node never registered",
+			err.Error()+". Check that the SSM Agent is installed and running and that the instance profile allows Systems Manager, or raise `wait_for_target` for a node that is still starting.",
+		)
+	}
+}
+
+// ssmConfig prepares everything ForkRemoteTunnel needs from the model,
+// recording the managed node ssm_instance_filters picked, or the ECS Exec
+// target of the ecs_* attributes.
 func ssmConfig(ctx context.Context, data *SSMModel) (ssm.TunnelConfig, aws.Config, diag.Diagnostics) {
-	cfg, diags := ssmTunnelConfig(data)
+	cfg, diags := ssmTunnelConfig(ctx, data)
 	if diags.HasError() {
 		return ssm.TunnelConfig{}, aws.Config{}, diags
 	}
@@ -136,5 +357,11 @@ func ssmConfig(ctx context.Context, data *SSMModel) (ssm.TunnelConfig, aws.Confi
 		return ssm.TunnelConfig{}, aws.Config{}, diags
 	}
 
+	if err := ssm.ResolveInstance(ctx, awsCfg, &cfg); err != nil {
+		diags.Append(ssmTargetDiagnostic(err))
+		return ssm.TunnelConfig{}, aws.Config{}, diags
+	}
+	data.SSMInstance = types.StringValue(cfg.SSMInstance)
+
 	return cfg, awsCfg, diags
 }
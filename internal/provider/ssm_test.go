@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"context"
+	"errors"
 	"reflect"
 	"strings"
 	"testing"
@@ -8,27 +10,38 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/dfns/terraform-provider-tunnel/internal/ssm"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 func minimalSSMModel() SSMModel {
 	return SSMModel{
-		LocalHost:   types.StringNull(),
-		LocalPort:   types.Int64Value(14433),
-		SSMInstance: types.StringValue("i-instanceid"),
-		SSMDocument: types.StringNull(),
-		SSMProfile:  types.StringNull(),
-		SSMRoleARN:  types.StringNull(),
-		SSMRegion:   types.StringNull(),
-		TargetHost:  types.StringValue("db.internal"),
-		TargetPort:  types.Int64Value(5432),
+		LocalHost:             types.StringNull(),
+		LocalPort:             types.Int64Value(14433),
+		LocalSocket:           types.StringNull(),
+		SSMInstance:           types.StringValue("i-instanceid"),
+		ECSCluster:            types.StringNull(),
+		ECSService:            types.StringNull(),
+		ECSTask:               types.StringNull(),
+		ECSContainer:          types.StringNull(),
+		ECSEndpointURL:        types.StringNull(),
+		SSMDocument:           types.StringNull(),
+		SSMDocumentParameters: types.MapNull(types.ListType{ElemType: types.StringType}),
+		Reason:                types.StringNull(),
+		SSMEndpointURL:        types.StringNull(),
+		SSMProfile:            types.StringNull(),
+		SSMRoleARN:            types.StringNull(),
+		SSMRegion:             types.StringNull(),
+		TargetHost:            types.StringValue("db.internal"),
+		TargetPort:            types.Int64Value(5432),
+		WaitForTarget:         types.Int64Null(),
 	}
 }
 
 func TestSSMTunnelConfigDefaults(t *testing.T) {
 	data := minimalSSMModel()
 
-	cfg, diags := ssmTunnelConfig(&data)
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
 	if diags.HasError() {
 		t.Fatalf("unexpected diagnostics: %v", diags)
 	}
@@ -38,10 +51,8 @@ func TestSSMTunnelConfigDefaults(t *testing.T) {
 	if cfg.SSMInstance != "i-instanceid" || cfg.TargetHost != "db.internal" || cfg.TargetPort != "5432" {
 		t.Fatalf("target not mapped: %+v", cfg)
 	}
-	// The session manager plugin always binds localhost, so the model must say so
-	// regardless of what the caller configured.
-	if data.LocalHost.ValueString() != "localhost" {
-		t.Fatalf("model local host = %q, want localhost", data.LocalHost.ValueString())
+	if cfg.LocalHost != "localhost" || data.LocalHost.ValueString() != "localhost" {
+		t.Fatalf("local host = %q, model %q, want localhost", cfg.LocalHost, data.LocalHost.ValueString())
 	}
 	if data.LocalPort.ValueInt64() != 14433 {
 		t.Fatalf("model local port = %d, want 14433", data.LocalPort.ValueInt64())
@@ -60,7 +71,7 @@ func TestSSMTunnelConfigAllocatesFreeLocalPort(t *testing.T) {
 			data := minimalSSMModel()
 			data.LocalPort = tt.localPort
 
-			cfg, diags := ssmTunnelConfig(&data)
+			cfg, diags := ssmTunnelConfig(context.Background(), &data)
 			if diags.HasError() {
 				t.Fatalf("unexpected diagnostics: %v", diags)
 			}
@@ -76,6 +87,189 @@ func TestSSMTunnelConfigAllocatesFreeLocalPort(t *testing.T) {
 	}
 }
 
+func TestSSMTunnelConfigLocalHost(t *testing.T) {
+	data := minimalSSMModel()
+	data.LocalHost = types.StringValue("0.0.0.0")
+
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if cfg.LocalHost != "0.0.0.0" || data.LocalHost.ValueString() != "0.0.0.0" {
+		t.Fatalf("local host = %q, model %q, want 0.0.0.0", cfg.LocalHost, data.LocalHost.ValueString())
+	}
+}
+
+// A unix socket replaces the TCP address, so state must not report one.
+func TestSSMTunnelConfigLocalSocket(t *testing.T) {
+	data := minimalSSMModel()
+	data.LocalPort = types.Int64Null()
+	data.LocalSocket = types.StringValue("/run/db.sock")
+
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	if cfg.LocalSocket != "/run/db.sock" || cfg.LocalHost != "" || cfg.LocalPort != "" {
+		t.Fatalf("listener not mapped: %+v", cfg)
+	}
+	if !data.LocalHost.IsNull() || !data.LocalPort.IsNull() {
+		t.Fatalf("model local host = %v, port = %v, want both null", data.LocalHost, data.LocalPort)
+	}
+}
+
+func TestSSMTunnelConfigInstanceFilters(t *testing.T) {
+	data := minimalSSMModel()
+	data.SSMInstance = types.StringNull()
+	data.SSMEndpointURL = types.StringValue("http://127.0.0.1:4566")
+	data.SSMInstanceFilters = &SSMInstanceFiltersModel{
+		Name:     types.StringNull(),
+		Platform: types.StringValue("Linux"),
+		Tags:     types.MapValueMust(types.StringType, map[string]attr.Value{"Role": types.StringValue("bastion")}),
+	}
+
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	want := &ssm.InstanceFilters{Tags: map[string]string{"Role": "bastion"}, Platform: "Linux"}
+	if !reflect.DeepEqual(cfg.SSMInstanceFilters, want) || cfg.SSMEndpointURL != "http://127.0.0.1:4566" {
+		t.Fatalf("filters = %+v, endpoint = %q", cfg.SSMInstanceFilters, cfg.SSMEndpointURL)
+	}
+}
+
+func TestSSMInstanceFiltersExclusive(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*SSMModel)
+		wantErr string
+	}{
+		{
+			name: "both",
+			modify: func(m *SSMModel) {
+				m.SSMInstanceFilters = &SSMInstanceFiltersModel{Name: types.StringValue("bastion"), Tags: types.MapNull(types.StringType)}
+			},
+			wantErr: "mutually exclusive",
+		},
+		{name: "neither", modify: func(m *SSMModel) { m.SSMInstance = types.StringNull() }, wantErr: "must be set"},
+		{name: "instance and ECS", modify: func(m *SSMModel) { m.ECSCluster = types.StringValue("tunnel") }, wantErr: "mutually exclusive"},
+		{
+			name: "ECS without service or task",
+			modify: func(m *SSMModel) {
+				m.SSMInstance = types.StringNull()
+				m.ECSCluster = types.StringValue("tunnel")
+			},
+			wantErr: "exactly one of ecs_service and ecs_task",
+		},
+		{
+			name: "invalid filters",
+			modify: func(m *SSMModel) {
+				m.SSMInstance = types.StringNull()
+				m.SSMInstanceFilters = &SSMInstanceFiltersModel{Tags: types.MapNull(types.StringType)}
+			},
+			wantErr: "at least one",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := minimalSSMModel()
+			tt.modify(&data)
+			_, diags := ssmTunnelConfig(context.Background(), &data)
+			if !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), tt.wantErr) {
+				t.Fatalf("diagnostics = %v, want one containing %q", diags, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSSMTunnelConfigECSTask(t *testing.T) {
+	data := minimalSSMModel()
+	data.SSMInstance = types.StringNull()
+	data.ECSCluster = types.StringValue("tunnel")
+	data.ECSService = types.StringValue("api")
+	data.ECSContainer = types.StringValue("app")
+	data.ECSEndpointURL = types.StringValue("http://127.0.0.1:4566")
+
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	want := &ssm.ECSTask{Cluster: "tunnel", Service: "api", Container: "app"}
+	if !reflect.DeepEqual(cfg.ECSTask, want) || cfg.ECSEndpointURL != "http://127.0.0.1:4566" {
+		t.Fatalf("ECS task = %+v, endpoint = %q", cfg.ECSTask, cfg.ECSEndpointURL)
+	}
+}
+
+func TestSSMTargetDiagnostic(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: &ssm.TargetNotOnlineError{Target: "i-0abc"}, want: "SSM managed node never registered"},
+		{err: &ssm.TargetNotOnlineError{Target: "i-0abc", Offline: []string{"i-0abc (ConnectionLost)"}}, want: "SSM managed node is offline"},
+		{err: &ssm.TaskNotRunningError{Target: "ECS service api in cluster tunnel"}, want: "ECS task is not running"},
+		{err: errors.New("AccessDeniedException"), want: "Failed to resolve SSM managed node"},
+	}
+	for _, tt := range tests {
+		if got := ssmTargetDiagnostic(tt.err).Summary(); got != tt.want {
+			t.Errorf("ssmTargetDiagnostic(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSSMTunnelConfigRejectsNegativeWait(t *testing.T) {
+	data := minimalSSMModel()
+	data.WaitForTarget = types.Int64Value(-1)
+
+	if _, diags := ssmTunnelConfig(context.Background(), &data); !diags.HasError() {
+		t.Fatal("expected a diagnostic for a negative wait_for_target")
+	}
+}
+
+func TestValidateSSMListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*SSMModel)
+		wantErr bool
+	}{
+		{name: "port", modify: func(*SSMModel) {}},
+		{
+			name: "socket",
+			modify: func(m *SSMModel) {
+				m.LocalPort = types.Int64Null()
+				m.LocalSocket = types.StringValue("/run/db.sock")
+			},
+		},
+		{
+			name:    "socket and port",
+			modify:  func(m *SSMModel) { m.LocalSocket = types.StringValue("/run/db.sock") },
+			wantErr: true,
+		},
+		{
+			name: "socket and host",
+			modify: func(m *SSMModel) {
+				m.LocalPort = types.Int64Null()
+				m.LocalHost = types.StringValue("127.0.0.2")
+				m.LocalSocket = types.StringValue("/run/db.sock")
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := minimalSSMModel()
+			tt.modify(&data)
+			diags := validateSSMListener(&data)
+			if diags.HasError() != tt.wantErr {
+				t.Fatalf("validateSSMListener() = %v, want error %t", diags, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(diags.Errors()[0].Detail(), "`local_socket` cannot be combined") {
+				t.Fatalf("diagnostic detail = %q", diags.Errors()[0].Detail())
+			}
+		})
+	}
+}
+
 // A custom document defines its own host and port, so the tunnel config carries
 // neither and validation must not demand them.
 func TestSSMTunnelConfigCustomDocument(t *testing.T) {
@@ -84,7 +278,7 @@ func TestSSMTunnelConfigCustomDocument(t *testing.T) {
 	data.TargetHost = types.StringNull()
 	data.TargetPort = types.Int64Null()
 
-	cfg, diags := ssmTunnelConfig(&data)
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
 	if diags.HasError() {
 		t.Fatalf("unexpected diagnostics: %v", diags)
 	}
@@ -195,13 +389,113 @@ func TestValidateSSMTunnel(t *testing.T) {
 	}
 }
 
+func TestValidateSSMTunnelDocuments(t *testing.T) {
+	params := func(names ...string) types.Map {
+		elements := make(map[string]attr.Value)
+		for _, name := range names {
+			elements[name] = types.ListValueMust(types.StringType, []attr.Value{types.StringValue("value")})
+		}
+		return types.MapValueMust(types.ListType{ElemType: types.StringType}, elements)
+	}
+
+	tests := []struct {
+		name          string
+		modify        func(*SSMModel)
+		wantSummaries []string
+	}{
+		{
+			name: "node document with port",
+			modify: func(m *SSMModel) {
+				m.SSMDocument = types.StringValue(ssm.NodeSSMDocument)
+				m.TargetHost = types.StringNull()
+			},
+		},
+		{
+			name: "node document with host and without port",
+			modify: func(m *SSMModel) {
+				m.SSMDocument = types.StringValue(ssm.NodeSSMDocument)
+				m.TargetPort = types.Int64Null()
+			},
+			wantSummaries: []string{
+				"target_host is not supported by the AWS-StartPortForwardingSession document",
+				"target_port is required for the AWS-StartPortForwardingSession document",
+			},
+		},
+		{
+			name: "custom document parameters",
+			modify: func(m *SSMModel) {
+				m.SSMDocument = types.StringValue("My-Custom-PortForwardDoc")
+				m.SSMDocumentParameters = params("socketPath", "reason")
+			},
+		},
+		{
+			name: "parameter the tunnel sets",
+			modify: func(m *SSMModel) {
+				m.SSMDocument = types.StringValue("My-Custom-PortForwardDoc")
+				m.SSMDocumentParameters = params("portNumber")
+			},
+			wantSummaries: []string{"Conflicting SSM document parameter"},
+		},
+		{
+			name:          "parameters of the default document",
+			modify:        func(m *SSMModel) { m.SSMDocumentParameters = params("socketPath") },
+			wantSummaries: []string{"Unsupported SSM document parameters"},
+		},
+		{
+			name: "parameters of the node document",
+			modify: func(m *SSMModel) {
+				m.SSMDocument = types.StringValue(ssm.NodeSSMDocument)
+				m.TargetHost = types.StringNull()
+				m.SSMDocumentParameters = params("socketPath")
+			},
+			wantSummaries: []string{"Unsupported SSM document parameters"},
+		},
+		{
+			name:          "long reason",
+			modify:        func(m *SSMModel) { m.Reason = types.StringValue(strings.Repeat("x", 257)) },
+			wantSummaries: []string{"Invalid SSM tunnel configuration"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := minimalSSMModel()
+			tt.modify(&data)
+			var summaries []string
+			for _, d := range validateSSMTunnel(&data).Errors() {
+				summaries = append(summaries, d.Summary())
+			}
+			if !reflect.DeepEqual(summaries, tt.wantSummaries) {
+				t.Fatalf("summaries = %v, want %v", summaries, tt.wantSummaries)
+			}
+		})
+	}
+}
+
+func TestSSMTunnelConfigDocumentParameters(t *testing.T) {
+	data := minimalSSMModel()
+	data.SSMDocument = types.StringValue("My-Custom-PortForwardDoc")
+	data.SSMDocumentParameters = types.MapValueMust(types.ListType{ElemType: types.StringType}, map[string]attr.Value{
+		"socketPath": types.ListValueMust(types.StringType, []attr.Value{types.StringValue("/run/postgresql/.s.PGSQL.5432")}),
+	})
+	data.Reason = types.StringValue("CHG-1234")
+
+	cfg, diags := ssmTunnelConfig(context.Background(), &data)
+	if diags.HasError() {
+		t.Fatalf("unexpected diagnostics: %v", diags)
+	}
+	want := map[string][]string{"socketPath": {"/run/postgresql/.s.PGSQL.5432"}}
+	if !reflect.DeepEqual(cfg.SSMDocumentParameters, want) || cfg.Reason != "CHG-1234" {
+		t.Fatalf("parameters = %v, reason = %q", cfg.SSMDocumentParameters, cfg.Reason)
+	}
+}
+
 // Validation has to reach the caller through the config builder, or a rejected
 // configuration would still be forked.
 func TestSSMTunnelConfigSurfacesValidationDiagnostics(t *testing.T) {
 	data := minimalSSMModel()
 	data.TargetHost = types.StringNull()
 
-	if _, diags := ssmTunnelConfig(&data); !diags.HasError() {
+	if _, diags := ssmTunnelConfig(context.Background(), &data); !diags.HasError() {
 		t.Fatal("expected validation diagnostics, got none")
 	}
 }
@@ -254,14 +548,15 @@ func TestApplySSMSDKConfigRecordsResolvedValues(t *testing.T) {
 	if cfg.SSMRegion != "us-east-1" || cfg.SSMProfile != "tunnel-profile" {
 		t.Fatalf("tunnel config not back-filled: %+v", cfg)
 	}
-	if cfg.SSMRoleARN != "arn:aws:iam::123456789012:role/from-shared-config" {
-		t.Fatalf("role ARN = %q, want the shared config role", cfg.SSMRoleARN)
+	// The profile assumes its role already when the child loads it.
+	if cfg.SSMRoleARN != "" {
+		t.Fatalf("role ARN = %q, want the shared config role left to the profile", cfg.SSMRoleARN)
 	}
 	// These attributes are Optional+Computed, so state has to record what the
 	// credential chain actually resolved.
 	if data.SSMRegion.ValueString() != cfg.SSMRegion ||
 		data.SSMProfile.ValueString() != cfg.SSMProfile ||
-		data.SSMRoleARN.ValueString() != cfg.SSMRoleARN {
+		data.SSMRoleARN.ValueString() != "arn:aws:iam::123456789012:role/from-shared-config" {
 		t.Fatalf("model not back-filled: %+v", data)
 	}
 }
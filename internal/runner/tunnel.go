@@ -36,6 +36,10 @@ func StartTunnel(tun string) error {
 		return azb.StartRemoteTunnel(context.Background(), cfgJson, parentPid)
 	case ssh.TunnelType:
 		return ssh.StartRemoteTunnel(context.Background(), cfgJson, parentPid)
+	case ssh.ReverseTunnelType:
+		return ssh.StartRemoteReverseTunnel(context.Background(), cfgJson, parentPid)
+	case ssh.SOCKSTunnelType:
+		return ssh.StartRemoteSOCKSTunnel(context.Background(), cfgJson, parentPid)
 	case ssm.TunnelType:
 		return ssm.StartRemoteTunnel(context.Background(), cfgJson, parentPid)
 	case k8s.TunnelType:
@@ -0,0 +1,189 @@
+package ssh
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Presets for ssh_algorithm_preset.
+const (
+	// AlgorithmPresetModern drops SHA-1 MACs and 2048-bit Diffie-Hellman.
+	AlgorithmPresetModern = "modern"
+	// AlgorithmPresetFIPS keeps to FIPS 140 approved algorithms: NIST curves,
+	// AES and SHA-2.
+	AlgorithmPresetFIPS = "fips"
+	// AlgorithmPresetLegacy adds the SHA-1, CBC and DSA algorithms old
+	// appliances still need.
+	AlgorithmPresetLegacy = "legacy"
+)
+
+// AlgorithmPresets lists the preset names in documentation order.
+var AlgorithmPresets = []string{AlgorithmPresetModern, AlgorithmPresetFIPS, AlgorithmPresetLegacy}
+
+// The attributes that restrict each kind of algorithm.
+const (
+	attrCiphers           = "ssh_ciphers"
+	attrHostKeyAlgorithms = "ssh_host_key_algorithms"
+	attrKexAlgorithms     = "ssh_kex_algorithms"
+	attrMACs              = "ssh_macs"
+)
+
+var algorithmPresets = map[string]ssh.Algorithms{
+	AlgorithmPresetModern: {
+		KeyExchanges: []string{
+			ssh.KeyExchangeMLKEM768X25519, ssh.KeyExchangeCurve25519,
+			ssh.KeyExchangeECDHP256, ssh.KeyExchangeECDHP384, ssh.KeyExchangeECDHP521,
+			ssh.KeyExchangeDH16SHA512, ssh.KeyExchangeDHGEXSHA256,
+		},
+		Ciphers: []string{
+			ssh.CipherChaCha20Poly1305, ssh.CipherAES256GCM, ssh.CipherAES128GCM,
+			ssh.CipherAES256CTR, ssh.CipherAES192CTR, ssh.CipherAES128CTR,
+		},
+		MACs: []string{
+			ssh.HMACSHA256ETM, ssh.HMACSHA512ETM, ssh.HMACSHA256, ssh.HMACSHA512,
+		},
+		HostKeys: []string{
+			ssh.CertAlgoED25519v01,
+			ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+			ssh.KeyAlgoED25519,
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+	},
+	AlgorithmPresetFIPS: {
+		KeyExchanges: []string{
+			ssh.KeyExchangeECDHP256, ssh.KeyExchangeECDHP384, ssh.KeyExchangeECDHP521,
+			ssh.KeyExchangeDH14SHA256, ssh.KeyExchangeDH16SHA512, ssh.KeyExchangeDHGEXSHA256,
+		},
+		Ciphers: []string{
+			ssh.CipherAES256GCM, ssh.CipherAES128GCM,
+			ssh.CipherAES256CTR, ssh.CipherAES192CTR, ssh.CipherAES128CTR,
+		},
+		MACs: []string{
+			ssh.HMACSHA256ETM, ssh.HMACSHA512ETM, ssh.HMACSHA256, ssh.HMACSHA512,
+		},
+		HostKeys: []string{
+			ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+			ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+			ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+			ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+		},
+	},
+}
+
+// presetAlgorithms returns the algorithms of a preset. The legacy preset is
+// everything golang.org/x/crypto implements, insecure algorithms last.
+func presetAlgorithms(name string) (ssh.Algorithms, error) {
+	if name == AlgorithmPresetLegacy {
+		supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+		return ssh.Algorithms{
+			KeyExchanges: append(supported.KeyExchanges, insecure.KeyExchanges...),
+			Ciphers:      append(supported.Ciphers, insecure.Ciphers...),
+			MACs:         append(supported.MACs, insecure.MACs...),
+			HostKeys:     append(supported.HostKeys, insecure.HostKeys...),
+		}, nil
+	}
+	preset, ok := algorithmPresets[name]
+	if !ok {
+		return ssh.Algorithms{}, fmt.Errorf("ssh_algorithm_preset: unknown preset %q, use one of %s",
+			name, strings.Join(AlgorithmPresets, ", "))
+	}
+	return ssh.Algorithms{
+		KeyExchanges: slices.Clone(preset.KeyExchanges),
+		Ciphers:      slices.Clone(preset.Ciphers),
+		MACs:         slices.Clone(preset.MACs),
+		HostKeys:     slices.Clone(preset.HostKeys),
+	}, nil
+}
+
+// implementedAlgorithms is what golang.org/x/crypto can negotiate for the
+// attribute, secure or not.
+func implementedAlgorithms(attribute string) []string {
+	supported, insecure := ssh.SupportedAlgorithms(), ssh.InsecureAlgorithms()
+	switch attribute {
+	case attrCiphers:
+		return append(supported.Ciphers, insecure.Ciphers...)
+	case attrHostKeyAlgorithms:
+		return append(supported.HostKeys, insecure.HostKeys...)
+	case attrKexAlgorithms:
+		return append(supported.KeyExchanges, insecure.KeyExchanges...)
+	case attrMACs:
+		return append(supported.MACs, insecure.MACs...)
+	}
+	return nil
+}
+
+// ValidateAlgorithm checks a name given to one of ssh_ciphers,
+// ssh_host_key_algorithms, ssh_kex_algorithms or ssh_macs, so a typo fails at
+// plan time rather than as a handshake error.
+func ValidateAlgorithm(attribute, name string) error {
+	known := implementedAlgorithms(attribute)
+	if known == nil {
+		return fmt.Errorf("%s is not an algorithm attribute", attribute)
+	}
+	if !slices.Contains(known, name) {
+		return fmt.Errorf("unsupported algorithm %q, use one of %s", name, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// ValidateAlgorithmPreset checks an ssh_algorithm_preset name.
+func ValidateAlgorithmPreset(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := presetAlgorithms(name)
+	return err
+}
+
+func (cfg TunnelConfig) validateAlgorithms() error {
+	if err := ValidateAlgorithmPreset(cfg.SSHAlgorithmPreset); err != nil {
+		return err
+	}
+	for _, list := range []struct {
+		attribute string
+		names     []string
+	}{
+		{attrCiphers, cfg.SSHCiphers},
+		{attrHostKeyAlgorithms, cfg.SSHHostKeyAlgorithms},
+		{attrKexAlgorithms, cfg.SSHKexAlgorithms},
+		{attrMACs, cfg.SSHMACs},
+	} {
+		for i, name := range list.names {
+			if err := ValidateAlgorithm(list.attribute, name); err != nil {
+				return fmt.Errorf("%s[%d]: %w", list.attribute, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// algorithms is the preset with the lists set explicitly taking precedence.
+// Empty lists leave golang.org/x/crypto's defaults.
+func (cfg TunnelConfig) algorithms() (ssh.Algorithms, error) {
+	var algos ssh.Algorithms
+	if cfg.SSHAlgorithmPreset != "" {
+		preset, err := presetAlgorithms(cfg.SSHAlgorithmPreset)
+		if err != nil {
+			return ssh.Algorithms{}, err
+		}
+		algos = preset
+	}
+	if len(cfg.SSHCiphers) > 0 {
+		algos.Ciphers = cfg.SSHCiphers
+	}
+	if len(cfg.SSHHostKeyAlgorithms) > 0 {
+		algos.HostKeys = cfg.SSHHostKeyAlgorithms
+	}
+	if len(cfg.SSHKexAlgorithms) > 0 {
+		algos.KeyExchanges = cfg.SSHKexAlgorithms
+	}
+	if len(cfg.SSHMACs) > 0 {
+		algos.MACs = cfg.SSHMACs
+	}
+	return algos, nil
+}
@@ -0,0 +1,147 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPresetsOnlyNameImplementedAlgorithms(t *testing.T) {
+	for _, name := range AlgorithmPresets {
+		algos, err := presetAlgorithms(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for attribute, names := range map[string][]string{
+			attrCiphers:           algos.Ciphers,
+			attrHostKeyAlgorithms: algos.HostKeys,
+			attrKexAlgorithms:     algos.KeyExchanges,
+			attrMACs:              algos.MACs,
+		} {
+			if len(names) == 0 {
+				t.Errorf("preset %s leaves %s empty", name, attribute)
+			}
+			for _, algo := range names {
+				if err := ValidateAlgorithm(attribute, algo); err != nil {
+					t.Errorf("preset %s, %s: %v", name, attribute, err)
+				}
+			}
+		}
+	}
+
+	fips, _ := presetAlgorithms(AlgorithmPresetFIPS)
+	for _, algo := range slices.Concat(fips.Ciphers, fips.KeyExchanges, fips.HostKeys) {
+		if strings.Contains(algo, "chacha20") || strings.Contains(algo, "25519") {
+			t.Errorf("fips preset includes %s", algo)
+		}
+	}
+}
+
+func TestTunnelConfigValidateAlgorithms(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "preset", cfg: TunnelConfig{SSHAlgorithmPreset: AlgorithmPresetFIPS}},
+		{name: "lists", cfg: TunnelConfig{SSHCiphers: []string{"aes256-ctr"}, SSHMACs: []string{"hmac-sha2-512"}}},
+		{name: "insecure but implemented", cfg: TunnelConfig{SSHHostKeyAlgorithms: []string{"ssh-rsa"}, SSHKexAlgorithms: []string{"diffie-hellman-group1-sha1"}}},
+		{name: "unknown preset", cfg: TunnelConfig{SSHAlgorithmPreset: "paranoid"}, wantErr: "ssh_algorithm_preset"},
+		{name: "typo", cfg: TunnelConfig{SSHCiphers: []string{"aes256-ctr", "aes256-gmc@openssh.com"}}, wantErr: `ssh_ciphers[1]: unsupported algorithm "aes256-gmc@openssh.com"`},
+		{name: "not implemented", cfg: TunnelConfig{SSHMACs: []string{"umac-128-etm@openssh.com"}}, wantErr: "ssh_macs[0]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientConfigRestrictsAlgorithms(t *testing.T) {
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, authorizedKey)
+	dial := func(cfg TunnelConfig) error {
+		cfg.SSHUser, cfg.SSHKey = sshtest.User, keyPEM
+		cfg.SSHHostKeys = []string{srv.AuthorizedHostKey()}
+		clientCfg, err := clientConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := dialSSH(context.Background(), srv.Addr(), clientCfg)
+		if err == nil {
+			_ = client.Close()
+		}
+		return err
+	}
+
+	if err := dial(TunnelConfig{
+		SSHAlgorithmPreset: AlgorithmPresetModern,
+		SSHCiphers:         []string{ssh.CipherAES256CTR},
+		SSHKexAlgorithms:   []string{ssh.KeyExchangeECDHP384},
+		SSHMACs:            []string{ssh.HMACSHA512},
+	}); err != nil {
+		t.Fatalf("dial with a restricted set = %v", err)
+	}
+	// The server does not enable CBC ciphers, so nothing is left to agree on.
+	if err := dial(TunnelConfig{SSHCiphers: []string{ssh.InsecureCipherTripleDESCBC}}); err == nil || !strings.Contains(err.Error(), "no common algorithm") {
+		t.Fatalf("dial with only 3des-cbc = %v, want no common cipher", err)
+	}
+}
+
+// TestLegacyPresetReachesSHA1OnlyBastion talks to a bastion whose host key
+// only signs with ssh-rsa, as old appliances do.
+func TestLegacyPresetReachesSHA1OnlyBastion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		t.Fatal("RSA signer does not support choosing the algorithm")
+	}
+	sha1Only, err := ssh.NewSignerWithAlgorithms(algorithmSigner, []string{ssh.KeyAlgoRSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.Start(t, sshtest.Config{AuthorizedKey: authorizedKey, HostSigner: sha1Only})
+
+	dial := func(preset string) error {
+		clientCfg, err := clientConfig(TunnelConfig{
+			SSHAlgorithmPreset: preset,
+			SSHHostKeys:        []string{srv.AuthorizedHostKey()},
+			SSHKey:             keyPEM,
+			SSHUser:            sshtest.User,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := dialSSH(context.Background(), srv.Addr(), clientCfg)
+		if err == nil {
+			_ = client.Close()
+		}
+		return err
+	}
+	if err := dial(AlgorithmPresetModern); err == nil {
+		t.Fatal("the modern preset accepted an ssh-rsa host key")
+	}
+	if err := dial(AlgorithmPresetLegacy); err != nil {
+		t.Fatalf("dial with the legacy preset = %v", err)
+	}
+}
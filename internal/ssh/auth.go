@@ -2,12 +2,19 @@ package ssh
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
@@ -16,7 +23,6 @@ import (
 
 const (
 	defaultSSHPort = 22
-	defaultSSHUser = "root"
 	dialTimeout    = 15 * time.Second
 )
 
@@ -28,46 +34,167 @@ func clientConfig(cfg TunnelConfig) (*ssh.ClientConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	hostKeys, err := hostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
 	sshUser := cfg.SSHUser
 	if sshUser == "" {
-		sshUser = defaultSSHUser
+		sshUser, err = DefaultUser()
+		if err != nil {
+			return nil, err
+		}
+	}
+	algos, err := cfg.algorithms()
+	if err != nil {
+		return nil, err
 	}
 	return &ssh.ClientConfig{
-		User: sshUser,
-		Auth: methods,
-		// Preserve existing behavior for newly-created bastions with unknown keys.
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         dialTimeout,
+		Config: ssh.Config{
+			Ciphers:      algos.Ciphers,
+			KeyExchanges: algos.KeyExchanges,
+			MACs:         algos.MACs,
+		},
+		User:              sshUser,
+		Auth:              methods,
+		HostKeyCallback:   hostKeys,
+		HostKeyAlgorithms: algos.HostKeys,
+		Timeout:           dialTimeout,
 	}, nil
 }
 
+// DefaultUser is the SSH user when none is configured: the local user, as with
+// ssh(1).
+func DefaultUser() (string, error) {
+	current, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("determine the current user: %w", err)
+	}
+	return current.Username, nil
+}
+
 func authMethods(cfg TunnelConfig) ([]ssh.AuthMethod, error) {
 	var methods []ssh.AuthMethod
-	if cfg.SSHKey != "" {
-		signer, err := parseConfiguredKey(cfg.SSHKey, cfg.SSHKeyPassphrase)
+	switch {
+	case cfg.vaultCert != nil:
+		methods = append(methods, ssh.PublicKeysCallback(cfg.vaultCert.signers))
+	case cfg.SSHKey != "":
+		signers, err := configuredSigners(cfg)
 		if err != nil {
 			return nil, err
 		}
-		methods = append(methods, ssh.PublicKeys(signer))
+		methods = append(methods, ssh.PublicKeys(signers...))
 	}
 	if cfg.SSHPassword != "" {
 		methods = append(methods, ssh.Password(cfg.SSHPassword))
 	}
-	if len(methods) > 0 {
+	if len(methods) == 0 {
+		if keys := implicitKeys(cfg); keys != nil {
+			methods = append(methods, keys)
+		}
+	}
+	// Offered alongside the others, so a bastion requiring a key and then
+	// keyboard-interactive gets both through partial success.
+	if len(cfg.KeyboardInteractive) > 0 {
+		answers, err := keyboardInteractive(cfg.KeyboardInteractive)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, answers)
+	}
+
+	switch {
+	case len(methods) > 0:
 		return methods, nil
+	case cfg.agentOnly():
+		return nil, errors.New("no SSH credentials: ssh_use_agent and ssh_agent_identity need an ssh-agent, " +
+			"reachable through ssh_agent_socket or SSH_AUTH_SOCK")
+	case cfg.SSHIdentitiesOnly:
+		return nil, errors.New("no SSH credentials: none of the identity files from the SSH config " +
+			"could be loaded, and IdentitiesOnly excludes the ssh-agent")
+	default:
+		return nil, errors.New("no SSH credentials: set ssh_key, ssh_password or keyboard_interactive, " +
+			"keep a key in ~/.ssh, or run an ssh-agent")
 	}
+}
 
-	if keys := defaultKeys(); keys != nil {
-		methods = append(methods, keys)
+// implicitKeys offers the key files and the agent as a single method: ssh tries
+// each method name once, so a second publickey method would never be reached.
+func implicitKeys(cfg TunnelConfig) ssh.AuthMethod {
+	// Identity files from the SSH config replace the default keys, as with ssh(1).
+	var files []ssh.Signer
+	switch {
+	case cfg.agentOnly():
+	case len(cfg.SSHIdentityFiles) > 0:
+		files = identityFileKeys(cfg.SSHIdentityFiles, cfg.SSHKeyPassphrase)
+	default:
+		files = defaultKeys(cfg.SSHKeyPassphrase)
 	}
-	if keys := agentKeys(); keys != nil {
-		methods = append(methods, keys)
+	var agentSigners func() ([]ssh.Signer, error)
+	if cfg.agentEnabled() {
+		agentSigners = agentKeys(cfg.agentSocket(), cfg.SSHAgentIdentities)
 	}
-	if len(methods) == 0 {
-		return nil, errors.New("no SSH credentials: set ssh_key or ssh_password, " +
-			"keep a key in ~/.ssh, or run an ssh-agent")
+	if len(files) == 0 && agentSigners == nil {
+		return nil
+	}
+	if agentSigners == nil {
+		return ssh.PublicKeys(files...)
 	}
-	return methods, nil
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		fromAgent, err := agentSigners()
+		if err != nil && len(files) == 0 {
+			return nil, err
+		}
+		return append(append([]ssh.Signer{}, files...), fromAgent...), nil
+	})
+}
+
+// An explicit ssh_certificate replaces the plain key: a bastion that wants a
+// certificate would only count the key as a failed attempt.
+func configuredSigners(cfg TunnelConfig) ([]ssh.Signer, error) {
+	signer, err := parseConfiguredKey(cfg.SSHKey, cfg.SSHKeyPassphrase)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SSHCertificate != "" {
+		cert, err := parseCertificate(cfg.SSHCertificate)
+		if err != nil {
+			return nil, err
+		}
+		signed, err := certSigner(cert, signer)
+		if err != nil {
+			return nil, err
+		}
+		return []ssh.Signer{signed}, nil
+	}
+	if _, err := os.Stat(cfg.SSHKey); err == nil {
+		return withAdjacentCertificate(cfg.SSHKey, signer), nil
+	}
+	return []ssh.Signer{signer}, nil
+}
+
+// ephemeralKey generates an ed25519 key for a single tunnel, in the PEM form
+// ssh_key takes.
+func ephemeralKey() (string, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// withGeneratedCredentials replaces the settings that generate credentials
+// with the credentials themselves, before the tunnel is handed to its child.
+func (cfg TunnelConfig) withGeneratedCredentials(ctx context.Context) (TunnelConfig, error) {
+	cfg, err := cfg.withInstanceConnectKey(ctx)
+	if err != nil {
+		return cfg, err
+	}
+	return cfg.withVaultCertificate(ctx)
 }
 
 // ssh_key accepts either inline PEM or a file path.
@@ -94,33 +221,99 @@ func parseConfiguredKey(key, passphrase string) (ssh.Signer, error) {
 	return signer, nil
 }
 
-// Ignore unusable default keys because they are implicit candidates.
-func defaultKeys() ssh.AuthMethod {
+// Ignore unusable default keys because they are implicit candidates. An
+// encrypted one is decrypted with ssh_key_passphrase when that is set.
+func defaultKeys(passphrase string) []ssh.Signer {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		home = "/root"
 	}
+	paths := make([]string, len(defaultKeyNames))
+	for i, name := range defaultKeyNames {
+		paths[i] = filepath.Join(home, ".ssh", name)
+	}
+	return identityFileKeys(paths, passphrase)
+}
+
+// Skip unusable identity files: an encrypted one may still be offered by the
+// ssh-agent.
+func identityFileKeys(paths []string, passphrase string) []ssh.Signer {
 	var signers []ssh.Signer
-	for _, name := range defaultKeyNames {
-		pemBytes, err := os.ReadFile(filepath.Join(home, ".ssh", name))
+	for _, path := range paths {
+		pemBytes, err := os.ReadFile(path)
 		if err != nil {
 			continue
 		}
 		signer, err := ssh.ParsePrivateKey(pemBytes)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) && passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+		}
 		if err != nil {
 			continue
 		}
-		signers = append(signers, signer)
+		signers = append(signers, withAdjacentCertificate(path, signer)...)
 	}
-	if len(signers) == 0 {
+	return signers
+}
+
+// agentSocket is ssh_agent_socket, or SSH_AUTH_SOCK.
+func (cfg TunnelConfig) agentSocket() string {
+	if cfg.SSHAgentSocket != "" {
+		return cfg.SSHAgentSocket
+	}
+	return os.Getenv("SSH_AUTH_SOCK")
+}
+
+// agentOnly leaves the key files out, so the attempts a bastion's MaxAuthTries
+// allows go to the agent keys asked for.
+func (cfg TunnelConfig) agentOnly() bool {
+	return (cfg.SSHUseAgent != nil && *cfg.SSHUseAgent) || len(cfg.SSHAgentIdentities) > 0
+}
+
+// agentEnabled is ssh_use_agent, or else not IdentitiesOnly from the SSH
+// config.
+func (cfg TunnelConfig) agentEnabled() bool {
+	if cfg.SSHUseAgent != nil {
+		return *cfg.SSHUseAgent
+	}
+	return !cfg.SSHIdentitiesOnly
+}
+
+func (cfg TunnelConfig) validateAgent() error {
+	for i, identity := range cfg.SSHAgentIdentities {
+		if strings.TrimSpace(identity) == "" {
+			return fmt.Errorf("ssh_agent_identity[%d] is empty", i)
+		}
+	}
+	if !cfg.agentOnly() {
 		return nil
 	}
-	return ssh.PublicKeys(signers...)
+	if cfg.SSHUseAgent != nil && !*cfg.SSHUseAgent {
+		return errors.New("ssh_agent_identity cannot be combined with ssh_use_agent = false")
+	}
+	if cfg.SSHKey != "" || cfg.SSHPassword != "" || cfg.EC2InstanceConnect != nil || cfg.VaultSSHSigner != nil {
+		return errors.New("ssh_use_agent and ssh_agent_identity cannot be combined with ssh_key, ssh_password, " +
+			"ec2_instance_connect or vault_ssh_signer, which the agent is not consulted next to")
+	}
+	return nil
+}
+
+// agentIdentityMatches reports whether an ssh_agent_identity entry, a public
+// key, a SHA256 or MD5 fingerprint or a comment, names key.
+func agentIdentityMatches(identity string, key *agent.Key) bool {
+	identity = strings.TrimSpace(identity)
+	if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(identity)); err == nil {
+		return bytes.Equal(pub.Marshal(), key.Marshal())
+	}
+	return identity == ssh.FingerprintSHA256(key) ||
+		strings.TrimPrefix(identity, "MD5:") == ssh.FingerprintLegacyMD5(key) ||
+		identity == key.Comment
 }
 
 // Probe now, but reconnect for each agent request to avoid holding the socket.
-func agentKeys() ssh.AuthMethod {
-	socket := os.Getenv("SSH_AUTH_SOCK")
+// When identities are given, only the agent keys they name are offered.
+func agentKeys(socket string, identities []string) func() ([]ssh.Signer, error) {
 	if socket == "" {
 		return nil
 	}
@@ -130,7 +323,7 @@ func agentKeys() ssh.AuthMethod {
 	}
 	_ = probe.Close()
 
-	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
 		conn, err := net.Dial("unix", socket)
 		if err != nil {
 			return nil, err
@@ -142,10 +335,21 @@ func agentKeys() ssh.AuthMethod {
 		}
 		signers := make([]ssh.Signer, 0, len(keys))
 		for _, key := range keys {
+			if !usableAgentKey(key) {
+				continue
+			}
+			if len(identities) > 0 && !slices.ContainsFunc(identities, func(identity string) bool {
+				return agentIdentityMatches(identity, key)
+			}) {
+				continue
+			}
 			signers = append(signers, &agentSigner{socket: socket, pub: key})
 		}
+		if len(signers) == 0 && len(identities) > 0 {
+			return nil, fmt.Errorf("none of the %d keys in the ssh-agent matches ssh_agent_identity", len(keys))
+		}
 		return signers, nil
-	})
+	}
 }
 
 // agentSigner dials the agent per signature. agent.Client.Signers() would bind
@@ -1,14 +1,15 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/pem"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"testing"
 
@@ -174,9 +175,18 @@ func startAgent(t *testing.T, keyPEM string) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	serveAgent(t, agent.AddedKey{PrivateKey: key})
+}
+
+// serveAgent is startAgent for keys that need more than a private key, such as
+// a certificate. It returns the agent's socket.
+func serveAgent(t *testing.T, keys ...agent.AddedKey) string {
+	t.Helper()
 	keyring := agent.NewKeyring()
-	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
-		t.Fatal(err)
+	for _, key := range keys {
+		if err := keyring.Add(key); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	// Not t.TempDir(): its path can exceed the unix socket path length limit.
@@ -193,6 +203,7 @@ func startAgent(t *testing.T, keyPEM string) {
 
 	go acceptLoop(listener, func(conn net.Conn) { _ = agent.ServeAgent(keyring, conn) })
 	t.Setenv("SSH_AUTH_SOCK", listener.Addr().String())
+	return listener.Addr().String()
 }
 
 // TestAuthMethodsSignsWithAgentKey guards the agent path end to end: ssh asks the
@@ -203,27 +214,36 @@ func TestAuthMethodsSignsWithAgentKey(t *testing.T) {
 	isolateCredentials(t)
 	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
 	startAgent(t, keyPEM)
-	sshAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sshtest.StartServer(t, authorizedKey)))
+	srv := sshtest.StartServer(t, authorizedKey)
 
-	cfg, err := clientConfig(TunnelConfig{SSHUser: sshtest.User})
+	cfg, err := clientConfig(TunnelConfig{
+		SSHUser:     sshtest.User,
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+	})
 	if err != nil {
 		t.Fatalf("clientConfig() = %v", err)
 	}
-	client, err := dialSSH(context.Background(), sshAddr, cfg)
+	client, err := dialSSH(context.Background(), srv.Addr(), cfg)
 	if err != nil {
 		t.Fatalf("dialSSH() = %v", err)
 	}
 	_ = client.Close()
 }
 
-func TestClientConfigDefaultsToRoot(t *testing.T) {
+// TestClientConfigDefaultsToLocalUser matches the provider, which fills in the
+// same user for ssh_user.
+func TestClientConfigDefaultsToLocalUser(t *testing.T) {
 	isolateCredentials(t)
-	cfg, err := clientConfig(TunnelConfig{SSHKey: generateKey(t, "")})
+	cfg, err := clientConfig(TunnelConfig{SSHKey: generateKey(t, ""), SSHInsecureIgnoreHostKey: true})
 	if err != nil {
 		t.Fatalf("clientConfig() = %v", err)
 	}
-	if cfg.User != defaultSSHUser {
-		t.Errorf("User = %q, want %q", cfg.User, defaultSSHUser)
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.User != current.Username {
+		t.Errorf("User = %q, want %q", cfg.User, current.Username)
 	}
 	if cfg.Timeout != dialTimeout {
 		t.Errorf("Timeout = %v, want %v", cfg.Timeout, dialTimeout)
@@ -232,3 +252,146 @@ func TestClientConfigDefaultsToRoot(t *testing.T) {
 		t.Error("HostKeyCallback is nil, which makes every handshake fail")
 	}
 }
+
+// agentTestKeys are two keys, with comments, for an agent to hold.
+func agentTestKeys(t *testing.T) ([]agent.AddedKey, []ssh.PublicKey) {
+	t.Helper()
+	var added []agent.AddedKey
+	var public []ssh.PublicKey
+	for _, comment := range []string{"laptop", "deploy@ci"} {
+		key, err := ssh.ParseRawPrivateKey([]byte(generateKey(t, "")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, agent.AddedKey{PrivateKey: key, Comment: comment})
+		public = append(public, signer.PublicKey())
+	}
+	return added, public
+}
+
+func TestAgentKeysSelectsIdentity(t *testing.T) {
+	isolateCredentials(t)
+	keys, public := agentTestKeys(t)
+	socket := serveAgent(t, keys...)
+	deploy := public[1]
+
+	for name, identity := range map[string]string{
+		"public key": string(ssh.MarshalAuthorizedKey(deploy)),
+		"SHA256":     ssh.FingerprintSHA256(deploy),
+		"MD5":        "MD5:" + ssh.FingerprintLegacyMD5(deploy),
+		"comment":    "deploy@ci",
+	} {
+		signers, err := agentKeys(socket, []string{identity})()
+		if err != nil {
+			t.Fatalf("%s: agentKeys() = %v", name, err)
+		}
+		if len(signers) != 1 || !bytes.Equal(signers[0].PublicKey().Marshal(), deploy.Marshal()) {
+			t.Fatalf("%s: agentKeys() offered %d keys, want the deploy key alone", name, len(signers))
+		}
+	}
+
+	if signers, err := agentKeys(socket, nil)(); err != nil || len(signers) != 2 {
+		t.Fatalf("agentKeys() = %d keys, %v, want every key", len(signers), err)
+	}
+	if _, err := agentKeys(socket, []string{"nobody"})(); err == nil || !strings.Contains(err.Error(), "ssh_agent_identity") {
+		t.Fatalf("agentKeys() = %v, want no matching key reported", err)
+	}
+}
+
+// TestAuthMethodsAgentOnly reaches a bastion that only accepts the second
+// agent key through ssh_agent_socket, with the default keys left out.
+func TestAuthMethodsAgentOnly(t *testing.T) {
+	home := isolateCredentials(t)
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, filepath.Join(home, ".ssh"), "id_ed25519", generateKey(t, ""))
+	keys, public := agentTestKeys(t)
+	socket := serveAgent(t, keys...)
+	t.Setenv("SSH_AUTH_SOCK", "")
+	srv := sshtest.StartServer(t, public[1])
+
+	cfg, err := clientConfig(TunnelConfig{
+		SSHAgentIdentities: []string{"deploy@ci"},
+		SSHAgentSocket:     socket,
+		SSHHostKeys:        []string{srv.AuthorizedHostKey()},
+		SSHUser:            sshtest.User,
+	})
+	if err != nil {
+		t.Fatalf("clientConfig() = %v", err)
+	}
+	client, err := dialSSH(context.Background(), srv.Addr(), cfg)
+	if err != nil {
+		t.Fatalf("dialSSH() = %v", err)
+	}
+	_ = client.Close()
+
+	useAgent := true
+	if _, err := authMethods(TunnelConfig{SSHUseAgent: &useAgent}); err == nil || !strings.Contains(err.Error(), "ssh_agent_socket") {
+		t.Fatalf("authMethods() = %v, want the missing agent reported rather than ~/.ssh used", err)
+	}
+}
+
+func TestAuthMethodsWithoutAgent(t *testing.T) {
+	isolateCredentials(t)
+	startAgent(t, generateKey(t, ""))
+	useAgent := false
+	if _, err := authMethods(TunnelConfig{SSHUseAgent: &useAgent}); err == nil {
+		t.Fatal("authMethods() = nil, want the agent left alone")
+	}
+}
+
+func TestDefaultKeysDecryptedWithPassphrase(t *testing.T) {
+	home := isolateCredentials(t)
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := generateKey(t, "hunter2")
+	writeKeyFile(t, filepath.Join(home, ".ssh"), "id_ed25519", keyPEM)
+
+	if keys := defaultKeys(""); len(keys) != 0 {
+		t.Fatalf("defaultKeys() = %d keys, want the encrypted key skipped", len(keys))
+	}
+	keys := defaultKeys("hunter2")
+	if len(keys) != 1 {
+		t.Fatalf("defaultKeys() = %d keys, want the key decrypted", len(keys))
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase([]byte(keyPEM), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys[0].PublicKey().Marshal(), signer.PublicKey().Marshal()) {
+		t.Fatal("defaultKeys() decrypted another key")
+	}
+}
+
+func TestTunnelConfigValidateAgent(t *testing.T) {
+	useAgent, noAgent := true, false
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "identity", cfg: TunnelConfig{SSHAgentIdentities: []string{"deploy@ci"}, SSHAgentSocket: "/run/agent.sock"}},
+		{name: "agent only", cfg: TunnelConfig{SSHUseAgent: &useAgent}},
+		{name: "no agent with key", cfg: TunnelConfig{SSHUseAgent: &noAgent, SSHKey: generateKey(t, "")}},
+		{name: "empty identity", cfg: TunnelConfig{SSHAgentIdentities: []string{""}}, wantErr: "ssh_agent_identity[0]"},
+		{name: "identity without agent", cfg: TunnelConfig{SSHAgentIdentities: []string{"a"}, SSHUseAgent: &noAgent}, wantErr: "ssh_use_agent = false"},
+		{name: "agent with password", cfg: TunnelConfig{SSHUseAgent: &useAgent, SSHPassword: "pw"}, wantErr: "cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH looks for a certificate next to each identity under this suffix.
+const certificateSuffix = "-cert.pub"
+
+// parseCertificate reads a user certificate in authorized_keys format, inline
+// or from a path, such as the id_ed25519-cert.pub ssh-keygen -s writes.
+func parseCertificate(value string) (*ssh.Certificate, error) {
+	content := []byte(value)
+	if _, statErr := os.Stat(value); statErr == nil {
+		read, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("read SSH certificate file %s: %w", value, err)
+		}
+		content = read
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("parse SSH certificate: %w", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("parse SSH certificate: got a plain %s public key", key.Type())
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, errors.New("parse SSH certificate: it is a host certificate, not a user certificate")
+	}
+	return cert, nil
+}
+
+// checkCertificateValidity reports what the bastion would reject the
+// certificate for, so a stale one fails with its dates rather than as a
+// generic authentication failure.
+func checkCertificateValidity(cert *ssh.Certificate, now time.Time) error {
+	unix := uint64(now.Unix())
+	if unix < cert.ValidAfter {
+		return fmt.Errorf("SSH certificate %q is not valid until %s",
+			cert.KeyId, time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && unix >= cert.ValidBefore {
+		return fmt.Errorf("SSH certificate %q expired at %s",
+			cert.KeyId, time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// certSigner presents signer's key with cert, which must certify that key.
+func certSigner(cert *ssh.Certificate, signer ssh.Signer) (ssh.Signer, error) {
+	if err := checkCertificateValidity(cert, time.Now()); err != nil {
+		return nil, err
+	}
+	signed, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("SSH certificate %q: %w", cert.KeyId, err)
+	}
+	return signed, nil
+}
+
+// withAdjacentCertificate puts the certificate OpenSSH would pair with the key
+// at keyPath ahead of the key itself. A certificate that cannot be used is
+// logged and left out: the plain key may still be accepted.
+func withAdjacentCertificate(keyPath string, signer ssh.Signer) []ssh.Signer {
+	certPath := keyPath + certificateSuffix
+	if _, err := os.Stat(certPath); err != nil {
+		return []ssh.Signer{signer}
+	}
+	cert, err := parseCertificate(certPath)
+	if err == nil {
+		var signed ssh.Signer
+		if signed, err = certSigner(cert, signer); err == nil {
+			return []ssh.Signer{signed, signer}
+		}
+	}
+	log.Printf("skipping SSH certificate %s: %v", certPath, err)
+	return []ssh.Signer{signer}
+}
+
+// usableAgentKey leaves out agent certificates outside their validity period.
+func usableAgentKey(key ssh.PublicKey) bool {
+	parsed, err := ssh.ParsePublicKey(key.Marshal())
+	if err != nil {
+		return true
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return true
+	}
+	if err := checkCertificateValidity(cert, time.Now()); err != nil {
+		log.Printf("skipping ssh-agent certificate: %v", err)
+		return false
+	}
+	return true
+}
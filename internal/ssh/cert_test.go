@@ -0,0 +1,210 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// userCert signs key as a user certificate for sshtest.User, valid from after
+// until before.
+func userCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, after, before time.Time) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		KeyId:           "ci@example.com",
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{sshtest.User},
+		ValidAfter:      uint64(after.Unix()),
+		ValidBefore:     uint64(before.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func validUserCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey) *ssh.Certificate {
+	t.Helper()
+	return userCert(t, ca, key, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// TestCertificateAuthentication covers every place a certificate comes from,
+// against a bastion that accepts nothing but certificates from its CA.
+func TestCertificateAuthentication(t *testing.T) {
+	ca := newSigner(t)
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, home, keyPEM string, pub ssh.PublicKey) TunnelConfig
+	}{
+		{
+			name: "inline ssh_certificate",
+			setup: func(t *testing.T, _, keyPEM string, pub ssh.PublicKey) TunnelConfig {
+				cert := validUserCert(t, ca, pub)
+				return TunnelConfig{SSHKey: keyPEM, SSHCertificate: authorizedKey(cert)}
+			},
+		},
+		{
+			name: "ssh_certificate path",
+			setup: func(t *testing.T, home, keyPEM string, pub ssh.PublicKey) TunnelConfig {
+				cert := validUserCert(t, ca, pub)
+				return TunnelConfig{SSHKey: keyPEM, SSHCertificate: writeKeyFile(t, home, "ci-cert.pub", authorizedKey(cert))}
+			},
+		},
+		{
+			name: "certificate next to ssh_key",
+			setup: func(t *testing.T, home, keyPEM string, pub ssh.PublicKey) TunnelConfig {
+				writeKeyFile(t, home, "ci-cert.pub", authorizedKey(validUserCert(t, ca, pub)))
+				return TunnelConfig{SSHKey: writeKeyFile(t, home, "ci", keyPEM)}
+			},
+		},
+		{
+			name: "certificate next to a default key",
+			setup: func(t *testing.T, home, keyPEM string, pub ssh.PublicKey) TunnelConfig {
+				dir := filepath.Join(home, ".ssh")
+				if err := os.Mkdir(dir, 0700); err != nil {
+					t.Fatal(err)
+				}
+				writeKeyFile(t, dir, "id_ed25519", keyPEM)
+				writeKeyFile(t, dir, "id_ed25519-cert.pub", authorizedKey(validUserCert(t, ca, pub)))
+				return TunnelConfig{}
+			},
+		},
+		{
+			name: "certificate held by the ssh-agent",
+			setup: func(t *testing.T, _, keyPEM string, pub ssh.PublicKey) TunnelConfig {
+				key, err := ssh.ParseRawPrivateKey([]byte(keyPEM))
+				if err != nil {
+					t.Fatal(err)
+				}
+				serveAgent(t, agent.AddedKey{PrivateKey: key, Certificate: validUserCert(t, ca, pub)})
+				return TunnelConfig{}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := isolateCredentials(t)
+			keyPEM, pub := sshtest.GenerateClientKey(t)
+			srv := sshtest.Start(t, sshtest.Config{UserCA: ca.PublicKey()})
+
+			cfg := tt.setup(t, home, keyPEM, pub)
+			cfg.SSHUser = sshtest.User
+			cfg.SSHHostKeys = []string{srv.AuthorizedHostKey()}
+			clientCfg, err := clientConfig(cfg)
+			if err != nil {
+				t.Fatalf("clientConfig() = %v", err)
+			}
+			client, err := dialSSH(context.Background(), srv.Addr(), clientCfg)
+			if err != nil {
+				t.Fatalf("dialSSH() = %v", err)
+			}
+			_ = client.Close()
+		})
+	}
+}
+
+func TestCertificateValidityIsCheckedBeforeHandshake(t *testing.T) {
+	ca := newSigner(t)
+	now := time.Now()
+	tests := []struct {
+		name          string
+		after, before time.Time
+		wantErr       string
+	}{
+		{name: "expired", after: now.Add(-2 * time.Hour), before: now.Add(-time.Hour), wantErr: "expired at"},
+		{name: "not yet valid", after: now.Add(time.Hour), before: now.Add(2 * time.Hour), wantErr: "not valid until"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateCredentials(t)
+			keyPEM, pub := sshtest.GenerateClientKey(t)
+			cfg := TunnelConfig{
+				SSHKey:         keyPEM,
+				SSHCertificate: authorizedKey(userCert(t, ca, pub, tt.after, tt.before)),
+			}
+
+			if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+			if _, err := authMethods(cfg); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("authMethods() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// An expired certificate OpenSSH would pick up on its own must not stop the
+// plain key from being offered.
+func TestExpiredAdjacentCertificateFallsBackToKey(t *testing.T) {
+	home := isolateCredentials(t)
+	ca := newSigner(t)
+	keyPEM, pub := sshtest.GenerateClientKey(t)
+	expired := userCert(t, ca, pub, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	writeKeyFile(t, home, "ci-cert.pub", authorizedKey(expired))
+	srv := sshtest.Start(t, sshtest.Config{AuthorizedKey: pub, UserCA: ca.PublicKey()})
+
+	clientCfg, err := clientConfig(TunnelConfig{
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+		SSHKey:      writeKeyFile(t, home, "ci", keyPEM),
+		SSHUser:     sshtest.User,
+	})
+	if err != nil {
+		t.Fatalf("clientConfig() = %v", err)
+	}
+	client, err := dialSSH(context.Background(), srv.Addr(), clientCfg)
+	if err != nil {
+		t.Fatalf("dialSSH() = %v", err)
+	}
+	_ = client.Close()
+}
+
+func TestTunnelConfigValidateCertificate(t *testing.T) {
+	ca := newSigner(t)
+	keyPEM, pub := sshtest.GenerateClientKey(t)
+	cert := authorizedKey(validUserCert(t, ca, pub))
+	hostCert := hostCertSigner(t, ca, newSigner(t), "bastion").PublicKey()
+
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "paired with a key", cfg: TunnelConfig{SSHKey: keyPEM, SSHCertificate: cert}},
+		{name: "without a key", cfg: TunnelConfig{SSHCertificate: cert}, wantErr: "requires ssh_key"},
+		{name: "plain public key", cfg: TunnelConfig{SSHKey: keyPEM, SSHCertificate: authorizedKey(pub)}, wantErr: "plain"},
+		{name: "host certificate", cfg: TunnelConfig{SSHKey: keyPEM, SSHCertificate: authorizedKey(hostCert)}, wantErr: "host certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCertificateForAnotherKeyIsRejected(t *testing.T) {
+	isolateCredentials(t)
+	ca := newSigner(t)
+	keyPEM, _ := sshtest.GenerateClientKey(t)
+	_, otherPub := sshtest.GenerateClientKey(t)
+
+	_, err := authMethods(TunnelConfig{SSHKey: keyPEM, SSHCertificate: authorizedKey(validUserCert(t, ca, otherPub))})
+	if err == nil || !strings.Contains(err.Error(), "ci@example.com") {
+		t.Fatalf("authMethods() = %v, want an error naming the certificate", err)
+	}
+}
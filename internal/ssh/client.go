@@ -2,19 +2,119 @@ package ssh
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
-// Keep the connection ahead of Azure's idle timeout.
-const keepaliveInterval = 30 * time.Second
+// The interval keeps the connection ahead of Azure's idle timeout; the count
+// is ssh(1)'s ServerAliveCountMax default.
+const (
+	defaultKeepaliveInterval = 30 * time.Second
+	defaultKeepaliveCountMax = 3
+)
+
+var errKeepaliveTimeout = errors.New("no keepalive reply")
+
+// keepalivePolicy is ssh(1)'s ServerAliveInterval and ServerAliveCountMax: a
+// connection that leaves countMax keepalives in a row unanswered, each for
+// interval, is torn down. Zero fields take the defaults.
+type keepalivePolicy struct {
+	interval time.Duration
+	countMax int
+}
+
+func newKeepalivePolicy(cfg TunnelConfig) keepalivePolicy {
+	return keepalivePolicy{
+		interval: time.Duration(cfg.KeepaliveInterval) * time.Second,
+		countMax: cfg.KeepaliveCountMax,
+	}.withDefaults()
+}
+
+func (k keepalivePolicy) withDefaults() keepalivePolicy {
+	if k.interval <= 0 {
+		k.interval = defaultKeepaliveInterval
+	}
+	if k.countMax <= 0 {
+		k.countMax = defaultKeepaliveCountMax
+	}
+	return k
+}
+
+// tcpDialer lets the kernel probe the bastion connection on the same schedule,
+// which also catches a dead path while a keepalive reply is awaited.
+func (k keepalivePolicy) tcpDialer() *net.Dialer {
+	k = k.withDefaults()
+	return &net.Dialer{KeepAliveConfig: net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     k.interval,
+		Interval: k.interval,
+		Count:    k.countMax,
+	}}
+}
+
+// ping sends one keepalive and waits at most interval for its reply.
+func (k keepalivePolicy) ping(client *ssh.Client) error {
+	k = k.withDefaults()
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+	select {
+	case err := <-reply:
+		return err
+	case <-timer.C:
+		return errKeepaliveTimeout
+	}
+}
+
+// watch pings client every interval until stop is closed. It returns why the
+// connection is dead once countMax pings in a row go unanswered, and nil when
+// the connection failed on its own.
+func (k keepalivePolicy) watch(client *ssh.Client, stop <-chan struct{}) error {
+	k = k.withDefaults()
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+		err := k.ping(client)
+		switch {
+		case err == nil:
+			missed = 0
+		case errors.Is(err, errKeepaliveTimeout):
+			missed++
+			if missed >= k.countMax {
+				return fmt.Errorf("%w to %d keepalives sent %s apart", errKeepaliveTimeout, missed, k.interval)
+			}
+		default:
+			return nil
+		}
+	}
+}
 
 // dialSSH uses one context for the TCP connection and SSH handshake.
 func dialSSH(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	return dialSSHVia(ctx, nil, addr, cfg)
+}
+
+// dialSSHVia reaches addr through dialer when it is set, which is how a jump
+// host forwards the next hop and how a proxy is crossed. Any proxy
+// negotiation shares the handshake's context and timeout.
+func dialSSHVia(ctx context.Context, dialer contextDialer, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
 	connectCtx := ctx
 	cancel := func() {}
 	if cfg.Timeout > 0 {
@@ -22,7 +122,10 @@ func dialSSH(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Clie
 	}
 	defer cancel()
 
-	conn, err := (&net.Dialer{}).DialContext(connectCtx, "tcp", addr)
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(connectCtx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -48,87 +151,189 @@ func dialSSH(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Clie
 	return ssh.NewClient(sshConn, chans, reqs), nil
 }
 
-// clientPool multiplexes forwarded channels over one SSH connection.
+// clientPool multiplexes forwarded channels over up to maxClients SSH
+// connections. A connection is added when every open one carries channels, so
+// parallel transfers are not held to one connection's window and sshd limits.
 type clientPool struct {
-	dial func(context.Context) (*ssh.Client, error)
+	dial      func(context.Context) (*ssh.Client, error)
+	keepalive keepalivePolicy
+	// maxClients is 1 when zero.
+	maxClients int
 
 	mu       sync.Mutex
-	client   *ssh.Client
+	clients  []*pooledClient
 	inflight *handshake
 	closed   bool
+	// lost is why the last connection was discarded, logged on reconnect.
+	lost error
+}
+
+type pooledClient struct {
+	client   *ssh.Client
+	channels int
+	// full is set when the server refused a channel for lack of resources,
+	// until one of the client's channels closes.
+	full bool
 }
 
 type handshake struct {
-	done   chan struct{}
-	client *ssh.Client
-	err    error
+	done chan struct{}
+	err  error
 }
 
-// Concurrent callers share one in-flight handshake.
+// get returns a connection without accounting for a channel on it, for
+// callers that only need the bastion reachable.
 func (p *clientPool) get(ctx context.Context) (*ssh.Client, error) {
-	p.mu.Lock()
-	if p.closed {
-		p.mu.Unlock()
-		return nil, net.ErrClosed
+	client, release, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if p.client != nil {
-		client := p.client
+	release()
+	return client, nil
+}
+
+// acquire picks the least loaded connection for a new channel, opening
+// another one first while the pool has room and every connection is busy.
+// release must be called once the channel is closed. Concurrent callers share
+// one in-flight handshake.
+func (p *clientPool) acquire(ctx context.Context) (*ssh.Client, func(), error) {
+	grow := true
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, nil, net.ErrClosed
+		}
+		best := p.leastLoaded()
+		roomy := grow && len(p.clients) < max(p.maxClients, 1)
+		// A busy connection beats waiting for another handshake.
+		if best != nil && ((best.channels == 0 && !best.full) || !roomy || p.inflight != nil) {
+			best.channels++
+			p.mu.Unlock()
+			return best.client, p.releaser(best), nil
+		}
+		if attempt := p.inflight; attempt != nil {
+			p.mu.Unlock()
+			select {
+			case <-attempt.done:
+				if attempt.err != nil {
+					return nil, nil, attempt.err
+				}
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		attempt := &handshake{done: make(chan struct{})}
+		p.inflight = attempt
+		lost, open := p.lost, len(p.clients)
 		p.mu.Unlock()
-		return client, nil
-	}
-	if attempt := p.inflight; attempt != nil {
+
+		switch {
+		case open > 0:
+			log.Printf("opening SSH connection %d of %d, every open one is busy", open+1, max(p.maxClients, 1))
+		case lost != nil:
+			log.Printf("reconnecting SSH after the previous connection was lost: %v", lost)
+		}
+		client, err := p.dial(ctx)
+
+		p.mu.Lock()
+		p.inflight = nil
+		if err == nil {
+			if p.closed {
+				_ = client.Close()
+				err = net.ErrClosed
+			} else {
+				p.clients = append(p.clients, &pooledClient{client: client})
+				p.lost = nil
+				go p.tend(client)
+			}
+		}
 		p.mu.Unlock()
-		select {
-		case <-attempt.done:
-			return attempt.client, attempt.err
-		case <-ctx.Done():
-			return nil, ctx.Err()
+
+		attempt.err = err
+		close(attempt.done)
+		if err != nil {
+			if open == 0 || errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				return nil, nil, err
+			}
+			// The open connections still work; share them instead.
+			log.Printf("open another SSH connection: %v", err)
+			grow = false
 		}
 	}
-	attempt := &handshake{done: make(chan struct{})}
-	p.inflight = attempt
-	p.mu.Unlock()
-
-	client, err := p.dial(ctx)
+}
 
-	p.mu.Lock()
-	p.inflight = nil
-	if err == nil {
-		if p.closed {
-			_ = client.Close()
-			client, err = nil, net.ErrClosed
-		} else {
-			p.client = client
-			go p.tend(client)
+// leastLoaded prefers connections the server has not refused a channel on.
+// The caller holds p.mu.
+func (p *clientPool) leastLoaded() *pooledClient {
+	var best *pooledClient
+	for _, c := range p.clients {
+		if best == nil || best.full && !c.full ||
+			best.full == c.full && c.channels < best.channels {
+			best = c
 		}
 	}
-	p.mu.Unlock()
+	return best
+}
 
-	attempt.client, attempt.err = client, err
-	close(attempt.done)
-	return client, err
+func (p *clientPool) releaser(c *pooledClient) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			c.channels--
+			c.full = false
+		})
+	}
 }
 
-func (p *clientPool) tend(client *ssh.Client) {
-	go keepalive(client)
-	log.Printf("ssh connection ended: %v", client.Wait())
-	p.discard(client)
+// saturated records that the server refused a channel on client for lack of
+// resources, so new channels go to another connection.
+func (p *clientPool) saturated(client *ssh.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.clients {
+		if c.client == client {
+			c.full = true
+		}
+	}
 }
 
-func keepalive(client *ssh.Client) {
-	ticker := time.NewTicker(keepaliveInterval)
-	defer ticker.Stop()
-	for range ticker.C {
-		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
-			return
+func (p *clientPool) tend(client *ssh.Client) {
+	stop := make(chan struct{})
+	dead := make(chan error, 1)
+	go func() {
+		if err := p.keepalive.watch(client, stop); err != nil {
+			dead <- err
+			_ = client.Close()
 		}
+	}()
+	reason := client.Wait()
+	close(stop)
+	select {
+	case err := <-dead:
+		reason = err
+	default:
 	}
+	log.Printf("ssh connection ended: %v", reason)
+	p.discard(client, reason)
 }
 
-func (p *clientPool) discard(client *ssh.Client) {
+// discard drops client, which failed because of reason, so the next acquire
+// replaces it.
+func (p *clientPool) discard(client *ssh.Client, reason error) {
 	p.mu.Lock()
-	if p.client == client {
-		p.client = nil
+	for i, c := range p.clients {
+		if c.client == client {
+			p.clients = slices.Delete(p.clients, i, i+1)
+			if reason == nil {
+				reason = errors.New("connection closed")
+			}
+			p.lost = reason
+			break
+		}
 	}
 	p.mu.Unlock()
 	_ = client.Close()
@@ -136,10 +341,30 @@ func (p *clientPool) discard(client *ssh.Client) {
 
 func (p *clientPool) close() {
 	p.mu.Lock()
-	client := p.client
-	p.client, p.closed = nil, true
+	clients := p.clients
+	p.clients, p.closed = nil, true
 	p.mu.Unlock()
-	if client != nil {
-		_ = client.Close()
+	for _, c := range clients {
+		_ = c.client.Close()
+	}
+}
+
+// pooledConn gives its connection's slot back to the pool when closed.
+type pooledConn struct {
+	net.Conn
+	release func()
+}
+
+// CloseWrite keeps half-close working through the wrapper.
+func (c *pooledConn) CloseWrite() error {
+	if hc, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
 	}
+	return errors.ErrUnsupported
+}
+
+func (c *pooledConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
 }
@@ -1,13 +1,19 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"io"
+	"log"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -82,3 +88,219 @@ func TestDialSSHCancelsHandshake(t *testing.T) {
 		t.Fatal("dialSSH did not stop after context cancellation")
 	}
 }
+
+// logBuffer collects the standard logger's output while connections log from
+// their own goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	captured := &logBuffer{}
+	previous := log.Writer()
+	log.SetOutput(captured)
+	t.Cleanup(func() { log.SetOutput(previous) })
+	return captured
+}
+
+// TestClientPoolDropsUnresponsiveConnection covers a path that stays open but
+// stops carrying replies: the keepalive policy tears the client down and the
+// next get reconnects, logging why.
+func TestClientPoolDropsUnresponsiveConnection(t *testing.T) {
+	logs := captureLogs(t)
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, authorizedKey)
+	clientCfg, err := clientConfig(TunnelConfig{
+		SSHUser:     sshtest.User,
+		SSHKey:      keyPEM,
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &clientPool{
+		dial: func(ctx context.Context) (*ssh.Client, error) {
+			return dialSSH(ctx, srv.Addr(), clientCfg)
+		},
+		keepalive: keepalivePolicy{interval: 50 * time.Millisecond, countMax: 2},
+	}
+	t.Cleanup(pool.close)
+
+	first, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Answered keepalives keep the connection.
+	time.Sleep(300 * time.Millisecond)
+	if current, err := pool.get(context.Background()); err != nil || current != first {
+		t.Fatalf("get() = %p, %v; want the healthy client kept", current, err)
+	}
+
+	srv.StallConnections()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mu.Lock()
+		discarded := len(pool.clients) == 0 || pool.clients[0].client != first
+		pool.mu.Unlock()
+		if discarded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unanswered keepalives did not tear the connection down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatalf("get() after the stall = %v", err)
+	}
+	if second == first || srv.Handshakes() != 2 {
+		t.Fatalf("get() reused the dead client (handshakes = %d)", srv.Handshakes())
+	}
+	if want := "lost: no keepalive reply to 2 keepalives sent 50ms apart"; !strings.Contains(logs.String(), want) {
+		t.Fatalf("logs = %q, want the reconnect reason %q", logs.String(), want)
+	}
+}
+
+func TestKeepalivePolicyDefaults(t *testing.T) {
+	got := newKeepalivePolicy(TunnelConfig{})
+	if got.interval != 30*time.Second || got.countMax != 3 {
+		t.Fatalf("newKeepalivePolicy() = %+v, want 30s and 3", got)
+	}
+	got = newKeepalivePolicy(TunnelConfig{KeepaliveInterval: 5, KeepaliveCountMax: 1})
+	if got.interval != 5*time.Second || got.countMax != 1 {
+		t.Fatalf("newKeepalivePolicy() = %+v, want 5s and 1", got)
+	}
+	if err := (TunnelConfig{KeepaliveInterval: -1}).Validate(); err == nil {
+		t.Fatal("Validate() accepted a negative keepalive_interval")
+	}
+}
+
+// testPool dials srv, counting handshakes and the most that ever ran at once.
+func testPool(t *testing.T, handle func(ssh.NewChannel), maxClients int) (*clientPool, *atomic.Int32, *atomic.Int32) {
+	t.Helper()
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServerWithChannelHandler(t, authorizedKey, handle)
+	clientCfg, err := clientConfig(TunnelConfig{
+		SSHUser:     sshtest.User,
+		SSHKey:      keyPEM,
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handshakes, inflight, peak atomic.Int32
+	pool := &clientPool{
+		dial: func(ctx context.Context) (*ssh.Client, error) {
+			handshakes.Add(1)
+			n := inflight.Add(1)
+			defer inflight.Add(-1)
+			for {
+				if p := peak.Load(); n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return dialSSH(ctx, srv.Addr(), clientCfg)
+		},
+		maxClients: maxClients,
+	}
+	t.Cleanup(pool.close)
+	return pool, &handshakes, &peak
+}
+
+func TestClientPoolGrowsOneHandshakeAtATime(t *testing.T) {
+	pool, handshakes, peak := testPool(t, sshtest.HandleChannel, 4)
+
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := pool.acquire(context.Background()); err != nil {
+				t.Errorf("acquire() = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := peak.Load(); got != 1 {
+		t.Fatalf("%d handshakes ran at once, want 1", got)
+	}
+	if got := handshakes.Load(); got < 1 || got > 4 {
+		t.Fatalf("SSH handshakes = %d, want between 1 and max_connections", got)
+	}
+}
+
+func TestClientPoolBalancesChannels(t *testing.T) {
+	pool, handshakes, _ := testPool(t, sshtest.HandleChannel, 3)
+
+	var releases []func()
+	seen := make(map[*ssh.Client]int)
+	for range 6 {
+		client, release, err := pool.acquire(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[client]++
+		releases = append(releases, release)
+	}
+	if got := handshakes.Load(); got != 3 {
+		t.Fatalf("SSH handshakes = %d, want the pool grown to 3", got)
+	}
+	for client, n := range seen {
+		if n != 2 {
+			t.Fatalf("client %p carries %d of 6 channels, want 2", client, n)
+		}
+	}
+
+	// A released slot is the next one used.
+	releases[0]()
+	client, _, err := pool.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen[client] != 2 || pool.clients[0].client != client {
+		t.Fatalf("acquire() did not pick the connection with a free slot")
+	}
+}
+
+// TestDialThroughOpensConnectionOnResourceShortage has the server refuse the
+// first channel for lack of resources: the local connection is served over a
+// second SSH connection instead of failing.
+func TestDialThroughOpensConnectionOnResourceShortage(t *testing.T) {
+	var refused atomic.Bool
+	pool, handshakes, _ := testPool(t, func(nc ssh.NewChannel) {
+		if refused.CompareAndSwap(false, true) {
+			_ = nc.Reject(ssh.ResourceShortage, "too many sessions")
+			return
+		}
+		sshtest.HandleChannel(nc)
+	}, 2)
+	target := startTCPTarget(t, echoUntilEOF)
+
+	conn, err := dialThrough(context.Background(), pool, "tcp", target)
+	if err != nil {
+		t.Fatalf("dialThrough() = %v, want the channel opened on another connection", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("second connection"))
+	if got := handshakes.Load(); got != 2 {
+		t.Fatalf("SSH handshakes = %d, want 2", got)
+	}
+}
@@ -0,0 +1,110 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CommandConfig describes a command to run on the bastion, like `ssh host
+// command`. The Local and Target fields of TunnelConfig are unused.
+type CommandConfig struct {
+	TunnelConfig
+	Command string
+	Stdin   string
+	// Timeout bounds connecting and running the command, in seconds. The
+	// command is killed when it runs out; zero means no limit.
+	Timeout int
+}
+
+// CommandResult is what the command left behind. A non-zero exit status is a
+// result, not an error.
+type CommandResult struct {
+	ExitStatus int
+	Stderr     string
+	Stdout     string
+}
+
+// Validate catches settings that would only fail once the command runs.
+func (cfg CommandConfig) Validate() error {
+	if err := cfg.TunnelConfig.Validate(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(cfg.Command) == "" {
+		return errors.New("command is empty")
+	}
+	if cfg.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+// RunCommand runs the command in a session of its own connection to the
+// bastion, reached the way a tunnel would be.
+func RunCommand(ctx context.Context, cfg CommandConfig) (CommandResult, error) {
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	tunnelCfg, err := cfg.withGeneratedCredentials(ctx)
+	if err != nil {
+		return CommandResult{}, err
+	}
+	hops, err := newBastions(tunnelCfg)
+	if err != nil {
+		return CommandResult{}, err
+	}
+	client, err := hops.dial(ctx)
+	if err != nil {
+		return CommandResult{}, fmt.Errorf("failed to connect to %s: %w", hops.addr(), err)
+	}
+	defer func() { _ = client.Close() }()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return CommandResult{}, fmt.Errorf("failed to open a session on %s: %w", hops.addr(), err)
+	}
+	defer func() { _ = session.Close() }()
+	var stdout, stderr bytes.Buffer
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	if cfg.Stdin != "" {
+		session.Stdin = strings.NewReader(cfg.Stdin)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(cfg.Command) }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Not every sshd honours signals; closing the connection hangs up
+		// on the command either way.
+		_ = session.Signal(ssh.SIGKILL)
+		_ = client.Close()
+		<-done
+		if cfg.Timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return CommandResult{}, fmt.Errorf("command did not finish within %ds", cfg.Timeout)
+		}
+		return CommandResult{}, ctx.Err()
+	}
+
+	result := CommandResult{Stdout: stdout.String(), Stderr: stderr.String()}
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr) && exitErr.Signal() == "":
+		result.ExitStatus = exitErr.ExitStatus()
+	case errors.As(err, &exitErr):
+		return result, fmt.Errorf("command was killed by signal %s", exitErr.Signal())
+	default:
+		return result, fmt.Errorf("failed to run command on %s: %w", hops.addr(), err)
+	}
+	return result, nil
+}
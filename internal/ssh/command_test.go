@@ -0,0 +1,89 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+)
+
+func startCommandServer(t *testing.T, exec sshtest.Exec) CommandConfig {
+	t.Helper()
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.Start(t, sshtest.Config{AuthorizedKey: authorizedKey, Exec: exec})
+	return CommandConfig{TunnelConfig: TunnelConfig{
+		SSHHost:     "127.0.0.1",
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+		SSHKey:      keyPEM,
+		SSHPort:     srv.Port,
+		SSHUser:     sshtest.User,
+	}}
+}
+
+func TestRunCommand(t *testing.T) {
+	cfg := startCommandServer(t, func(command string, stdin io.Reader, stdout, stderr io.Writer, _ <-chan struct{}) uint32 {
+		input, _ := io.ReadAll(stdin)
+		_, _ = fmt.Fprintf(stdout, "%s <%s>", command, input)
+		_, _ = io.WriteString(stderr, "warning: generated password is short")
+		if strings.HasPrefix(command, "false") {
+			return 3
+		}
+		return 0
+	})
+
+	cfg.Command, cfg.Stdin = "cat /run/db-password", "secret"
+	result, err := RunCommand(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("RunCommand() = %v", err)
+	}
+	want := CommandResult{Stdout: "cat /run/db-password <secret>", Stderr: "warning: generated password is short"}
+	if result != want {
+		t.Fatalf("RunCommand() = %+v, want %+v", result, want)
+	}
+
+	cfg.Command, cfg.Stdin = "false", ""
+	result, err = RunCommand(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("RunCommand() of a failing command = %v, want its exit status", err)
+	}
+	if result.ExitStatus != 3 || result.Stdout != "false <>" {
+		t.Fatalf("RunCommand() = %+v, want exit status 3", result)
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	hungUp := make(chan struct{})
+	cfg := startCommandServer(t, func(_ string, _ io.Reader, _, _ io.Writer, done <-chan struct{}) uint32 {
+		<-done
+		close(hungUp)
+		return 0
+	})
+	cfg.Command, cfg.Timeout = "sleep infinity", 1
+
+	start := time.Now()
+	_, err := RunCommand(context.Background(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "within 1s") {
+		t.Fatalf("RunCommand() = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("RunCommand() took %s, want it bounded by the timeout", elapsed)
+	}
+	select {
+	case <-hungUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command was left running on the bastion")
+	}
+}
+
+func TestCommandConfigValidate(t *testing.T) {
+	if err := (CommandConfig{Command: "  "}).Validate(); err == nil || !strings.Contains(err.Error(), "command") {
+		t.Fatalf("Validate() = %v, want an empty command rejected", err)
+	}
+	if err := (CommandConfig{Command: "uptime", Timeout: -1}).Validate(); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Validate() = %v, want a negative timeout rejected", err)
+	}
+}
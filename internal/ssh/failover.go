@@ -0,0 +1,195 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Orders in which the bastions in ssh_hosts are tried.
+const (
+	HostOrderSequential = "sequential"
+	HostOrderRandom     = "random"
+)
+
+const defaultHostCooldown = 60 * time.Second
+
+// bastions are the routes to each bastion a tunnel may be served by. Every
+// connection, including a reconnect, goes to the first bastion that accepts
+// it, so the tunnel fails over when the one serving it goes away.
+type bastions struct {
+	routes   []route
+	random   bool
+	cooldown time.Duration
+	// instanceConnect, when set, pushes the key before connections are made.
+	instanceConnect *instanceConnectKey
+	// vaultCert, when set, has the key signed again before connections are
+	// made once its certificate is about to expire.
+	vaultCert *vaultCertificate
+
+	mu sync.Mutex
+	// failedAt records when each bastion last failed. Bastions still cooling
+	// down are only tried once the others have failed too.
+	failedAt map[int]time.Time
+}
+
+func newBastions(cfg TunnelConfig) (*bastions, error) {
+	b := &bastions{
+		random:   cfg.SSHHostOrder == HostOrderRandom,
+		cooldown: time.Duration(cfg.SSHHostCooldown) * time.Second,
+		failedAt: make(map[int]time.Time),
+	}
+	if b.cooldown == 0 {
+		b.cooldown = defaultHostCooldown
+	}
+	if cfg.EC2InstanceConnect != nil {
+		key, err := newInstanceConnectKey(cfg)
+		if err != nil {
+			return nil, err
+		}
+		b.instanceConnect = key
+	}
+	if cfg.VaultSSHSigner != nil {
+		cert, err := newVaultCertificate(cfg)
+		if err != nil {
+			return nil, err
+		}
+		b.vaultCert, cfg.vaultCert = cert, cert
+	}
+	for _, addr := range cfg.bastionAddrs() {
+		r, err := newRoute(cfg, addr)
+		if err != nil {
+			return nil, err
+		}
+		b.routes = append(b.routes, r)
+	}
+	return b, nil
+}
+
+// bastionAddrs is ssh_hosts, or ssh_host alone. Entries without a port use
+// ssh_port.
+func (cfg TunnelConfig) bastionAddrs() []string {
+	if len(cfg.SSHHosts) == 0 {
+		return []string{sshAddress(cfg.SSHHost, cfg.SSHPort)}
+	}
+	addrs := make([]string, len(cfg.SSHHosts))
+	for i, host := range cfg.SSHHosts {
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			addrs[i] = host
+		} else {
+			addrs[i] = sshAddress(strings.Trim(host, "[]"), cfg.SSHPort)
+		}
+	}
+	return addrs
+}
+
+// bastionName identifies the tunnel's bastion in log file names.
+func (cfg TunnelConfig) bastionName() string {
+	if len(cfg.SSHHosts) > 0 {
+		host, _, err := net.SplitHostPort(cfg.SSHHosts[0])
+		if err != nil {
+			return cfg.SSHHosts[0]
+		}
+		return host
+	}
+	return cfg.SSHHost
+}
+
+func (b *bastions) String() string {
+	if len(b.routes) == 1 {
+		return b.routes[0].String()
+	}
+	names := make([]string, len(b.routes))
+	for i, r := range b.routes {
+		names[i] = r.String()
+	}
+	return "{" + strings.Join(names, " | ") + "}"
+}
+
+// addr names the bastions in errors.
+func (b *bastions) addr() string {
+	addrs := make([]string, len(b.routes))
+	for i, r := range b.routes {
+		addrs[i] = r.bastion()
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// dial connects to the first bastion that accepts, starting with those that
+// have not failed recently.
+func (b *bastions) dial(ctx context.Context) (*ssh.Client, error) {
+	if b.instanceConnect != nil {
+		if err := b.instanceConnect.push(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if b.vaultCert != nil {
+		if err := b.vaultCert.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.routes) == 1 {
+		client, err := b.routes[0].dial(ctx)
+		if err == nil {
+			log.Printf("connected to SSH bastion %s", b.routes[0].bastion())
+		}
+		return client, err
+	}
+
+	var errs []error
+	for _, i := range b.order() {
+		r := b.routes[i]
+		client, err := r.dial(ctx)
+		if err == nil {
+			b.mu.Lock()
+			delete(b.failedAt, i)
+			b.mu.Unlock()
+			log.Printf("connected to SSH bastion %s", r.bastion())
+			return client, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Printf("SSH bastion %s failed, trying the next one: %v", r.bastion(), err)
+		b.mu.Lock()
+		b.failedAt[i] = time.Now()
+		b.mu.Unlock()
+		errs = append(errs, fmt.Errorf("%s: %w", r.bastion(), err))
+	}
+	return nil, fmt.Errorf("every SSH bastion failed: %w", errors.Join(errs...))
+}
+
+// order lists the bastions to try: the available ones in the configured
+// order, then those cooling down, oldest failure first.
+func (b *bastions) order() []int {
+	indexes := make([]int, len(b.routes))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	if b.random {
+		rand.Shuffle(len(indexes), func(i, j int) { indexes[i], indexes[j] = indexes[j], indexes[i] })
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	var ready, cooling []int
+	for _, i := range indexes {
+		if failed, ok := b.failedAt[i]; ok && now.Sub(failed) < b.cooldown {
+			cooling = append(cooling, i)
+		} else {
+			ready = append(ready, i)
+		}
+	}
+	slices.SortStableFunc(cooling, func(x, y int) int { return b.failedAt[x].Compare(b.failedAt[y]) })
+	return append(ready, cooling...)
+}
@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+)
+
+// failoverConfig trusts both servers, the way a pair of bastions sharing a
+// host CA or pinned keys would be trusted.
+func failoverConfig(t *testing.T, hosts ...string) (TunnelConfig, *sshtest.Server, *sshtest.Server) {
+	t.Helper()
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	first := sshtest.StartServer(t, authorizedKey)
+	second := sshtest.StartServer(t, authorizedKey)
+	cfg := TunnelConfig{
+		SSHHostKeys: []string{first.AuthorizedHostKey(), second.AuthorizedHostKey()},
+		SSHHosts:    hosts,
+		SSHKey:      keyPEM,
+		SSHUser:     sshtest.User,
+	}
+	if cfg.SSHHosts == nil {
+		cfg.SSHHosts = []string{first.Addr(), second.Addr()}
+	}
+	return cfg, first, second
+}
+
+func TestBastionsSkipUnreachableHost(t *testing.T) {
+	closed, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := net.JoinHostPort("127.0.0.1", strconv.Itoa(closed))
+	cfg, _, second := failoverConfig(t)
+	cfg.SSHHosts = []string{dead, second.Addr()}
+
+	b, err := newBastions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := b.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() = %v, want the second bastion", err)
+	}
+	_ = client.Close()
+	if second.Handshakes() != 1 {
+		t.Fatalf("second bastion handshakes = %d, want 1", second.Handshakes())
+	}
+	// The dead bastion now cools down behind the healthy one.
+	if got := b.order(); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Fatalf("order() = %v, want the failed bastion last", got)
+	}
+}
+
+func TestBastionsReportEveryFailure(t *testing.T) {
+	var dead []string
+	for range 2 {
+		port, err := libs.GetFreePort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead = append(dead, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	}
+	cfg, _, _ := failoverConfig(t, dead...)
+
+	b, err := newBastions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.dial(context.Background())
+	if err == nil || !strings.Contains(err.Error(), dead[0]) || !strings.Contains(err.Error(), dead[1]) {
+		t.Fatalf("dial() = %v, want both bastions' failures", err)
+	}
+}
+
+// TestClientPoolFailsOverOnReconnect replaces the bastion serving a pool: the
+// reconnect lands on its twin and the log says which one serves the tunnel.
+func TestClientPoolFailsOverOnReconnect(t *testing.T) {
+	logs := captureLogs(t)
+	cfg, first, second := failoverConfig(t)
+	b, err := newBastions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &clientPool{dial: b.dial}
+	t.Cleanup(pool.close)
+
+	client, err := pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Close()
+	_ = client.Wait()
+	pool.discard(client, nil)
+
+	if _, err := pool.get(context.Background()); err != nil {
+		t.Fatalf("get() after the first bastion went away = %v", err)
+	}
+	if second.Handshakes() != 1 {
+		t.Fatalf("second bastion handshakes = %d, want 1", second.Handshakes())
+	}
+	if want := "connected to SSH bastion " + second.Addr(); !strings.Contains(logs.String(), want) {
+		t.Fatalf("logs = %q, want %q", logs.String(), want)
+	}
+}
+
+func TestBastionsOrder(t *testing.T) {
+	b := &bastions{routes: make([]route, 3), cooldown: time.Minute, failedAt: make(map[int]time.Time)}
+	now := time.Now()
+	b.failedAt[0] = now.Add(-10 * time.Second)
+	b.failedAt[1] = now.Add(-20 * time.Second)
+	if got := b.order(); !reflect.DeepEqual(got, []int{2, 1, 0}) {
+		t.Fatalf("order() = %v, want the available bastion, then the oldest failure", got)
+	}
+	b.failedAt[1] = now.Add(-2 * time.Minute)
+	if got := b.order(); !reflect.DeepEqual(got, []int{1, 2, 0}) {
+		t.Fatalf("order() = %v, want a cooled-down bastion back in line", got)
+	}
+
+	b = &bastions{routes: make([]route, 3), random: true, failedAt: make(map[int]time.Time)}
+	seen := make(map[int]bool)
+	for range 100 {
+		seen[b.order()[0]] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("random order only ever started with %v", seen)
+	}
+}
+
+func TestBastionAddrs(t *testing.T) {
+	cfg := TunnelConfig{SSHHosts: []string{"a.internal", "b.internal:2222", "10.0.0.1", "[fd00::1]"}, SSHPort: 22}
+	want := []string{"a.internal:22", "b.internal:2222", "10.0.0.1:22", "[fd00::1]:22"}
+	if got := cfg.bastionAddrs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("bastionAddrs() = %v, want %v", got, want)
+	}
+	if got := (TunnelConfig{SSHHost: "bastion", SSHPort: 2200}).bastionAddrs(); !reflect.DeepEqual(got, []string{"bastion:2200"}) {
+		t.Fatalf("bastionAddrs() = %v, want ssh_host alone", got)
+	}
+}
+
+func TestTunnelConfigValidateSSHHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "hosts", cfg: TunnelConfig{SSHHosts: []string{"a", "b:2222"}, SSHHostOrder: HostOrderRandom}},
+		{name: "both", cfg: TunnelConfig{SSHHost: "a", SSHHosts: []string{"b"}}, wantErr: "cannot be combined"},
+		{name: "empty entry", cfg: TunnelConfig{SSHHosts: []string{"a", " "}}, wantErr: "ssh_hosts[1]"},
+		{name: "bad port", cfg: TunnelConfig{SSHHosts: []string{"a:0"}}, wantErr: "ssh_hosts[0]"},
+		{name: "bad order", cfg: TunnelConfig{SSHHosts: []string{"a"}, SSHHostOrder: "round_robin"}, wantErr: "ssh_hosts_order"},
+		{name: "negative cooldown", cfg: TunnelConfig{SSHHosts: []string{"a"}, SSHHostCooldown: -1}, wantErr: "ssh_hosts_cooldown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
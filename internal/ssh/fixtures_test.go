@@ -3,7 +3,6 @@ package ssh
 import (
 	"context"
 	"net"
-	"strconv"
 	"sync/atomic"
 	"testing"
 
@@ -26,8 +25,13 @@ func startTunnel(t *testing.T, network, target string) *tunnel {
 	t.Helper()
 
 	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
-	sshAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sshtest.StartServer(t, authorizedKey)))
-	clientCfg, err := clientConfig(TunnelConfig{SSHUser: sshtest.User, SSHKey: keyPEM})
+	srv := sshtest.StartServer(t, authorizedKey)
+	sshAddr := srv.Addr()
+	clientCfg, err := clientConfig(TunnelConfig{
+		SSHUser:     sshtest.User,
+		SSHKey:      keyPEM,
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,7 +47,7 @@ func startTunnel(t *testing.T, network, target string) *tunnel {
 		t.Fatal(err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
-	fwd := newForwarder(listener, clients, network, target)
+	fwd := newForwarder(listener, clients, &targets{network: network, addrs: []string{target}})
 	served := make(chan error, 1)
 	go func() { served <- fwd.Serve(ctx) }()
 	t.Cleanup(func() {
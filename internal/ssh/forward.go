@@ -3,8 +3,10 @@ package ssh
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"time"
 
 	"github.com/dfns/terraform-provider-tunnel/internal/libs"
 	"golang.org/x/crypto/ssh"
@@ -12,13 +14,12 @@ import (
 
 type forwarder struct {
 	clients *clientPool
-	network string
-	target  string
+	targets *targets
 	server  *libs.ConnServer
 }
 
-func newForwarder(listener net.Listener, clients *clientPool, network, target string) *forwarder {
-	f := &forwarder{clients: clients, network: network, target: target}
+func newForwarder(listener net.Listener, clients *clientPool, targets *targets) *forwarder {
+	f := &forwarder{clients: clients, targets: targets}
 	f.server = libs.NewConnServer(listener, f.handle)
 	return f
 }
@@ -35,29 +36,56 @@ func (f *forwarder) handle(ctx context.Context, local net.Conn) {
 	remote, err := f.dialTarget(ctx)
 	if err != nil {
 		// A target may come up later without requiring a new tunnel.
-		log.Printf("forward to %s failed: %v", f.target, err)
+		log.Printf("forward to %s failed: %v", f.targets, err)
 		return
 	}
 	libs.Relay(local, remote)
 }
 
-// Retry transport failures once; target rejections leave the SSH client usable.
 func (f *forwarder) dialTarget(ctx context.Context) (net.Conn, error) {
+	return f.targets.dial(ctx, f.clients)
+}
+
+// Retry transport failures once; target rejections leave the SSH client usable.
+// A server out of resources for another channel is retried on a different
+// connection when the pool can open one.
+func dialThrough(ctx context.Context, clients *clientPool, network, address string) (net.Conn, error) {
+	return dialThroughWithin(ctx, clients, network, address, 0)
+}
+
+// dialThroughWithin is dialThrough giving the target timeout to answer once
+// a connection to the bastion is at hand. A target that does not answer in
+// time leaves that connection usable.
+func dialThroughWithin(ctx context.Context, clients *clientPool, network, address string, timeout time.Duration) (net.Conn, error) {
 	var lastErr error
 	for range 2 {
-		client, err := f.clients.get(ctx)
+		client, release, err := clients.acquire(ctx)
 		if err != nil {
 			return nil, err
 		}
-		remote, err := client.DialContext(ctx, f.network, f.target)
+		dialCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		remote, err := client.DialContext(dialCtx, network, address)
+		timedOut := dialCtx.Err() != nil && ctx.Err() == nil
+		cancel()
 		if err == nil {
-			return remote, nil
+			return &pooledConn{Conn: remote, release: release}, nil
+		}
+		release()
+		if timedOut {
+			return nil, fmt.Errorf("%s did not answer within %s: %w", address, timeout, context.DeadlineExceeded)
 		}
 		var openErr *ssh.OpenChannelError
 		if errors.As(err, &openErr) {
-			return nil, err
+			if openErr.Reason != ssh.ResourceShortage {
+				return nil, err
+			}
+			clients.saturated(client)
+		} else {
+			clients.discard(client, err)
 		}
-		f.clients.discard(client)
 		lastErr = err
 	}
 	return nil, lastErr
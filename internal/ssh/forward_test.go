@@ -6,7 +6,6 @@ import (
 	"io"
 	"net"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -159,15 +158,19 @@ func TestForwardKeepsSSHConnectionWhenTargetRefuses(t *testing.T) {
 func TestForwardCancellationInterruptsTargetDial(t *testing.T) {
 	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
 	channelOpened := make(chan struct{}, 1)
-	sshPort := sshtest.StartServerWithChannelHandler(t, authorizedKey, func(ssh.NewChannel) {
+	srv := sshtest.StartServerWithChannelHandler(t, authorizedKey, func(ssh.NewChannel) {
 		channelOpened <- struct{}{}
 		// Deliberately leave the channel-open request unanswered.
 	})
-	clientCfg, err := clientConfig(TunnelConfig{SSHUser: sshtest.User, SSHKey: keyPEM})
+	clientCfg, err := clientConfig(TunnelConfig{
+		SSHUser:     sshtest.User,
+		SSHKey:      keyPEM,
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	sshAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sshPort))
+	sshAddr := srv.Addr()
 	clients := &clientPool{dial: func(ctx context.Context) (*ssh.Client, error) {
 		return dialSSH(ctx, sshAddr, clientCfg)
 	}}
@@ -178,7 +181,7 @@ func TestForwardCancellationInterruptsTargetDial(t *testing.T) {
 		t.Fatal(err)
 	}
 	ctx, cancel := context.WithCancel(context.Background())
-	fwd := newForwarder(listener, clients, "tcp", "target.internal:443")
+	fwd := newForwarder(listener, clients, &targets{network: "tcp", addrs: []string{"target.internal:443"}})
 	served := make(chan error, 1)
 	go func() { served <- fwd.Serve(ctx) }()
 	t.Cleanup(func() {
@@ -310,6 +313,7 @@ func TestRunTunnelReportsBadCredentials(t *testing.T) {
 // means both the SSH connection and the configured target have been reached.
 func TestRunTunnelReportsUnreachableTarget(t *testing.T) {
 	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, authorizedKey)
 	localPort, err := libs.GetFreePort()
 	if err != nil {
 		t.Fatal(err)
@@ -322,8 +326,9 @@ func TestRunTunnelReportsUnreachableTarget(t *testing.T) {
 		LocalHost:    "127.0.0.1",
 		LocalPort:    localPort,
 		SSHHost:      "127.0.0.1",
+		SSHHostKeys:  []string{srv.AuthorizedHostKey()},
 		SSHKey:       keyPEM,
-		SSHPort:      sshtest.StartServer(t, authorizedKey),
+		SSHPort:      srv.Port,
 		SSHUser:      sshtest.User,
 		TargetSocket: missingSocket,
 	})
@@ -0,0 +1,149 @@
+package ssh
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var errNoHostKeyTrust = errors.New("no way to verify the SSH bastion's host key: set ssh_host_key, " +
+	"ssh_host_ca_key or ssh_known_hosts_file, add the bastion to ~/.ssh/known_hosts, " +
+	"or set ssh_insecure_ignore_host_key = true to skip verification")
+
+// hostKeyVerifier accepts a host key that any configured trust source accepts.
+type hostKeyVerifier struct {
+	pinned         []ssh.PublicKey
+	authorities    []ssh.PublicKey
+	knownHosts     ssh.HostKeyCallback
+	knownHostsFile string
+}
+
+func hostKeyCallback(cfg TunnelConfig) (ssh.HostKeyCallback, error) {
+	if cfg.SSHInsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	pinned, err := parsePublicKeys("ssh_host_key", cfg.SSHHostKeys)
+	if err != nil {
+		return nil, err
+	}
+	authorities, err := parsePublicKeys("ssh_host_ca_key", cfg.SSHHostCAKeys)
+	if err != nil {
+		return nil, err
+	}
+	v := &hostKeyVerifier{pinned: pinned, authorities: authorities}
+
+	v.knownHostsFile = cfg.SSHKnownHostsFile
+	if v.knownHostsFile == "" && len(pinned) == 0 && len(authorities) == 0 {
+		// Explicit keys are authoritative, so the user's file is only a fallback.
+		v.knownHostsFile = defaultKnownHostsFile()
+	}
+	if v.knownHostsFile != "" {
+		v.knownHosts, err = knownhosts.New(v.knownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("read known hosts file %s: %w", v.knownHostsFile, err)
+		}
+	}
+
+	if len(pinned) == 0 && len(authorities) == 0 && v.knownHosts == nil {
+		return nil, errNoHostKeyTrust
+	}
+	return v.check, nil
+}
+
+// Missing is not an error: the file is only consulted when it exists.
+func defaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if v.isPinned(key) {
+		return nil
+	}
+	var reasons []string
+	if cert, ok := key.(*ssh.Certificate); ok && len(v.authorities) > 0 {
+		checker := &ssh.CertChecker{IsHostAuthority: v.isAuthority}
+		err := checker.CheckHostKey(hostname, remote, cert)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("ssh_host_ca_key: %v", err))
+	}
+	if v.knownHosts != nil {
+		err := v.knownHosts(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, knownHostsReason(v.knownHostsFile, err))
+	}
+	if len(v.pinned) > 0 {
+		reasons = append(reasons, "ssh_host_key: not among the pinned keys")
+	}
+	return fmt.Errorf("SSH host key verification failed for %s: the bastion presented %s key %s (%s)",
+		hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(reasons, "; "))
+}
+
+// A certificate also matches a pin on the key it certifies.
+func (v *hostKeyVerifier) isPinned(key ssh.PublicKey) bool {
+	candidates := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		candidates = append(candidates, cert.Key)
+	}
+	for _, pin := range v.pinned {
+		for _, candidate := range candidates {
+			if bytes.Equal(pin.Marshal(), candidate.Marshal()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *hostKeyVerifier) isAuthority(auth ssh.PublicKey, _ string) bool {
+	for _, ca := range v.authorities {
+		if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// A changed key is worth calling out: it is what a man in the middle looks like.
+func knownHostsReason(file string, err error) string {
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+		return fmt.Sprintf("%s: does not match the key recorded at line %d", file, keyErr.Want[0].Line)
+	}
+	if errors.As(err, &keyErr) {
+		return fmt.Sprintf("%s: no entry for this host", file)
+	}
+	return fmt.Sprintf("%s: %v", file, err)
+}
+
+// parsePublicKeys reads authorized_keys-format lines, such as the contents of a
+// host's /etc/ssh/ssh_host_ed25519_key.pub.
+func parsePublicKeys(attribute string, lines []string) ([]ssh.PublicKey, error) {
+	keys := make([]ssh.PublicKey, 0, len(lines))
+	for _, line := range lines {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s %q: %w", attribute, line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
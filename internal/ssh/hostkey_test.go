@@ -0,0 +1,233 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorizedKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// hostCertSigner presents hostKey as a host certificate signed by ca.
+func hostCertSigner(t *testing.T, ca, hostKey ssh.Signer, principals ...string) ssh.Signer {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             hostKey.PublicKey(),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(cert, hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// dialWithHostKeyConfig handshakes with srv using cfg's host key settings.
+func dialWithHostKeyConfig(t *testing.T, srv *sshtest.Server, keyPEM string, cfg TunnelConfig) error {
+	t.Helper()
+	cfg.SSHUser = sshtest.User
+	cfg.SSHKey = keyPEM
+	clientCfg, err := clientConfig(cfg)
+	if err != nil {
+		return err
+	}
+	client, err := dialSSH(context.Background(), srv.Addr(), clientCfg)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func TestHostKeyVerification(t *testing.T) {
+	ca := newSigner(t)
+	otherCA := newSigner(t)
+	hostKey := newSigner(t)
+	stranger := newSigner(t)
+
+	tests := []struct {
+		name       string
+		hostSigner ssh.Signer
+		cfg        func(dir string, srv *sshtest.Server) TunnelConfig
+		wantErr    string
+	}{
+		{
+			name:       "pinned key",
+			hostSigner: hostKey,
+			cfg: func(_ string, srv *sshtest.Server) TunnelConfig {
+				return TunnelConfig{SSHHostKeys: []string{authorizedKey(stranger.PublicKey()), srv.AuthorizedHostKey()}}
+			},
+		},
+		{
+			name:       "wrong pinned key names the presented fingerprint",
+			hostSigner: hostKey,
+			cfg: func(string, *sshtest.Server) TunnelConfig {
+				return TunnelConfig{SSHHostKeys: []string{authorizedKey(stranger.PublicKey())}}
+			},
+			wantErr: ssh.FingerprintSHA256(hostKey.PublicKey()),
+		},
+		{
+			name:       "known hosts file",
+			hostSigner: hostKey,
+			cfg: func(dir string, srv *sshtest.Server) TunnelConfig {
+				line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, hostKey.PublicKey())
+				return TunnelConfig{SSHKnownHostsFile: writeKeyFile(t, dir, "known_hosts", line+"\n")}
+			},
+		},
+		{
+			name:       "changed key in known hosts file",
+			hostSigner: hostKey,
+			cfg: func(dir string, srv *sshtest.Server) TunnelConfig {
+				line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, stranger.PublicKey())
+				return TunnelConfig{SSHKnownHostsFile: writeKeyFile(t, dir, "known_hosts", line+"\n")}
+			},
+			wantErr: "does not match the key recorded at line 1",
+		},
+		{
+			name:       "host certificate from trusted CA",
+			hostSigner: hostCertSigner(t, ca, hostKey, "127.0.0.1"),
+			cfg: func(string, *sshtest.Server) TunnelConfig {
+				return TunnelConfig{SSHHostCAKeys: []string{authorizedKey(ca.PublicKey())}}
+			},
+		},
+		{
+			name:       "host certificate from another CA",
+			hostSigner: hostCertSigner(t, otherCA, hostKey, "127.0.0.1"),
+			cfg: func(string, *sshtest.Server) TunnelConfig {
+				return TunnelConfig{SSHHostCAKeys: []string{authorizedKey(ca.PublicKey())}}
+			},
+			wantErr: "ssh_host_ca_key",
+		},
+		{
+			name:       "host certificate for another host",
+			hostSigner: hostCertSigner(t, ca, hostKey, "bastion.example.com"),
+			cfg: func(string, *sshtest.Server) TunnelConfig {
+				return TunnelConfig{SSHHostCAKeys: []string{authorizedKey(ca.PublicKey())}}
+			},
+			wantErr: "ssh_host_ca_key",
+		},
+		{
+			name:       "cert-authority line in known hosts file",
+			hostSigner: hostCertSigner(t, ca, hostKey, "127.0.0.1"),
+			cfg: func(dir string, srv *sshtest.Server) TunnelConfig {
+				line := "@cert-authority " + knownhosts.Normalize(srv.Addr()) + " " + authorizedKey(ca.PublicKey())
+				return TunnelConfig{SSHKnownHostsFile: writeKeyFile(t, dir, "known_hosts", line+"\n")}
+			},
+		},
+		{
+			name:       "insecure opt-out",
+			hostSigner: hostKey,
+			cfg: func(string, *sshtest.Server) TunnelConfig {
+				return TunnelConfig{SSHInsecureIgnoreHostKey: true}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := isolateCredentials(t)
+			keyPEM, clientKey := sshtest.GenerateClientKey(t)
+			srv := sshtest.Start(t, sshtest.Config{AuthorizedKey: clientKey, HostSigner: tt.hostSigner})
+
+			err := dialWithHostKeyConfig(t, srv, keyPEM, tt.cfg(dir, srv))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("dial = %v, want success", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("dial succeeded, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("dial = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestHostKeyVerificationRequiresTrust is the security fix itself: with nothing
+// to verify against, the tunnel refuses to connect instead of trusting anything.
+func TestHostKeyVerificationRequiresTrust(t *testing.T) {
+	isolateCredentials(t)
+	_, err := clientConfig(TunnelConfig{SSHKey: generateKey(t, "")})
+	if !errors.Is(err, errNoHostKeyTrust) {
+		t.Fatalf("clientConfig() = %v, want %v", err, errNoHostKeyTrust)
+	}
+}
+
+func TestHostKeyVerificationUsesDefaultKnownHosts(t *testing.T) {
+	home := isolateCredentials(t)
+	keyPEM, clientKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, clientKey)
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, srv.HostKey)
+	writeKeyFile(t, filepath.Join(home, ".ssh"), "known_hosts", line+"\n")
+
+	if err := dialWithHostKeyConfig(t, srv, keyPEM, TunnelConfig{}); err != nil {
+		t.Fatalf("dial = %v, want ~/.ssh/known_hosts to be trusted", err)
+	}
+}
+
+func TestTunnelConfigValidateHostKeys(t *testing.T) {
+	pin := authorizedKey(newSigner(t).PublicKey())
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "pinned key", cfg: TunnelConfig{SSHHostKeys: []string{pin}}},
+		{name: "insecure alone", cfg: TunnelConfig{SSHInsecureIgnoreHostKey: true}},
+		{
+			name:    "insecure with pinned key",
+			cfg:     TunnelConfig{SSHInsecureIgnoreHostKey: true, SSHHostKeys: []string{pin}},
+			wantErr: "cannot be combined",
+		},
+		{
+			name:    "malformed pinned key",
+			cfg:     TunnelConfig{SSHHostKeys: []string{"ssh-ed25519 not-base64"}},
+			wantErr: "parse ssh_host_key",
+		},
+		{
+			name:    "malformed CA key",
+			cfg:     TunnelConfig{SSHHostCAKeys: []string{"garbage"}},
+			wantErr: "parse ssh_host_ca_key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
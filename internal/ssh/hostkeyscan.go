@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A server proves a single host key per handshake, so ScanHostKeys offers
+// each family of key types in a handshake of its own, as ssh-keyscan does.
+var hostKeyFamilies = [][]string{
+	{ssh.KeyAlgoED25519},
+	{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521},
+	{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA},
+}
+
+var errHostKeyCaptured = errors.New("host key captured")
+
+// HostKey is a key an SSH server proved it holds.
+type HostKey struct {
+	// AuthorizedKey is the key in authorized_keys format, the form
+	// ssh_host_key takes.
+	AuthorizedKey string
+	// Fingerprint is the SHA256 fingerprint ssh-keygen -l prints.
+	Fingerprint string
+}
+
+// ScanHostKeys returns the host keys the server at host:port offers, without
+// authenticating. proxyURL and ALL_PROXY are honoured like ssh_proxy_url.
+func ScanHostKeys(ctx context.Context, host string, port int, proxyURL string) ([]HostKey, error) {
+	addr := sshAddress(host, port)
+	proxy, err := proxyFor(proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+	var dialer contextDialer = &net.Dialer{}
+	if proxy != nil {
+		dialer = &proxyDialer{proxy: proxy}
+	}
+
+	var keys []HostKey
+	var refused error
+	for _, family := range hostKeyFamilies {
+		var offered ssh.PublicKey
+		cfg := &ssh.ClientConfig{
+			User:              "tunnel",
+			HostKeyAlgorithms: family,
+			HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+				offered = key
+				return errHostKeyCaptured
+			},
+			Timeout: dialTimeout,
+		}
+		connection := &connectionDialer{dialer: dialer}
+		client, err := dialSSHVia(ctx, connection, addr, cfg)
+		if client != nil {
+			_ = client.Close()
+		}
+		if offered != nil {
+			keys = append(keys, HostKey{
+				AuthorizedKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(offered))),
+				Fingerprint:   ssh.FingerprintSHA256(offered),
+			})
+			continue
+		}
+		// Failing to connect would repeat for every family. A server that
+		// took the connection but never showed a key has none of the family.
+		if !connection.connected || ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to scan host keys of %s: %w", addr, err)
+		}
+		refused = err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s offered no host key of a supported type: %w", addr, refused)
+	}
+	return keys, nil
+}
+
+// connectionDialer records whether the connection was made, to tell a server
+// that is unreachable from one that refused the handshake.
+type connectionDialer struct {
+	dialer    contextDialer
+	connected bool
+}
+
+func (d *connectionDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, addr)
+	d.connected = err == nil
+	return conn, err
+}
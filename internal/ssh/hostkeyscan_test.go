@@ -0,0 +1,89 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestScanHostKeys(t *testing.T) {
+	_, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, authorizedKey)
+
+	keys, err := ScanHostKeys(context.Background(), "127.0.0.1", srv.Port, "")
+	if err != nil {
+		t.Fatalf("ScanHostKeys() = %v", err)
+	}
+	want := HostKey{AuthorizedKey: srv.AuthorizedHostKey(), Fingerprint: ssh.FingerprintSHA256(srv.HostKey)}
+	if len(keys) != 1 || keys[0] != want {
+		t.Fatalf("ScanHostKeys() = %+v, want %+v", keys, want)
+	}
+	if srv.Handshakes() != 0 {
+		t.Fatalf("scan authenticated %d times, want none", srv.Handshakes())
+	}
+}
+
+func TestScanHostKeysOfAnotherType(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := sshtest.Start(t, sshtest.Config{HostSigner: signer})
+
+	keys, err := ScanHostKeys(context.Background(), "localhost", srv.Port, "")
+	if err != nil {
+		t.Fatalf("ScanHostKeys() = %v", err)
+	}
+	if len(keys) != 1 || !strings.HasPrefix(keys[0].AuthorizedKey, ssh.KeyAlgoECDSA384+" ") {
+		t.Fatalf("ScanHostKeys() = %+v, want the ECDSA P-384 key", keys)
+	}
+}
+
+func TestScanHostKeysUnreachable(t *testing.T) {
+	port, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ScanHostKeys(context.Background(), "127.0.0.1", port, "")
+	if err == nil || !strings.Contains(err.Error(), net.JoinHostPort("127.0.0.1", strconv.Itoa(port))) {
+		t.Fatalf("ScanHostKeys() = %v, want the unreachable address named", err)
+	}
+}
+
+// A server that takes the connection but never shows a key is reported as
+// offering none, with the handshake failure.
+func TestScanHostKeysWithoutHandshake(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	_, err = ScanHostKeys(context.Background(), "127.0.0.1", port, "")
+	if err == nil || !strings.Contains(err.Error(), "offered no host key of a supported type") {
+		t.Fatalf("ScanHostKeys() = %v, want no host key offered", err)
+	}
+}
@@ -0,0 +1,127 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2instanceconnect"
+	"github.com/dfns/terraform-provider-tunnel/internal/awsconfig"
+	"golang.org/x/crypto/ssh"
+)
+
+// EC2 Instance Connect honours a pushed key for 60 seconds; it is pushed
+// again before any connection made later than this.
+const instanceConnectRepush = 45 * time.Second
+
+// EC2InstanceConnect authenticates to the bastion with a key generated for
+// the tunnel and pushed with EC2 Instance Connect, for ssh_user on InstanceID.
+type EC2InstanceConnect struct {
+	InstanceID       string
+	AvailabilityZone string
+	// EndpointURL overrides the EC2 Instance Connect endpoint.
+	EndpointURL string
+	Profile     string
+	Region      string
+	RoleARN     string
+	// PushedAt is when the provider pushed the key it handed to the child,
+	// which pushes it again once that has expired.
+	PushedAt time.Time
+}
+
+func (e EC2InstanceConnect) validate(cfg TunnelConfig) error {
+	if !strings.HasPrefix(e.InstanceID, "i-") {
+		return fmt.Errorf("ec2_instance_connect.instance_id %q is not an EC2 instance ID", e.InstanceID)
+	}
+	if cfg.SSHKey != "" || cfg.SSHCertificate != "" {
+		return errors.New("ec2_instance_connect cannot be combined with ssh_key or ssh_certificate")
+	}
+	return nil
+}
+
+// instanceConnectKey pushes the tunnel's public key whenever the last push
+// is about to expire.
+type instanceConnectKey struct {
+	settings  EC2InstanceConnect
+	user      string
+	publicKey string
+
+	mu       sync.Mutex
+	client   *ec2instanceconnect.Client
+	pushedAt time.Time
+}
+
+func newInstanceConnectKey(cfg TunnelConfig) (*instanceConnectKey, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(cfg.SSHKey))
+	if err != nil {
+		return nil, fmt.Errorf("parse EC2 Instance Connect key: %w", err)
+	}
+	return &instanceConnectKey{
+		settings:  *cfg.EC2InstanceConnect,
+		user:      cfg.SSHUser,
+		publicKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+		pushedAt:  cfg.EC2InstanceConnect.PushedAt,
+	}, nil
+}
+
+func (k *instanceConnectKey) push(ctx context.Context) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.pushedAt) < instanceConnectRepush {
+		return nil
+	}
+
+	if k.client == nil {
+		awsCfg, err := awsconfig.Load(ctx, k.settings.Region, k.settings.Profile, k.settings.RoleARN)
+		if err != nil {
+			return fmt.Errorf("load AWS config for EC2 Instance Connect: %w", err)
+		}
+		k.client = ec2instanceconnect.NewFromConfig(awsCfg, func(o *ec2instanceconnect.Options) {
+			if k.settings.EndpointURL != "" {
+				o.BaseEndpoint = aws.String(k.settings.EndpointURL)
+			}
+		})
+	}
+	input := &ec2instanceconnect.SendSSHPublicKeyInput{
+		InstanceId:     aws.String(k.settings.InstanceID),
+		InstanceOSUser: aws.String(k.user),
+		SSHPublicKey:   aws.String(k.publicKey),
+	}
+	if k.settings.AvailabilityZone != "" {
+		input.AvailabilityZone = aws.String(k.settings.AvailabilityZone)
+	}
+	pushedAt := time.Now()
+	if _, err := k.client.SendSSHPublicKey(ctx, input); err != nil {
+		return fmt.Errorf("push SSH key to %s with EC2 Instance Connect: %w", k.settings.InstanceID, err)
+	}
+	k.pushedAt = pushedAt
+	return nil
+}
+
+// withInstanceConnectKey generates the tunnel's key and pushes it, so a
+// missing permission fails the apply rather than the child.
+func (cfg TunnelConfig) withInstanceConnectKey(ctx context.Context) (TunnelConfig, error) {
+	if cfg.EC2InstanceConnect == nil {
+		return cfg, nil
+	}
+	var err error
+	cfg.SSHKey, err = ephemeralKey()
+	if err != nil {
+		return cfg, err
+	}
+	key, err := newInstanceConnectKey(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	if err := key.push(ctx); err != nil {
+		return cfg, err
+	}
+	settings := *cfg.EC2InstanceConnect
+	settings.PushedAt = key.pushedAt
+	cfg.EC2InstanceConnect = &settings
+	return cfg, nil
+}
@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// instanceConnectStandIn answers SendSSHPublicKey like the EC2 Instance
+// Connect API, authorizing the pushed key on the bastion.
+type instanceConnectStandIn struct {
+	url string
+
+	mu     sync.Mutex
+	pushes []map[string]string
+}
+
+func startInstanceConnectStandIn(t *testing.T, bastion *sshtest.Server) *instanceConnectStandIn {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(home, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(home, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	standIn := &instanceConnectStandIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input map[string]string
+		if r.Header.Get("X-Amz-Target") != "AWSEC2InstanceConnectService.SendSSHPublicKey" || json.NewDecoder(r.Body).Decode(&input) != nil {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		standIn.mu.Lock()
+		standIn.pushes = append(standIn.pushes, input)
+		standIn.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if input["InstanceId"] != "i-0123456789abcdef0" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"__type":"EC2InstanceNotFoundException","Message":"Instance not found"}`)
+			return
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(input["SSHPublicKey"]))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bastion.Authorize(key)
+		_, _ = io.WriteString(w, `{"RequestId":"req-1","Success":true}`)
+	}))
+	t.Cleanup(server.Close)
+	standIn.url = server.URL
+	return standIn
+}
+
+func (s *instanceConnectStandIn) pushed() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.pushes...)
+}
+
+func instanceConnectConfig(bastion *sshtest.Server, standIn *instanceConnectStandIn) TunnelConfig {
+	return TunnelConfig{
+		EC2InstanceConnect: &EC2InstanceConnect{InstanceID: "i-0123456789abcdef0", EndpointURL: standIn.url},
+		SSHHost:            "127.0.0.1",
+		SSHHostKeys:        []string{bastion.AuthorizedHostKey()},
+		SSHPort:            bastion.Port,
+		SSHUser:            sshtest.User,
+	}
+}
+
+func TestRunCommandWithInstanceConnect(t *testing.T) {
+	bastion := sshtest.Start(t, sshtest.Config{Exec: func(command string, _ io.Reader, stdout, _ io.Writer, _ <-chan struct{}) uint32 {
+		_, _ = io.WriteString(stdout, "ok")
+		return 0
+	}})
+	standIn := startInstanceConnectStandIn(t, bastion)
+
+	result, err := RunCommand(context.Background(), CommandConfig{
+		TunnelConfig: instanceConnectConfig(bastion, standIn),
+		Command:      "uptime",
+	})
+	if err != nil {
+		t.Fatalf("RunCommand() = %v", err)
+	}
+	if result.Stdout != "ok" {
+		t.Fatalf("RunCommand() = %+v", result)
+	}
+	pushes := standIn.pushed()
+	if len(pushes) != 1 {
+		t.Fatalf("pushed %d keys, want 1", len(pushes))
+	}
+	if pushes[0]["InstanceId"] != "i-0123456789abcdef0" || pushes[0]["InstanceOSUser"] != sshtest.User ||
+		!strings.HasPrefix(pushes[0]["SSHPublicKey"], ssh.KeyAlgoED25519+" ") {
+		t.Fatalf("SendSSHPublicKey input = %v", pushes[0])
+	}
+}
+
+// TestInstanceConnectPushesAgainOnReconnect is the child's side: the key the
+// provider pushed has expired by the time the connection is re-established.
+func TestInstanceConnectPushesAgainOnReconnect(t *testing.T) {
+	bastion := sshtest.Start(t, sshtest.Config{})
+	standIn := startInstanceConnectStandIn(t, bastion)
+
+	cfg, err := instanceConnectConfig(bastion, standIn).withInstanceConnectKey(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SSHKey == "" || cfg.EC2InstanceConnect.PushedAt.IsZero() {
+		t.Fatal("the generated key and push time are not handed on")
+	}
+	hops, err := newBastions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := hops.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() = %v", err)
+	}
+	_ = client.Close()
+	if n := len(standIn.pushed()); n != 1 {
+		t.Fatalf("pushed %d keys, want the provider's push reused", n)
+	}
+
+	hops.instanceConnect.mu.Lock()
+	hops.instanceConnect.pushedAt = time.Now().Add(-time.Minute)
+	hops.instanceConnect.mu.Unlock()
+	client, err = hops.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() after the key expired = %v", err)
+	}
+	_ = client.Close()
+	if n := len(standIn.pushed()); n != 2 {
+		t.Fatalf("pushed %d keys, want the key pushed again", n)
+	}
+}
+
+func TestInstanceConnectPushFailure(t *testing.T) {
+	bastion := sshtest.Start(t, sshtest.Config{})
+	standIn := startInstanceConnectStandIn(t, bastion)
+	cfg := instanceConnectConfig(bastion, standIn)
+	cfg.EC2InstanceConnect.InstanceID = "i-0000000000000000f"
+
+	_, err := cfg.withInstanceConnectKey(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "i-0000000000000000f") || !strings.Contains(err.Error(), "EC2InstanceNotFoundException") {
+		t.Fatalf("withInstanceConnectKey() = %v, want the API error for the instance", err)
+	}
+}
+
+func TestTunnelConfigValidateInstanceConnect(t *testing.T) {
+	if err := (TunnelConfig{EC2InstanceConnect: &EC2InstanceConnect{InstanceID: "bastion"}}).Validate(); err == nil || !strings.Contains(err.Error(), "instance_id") {
+		t.Fatalf("Validate() = %v, want the instance ID rejected", err)
+	}
+	cfg := TunnelConfig{EC2InstanceConnect: &EC2InstanceConnect{InstanceID: "i-0123456789abcdef0"}, SSHKey: "key"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "ssh_key") {
+		t.Fatalf("Validate() = %v, want ssh_key rejected", err)
+	}
+}
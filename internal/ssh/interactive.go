@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30 * time.Second
+)
+
+// PromptAnswer answers the keyboard-interactive prompts that Prompt matches,
+// either with Answer or with the current TOTP code for TOTPSecret.
+type PromptAnswer struct {
+	Prompt     string
+	Answer     string
+	TOTPSecret string
+}
+
+func (a PromptAnswer) validate(attribute string) error {
+	if _, err := regexp.Compile(a.Prompt); err != nil {
+		return fmt.Errorf("%s.prompt: %w", attribute, err)
+	}
+	if (a.Answer == "") == (a.TOTPSecret == "") {
+		return fmt.Errorf("%s: exactly one of answer or totp_secret must be set", attribute)
+	}
+	if a.TOTPSecret != "" {
+		if _, err := decodeTOTPSecret(a.TOTPSecret); err != nil {
+			return fmt.Errorf("%s.totp_secret: %w", attribute, err)
+		}
+	}
+	return nil
+}
+
+type promptResponder struct {
+	pattern *regexp.Regexp
+	answer  PromptAnswer
+}
+
+// keyboardInteractive answers each prompt with the first answer whose pattern
+// matches it. Answers are computed per round, so a reconnect gets a fresh TOTP
+// code.
+func keyboardInteractive(answers []PromptAnswer) (ssh.AuthMethod, error) {
+	responders := make([]promptResponder, len(answers))
+	for i, answer := range answers {
+		pattern, err := regexp.Compile(answer.Prompt)
+		if err != nil {
+			return nil, fmt.Errorf("keyboard_interactive[%d].prompt: %w", i, err)
+		}
+		responders[i] = promptResponder{pattern: pattern, answer: answer}
+	}
+
+	return ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+		replies := make([]string, len(questions))
+		for i, question := range questions {
+			reply, err := respond(responders, question)
+			if err != nil {
+				return nil, err
+			}
+			replies[i] = reply
+		}
+		return replies, nil
+	}), nil
+}
+
+func respond(responders []promptResponder, question string) (string, error) {
+	for _, r := range responders {
+		if !r.pattern.MatchString(question) {
+			continue
+		}
+		if r.answer.TOTPSecret != "" {
+			return totpCode(r.answer.TOTPSecret, time.Now())
+		}
+		return r.answer.Answer, nil
+	}
+	return "", fmt.Errorf("no keyboard_interactive prompt matches the bastion's prompt %q", question)
+}
+
+// decodeTOTPSecret accepts the base32 secret authenticator apps are given,
+// with or without padding, spaces or lowercase.
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	normalized := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	normalized = strings.TrimRight(normalized, "=")
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(normalized)
+	if err != nil {
+		return nil, errors.New("not a base32 TOTP secret")
+	}
+	return key, nil
+}
+
+// totpCode is the RFC 6238 code for now: HMAC-SHA1, 30 second steps, 6 digits,
+// the parameters authenticator apps default to.
+func totpCode(secret string, now time.Time) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now.Unix()/int64(totpPeriod/time.Second)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1_000_000), nil
+}
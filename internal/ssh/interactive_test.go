@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+)
+
+// The RFC 6238 appendix B SHA-1 vectors, truncated to six digits.
+func TestTOTPCode(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := totpCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatalf("totpCode() = %v", err)
+		}
+		if got != want {
+			t.Errorf("totpCode(%d) = %s, want %s", unix, got, want)
+		}
+	}
+
+	// Authenticator apps show secrets grouped and in lowercase.
+	got, err := totpCode("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	if err != nil || got != "287082" {
+		t.Fatalf("totpCode() of a formatted secret = %s, %v", got, err)
+	}
+}
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// acceptTOTP accepts the current code or the previous one, so a round that
+// straddles a step boundary does not fail.
+func acceptTOTP(t *testing.T) func(string) bool {
+	return func(answer string) bool {
+		now := time.Now()
+		for _, at := range []time.Time{now, now.Add(-totpPeriod)} {
+			code, err := totpCode(testTOTPSecret, at)
+			if err != nil {
+				t.Error(err)
+				return false
+			}
+			if answer == code {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// startMFAServer requires the client key and then answers to a password and a
+// verification code prompt.
+func startMFAServer(t *testing.T) (*sshtest.Server, string) {
+	t.Helper()
+	keyPEM, clientKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.Start(t, sshtest.Config{
+		AuthorizedKey: clientKey,
+		Challenges: []sshtest.Challenge{
+			{Prompt: "Password: ", Accept: func(answer string) bool { return answer == "hunter2" }},
+			{Prompt: "Verification code: ", Accept: acceptTOTP(t)},
+		},
+	})
+	return srv, keyPEM
+}
+
+func dialMFA(t *testing.T, srv *sshtest.Server, cfg TunnelConfig) error {
+	t.Helper()
+	cfg.SSHUser = sshtest.User
+	cfg.SSHHostKeys = []string{srv.AuthorizedHostKey()}
+	clientCfg, err := clientConfig(cfg)
+	if err != nil {
+		return err
+	}
+	client, err := dialSSH(context.Background(), srv.Addr(), clientCfg)
+	if err != nil {
+		return err
+	}
+	return client.Close()
+}
+
+func TestKeyboardInteractiveAfterPublicKey(t *testing.T) {
+	isolateCredentials(t)
+	srv, keyPEM := startMFAServer(t)
+	answers := []PromptAnswer{
+		{Prompt: "(?i)verification code", TOTPSecret: testTOTPSecret},
+		{Prompt: "^Password:", Answer: "hunter2"},
+	}
+
+	if err := dialMFA(t, srv, TunnelConfig{SSHKey: keyPEM, KeyboardInteractive: answers}); err != nil {
+		t.Fatalf("dial = %v, want the key and both answers accepted", err)
+	}
+	if err := dialMFA(t, srv, TunnelConfig{SSHKey: keyPEM}); err == nil {
+		t.Fatal("dial without keyboard_interactive succeeded, want the second factor required")
+	}
+}
+
+func TestKeyboardInteractiveUnmatchedPrompt(t *testing.T) {
+	isolateCredentials(t)
+	srv, keyPEM := startMFAServer(t)
+
+	err := dialMFA(t, srv, TunnelConfig{
+		SSHKey:              keyPEM,
+		KeyboardInteractive: []PromptAnswer{{Prompt: "^Password:", Answer: "hunter2"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), `"Verification code: "`) {
+		t.Fatalf("dial = %v, want it to name the unanswered prompt", err)
+	}
+}
+
+// TestKeyboardInteractiveAfterAgentKey chains keyboard-interactive after a key
+// the agent offers once a default key file was refused, which only works when
+// both come from one publickey method.
+func TestKeyboardInteractiveAfterAgentKey(t *testing.T) {
+	home := isolateCredentials(t)
+	srv, keyPEM := startMFAServer(t)
+	startAgent(t, keyPEM)
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, filepath.Join(home, ".ssh"), "id_ed25519", generateKey(t, ""))
+
+	err := dialMFA(t, srv, TunnelConfig{KeyboardInteractive: []PromptAnswer{
+		{Prompt: "Verification code", TOTPSecret: testTOTPSecret},
+		{Prompt: "Password", Answer: "hunter2"},
+	}})
+	if err != nil {
+		t.Fatalf("dial = %v", err)
+	}
+}
+
+func TestTunnelConfigValidateKeyboardInteractive(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  PromptAnswer
+		wantErr string
+	}{
+		{name: "static answer", answer: PromptAnswer{Prompt: "Password", Answer: "hunter2"}},
+		{name: "totp", answer: PromptAnswer{Prompt: "code", TOTPSecret: testTOTPSecret}},
+		{name: "bad pattern", answer: PromptAnswer{Prompt: "(", Answer: "x"}, wantErr: "keyboard_interactive[0].prompt"},
+		{name: "neither", answer: PromptAnswer{Prompt: "code"}, wantErr: "exactly one"},
+		{name: "both", answer: PromptAnswer{Prompt: "code", Answer: "x", TOTPSecret: testTOTPSecret}, wantErr: "exactly one"},
+		{name: "bad secret", answer: PromptAnswer{Prompt: "code", TOTPSecret: "not base32!"}, wantErr: "totp_secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := TunnelConfig{KeyboardInteractive: []PromptAnswer{tt.answer}}.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hop is one SSH connection on the way to the bastion.
+type hop struct {
+	addr   string
+	config *ssh.ClientConfig
+	// dialer opens the first hop's TCP connection, through the proxy if any.
+	dialer contextDialer
+}
+
+// route is the jump hosts in order, followed by the bastion.
+type route []hop
+
+// newRoute reaches the bastion at addr through the tunnel's jump hosts.
+func newRoute(cfg TunnelConfig, bastion string) (route, error) {
+	// The bastion first, so its credential errors are the ones reported.
+	bastionCfg, err := clientConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := make(route, 0, len(cfg.JumpHosts)+1)
+	for _, jump := range cfg.JumpHosts {
+		jumpCfg, err := clientConfig(cfg.jumpHostConfig(jump))
+		if err != nil {
+			return nil, fmt.Errorf("jump host %s: %w", jump.Host, err)
+		}
+		r = append(r, hop{addr: sshAddress(jump.Host, jump.Port), config: jumpCfg})
+	}
+	r = append(r, hop{addr: bastion, config: bastionCfg})
+
+	proxy, err := proxyFor(cfg.SSHProxyURL, r[0].addr)
+	if err != nil {
+		return nil, err
+	}
+	tcp := newKeepalivePolicy(cfg).tcpDialer()
+	r[0].dialer = tcp
+	if proxy != nil {
+		log.Printf("connecting to %s through proxy %s", r[0].addr, proxy.Redacted())
+		r[0].dialer = &proxyDialer{proxy: proxy, dialer: tcp}
+	}
+	return r, nil
+}
+
+// jumpHostConfig keeps the tunnel's trust settings, which name authorities and
+// files rather than a single host, and its algorithm restrictions.
+func (cfg TunnelConfig) jumpHostConfig(jump JumpHost) TunnelConfig {
+	hopCfg := TunnelConfig{
+		SSHAlgorithmPreset:       cfg.SSHAlgorithmPreset,
+		SSHCiphers:               cfg.SSHCiphers,
+		SSHHost:                  jump.Host,
+		SSHHostKeyAlgorithms:     cfg.SSHHostKeyAlgorithms,
+		SSHHostCAKeys:            cfg.SSHHostCAKeys,
+		SSHHostKeys:              jump.HostKeys,
+		SSHInsecureIgnoreHostKey: cfg.SSHInsecureIgnoreHostKey,
+		SSHKexAlgorithms:         cfg.SSHKexAlgorithms,
+		SSHKey:                   jump.Key,
+		SSHKnownHostsFile:        cfg.SSHKnownHostsFile,
+		SSHMACs:                  cfg.SSHMACs,
+		SSHPassword:              jump.Password,
+		SSHPort:                  jump.Port,
+		SSHUser:                  jump.User,
+	}
+	if hopCfg.SSHKey == "" && hopCfg.SSHPassword == "" {
+		// The EC2 Instance Connect key is only pushed to the bastion.
+		if cfg.EC2InstanceConnect == nil {
+			hopCfg.SSHKey, hopCfg.SSHKeyPassphrase = cfg.SSHKey, cfg.SSHKeyPassphrase
+		}
+		hopCfg.SSHCertificate, hopCfg.vaultCert = cfg.SSHCertificate, cfg.vaultCert
+		hopCfg.SSHPassword = cfg.SSHPassword
+		hopCfg.SSHIdentityFiles, hopCfg.SSHIdentitiesOnly = cfg.SSHIdentityFiles, cfg.SSHIdentitiesOnly
+		hopCfg.SSHAgentIdentities, hopCfg.SSHAgentSocket, hopCfg.SSHUseAgent = cfg.SSHAgentIdentities, cfg.SSHAgentSocket, cfg.SSHUseAgent
+	}
+	if hopCfg.SSHUser == "" {
+		hopCfg.SSHUser = cfg.SSHUser
+	}
+	return hopCfg
+}
+
+func sshAddress(host string, port int) string {
+	if port == 0 {
+		port = defaultSSHPort
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (r route) bastion() string {
+	return r[len(r)-1].addr
+}
+
+func (r route) String() string {
+	addrs := make([]string, len(r))
+	for i, h := range r {
+		addrs[i] = h.addr
+	}
+	return strings.Join(addrs, " - ")
+}
+
+// dial connects each hop through the one before it. The returned client owns
+// the whole chain: closing it closes every jump connection, and any jump
+// connection failing ends it, so the pool always rebuilds the chain as a unit.
+func (r route) dial(ctx context.Context) (*ssh.Client, error) {
+	var jumps []*ssh.Client
+	closeJumps := func() {
+		for i := len(jumps) - 1; i >= 0; i-- {
+			_ = jumps[i].Close()
+		}
+	}
+
+	var via *ssh.Client
+	for i, h := range r {
+		dialer := h.dialer
+		if via != nil {
+			dialer = via
+		}
+		client, err := dialSSHVia(ctx, dialer, h.addr, h.config)
+		if err != nil {
+			closeJumps()
+			if i < len(r)-1 {
+				return nil, fmt.Errorf("jump host %s: %w", h.addr, err)
+			}
+			return nil, err
+		}
+		if i < len(r)-1 {
+			jumps = append(jumps, client)
+		}
+		via = client
+	}
+
+	if len(jumps) > 0 {
+		go func() {
+			_ = via.Wait()
+			closeJumps()
+		}()
+	}
+	return via, nil
+}
@@ -0,0 +1,188 @@
+package ssh
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpChain is a bastion reachable through two jump hosts, all in process.
+type jumpChain struct {
+	cfg     TunnelConfig
+	jumps   []*sshtest.Server
+	bastion *sshtest.Server
+	// relayed counts the direct-tcpip channels the first jump host opened.
+	relayed *atomic.Int32
+}
+
+func startJumpChain(t *testing.T) *jumpChain {
+	t.Helper()
+	keyPEM, clientKey := sshtest.GenerateClientKey(t)
+	var relayed atomic.Int32
+	first := sshtest.StartServerWithChannelHandler(t, clientKey, func(nc ssh.NewChannel) {
+		relayed.Add(1)
+		sshtest.HandleChannel(nc)
+	})
+	second := sshtest.StartServer(t, clientKey)
+	bastion := sshtest.StartServer(t, clientKey)
+
+	jumps := []JumpHost{
+		{Host: "127.0.0.1", Port: first.Port, HostKeys: []string{first.AuthorizedHostKey()}},
+		{Host: "127.0.0.1", Port: second.Port, HostKeys: []string{second.AuthorizedHostKey()}},
+	}
+	return &jumpChain{
+		cfg: TunnelConfig{
+			JumpHosts:   jumps,
+			SSHHost:     "127.0.0.1",
+			SSHHostKeys: []string{bastion.AuthorizedHostKey()},
+			SSHKey:      keyPEM,
+			SSHPort:     bastion.Port,
+			SSHUser:     sshtest.User,
+		},
+		jumps:   []*sshtest.Server{first, second},
+		bastion: bastion,
+		relayed: &relayed,
+	}
+}
+
+func TestRouteDialsThroughJumpHosts(t *testing.T) {
+	isolateCredentials(t)
+	chain := startJumpChain(t)
+	target := startTCPTarget(t, echoUntilEOF)
+
+	hops, err := newRoute(chain.cfg, sshAddress(chain.cfg.SSHHost, chain.cfg.SSHPort))
+	if err != nil {
+		t.Fatalf("newRoute() = %v", err)
+	}
+	client, err := hops.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() = %v", err)
+	}
+	defer client.Close()
+
+	remote, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("dialing target through the chain: %v", err)
+	}
+	assertEcho(t, remote, []byte("three hops"))
+	_ = remote.Close()
+
+	// The first jump relayed only the second jump's connection; the target
+	// channel is the bastion's to open.
+	if got := chain.relayed.Load(); got != 1 {
+		t.Fatalf("first jump host relayed %d channels, want 1", got)
+	}
+	for i, srv := range append(chain.jumps, chain.bastion) {
+		if got := srv.Handshakes(); got != 1 {
+			t.Fatalf("hop %d handshakes = %d, want 1", i, got)
+		}
+	}
+}
+
+// TestRouteRebuildsChainAfterJumpHostLoss covers the middle of the chain going
+// away: the bastion connection rides on it, so the pool has to rebuild every hop.
+func TestRouteRebuildsChainAfterJumpHostLoss(t *testing.T) {
+	isolateCredentials(t)
+	chain := startJumpChain(t)
+	target := startTCPTarget(t, echoUntilEOF)
+	hops, err := newRoute(chain.cfg, sshAddress(chain.cfg.SSHHost, chain.cfg.SSHPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := &clientPool{dial: hops.dial}
+	t.Cleanup(clients.close)
+
+	first, err := clients.get(context.Background())
+	if err != nil {
+		t.Fatalf("get() = %v", err)
+	}
+	chain.jumps[1].DropConnections()
+	// The bastion connection ran over the dropped hop, so it ends with it.
+	_ = first.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client, err := clients.get(context.Background())
+		if err != nil {
+			t.Fatalf("get() after jump loss = %v", err)
+		}
+		if client != first {
+			remote, err := client.Dial("tcp", target)
+			if err != nil {
+				t.Fatalf("dialing target through the rebuilt chain: %v", err)
+			}
+			assertEcho(t, remote, []byte("rebuilt"))
+			_ = remote.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("pool kept the client of a broken chain")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i, srv := range append(chain.jumps, chain.bastion) {
+		if got := srv.Handshakes(); got != 2 {
+			t.Fatalf("hop %d handshakes = %d, want 2", i, got)
+		}
+	}
+}
+
+func TestRouteNamesFailingJumpHost(t *testing.T) {
+	isolateCredentials(t)
+	chain := startJumpChain(t)
+	chain.cfg.JumpHosts[1].HostKeys = []string{chain.bastion.AuthorizedHostKey()}
+
+	hops, err := newRoute(chain.cfg, sshAddress(chain.cfg.SSHHost, chain.cfg.SSHPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hops.dial(context.Background())
+	if err == nil {
+		t.Fatal("dial() = nil, want the second jump host's host key to be rejected")
+	}
+	if want := "jump host " + chain.jumps[1].Addr(); !strings.Contains(err.Error(), want) {
+		t.Fatalf("dial() = %v, want it to name %q", err, want)
+	}
+}
+
+func TestJumpHostConfigInheritsBastionSettings(t *testing.T) {
+	cfg := TunnelConfig{
+		SSHKey:            "bastion-key",
+		SSHKnownHostsFile: "/etc/ssh/ssh_known_hosts",
+		SSHUser:           "ops",
+	}
+
+	inherited := cfg.jumpHostConfig(JumpHost{Host: "jump.internal"})
+	if inherited.SSHKey != "bastion-key" || inherited.SSHUser != "ops" ||
+		inherited.SSHKnownHostsFile != cfg.SSHKnownHostsFile {
+		t.Fatalf("jump host did not inherit the bastion's settings: %+v", inherited)
+	}
+
+	own := cfg.jumpHostConfig(JumpHost{Host: "jump.internal", User: "jump", Password: "hunter2"})
+	if own.SSHKey != "" || own.SSHPassword != "hunter2" || own.SSHUser != "jump" {
+		t.Fatalf("jump host credentials were mixed with the bastion's: %+v", own)
+	}
+}
+
+// The key EC2 Instance Connect pushes to the bastion is no good on the jump
+// hosts, which authenticate with the default keys and the agent instead.
+func TestJumpHostConfigSkipsInstanceConnectKey(t *testing.T) {
+	useAgent := true
+	cfg := TunnelConfig{
+		EC2InstanceConnect: &EC2InstanceConnect{InstanceID: "i-0abc"},
+		SSHKey:             "ephemeral-key",
+		SSHUseAgent:        &useAgent,
+		SSHUser:            "ec2-user",
+	}
+
+	hop := cfg.jumpHostConfig(JumpHost{Host: "jump.internal"})
+	if hop.SSHKey != "" || hop.SSHUseAgent != &useAgent || hop.SSHUser != "ec2-user" {
+		t.Fatalf("jump host config = %+v, want the agent without the pushed key", hop)
+	}
+}
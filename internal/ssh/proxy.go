@@ -0,0 +1,319 @@
+package ssh
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// contextDialer opens the connection an SSH handshake runs over: a TCP
+// connection, a channel of a jump host or a tunnel through a proxy.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyDialer connects through an HTTP CONNECT or SOCKS5 proxy.
+type proxyDialer struct {
+	proxy *url.URL
+	// dialer reaches the proxy; a plain net.Dialer when nil.
+	dialer *net.Dialer
+	// tlsConfig is used for https proxies; the system roots when nil.
+	tlsConfig *tls.Config
+}
+
+// parseProxyURL accepts the schemes curl and ALL_PROXY use for the proxies
+// the dialer speaks.
+func parseProxyURL(value string) (*url.URL, error) {
+	proxy, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https, socks5 or socks5h", proxy.Scheme)
+	}
+	if proxy.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", proxy.Redacted())
+	}
+	return proxy, nil
+}
+
+// proxyFor picks the proxy for the first SSH hop: proxyURL when set, otherwise
+// ALL_PROXY unless NO_PROXY exempts addr.
+func proxyFor(proxyURL, addr string) (*url.URL, error) {
+	if proxyURL != "" {
+		proxy, err := parseProxyURL(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("ssh_proxy_url: %w", err)
+		}
+		return proxy, nil
+	}
+	value := getenvAny("ALL_PROXY", "all_proxy")
+	if value == "" || noProxy(getenvAny("NO_PROXY", "no_proxy"), addr) {
+		return nil, nil
+	}
+	proxy, err := parseProxyURL(value)
+	if err != nil {
+		return nil, fmt.Errorf("ALL_PROXY: %w", err)
+	}
+	return proxy, nil
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// noProxy reports whether the NO_PROXY list exempts addr. Entries are host
+// names, which cover their subdomains, IP addresses, CIDRs, or *, each with
+// an optional port.
+func noProxy(list, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(host)
+	ip, ipErr := netip.ParseAddr(host)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			if ipErr == nil && prefix.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		if entryIP, err := netip.ParseAddr(strings.Trim(entryHost, "[]")); err == nil {
+			if ipErr == nil && entryIP == ip {
+				return true
+			}
+			continue
+		}
+		entryHost = strings.TrimPrefix(entryHost, ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext reaches addr through the proxy. The negotiation ends as soon as
+// ctx does, like the handshake that follows.
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	port := d.proxy.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[d.proxy.Scheme]
+		if port == "" {
+			port = "1080"
+		}
+	}
+	proxyAddr := net.JoinHostPort(d.proxy.Hostname(), port)
+	dialer := d.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to proxy %s: %w", d.proxy.Redacted(), err)
+	}
+
+	// Closing the connection unblocks the negotiation when ctx ends.
+	closeDone := make(chan struct{})
+	stopClose := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+		close(closeDone)
+	})
+	tunnel, err := d.negotiate(ctx, conn, addr)
+	if !stopClose() {
+		<-closeDone
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", d.proxy.Redacted(), err)
+	}
+	return tunnel, nil
+}
+
+func (d *proxyDialer) negotiate(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	switch d.proxy.Scheme {
+	case "https":
+		tlsConfig := d.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = d.proxy.Hostname()
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		return connectViaHTTP(tlsConn, d.proxy, addr)
+	case "http":
+		return connectViaHTTP(conn, d.proxy, addr)
+	default:
+		return connectViaSOCKS(ctx, conn, d.proxy, addr)
+	}
+}
+
+// connectViaHTTP asks an HTTP proxy for a tunnel to addr.
+func connectViaHTTP(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := proxy.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	// The SSH server speaks first, so its banner may already be buffered.
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connectViaSOCKS asks a SOCKS5 proxy for a connection to addr. socks5 resolves
+// the host locally; socks5h leaves it to the proxy.
+func connectViaSOCKS(ctx context.Context, conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	host, portValue, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portValue)
+	}
+
+	method := byte(socksAuthNone)
+	if proxy.User != nil {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return nil, err
+	}
+	var selected [2]byte
+	if _, err := io.ReadFull(conn, selected[:]); err != nil {
+		return nil, err
+	}
+	if selected[1] != method {
+		return nil, errors.New("SOCKS5 proxy refused the authentication method")
+	}
+	if method == socksAuthPassword {
+		username := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return nil, errors.New("SOCKS5 username and password must be at most 255 bytes")
+		}
+		request := append([]byte{socksPasswordVersion, byte(len(username))}, username...)
+		request = append(append(request, byte(len(password))), password...)
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return nil, err
+		}
+		if status[1] != 0x00 {
+			return nil, errors.New("SOCKS5 proxy refused the username and password")
+		}
+	}
+
+	if proxy.Scheme == "socks5" {
+		if _, err := netip.ParseAddr(host); err != nil {
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+			host = addrs[0].Unmap().String()
+		}
+	}
+	request := []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			request = append(request, socksAddrIPv4)
+		} else {
+			request = append(request, socksAddrIPv6)
+		}
+		request = append(request, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q is too long for SOCKS5", host)
+		}
+		request = append(append(request, socksAddrDomain, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[1] != socksSucceeded {
+		return nil, fmt.Errorf("SOCKS5 CONNECT %s failed with reply %d", addr, reply[1])
+	}
+	// Skip the bound address, which a tunnel has no use for.
+	if _, err := readSOCKSAddr(conn, reply[3]); err != nil {
+		return nil, err
+	}
+	var boundPort [2]byte
+	if _, err := io.ReadFull(conn, boundPort[:]); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
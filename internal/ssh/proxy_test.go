@@ -0,0 +1,303 @@
+package ssh
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// pipe copies both ways until either side closes.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { _, _ = io.Copy(a, b); done <- struct{}{} }()
+	go func() { _, _ = io.Copy(b, a); done <- struct{}{} }()
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// startHTTPProxy serves CONNECT, over TLS when secure, and requires
+// credentials when they are set.
+func startHTTPProxy(t *testing.T, secure bool, credentials string) *httptest.Server {
+	t.Helper()
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if credentials != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			_ = target.Close()
+			return
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+			_ = target.Close()
+			_ = conn.Close()
+			return
+		}
+		pipe(conn, target)
+	}))
+	if secure {
+		proxy.StartTLS()
+	} else {
+		proxy.Start()
+	}
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+// socksTestProxy is a SOCKS5 proxy that connects directly and remembers the
+// hosts it was asked for.
+type socksTestProxy struct {
+	addr string
+
+	mu    sync.Mutex
+	hosts []string
+}
+
+func startSOCKSTestProxy(t *testing.T, username, password string) *socksTestProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	p := &socksTestProxy{addr: listener.Addr().String()}
+	server := &socksProxy{username: username, password: password}
+	go acceptLoop(listener, func(conn net.Conn) {
+		host, port, err := server.negotiate(conn)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.hosts = append(p.hosts, host)
+		p.mu.Unlock()
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			_ = writeSOCKSReply(conn, socksConnectionRefused)
+			return
+		}
+		if writeSOCKSReply(conn, socksSucceeded) == nil {
+			pipe(conn, target)
+		}
+	})
+	return p
+}
+
+func (p *socksTestProxy) requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.hosts...)
+}
+
+func proxyTestClientConfig(timeout time.Duration) *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:            sshtest.User,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         timeout,
+	}
+}
+
+func TestDialSSHThroughProxy(t *testing.T) {
+	isolateCredentials(t)
+	httpProxy := startHTTPProxy(t, false, "")
+	authProxy := startHTTPProxy(t, false, "ci:s3cret")
+	tlsProxy := startHTTPProxy(t, true, "")
+	socks := startSOCKSTestProxy(t, "", "")
+	socksAuth := startSOCKSTestProxy(t, "ci", "s3cret")
+
+	tests := []struct {
+		name      string
+		proxyURL  string
+		wantHost  string
+		socks     *socksTestProxy
+		tlsServer *httptest.Server
+	}{
+		{name: "http", proxyURL: httpProxy.URL},
+		{name: "http with credentials", proxyURL: "http://ci:s3cret@" + authProxy.Listener.Addr().String()},
+		{name: "https", proxyURL: tlsProxy.URL, tlsServer: tlsProxy},
+		{name: "socks5 resolves locally", proxyURL: "socks5://" + socks.addr, socks: socks, wantHost: "127.0.0.1"},
+		{name: "socks5h leaves names to the proxy", proxyURL: "socks5h://" + socks.addr, socks: socks, wantHost: "localhost"},
+		{name: "socks5 with credentials", proxyURL: "socks5h://ci:s3cret@" + socksAuth.addr, socks: socksAuth, wantHost: "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+			srv := sshtest.StartServer(t, authorizedKey)
+			hops, err := newRoute(TunnelConfig{
+				SSHHostKeys: []string{srv.AuthorizedHostKey()},
+				SSHKey:      keyPEM,
+				SSHProxyURL: tt.proxyURL,
+				SSHUser:     sshtest.User,
+			}, net.JoinHostPort("localhost", strconv.Itoa(srv.Port)))
+			if err != nil {
+				t.Fatalf("newRoute() = %v", err)
+			}
+			dialer, ok := hops[0].dialer.(*proxyDialer)
+			if !ok {
+				t.Fatalf("first hop dialer = %T, want the proxy", hops[0].dialer)
+			}
+			if tt.tlsServer != nil {
+				transport, ok := tt.tlsServer.Client().Transport.(*http.Transport)
+				if !ok {
+					t.Fatalf("test server transport = %T", tt.tlsServer.Client().Transport)
+				}
+				dialer.tlsConfig = transport.TLSClientConfig
+			}
+
+			before := 0
+			if tt.socks != nil {
+				before = len(tt.socks.requested())
+			}
+			client, err := hops.dial(context.Background())
+			if err != nil {
+				t.Fatalf("dial through %s = %v", tt.name, err)
+			}
+			_ = client.Close()
+
+			if tt.socks != nil {
+				hosts := tt.socks.requested()[before:]
+				if len(hosts) != 1 || (hosts[0] != tt.wantHost && !(tt.wantHost == "127.0.0.1" && hosts[0] == "::1")) {
+					t.Fatalf("SOCKS5 proxy was asked for %v, want %s", hosts, tt.wantHost)
+				}
+			}
+		})
+	}
+}
+
+func TestDialSSHThroughProxyRejectsWrongCredentials(t *testing.T) {
+	proxy := startHTTPProxy(t, false, "ci:s3cret")
+	proxyURL, _ := url.Parse("http://ci:wrong@" + proxy.Listener.Addr().String())
+	_, err := dialSSHVia(context.Background(), &proxyDialer{proxy: proxyURL}, "127.0.0.1:22", proxyTestClientConfig(5*time.Second))
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("dial = %v, want the proxy's 407 reported", err)
+	}
+	if strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("dial error %q leaks the proxy password", err)
+	}
+}
+
+// TestDialSSHBoundsProxyNegotiation keeps the handshake timeout in force while
+// a proxy that accepted the connection never answers.
+func TestDialSSHBoundsProxyNegotiation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go acceptLoop(listener, func(conn net.Conn) { _, _ = io.Copy(io.Discard, conn) })
+
+	for _, scheme := range []string{"http", "socks5h"} {
+		proxyURL, _ := url.Parse(scheme + "://" + listener.Addr().String())
+		start := time.Now()
+		_, err := dialSSHVia(context.Background(), &proxyDialer{proxy: proxyURL}, "bastion.internal:22", proxyTestClientConfig(200*time.Millisecond))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: dial = %v, want the handshake timeout", scheme, err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("%s: dial took %s, want it bounded by the timeout", scheme, elapsed)
+		}
+	}
+}
+
+func TestProxyForEnvironment(t *testing.T) {
+	t.Setenv("ALL_PROXY", "socks5h://proxy.corp:1080")
+	t.Setenv("NO_PROXY", ".internal,10.0.0.0/8")
+
+	tests := []struct {
+		name     string
+		proxyURL string
+		addr     string
+		want     string
+	}{
+		{name: "environment", addr: "bastion.example.com:22", want: "socks5h://proxy.corp:1080"},
+		{name: "NO_PROXY domain", addr: "bastion.prod.internal:22"},
+		{name: "NO_PROXY CIDR", addr: "10.1.2.3:22"},
+		{name: "explicit wins", proxyURL: "http://squid:3128", addr: "bastion.prod.internal:22", want: "http://squid:3128"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := proxyFor(tt.proxyURL, tt.addr)
+			if err != nil {
+				t.Fatalf("proxyFor() = %v", err)
+			}
+			got := ""
+			if proxy != nil {
+				got = proxy.String()
+			}
+			if got != tt.want {
+				t.Fatalf("proxyFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("ALL_PROXY", "ftp://proxy.corp")
+	if _, err := proxyFor("", "bastion.example.com:22"); err == nil || !strings.Contains(err.Error(), "ALL_PROXY") {
+		t.Fatalf("proxyFor() = %v, want the bad ALL_PROXY named", err)
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	tests := []struct {
+		list string
+		addr string
+		want bool
+	}{
+		{list: "*", addr: "anything:22", want: true},
+		{list: "example.com", addr: "example.com:22", want: true},
+		{list: "example.com", addr: "bastion.example.com:22", want: true},
+		{list: ".example.com", addr: "bastion.example.com:22", want: true},
+		{list: "*.example.com", addr: "bastion.example.com:22", want: true},
+		{list: "example.com", addr: "badexample.com:22", want: false},
+		{list: "example.com:2222", addr: "example.com:22", want: false},
+		{list: "example.com:22", addr: "example.com:22", want: true},
+		{list: "192.168.0.0/16, 10.0.0.5", addr: "10.0.0.5:22", want: true},
+		{list: "192.168.0.0/16", addr: "192.168.3.4:22", want: true},
+		{list: "[::1]", addr: "[::1]:22", want: true},
+		{list: "", addr: "example.com:22", want: false},
+	}
+	for _, tt := range tests {
+		if got := noProxy(tt.list, tt.addr); got != tt.want {
+			t.Errorf("noProxy(%q, %q) = %v, want %v", tt.list, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTunnelConfigValidateProxyURL(t *testing.T) {
+	for value, wantErr := range map[string]bool{
+		"http://squid.corp:3128":      false,
+		"https://user:pw@proxy.corp":  false,
+		"socks5h://127.0.0.1:1080":    false,
+		"ftp://proxy.corp":            true,
+		"http://":                     true,
+		"socks4://proxy.corp:1080":    true,
+		"http://proxy.corp:3128/path": false,
+	} {
+		err := TunnelConfig{SSHProxyURL: value}.Validate()
+		if (err != nil) != wantErr {
+			t.Errorf("Validate(%q) = %v, want error %v", value, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package ssh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"golang.org/x/crypto/ssh"
+)
+
+var ReverseTunnelType string = "ssh-reverse"
+
+// How long to wait between attempts to get the remote forward back after the
+// connection to the bastion was lost.
+const reverseRetryDelay = 2 * time.Second
+
+// ReverseTunnelConfig describes an `ssh -R` forward: the bastion listens on
+// RemoteHost:RemotePort, or RemoteSocket, and the connections it accepts are
+// relayed to LocalHost:LocalPort, or LocalSocket, on this machine. The Target
+// fields of TunnelConfig are unused.
+type ReverseTunnelConfig struct {
+	TunnelConfig
+	LocalSocket  string
+	RemoteHost   string
+	RemotePort   int
+	RemoteSocket string
+}
+
+// Validate catches settings that would only fail once the tunnel child runs.
+func (cfg ReverseTunnelConfig) Validate() error {
+	if err := cfg.TunnelConfig.Validate(); err != nil {
+		return err
+	}
+	if cfg.RemotePort < 0 || cfg.RemotePort > 65535 {
+		return fmt.Errorf("remote_port %d is not a TCP port", cfg.RemotePort)
+	}
+	if cfg.RemoteSocket != "" && (cfg.RemoteHost != "" || cfg.RemotePort != 0) {
+		return errors.New("remote_socket cannot be combined with remote_host or remote_port")
+	}
+	return nil
+}
+
+// ForkReverseTunnel starts the tunnel and returns the port the bastion listens
+// on, which it chose when RemotePort is 0. It is 0 for a RemoteSocket.
+func ForkReverseTunnel(ctx context.Context, cfg ReverseTunnelConfig) (*exec.Cmd, int, error) {
+	remote := strconv.Itoa(cfg.RemotePort)
+	if cfg.RemoteSocket != "" {
+		remote = strings.ReplaceAll(cfg.RemoteSocket, string(os.PathSeparator), "_")
+	}
+	logName := fmt.Sprintf("ssh-reverse-tunnel-%s-%s.log", cfg.bastionName(), remote)
+	var err error
+	cfg.TunnelConfig, err = cfg.withGeneratedCredentials(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	cmd, result, err := libs.ForkTunnelWithResult(ctx, ReverseTunnelType, logName, cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(string(result))
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, 0, fmt.Errorf("read remote port from tunnel: %w", err)
+	}
+	return cmd, port, nil
+}
+
+func StartRemoteReverseTunnel(ctx context.Context, cfgJson string, parentPid int) error {
+	var cfg ReverseTunnelConfig
+	if err := json.Unmarshal([]byte(cfgJson), &cfg); err != nil {
+		return err
+	}
+
+	if err := libs.WatchProcess(parentPid); err != nil {
+		return err
+	}
+
+	return runReverseTunnel(ctx, cfg)
+}
+
+func runReverseTunnel(ctx context.Context, cfg ReverseTunnelConfig) error {
+	hops, err := newBastions(cfg.TunnelConfig)
+	if err != nil {
+		return err
+	}
+
+	sshAddr := hops.addr()
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	clients := &clientPool{dial: hops.dial, keepalive: newKeepalivePolicy(cfg.TunnelConfig)}
+	defer clients.close()
+	fwd := newReverseForwarder(cfg, clients)
+	log.Printf("starting reverse tunnel: %s - %s - %s", fwd.local, hops, fwd.remote)
+
+	client, err := clients.get(runCtx)
+	if err != nil {
+		return fmt.Errorf("connect to SSH bastion %s: %w", sshAddr, err)
+	}
+
+	listener, err := fwd.listen(client)
+	if err != nil {
+		return fmt.Errorf("request remote forward %s from SSH bastion %s: %w", fwd.remote, sshAddr, err)
+	}
+	// A port the bastion chose is asked for again after a reconnect, so the
+	// address handed to Terraform stays valid.
+	port := 0
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		port = addr.Port
+		fwd.pin(port)
+	}
+
+	if err := libs.SignalReadyWithResult([]byte(strconv.Itoa(port))); err != nil {
+		_ = listener.Close()
+		return err
+	}
+	log.Printf("SSH bastion listening on %s", fwd.remote)
+	defer log.Println("stopping tunnel")
+
+	for {
+		server := libs.NewConnServer(listener, fwd.handle)
+		err := server.Serve(runCtx)
+		server.Close()
+		if runCtx.Err() != nil {
+			return nil
+		}
+		if err == nil || errors.Is(err, io.EOF) {
+			// The listener ends with the connection that registered it.
+			err = errors.New("SSH connection closed")
+		}
+		log.Printf("remote forward %s lost: %v", fwd.remote, err)
+		clients.discard(client, err)
+
+		client, listener, err = fwd.reregister(runCtx)
+		if err != nil {
+			return nil
+		}
+		log.Printf("remote forward %s registered again", fwd.remote)
+	}
+}
+
+// reverseForwarder relays the connections the bastion accepts on the remote
+// listener to the local service.
+type reverseForwarder struct {
+	clients *clientPool
+
+	localNetwork string
+	local        string
+	remoteHost   string
+	remoteSocket string
+	remote       string
+}
+
+func newReverseForwarder(cfg ReverseTunnelConfig, clients *clientPool) *reverseForwarder {
+	f := &reverseForwarder{
+		clients:      clients,
+		localNetwork: "tcp",
+		remoteHost:   cfg.RemoteHost,
+		remoteSocket: cfg.RemoteSocket,
+	}
+	if cfg.LocalSocket != "" {
+		f.localNetwork, f.local = "unix", cfg.LocalSocket
+	} else {
+		localHost := cfg.LocalHost
+		if localHost == "" {
+			localHost = "localhost"
+		}
+		f.local = net.JoinHostPort(localHost, strconv.Itoa(cfg.LocalPort))
+	}
+	if f.remoteHost == "" {
+		f.remoteHost = "localhost"
+	}
+	f.pin(cfg.RemotePort)
+	return f
+}
+
+func (f *reverseForwarder) pin(port int) {
+	f.remote = f.remoteSocket
+	if f.remoteSocket == "" {
+		f.remote = net.JoinHostPort(f.remoteHost, strconv.Itoa(port))
+	}
+}
+
+// listen asks the bastion to listen with tcpip-forward, or
+// streamlocal-forward@openssh.com for a socket.
+func (f *reverseForwarder) listen(client *ssh.Client) (net.Listener, error) {
+	if f.remoteSocket != "" {
+		return client.ListenUnix(f.remoteSocket)
+	}
+	return client.Listen("tcp", f.remote)
+}
+
+// reregister reconnects and asks for the same remote forward until it is
+// granted. The bastion may briefly hold on to the old listener, so a refused
+// request is retried too.
+func (f *reverseForwarder) reregister(ctx context.Context) (*ssh.Client, net.Listener, error) {
+	for {
+		client, err := f.clients.get(ctx)
+		if err == nil {
+			var listener net.Listener
+			if listener, err = f.listen(client); err == nil {
+				return client, listener, nil
+			}
+			if pingErr := f.clients.keepalive.ping(client); pingErr != nil {
+				f.clients.discard(client, pingErr)
+			}
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		log.Printf("re-register remote forward %s: %v", f.remote, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(reverseRetryDelay):
+		}
+	}
+}
+
+func (f *reverseForwarder) handle(ctx context.Context, remote net.Conn) {
+	local, err := (&net.Dialer{}).DialContext(ctx, f.localNetwork, f.local)
+	if err != nil {
+		// The local service may come up later without requiring a new tunnel.
+		log.Printf("forward to %s failed: %v", f.local, err)
+		return
+	}
+	libs.Relay(remote, local)
+}
@@ -0,0 +1,172 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+)
+
+// startReverseTunnel runs a reverse tunnel to local through a fresh in-process
+// bastion until the test ends and returns the bastion with the port it
+// reported as bound.
+func startReverseTunnel(t *testing.T, cfg ReverseTunnelConfig) (*sshtest.Server, int) {
+	t.Helper()
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, authorizedKey)
+	cfg.SSHHost = "127.0.0.1"
+	cfg.SSHPort = srv.Port
+	cfg.SSHUser = sshtest.User
+	cfg.SSHKey = keyPEM
+	cfg.SSHHostKeys = []string{srv.AuthorizedHostKey()}
+
+	readyPath := filepath.Join(t.TempDir(), "ready")
+	t.Setenv(libs.TunnelReadyEnv, readyPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runReverseTunnel(ctx, cfg) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("runReverseTunnel() = %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if result, err := os.ReadFile(readyPath); err == nil {
+			port, err := strconv.Atoi(string(result))
+			if err != nil {
+				t.Fatalf("readiness result %q is not a port", result)
+			}
+			return srv, port
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("runReverseTunnel() = %v before signalling readiness", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("reverse tunnel did not signal readiness")
+	return nil, 0
+}
+
+func localEchoPort(t *testing.T) int {
+	t.Helper()
+	_, port, err := net.SplitHostPort(startTCPTarget(t, echoUntilEOF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestReverseTunnelReportsBoundPort(t *testing.T) {
+	_, port := startReverseTunnel(t, ReverseTunnelConfig{
+		TunnelConfig: TunnelConfig{LocalHost: "127.0.0.1", LocalPort: localEchoPort(t)},
+	})
+	if port == 0 {
+		t.Fatal("bound port = 0, want the port the bastion chose")
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dialing the bastion's listener: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello from the bastion"))
+}
+
+func TestReverseTunnelReregistersAfterConnectionLoss(t *testing.T) {
+	srv, port := startReverseTunnel(t, ReverseTunnelConfig{
+		TunnelConfig: TunnelConfig{LocalHost: "127.0.0.1", LocalPort: localEchoPort(t)},
+	})
+	remote := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	srv.DropConnections()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", remote)
+		if err == nil {
+			payload := []byte("after reconnect")
+			_ = conn.SetDeadline(time.Now().Add(time.Second))
+			_, err = conn.Write(payload)
+			got := make([]byte, len(payload))
+			if err == nil {
+				_, err = conn.Read(got)
+			}
+			_ = conn.Close()
+			if err == nil && string(got) == string(payload) {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("remote forward on %s did not come back: %v", remote, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if got := srv.Handshakes(); got < 2 {
+		t.Fatalf("handshakes = %d, want a reconnect", got)
+	}
+}
+
+func TestReverseTunnelToUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	localSocket := filepath.Join(dir, "local.sock")
+	listener, err := net.Listen("unix", localSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go acceptLoop(listener, echoUntilEOF)
+
+	remoteSocket := filepath.Join(dir, "remote.sock")
+	_, port := startReverseTunnel(t, ReverseTunnelConfig{LocalSocket: localSocket, RemoteSocket: remoteSocket})
+	if port != 0 {
+		t.Fatalf("bound port = %d, want 0 for a socket", port)
+	}
+
+	conn, err := net.Dial("unix", remoteSocket)
+	if err != nil {
+		t.Fatalf("dialing the bastion's socket: %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("over streamlocal"))
+}
+
+func TestReverseTunnelConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     ReverseTunnelConfig
+		wantErr string
+	}{
+		{name: "port", cfg: ReverseTunnelConfig{RemoteHost: "0.0.0.0", RemotePort: 8080}},
+		{name: "socket", cfg: ReverseTunnelConfig{RemoteSocket: "/run/app.sock"}},
+		{name: "port out of range", cfg: ReverseTunnelConfig{RemotePort: 70000}, wantErr: "not a TCP port"},
+		{name: "socket and port", cfg: ReverseTunnelConfig{RemoteSocket: "/run/app.sock", RemotePort: 80}, wantErr: "remote_socket"},
+		{
+			name:    "connection settings",
+			cfg:     ReverseTunnelConfig{TunnelConfig: TunnelConfig{SSHHostKeys: []string{"not a key"}}},
+			wantErr: "ssh_host_key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
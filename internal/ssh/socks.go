@@ -0,0 +1,397 @@
+package ssh
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"golang.org/x/crypto/ssh"
+)
+
+var SOCKSTunnelType string = "ssh-socks"
+
+// A client gets this long to say where it wants to go.
+const socksHandshakeTimeout = 30 * time.Second
+
+// RFC 1928 and RFC 1929 constants.
+const (
+	socksVersion         = 0x05
+	socksPasswordVersion = 0x01
+
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+)
+
+// SOCKSTunnelConfig describes an `ssh -D` proxy listening on
+// LocalHost:LocalPort. The Target fields of TunnelConfig are unused.
+type SOCKSTunnelConfig struct {
+	TunnelConfig
+	AllowedDestinations []string
+	SOCKSPassword       string
+	SOCKSUsername       string
+}
+
+// Validate catches settings that would only fail once the tunnel child runs.
+func (cfg SOCKSTunnelConfig) Validate() error {
+	if err := cfg.TunnelConfig.Validate(); err != nil {
+		return err
+	}
+	if (cfg.SOCKSUsername == "") != (cfg.SOCKSPassword == "") {
+		return errors.New("socks_username and socks_password must be set together")
+	}
+	// RFC 1929 sends both with a one byte length.
+	if len(cfg.SOCKSUsername) > 255 || len(cfg.SOCKSPassword) > 255 {
+		return errors.New("socks_username and socks_password must be at most 255 bytes")
+	}
+	_, err := parseDestinationAllowlist(cfg.AllowedDestinations)
+	return err
+}
+
+func ForkSOCKSTunnel(ctx context.Context, cfg SOCKSTunnelConfig) (*exec.Cmd, error) {
+	logName := fmt.Sprintf("ssh-socks-%s-%d.log", cfg.bastionName(), cfg.LocalPort)
+	var err error
+	cfg.TunnelConfig, err = cfg.withGeneratedCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return libs.ForkTunnel(ctx, SOCKSTunnelType, logName, cfg)
+}
+
+func StartRemoteSOCKSTunnel(ctx context.Context, cfgJson string, parentPid int) error {
+	var cfg SOCKSTunnelConfig
+	if err := json.Unmarshal([]byte(cfgJson), &cfg); err != nil {
+		return err
+	}
+
+	if err := libs.WatchProcess(parentPid); err != nil {
+		return err
+	}
+
+	return runSOCKSTunnel(ctx, cfg)
+}
+
+func runSOCKSTunnel(ctx context.Context, cfg SOCKSTunnelConfig) error {
+	hops, err := newBastions(cfg.TunnelConfig)
+	if err != nil {
+		return err
+	}
+	allow, err := parseDestinationAllowlist(cfg.AllowedDestinations)
+	if err != nil {
+		return err
+	}
+
+	localHost := cfg.LocalHost
+	if localHost == "" {
+		localHost = "localhost"
+	}
+	sshAddr := hops.addr()
+	localAddr := net.JoinHostPort(localHost, strconv.Itoa(cfg.LocalPort))
+	log.Printf("starting SOCKS5 proxy: %s - %s", localAddr, hops)
+
+	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	clients := &clientPool{
+		dial:       hops.dial,
+		keepalive:  newKeepalivePolicy(cfg.TunnelConfig),
+		maxClients: cfg.MaxConnections,
+	}
+	defer clients.close()
+
+	// Authenticate before reporting readiness.
+	if _, err := clients.get(runCtx); err != nil {
+		return fmt.Errorf("connect to SSH bastion %s: %w", sshAddr, err)
+	}
+
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", localAddr, err)
+	}
+	proxy := &socksProxy{
+		clients:  clients,
+		allow:    allow,
+		username: cfg.SOCKSUsername,
+		password: cfg.SOCKSPassword,
+	}
+	server := libs.NewConnServer(listener, proxy.handle)
+	defer server.Close()
+
+	if err := libs.SignalReadyIfRequested(); err != nil {
+		return err
+	}
+	log.Printf("SOCKS5 proxy listening on %s", listener.Addr())
+	defer log.Println("stopping tunnel")
+
+	return server.Serve(runCtx)
+}
+
+// socksProxy serves SOCKS5 CONNECT requests with channels of the shared SSH
+// connection, as `ssh -D` does.
+type socksProxy struct {
+	clients  *clientPool
+	allow    *destinationAllowlist
+	username string
+	password string
+}
+
+func (p *socksProxy) handle(ctx context.Context, local net.Conn) {
+	// A client that stalls before its request must not hold a connection.
+	_ = local.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	host, port, err := p.negotiate(local)
+	if err != nil {
+		log.Printf("SOCKS5 request from %s: %v", local.RemoteAddr(), err)
+		return
+	}
+	dest := net.JoinHostPort(host, strconv.Itoa(port))
+	if !p.allow.allows(host) {
+		log.Printf("SOCKS5 destination %s is not in allowed_destinations", dest)
+		_ = writeSOCKSReply(local, socksNotAllowed)
+		return
+	}
+
+	remote, err := dialThrough(ctx, p.clients, "tcp", dest)
+	if err != nil {
+		log.Printf("forward to %s failed: %v", dest, err)
+		_ = writeSOCKSReply(local, socksReplyFor(err))
+		return
+	}
+	if err := writeSOCKSReply(local, socksSucceeded); err != nil {
+		_ = remote.Close()
+		return
+	}
+	_ = local.SetDeadline(time.Time{})
+	libs.Relay(local, remote)
+}
+
+// negotiate runs the method selection, the optional username/password
+// subnegotiation and reads a CONNECT request.
+func (p *socksProxy) negotiate(conn net.Conn) (string, int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", 0, err
+	}
+	if header[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", 0, err
+	}
+
+	method := byte(socksAuthNone)
+	if p.username != "" {
+		method = socksAuthPassword
+	}
+	if !containsByte(methods, method) {
+		_, _ = conn.Write([]byte{socksVersion, socksAuthNoAcceptable})
+		return "", 0, errors.New("client offers no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", 0, err
+	}
+	if method == socksAuthPassword {
+		if err := p.authenticate(conn); err != nil {
+			return "", 0, err
+		}
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", 0, err
+	}
+	if request[0] != socksVersion {
+		return "", 0, fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+	host, err := readSOCKSAddr(conn, request[3])
+	if err != nil {
+		_ = writeSOCKSReply(conn, socksAddressNotSupported)
+		return "", 0, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", 0, err
+	}
+	if request[1] != socksCmdConnect {
+		_ = writeSOCKSReply(conn, socksCommandNotSupported)
+		return "", 0, fmt.Errorf("unsupported SOCKS command %d, only CONNECT is", request[1])
+	}
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+func (p *socksProxy) authenticate(conn net.Conn) error {
+	var version [1]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return err
+	}
+	if version[0] != socksPasswordVersion {
+		return fmt.Errorf("unsupported username/password version %d", version[0])
+	}
+	username, err := readLengthPrefixed(conn)
+	if err != nil {
+		return err
+	}
+	password, err := readLengthPrefixed(conn)
+	if err != nil {
+		return err
+	}
+	usernameOK := subtle.ConstantTimeCompare(username, []byte(p.username)) == 1
+	passwordOK := subtle.ConstantTimeCompare(password, []byte(p.password)) == 1
+	if !usernameOK || !passwordOK {
+		_, _ = conn.Write([]byte{socksPasswordVersion, 0x01})
+		return fmt.Errorf("wrong username or password for %q", username)
+	}
+	_, err = conn.Write([]byte{socksPasswordVersion, 0x00})
+	return err
+}
+
+func readSOCKSAddr(r io.Reader, addrType byte) (string, error) {
+	switch addrType {
+	case socksAddrIPv4, socksAddrIPv6:
+		size := net.IPv4len
+		if addrType == socksAddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		return net.IP(ip).String(), nil
+	case socksAddrDomain:
+		name, err := readLengthPrefixed(r)
+		if err != nil {
+			return "", err
+		}
+		return string(name), nil
+	default:
+		return "", fmt.Errorf("unsupported SOCKS address type %d", addrType)
+	}
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	value := make([]byte, size[0])
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// writeSOCKSReply answers a request. The bound address is left zero: it is a
+// channel on the bastion, which has none worth reporting.
+func writeSOCKSReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyFor maps a failed channel open to the closest SOCKS reply.
+func socksReplyFor(err error) byte {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		return socksGeneralFailure
+	}
+	switch openErr.Reason {
+	case ssh.Prohibited:
+		return socksNotAllowed
+	case ssh.ConnectionFailed:
+		return socksConnectionRefused
+	default:
+		return socksGeneralFailure
+	}
+}
+
+func containsByte(values []byte, b byte) bool {
+	for _, v := range values {
+		if v == b {
+			return true
+		}
+	}
+	return false
+}
+
+// destinationAllowlist restricts where the proxy forwards to. A nil list
+// allows everything.
+type destinationAllowlist struct {
+	prefixes []netip.Prefix
+	hosts    []string
+}
+
+// parseDestinationAllowlist reads CIDRs, IP addresses and host globs with *
+// and ?.
+func parseDestinationAllowlist(entries []string) (*destinationAllowlist, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	allow := &destinationAllowlist{}
+	for i, entry := range entries {
+		switch {
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("allowed_destinations[%d]: %w", i, err)
+			}
+			allow.prefixes = append(allow.prefixes, prefix.Masked())
+		case entry == "":
+			return nil, fmt.Errorf("allowed_destinations[%d]: empty entry", i)
+		default:
+			if addr, err := netip.ParseAddr(entry); err == nil {
+				allow.prefixes = append(allow.prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+				continue
+			}
+			allow.hosts = append(allow.hosts, strings.ToLower(entry))
+		}
+	}
+	return allow, nil
+}
+
+// allows reports whether host may be reached. Names are resolved by the
+// bastion, not here, so CIDRs only match destinations requested by address.
+func (a *destinationAllowlist) allows(host string) bool {
+	if a == nil {
+		return true
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		for _, prefix := range a.prefixes {
+			if prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range a.hosts {
+		if matchPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+package ssh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSOCKSProxy serves proxy through a fresh in-process bastion until the
+// test ends and returns the proxy's address.
+func startSOCKSProxy(t *testing.T, proxy *socksProxy) string {
+	t.Helper()
+	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, authorizedKey)
+	clientCfg, err := clientConfig(TunnelConfig{
+		SSHUser:     sshtest.User,
+		SSHKey:      keyPEM,
+		SSHHostKeys: []string{srv.AuthorizedHostKey()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.clients = &clientPool{dial: func(ctx context.Context) (*ssh.Client, error) {
+		return dialSSH(ctx, srv.Addr(), clientCfg)
+	}}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server := libs.NewConnServer(listener, proxy.handle)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		proxy.clients.close()
+		if err := <-served; err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// socksConnect is a minimal SOCKS5 client. It returns the server's reply code,
+// or socksAuthNoAcceptable when method selection fails.
+func socksConnect(t *testing.T, proxyAddr, username, password, host string, port int) (net.Conn, byte, error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	method := byte(socksAuthNone)
+	if username != "" {
+		method = socksAuthPassword
+	}
+	if _, err := conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return nil, 0, err
+	}
+	var selected [2]byte
+	if _, err := io.ReadFull(conn, selected[:]); err != nil {
+		return nil, 0, err
+	}
+	if selected[1] == socksAuthNoAcceptable {
+		return nil, socksAuthNoAcceptable, nil
+	}
+	if method == socksAuthPassword {
+		request := append([]byte{socksPasswordVersion, byte(len(username))}, username...)
+		request = append(append(request, byte(len(password))), password...)
+		if _, err := conn.Write(request); err != nil {
+			return nil, 0, err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return nil, 0, err
+		}
+		if status[1] != 0 {
+			return nil, 0, errors.New("username/password refused")
+		}
+	}
+
+	request := []byte{socksVersion, socksCmdConnect, 0}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(append(request, socksAddrIPv4), ip...)
+	} else {
+		request = append(append(request, socksAddrDomain, byte(len(host))), host...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return nil, 0, err
+	}
+	var reply [10]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, 0, err
+	}
+	return conn, reply[1], nil
+}
+
+func echoTarget(t *testing.T) int {
+	t.Helper()
+	_, port, err := net.SplitHostPort(startTCPTarget(t, echoUntilEOF))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+func TestSOCKSProxyConnects(t *testing.T) {
+	port := echoTarget(t)
+	proxyAddr := startSOCKSProxy(t, &socksProxy{})
+
+	for _, host := range []string{"127.0.0.1", "localhost"} {
+		conn, code, err := socksConnect(t, proxyAddr, "", "", host, port)
+		if err != nil || code != socksSucceeded {
+			t.Fatalf("CONNECT %s = %d, %v; want success", host, code, err)
+		}
+		assertEcho(t, conn, []byte("through "+host))
+	}
+}
+
+func TestSOCKSProxyRequiresPassword(t *testing.T) {
+	port := echoTarget(t)
+	proxyAddr := startSOCKSProxy(t, &socksProxy{username: "ci", password: "hunter2"})
+
+	if _, code, _ := socksConnect(t, proxyAddr, "", "", "127.0.0.1", port); code != socksAuthNoAcceptable {
+		t.Fatalf("CONNECT without credentials = %d, want no acceptable method", code)
+	}
+	if _, _, err := socksConnect(t, proxyAddr, "ci", "wrong", "127.0.0.1", port); err == nil {
+		t.Fatal("CONNECT with a wrong password succeeded")
+	}
+	conn, code, err := socksConnect(t, proxyAddr, "ci", "hunter2", "127.0.0.1", port)
+	if err != nil || code != socksSucceeded {
+		t.Fatalf("CONNECT with credentials = %d, %v; want success", code, err)
+	}
+	assertEcho(t, conn, []byte("authenticated"))
+}
+
+func TestSOCKSProxyEnforcesAllowlist(t *testing.T) {
+	port := echoTarget(t)
+	allow, err := parseDestinationAllowlist([]string{"127.0.0.0/8", "*.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := startSOCKSProxy(t, &socksProxy{allow: allow})
+
+	if _, code, err := socksConnect(t, proxyAddr, "", "", "127.0.0.1", port); err != nil || code != socksSucceeded {
+		t.Fatalf("CONNECT to an allowed address = %d, %v; want success", code, err)
+	}
+	// Names are not resolved locally, so the CIDR does not cover localhost.
+	if _, code, err := socksConnect(t, proxyAddr, "", "", "localhost", port); err != nil || code != socksNotAllowed {
+		t.Fatalf("CONNECT to localhost = %d, %v; want not allowed", code, err)
+	}
+}
+
+func TestSOCKSProxyReportsRefusedTarget(t *testing.T) {
+	closed, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := startSOCKSProxy(t, &socksProxy{})
+
+	if _, code, err := socksConnect(t, proxyAddr, "", "", "127.0.0.1", closed); err != nil || code != socksConnectionRefused {
+		t.Fatalf("CONNECT to a closed port = %d, %v; want connection refused", code, err)
+	}
+}
+
+func TestSOCKSProxyRejectsBind(t *testing.T) {
+	proxyAddr := startSOCKSProxy(t, &socksProxy{})
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	const bind = 0x02
+	request := []byte{socksVersion, 1, socksAuthNone, socksVersion, bind, 0, socksAddrIPv4, 127, 0, 0, 1, 0, 80}
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	var reply [12]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socksCommandNotSupported {
+		t.Fatalf("BIND reply = %d, want command not supported", reply[3])
+	}
+}
+
+func TestDestinationAllowlist(t *testing.T) {
+	allow, err := parseDestinationAllowlist([]string{"10.0.0.0/16", "192.168.1.7", "fd00::/8", "*.RDS.amazonaws.com", "api-?.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"10.0.3.4":                     true,
+		"10.1.0.1":                     false,
+		"192.168.1.7":                  true,
+		"192.168.1.8":                  false,
+		"fd00::1":                      true,
+		"::ffff:10.0.0.1":              true,
+		"db-1.abc.rds.amazonaws.com":   true,
+		"rds.amazonaws.com.evil.test":  false,
+		"api-1.internal":               true,
+		"api-12.internal":              false,
+		"ip-10-0-0-1.ec2.internal.com": false,
+	}
+	for host, want := range tests {
+		if got := allow.allows(host); got != want {
+			t.Errorf("allows(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	var none *destinationAllowlist
+	if !none.allows("anything.example.com") {
+		t.Error("an empty allowlist must allow every destination")
+	}
+}
+
+func TestSOCKSTunnelConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     SOCKSTunnelConfig
+		wantErr string
+	}{
+		{name: "open", cfg: SOCKSTunnelConfig{}},
+		{name: "credentials", cfg: SOCKSTunnelConfig{SOCKSUsername: "ci", SOCKSPassword: "hunter2"}},
+		{name: "username only", cfg: SOCKSTunnelConfig{SOCKSUsername: "ci"}, wantErr: "set together"},
+		{name: "bad cidr", cfg: SOCKSTunnelConfig{AllowedDestinations: []string{"10.0.0.0/33"}}, wantErr: "allowed_destinations[0]"},
+		{name: "empty entry", cfg: SOCKSTunnelConfig{AllowedDestinations: []string{"10.0.0.0/8", ""}}, wantErr: "allowed_destinations[1]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
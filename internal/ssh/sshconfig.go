@@ -0,0 +1,553 @@
+package ssh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SSHConfigNone disables the OpenSSH client config, as with ssh -F none.
+const SSHConfigNone = "none"
+
+const maxConfigIncludeDepth = 16
+
+// ConfigSetting is a tunnel setting taken from an OpenSSH client config file.
+type ConfigSetting struct {
+	Attribute string
+	Value     string
+	Source    string
+}
+
+func (s ConfigSetting) String() string {
+	return fmt.Sprintf("%s = %q (%s)", s.Attribute, s.Value, s.Source)
+}
+
+// ApplySSHConfig fills the settings cfg leaves unset from its OpenSSH client
+// config file, resolving ssh_host and each jump host the way ssh(1) resolves a
+// Host alias. Settings in cfg always win over the file.
+func (cfg TunnelConfig) ApplySSHConfig() (TunnelConfig, []ConfigSetting, error) {
+	path := cfg.SSHConfigFile
+	// One Host section cannot describe several bastions, so ssh_hosts are
+	// used as given.
+	if path == SSHConfigNone || len(cfg.SSHHosts) > 0 {
+		return cfg, nil, nil
+	}
+	if path == "" {
+		path = defaultSSHConfigFile()
+		if path == "" {
+			return cfg, nil, nil
+		}
+	}
+	file, err := parseSSHConfig(expandHome(path))
+	if err != nil {
+		return cfg, nil, err
+	}
+
+	r := configResolver{file: file}
+	r.applyBastion(&cfg)
+	jumps := make([]JumpHost, len(cfg.JumpHosts))
+	for i, jump := range cfg.JumpHosts {
+		jumps[i] = r.applyJumpHost(fmt.Sprintf("jump_hosts[%d]", i), jump, cfg.SSHUser)
+	}
+	if len(jumps) > 0 {
+		cfg.JumpHosts = jumps
+	}
+	return cfg, r.settings, nil
+}
+
+// Missing is not an error: the file is only consulted when it exists.
+func defaultSSHConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(home, ".ssh", "config")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// configResolver records where each setting it applies came from.
+type configResolver struct {
+	file     *sshConfigFile
+	settings []ConfigSetting
+}
+
+func (r *configResolver) set(attribute, value string, opt configOption) {
+	r.settings = append(r.settings, ConfigSetting{Attribute: attribute, Value: value, Source: opt.source()})
+}
+
+func (r *configResolver) applyBastion(cfg *TunnelConfig) {
+	alias := cfg.SSHHost
+	opts := r.file.resolve(alias, cfg.SSHUser)
+	tokens := opts.tokens(alias, cfg.SSHUser, cfg.SSHPort)
+
+	if opt, ok := opts.first("hostname"); ok {
+		cfg.SSHHost = tokens.hostName(opt.args[0])
+		r.set("ssh_host", cfg.SSHHost, opt)
+	}
+	if opt, ok := opts.first("port"); ok && cfg.SSHPort == 0 {
+		if port, err := strconv.Atoi(opt.args[0]); err == nil {
+			cfg.SSHPort = port
+			r.set("ssh_port", opt.args[0], opt)
+		}
+	}
+	if opt, ok := opts.first("user"); ok && cfg.SSHUser == "" {
+		cfg.SSHUser = opt.args[0]
+		r.set("ssh_user", cfg.SSHUser, opt)
+	}
+	// ServerAliveInterval 0 disables ssh(1)'s keepalive; the tunnel keeps its own.
+	if opt, ok := opts.first("serveraliveinterval"); ok && cfg.KeepaliveInterval == 0 {
+		if seconds, err := strconv.Atoi(opt.args[0]); err == nil && seconds > 0 {
+			cfg.KeepaliveInterval = seconds
+			r.set("keepalive_interval", opt.args[0], opt)
+		}
+	}
+	if opt, ok := opts.first("serveralivecountmax"); ok && cfg.KeepaliveCountMax == 0 {
+		if count, err := strconv.Atoi(opt.args[0]); err == nil && count > 0 {
+			cfg.KeepaliveCountMax = count
+			r.set("keepalive_count_max", opt.args[0], opt)
+		}
+	}
+	tokens = opts.tokens(alias, cfg.SSHUser, cfg.SSHPort)
+
+	if cfg.SSHKey == "" && cfg.SSHPassword == "" {
+		for _, opt := range opts.all("identityfile") {
+			path := tokens.path(opt.args[0])
+			// Like ssh(1), identities that do not exist are skipped.
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			cfg.SSHIdentityFiles = append(cfg.SSHIdentityFiles, path)
+			r.set("identity file", path, opt)
+		}
+		if opt, ok := opts.first("identitiesonly"); ok && isYes(opt.args[0]) {
+			cfg.SSHIdentitiesOnly = true
+			r.set("identities only", "yes", opt)
+		}
+	}
+
+	// Explicit host keys are authoritative, as with the default known_hosts.
+	pinned := len(cfg.SSHHostKeys) > 0 || len(cfg.SSHHostCAKeys) > 0
+	if opt, ok := opts.first("userknownhostsfile"); ok && cfg.SSHKnownHostsFile == "" &&
+		!cfg.SSHInsecureIgnoreHostKey && !pinned && opt.args[0] != SSHConfigNone {
+		cfg.SSHKnownHostsFile = tokens.path(opt.args[0])
+		r.set("ssh_known_hosts_file", cfg.SSHKnownHostsFile, opt)
+	}
+
+	if opt, ok := opts.first("proxyjump"); ok && len(cfg.JumpHosts) == 0 &&
+		!strings.EqualFold(opt.args[0], SSHConfigNone) {
+		for _, spec := range strings.Split(opt.args[0], ",") {
+			cfg.JumpHosts = append(cfg.JumpHosts, parseJumpSpec(spec))
+			r.set(fmt.Sprintf("jump_hosts[%d].host", len(cfg.JumpHosts)-1), spec, opt)
+		}
+	}
+}
+
+// applyJumpHost resolves a jump host alias. A jump host's own ProxyJump is not
+// followed: the chain is the one given for the bastion.
+func (r *configResolver) applyJumpHost(attribute string, jump JumpHost, bastionUser string) JumpHost {
+	alias := jump.Host
+	opts := r.file.resolve(alias, jump.User)
+	if opt, ok := opts.first("hostname"); ok {
+		jump.Host = opts.tokens(alias, jump.User, jump.Port).hostName(opt.args[0])
+		r.set(attribute+".host", jump.Host, opt)
+	}
+	if opt, ok := opts.first("port"); ok && jump.Port == 0 {
+		if port, err := strconv.Atoi(opt.args[0]); err == nil {
+			jump.Port = port
+			r.set(attribute+".port", opt.args[0], opt)
+		}
+	}
+	if opt, ok := opts.first("user"); ok && jump.User == "" {
+		jump.User = opt.args[0]
+		r.set(attribute+".user", jump.User, opt)
+	}
+	if jump.Key == "" && jump.Password == "" {
+		jumpUser := jump.User
+		if jumpUser == "" {
+			jumpUser = bastionUser
+		}
+		tokens := opts.tokens(alias, jumpUser, jump.Port)
+		for _, opt := range opts.all("identityfile") {
+			path := tokens.path(opt.args[0])
+			if _, err := os.Stat(path); err == nil {
+				jump.Key = path
+				r.set(attribute+".key", path, opt)
+				break
+			}
+		}
+	}
+	return jump
+}
+
+// parseJumpSpec reads one ProxyJump entry, [user@]host[:port].
+func parseJumpSpec(spec string) JumpHost {
+	spec = strings.TrimPrefix(strings.TrimSpace(spec), "ssh://")
+	var jump JumpHost
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		jump.User, spec = spec[:at], spec[at+1:]
+	}
+	jump.Host = spec
+	if colon := strings.LastIndex(spec, ":"); colon >= 0 && !strings.Contains(spec[colon+1:], "]") {
+		if port, err := strconv.Atoi(spec[colon+1:]); err == nil {
+			jump.Host, jump.Port = spec[:colon], port
+		}
+	}
+	jump.Host = strings.TrimSuffix(strings.TrimPrefix(jump.Host, "["), "]")
+	return jump
+}
+
+// sshConfigFile is an OpenSSH client config, with Include directives inlined.
+type sshConfigFile struct {
+	blocks []configBlock
+}
+
+// configBlock is a Host or Match section. The options before the first section
+// form a block that always matches.
+type configBlock struct {
+	hostPatterns []string
+	criteria     []matchCriterion
+	options      []configOption
+}
+
+type matchCriterion struct {
+	name    string
+	negated bool
+	arg     string
+}
+
+type configOption struct {
+	keyword string
+	args    []string
+	file    string
+	line    int
+}
+
+func (o configOption) source() string {
+	return fmt.Sprintf("%s line %d", o.file, o.line)
+}
+
+func parseSSHConfig(path string) (*sshConfigFile, error) {
+	file := &sshConfigFile{blocks: []configBlock{{}}}
+	if err := file.parse(path, 0); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *sshConfigFile) parse(path string, depth int) error {
+	if depth > maxConfigIncludeDepth {
+		return fmt.Errorf("read SSH config file %s: Include nested too deeply", path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read SSH config file: %w", err)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args, err := splitConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", path, line, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s line %d: %s needs a value", path, line, keyword)
+		}
+		switch keyword {
+		case "host":
+			patterns := make([]string, len(args))
+			for i, arg := range args {
+				patterns[i] = strings.ToLower(arg)
+			}
+			f.blocks = append(f.blocks, configBlock{hostPatterns: patterns})
+		case "match":
+			criteria, err := parseMatchCriteria(args)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %w", path, line, err)
+			}
+			f.blocks = append(f.blocks, configBlock{criteria: criteria})
+		case "include":
+			for _, pattern := range args {
+				if err := f.include(path, pattern, depth); err != nil {
+					return err
+				}
+			}
+		default:
+			block := &f.blocks[len(f.blocks)-1]
+			block.options = append(block.options, configOption{keyword: keyword, args: args, file: path, line: line})
+		}
+	}
+	return scanner.Err()
+}
+
+// Relative includes are resolved against the including file's directory,
+// which is ~/.ssh for the user's config.
+func (f *sshConfigFile) include(from, pattern string, depth int) error {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(from), pattern)
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("%s: Include %s: %w", from, pattern, err)
+	}
+	for _, path := range paths {
+		if err := f.parse(path, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitConfigLine accepts both "Keyword value" and "Keyword=value", with
+// double quotes around arguments that contain spaces.
+func splitConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	var args []string
+	for rest != "" {
+		if rest[0] == '#' {
+			break
+		}
+		var arg string
+		if rest[0] == '"' {
+			closing := strings.IndexByte(rest[1:], '"')
+			if closing < 0 {
+				return "", nil, errors.New("unterminated quoted argument")
+			}
+			arg, rest = rest[1:closing+1], rest[closing+2:]
+		} else {
+			next := strings.IndexAny(rest, " \t")
+			if next < 0 {
+				next = len(rest)
+			}
+			arg, rest = rest[:next], rest[next:]
+		}
+		args = append(args, arg)
+		rest = strings.TrimSpace(rest)
+	}
+	return keyword, args, nil
+}
+
+func parseMatchCriteria(args []string) ([]matchCriterion, error) {
+	var criteria []matchCriterion
+	for i := 0; i < len(args); i++ {
+		c := matchCriterion{name: strings.ToLower(args[i])}
+		if strings.HasPrefix(c.name, "!") {
+			c.negated, c.name = true, c.name[1:]
+		}
+		switch c.name {
+		case "all", "canonical", "final":
+		default:
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("match criterion %s needs an argument", c.name)
+			}
+			i++
+			c.arg = args[i]
+		}
+		criteria = append(criteria, c)
+	}
+	return criteria, nil
+}
+
+// resolve collects the options of every block that applies to host, in file
+// order. remoteUser is the explicitly configured user, if any.
+func (f *sshConfigFile) resolve(host, remoteUser string) hostOptions {
+	var opts hostOptions
+	for _, block := range f.blocks {
+		if !block.matches(host, opts, remoteUser) {
+			continue
+		}
+		opts = append(opts, block.options...)
+	}
+	return opts
+}
+
+func (b configBlock) matches(host string, opts hostOptions, remoteUser string) bool {
+	if len(b.hostPatterns) > 0 {
+		return matchPatternList(b.hostPatterns, strings.ToLower(host))
+	}
+	for _, c := range b.criteria {
+		var ok bool
+		switch c.name {
+		case "all", "final":
+			// This is the only pass, so it is also the final one.
+			ok = true
+		case "host":
+			current := host
+			if opt, found := opts.first("hostname"); found {
+				current = opts.tokens(host, "", 0).hostName(opt.args[0])
+			}
+			ok = matchPatternList(strings.Split(strings.ToLower(c.arg), ","), strings.ToLower(current))
+		case "originalhost":
+			ok = matchPatternList(strings.Split(strings.ToLower(c.arg), ","), strings.ToLower(host))
+		case "user":
+			current := remoteUser
+			if current == "" {
+				if opt, found := opts.first("user"); found {
+					current = opt.args[0]
+				} else {
+					current = localUsername()
+				}
+			}
+			ok = matchPatternList(strings.Split(c.arg, ","), current)
+		case "localuser":
+			ok = matchPatternList(strings.Split(c.arg, ","), localUsername())
+		default:
+			// canonical and exec cannot hold here; unknown criteria never match.
+			ok = false
+		}
+		if ok == c.negated {
+			return false
+		}
+	}
+	return true
+}
+
+// hostOptions are the options that apply to one host. The first value given
+// for a keyword wins, except for keywords such as IdentityFile that accumulate.
+type hostOptions []configOption
+
+func (o hostOptions) first(keyword string) (configOption, bool) {
+	for _, opt := range o {
+		if opt.keyword == keyword {
+			return opt, true
+		}
+	}
+	return configOption{}, false
+}
+
+func (o hostOptions) all(keyword string) []configOption {
+	var found []configOption
+	for _, opt := range o {
+		if opt.keyword == keyword {
+			found = append(found, opt)
+		}
+	}
+	return found
+}
+
+func (o hostOptions) tokens(alias, remoteUser string, port int) configTokens {
+	t := configTokens{alias: alias, host: alias, remoteUser: remoteUser, port: port}
+	if opt, ok := o.first("hostname"); ok {
+		t.host = t.hostName(opt.args[0])
+	}
+	if t.port == 0 {
+		t.port = defaultSSHPort
+	}
+	return t
+}
+
+// configTokens expands the % tokens ssh_config(5) allows in paths.
+type configTokens struct {
+	alias      string
+	host       string
+	remoteUser string
+	port       int
+}
+
+func (t configTokens) hostName(value string) string {
+	return strings.NewReplacer("%%", "%", "%h", t.alias).Replace(value)
+}
+
+func (t configTokens) path(value string) string {
+	home, _ := os.UserHomeDir()
+	value = strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", t.host,
+		"%n", t.alias,
+		"%p", strconv.Itoa(t.port),
+		"%r", t.remoteUser,
+		"%u", localUsername(),
+	).Replace(value)
+	return expandHome(value)
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// matchPatternList reports whether s matches a comma or space separated
+// ssh_config pattern list: any pattern matches and no negated one does.
+func matchPatternList(patterns []string, s string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if !matchPattern(pattern, s) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// matchPattern matches s against a pattern of literal text, * and ?.
+func matchPattern(pattern, s string) bool {
+	for pattern != "" {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		default:
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+func isYes(value string) bool {
+	return strings.EqualFold(value, "yes") || strings.EqualFold(value, "true")
+}
+
+func localUsername() string {
+	name, err := DefaultUser()
+	if err != nil {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,279 @@
+package ssh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+)
+
+// writeSSHConfig writes ~/.ssh/config under the isolated home.
+func writeSSHConfig(t *testing.T, home, content string) string {
+	t.Helper()
+	dir := filepath.Join(home, ".ssh")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return writeKeyFile(t, dir, "config", content)
+}
+
+func TestApplySSHConfigResolvesHostAlias(t *testing.T) {
+	home := isolateCredentials(t)
+	writeKeyFile(t, home, "bastion_key", generateKey(t, ""))
+	writeSSHConfig(t, home, `
+Host prod-bastion
+    HostName bastion.prod.example.com
+    User ops
+    Port 2222
+    IdentityFile ~/bastion_key
+    IdentityFile ~/missing_key
+    IdentitiesOnly yes
+    UserKnownHostsFile ~/.ssh/known_hosts_%h
+    ProxyJump edge,admin@10.0.0.7:2200
+    ServerAliveInterval 15
+    ServerAliveCountMax 4
+
+Host edge
+    HostName edge.example.com
+    User jump
+
+Host *
+    User ignored
+    Port 22
+`)
+
+	cfg, settings, err := TunnelConfig{SSHHost: "prod-bastion"}.ApplySSHConfig()
+	if err != nil {
+		t.Fatalf("ApplySSHConfig() = %v", err)
+	}
+	want := TunnelConfig{
+		JumpHosts: []JumpHost{
+			{Host: "edge.example.com", Port: 22, User: "jump"},
+			{Host: "10.0.0.7", Port: 2200, User: "admin"},
+		},
+		KeepaliveCountMax: 4,
+		KeepaliveInterval: 15,
+		SSHHost:           "bastion.prod.example.com",
+		SSHIdentitiesOnly: true,
+		SSHIdentityFiles:  []string{filepath.Join(home, "bastion_key")},
+		SSHKnownHostsFile: filepath.Join(home, ".ssh", "known_hosts_bastion.prod.example.com"),
+		SSHPort:           2222,
+		SSHUser:           "ops",
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("ApplySSHConfig() =\n%+v\nwant\n%+v", cfg, want)
+	}
+
+	var attributes []string
+	for _, s := range settings {
+		attributes = append(attributes, s.Attribute)
+	}
+	wantAttributes := []string{
+		"ssh_host", "ssh_port", "ssh_user", "keepalive_interval", "keepalive_count_max", "identity file", "identities only", "ssh_known_hosts_file",
+		"jump_hosts[0].host", "jump_hosts[1].host",
+		"jump_hosts[0].host", "jump_hosts[0].port", "jump_hosts[0].user",
+	}
+	if !reflect.DeepEqual(attributes, wantAttributes) {
+		t.Fatalf("settings = %v, want %v", attributes, wantAttributes)
+	}
+	if want := filepath.Join(home, ".ssh", "config") + " line 3"; settings[0].Source != want {
+		t.Fatalf("ssh_host source = %q, want %q", settings[0].Source, want)
+	}
+}
+
+func TestApplySSHConfigKeepsExplicitSettings(t *testing.T) {
+	home := isolateCredentials(t)
+	writeKeyFile(t, home, "config_key", generateKey(t, ""))
+	writeSSHConfig(t, home, `
+Host bastion
+    HostName 10.0.0.5
+    User ops
+    Port 2222
+    IdentityFile ~/config_key
+    UserKnownHostsFile ~/.ssh/other_known_hosts
+    ProxyJump edge
+`)
+	explicit := TunnelConfig{
+		JumpHosts:   []JumpHost{{Host: "jump.internal"}},
+		SSHHost:     "bastion",
+		SSHHostKeys: []string{"ssh-ed25519 AAAA"},
+		SSHKey:      "inline key",
+		SSHPort:     22,
+		SSHUser:     "ec2-user",
+	}
+
+	cfg, _, err := explicit.ApplySSHConfig()
+	if err != nil {
+		t.Fatalf("ApplySSHConfig() = %v", err)
+	}
+	want := explicit
+	want.SSHHost = "10.0.0.5"
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("ApplySSHConfig() =\n%+v\nwant\n%+v", cfg, want)
+	}
+}
+
+func TestApplySSHConfigMatchesPatterns(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		host   string
+		want   string
+	}{
+		{name: "wildcard", config: "Host *.prod\n  User prod", host: "db.prod", want: "prod"},
+		{name: "question mark", config: "Host web?\n  User web", host: "web1", want: "web"},
+		{name: "case insensitive host", config: "Host Bastion\n  User ops", host: "BASTION", want: "ops"},
+		{name: "negated pattern", config: "Host *.prod !legacy.prod\n  User prod", host: "legacy.prod", want: ""},
+		{name: "first value wins", config: "Host bastion\n  User first\nHost *\n  User second", host: "bastion", want: "first"},
+		{name: "global option", config: "User everyone\nHost other\n  User other", host: "bastion", want: "everyone"},
+		{name: "equals sign", config: "Host=bastion\n  User = ops", host: "bastion", want: "ops"},
+		{name: "quoted argument", config: "Host \"bastion\"\n  User \"ops\"", host: "bastion", want: "ops"},
+		{name: "match all", config: "Match all\n  User ops", host: "bastion", want: "ops"},
+		{
+			name:   "match host uses HostName",
+			config: "Host bastion\n  HostName 10.1.2.3\nMatch host 10.1.*\n  User vpc",
+			host:   "bastion",
+			want:   "vpc",
+		},
+		{
+			name:   "match originalhost",
+			config: "Host bastion\n  HostName 10.1.2.3\nMatch originalhost bastion\n  User alias",
+			host:   "bastion",
+			want:   "alias",
+		},
+		{
+			name:   "match negated criterion",
+			config: "Match !host bastion\n  User other\nMatch all\n  User fallback",
+			host:   "bastion",
+			want:   "fallback",
+		},
+		{name: "match exec never holds", config: "Match exec \"true\"\n  User exec", host: "bastion", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := isolateCredentials(t)
+			writeSSHConfig(t, home, tt.config+"\n")
+			cfg, _, err := TunnelConfig{SSHHost: tt.host}.ApplySSHConfig()
+			if err != nil {
+				t.Fatalf("ApplySSHConfig() = %v", err)
+			}
+			if cfg.SSHUser != tt.want {
+				t.Fatalf("SSHUser = %q, want %q", cfg.SSHUser, tt.want)
+			}
+		})
+	}
+}
+
+// Match user sees the explicit ssh_user, which the file cannot override.
+func TestApplySSHConfigMatchesExplicitUser(t *testing.T) {
+	home := isolateCredentials(t)
+	writeSSHConfig(t, home, "Match user admin\n  Port 2222\n")
+
+	cfg, _, err := TunnelConfig{SSHHost: "bastion", SSHUser: "admin"}.ApplySSHConfig()
+	if err != nil {
+		t.Fatalf("ApplySSHConfig() = %v", err)
+	}
+	if cfg.SSHPort != 2222 {
+		t.Fatalf("SSHPort = %d, want 2222 from the Match user block", cfg.SSHPort)
+	}
+	cfg, _, _ = TunnelConfig{SSHHost: "bastion", SSHUser: "ops"}.ApplySSHConfig()
+	if cfg.SSHPort != 0 {
+		t.Fatalf("SSHPort = %d, want the Match user block skipped for ops", cfg.SSHPort)
+	}
+}
+
+func TestApplySSHConfigFollowsInclude(t *testing.T) {
+	home := isolateCredentials(t)
+	writeSSHConfig(t, home, "Include config.d/*\nHost *\n  User fallback\n")
+	dir := filepath.Join(home, ".ssh", "config.d")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, dir, "prod", "Host bastion\n  User ops\n")
+
+	cfg, settings, err := TunnelConfig{SSHHost: "bastion"}.ApplySSHConfig()
+	if err != nil {
+		t.Fatalf("ApplySSHConfig() = %v", err)
+	}
+	if cfg.SSHUser != "ops" {
+		t.Fatalf("SSHUser = %q, want the included file's ops", cfg.SSHUser)
+	}
+	if want := filepath.Join(dir, "prod") + " line 2"; settings[0].Source != want {
+		t.Fatalf("source = %q, want %q", settings[0].Source, want)
+	}
+}
+
+func TestApplySSHConfigFileSelection(t *testing.T) {
+	home := isolateCredentials(t)
+
+	// No ~/.ssh/config is not an error.
+	if _, settings, err := (TunnelConfig{SSHHost: "bastion"}).ApplySSHConfig(); err != nil || settings != nil {
+		t.Fatalf("ApplySSHConfig() without a config = %v, %v", settings, err)
+	}
+
+	writeSSHConfig(t, home, "Host bastion\n  User ops\n")
+	cfg, _, err := TunnelConfig{SSHHost: "bastion", SSHConfigFile: SSHConfigNone}.ApplySSHConfig()
+	if err != nil || cfg.SSHUser != "" {
+		t.Fatalf("ssh_config_file = none still applied the config: %+v, %v", cfg, err)
+	}
+
+	other := writeKeyFile(t, home, "team_config", "Host bastion\n  User team\n")
+	cfg, _, err = TunnelConfig{SSHHost: "bastion", SSHConfigFile: other}.ApplySSHConfig()
+	if err != nil || cfg.SSHUser != "team" {
+		t.Fatalf("explicit ssh_config_file not used: %+v, %v", cfg, err)
+	}
+
+	_, _, err = TunnelConfig{SSHHost: "bastion", SSHConfigFile: filepath.Join(home, "missing")}.ApplySSHConfig()
+	if err == nil {
+		t.Fatal("ApplySSHConfig() = nil, want an error for a missing explicit file")
+	}
+
+	bad := writeKeyFile(t, home, "bad_config", "Host bastion\n  User\n")
+	_, _, err = TunnelConfig{SSHHost: "bastion", SSHConfigFile: bad}.ApplySSHConfig()
+	if err == nil || !strings.Contains(err.Error(), bad+" line 2") {
+		t.Fatalf("ApplySSHConfig() = %v, want it to name %s line 2", err, bad)
+	}
+}
+
+// TestSSHConfigIdentityFileAuthenticates connects the way an engineer's
+// ~/.ssh/config describes the bastion, with nothing else configured.
+func TestSSHConfigIdentityFileAuthenticates(t *testing.T) {
+	home := isolateCredentials(t)
+	keyPEM, clientKey := sshtest.GenerateClientKey(t)
+	srv := sshtest.StartServer(t, clientKey)
+	writeKeyFile(t, home, "bastion_key", keyPEM)
+	// A default key the server does not accept, which IdentityFile replaces.
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeKeyFile(t, filepath.Join(home, ".ssh"), "id_ed25519", generateKey(t, ""))
+	writeSSHConfig(t, home, strings.Join([]string{
+		"Host bastion",
+		"  HostName 127.0.0.1",
+		"  Port " + strings.TrimPrefix(srv.Addr(), "127.0.0.1:"),
+		"  User " + sshtest.User,
+		"  IdentityFile ~/bastion_key",
+		"  IdentitiesOnly yes",
+	}, "\n")+"\n")
+
+	cfg, _, err := TunnelConfig{SSHHost: "bastion", SSHHostKeys: []string{srv.AuthorizedHostKey()}}.ApplySSHConfig()
+	if err != nil {
+		t.Fatalf("ApplySSHConfig() = %v", err)
+	}
+	clientCfg, err := clientConfig(cfg)
+	if err != nil {
+		t.Fatalf("clientConfig() = %v", err)
+	}
+	if len(clientCfg.Auth) != 1 {
+		t.Fatalf("got %d auth methods, want only the identity file", len(clientCfg.Auth))
+	}
+	client, err := dialSSH(context.Background(), sshAddress(cfg.SSHHost, cfg.SSHPort), clientCfg)
+	if err != nil {
+		t.Fatalf("dialSSH() = %v", err)
+	}
+	_ = client.Close()
+}
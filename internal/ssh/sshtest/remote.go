@@ -0,0 +1,185 @@
+package sshtest
+
+import (
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// remoteForwards holds the listeners one connection asked for with
+// tcpip-forward and streamlocal-forward@openssh.com, the server side of
+// `ssh -R`. They close with the connection, as sshd's do.
+type remoteForwards struct {
+	conn *ssh.ServerConn
+	// stalled leaves the requests unanswered, as over a dead network path.
+	stalled atomic.Bool
+
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func newRemoteForwards(conn *ssh.ServerConn) *remoteForwards {
+	return &remoteForwards{conn: conn, listeners: make(map[string]net.Listener)}
+}
+
+// serve answers the connection's global requests, refusing the ones it does
+// not know, as ssh.DiscardRequests would.
+func (f *remoteForwards) serve(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if f.stalled.Load() {
+			continue
+		}
+		switch req.Type {
+		case "tcpip-forward":
+			f.forwardTCP(req)
+		case "cancel-tcpip-forward":
+			var payload struct {
+				Addr string
+				Port uint32
+			}
+			ok := ssh.Unmarshal(req.Payload, &payload) == nil &&
+				f.cancel(net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+			_ = req.Reply(ok, nil)
+		case "streamlocal-forward@openssh.com":
+			f.forwardUnix(req)
+		case "cancel-streamlocal-forward@openssh.com":
+			var payload struct{ SocketPath string }
+			ok := ssh.Unmarshal(req.Payload, &payload) == nil && f.cancel(payload.SocketPath)
+			_ = req.Reply(ok, nil)
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// forwardTCP listens on loopback whatever the requested address, so a test
+// asking for the bastion's "localhost" or "0.0.0.0" stays on this machine.
+func (f *remoteForwards) forwardTCP(req *ssh.Request) {
+	var payload struct {
+		Addr string
+		Port uint32
+	}
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		_ = ln.Close()
+		_ = req.Reply(false, nil)
+		return
+	}
+	port := uint32(addr.Port)
+	f.add(net.JoinHostPort(payload.Addr, strconv.Itoa(int(port))), ln)
+
+	var reply []byte
+	if payload.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+	_ = req.Reply(true, reply)
+
+	go f.accept(ln, func(remote net.Addr) (string, []byte) {
+		origin, _ := remote.(*net.TCPAddr)
+		if origin == nil {
+			origin = &net.TCPAddr{IP: net.IPv4zero}
+		}
+		return "forwarded-tcpip", ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)})
+	})
+}
+
+func (f *remoteForwards) forwardUnix(req *ssh.Request) {
+	var payload struct{ SocketPath string }
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	_ = os.Remove(payload.SocketPath)
+	ln, err := net.Listen("unix", payload.SocketPath)
+	if err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+	f.add(payload.SocketPath, ln)
+	_ = req.Reply(true, nil)
+
+	go f.accept(ln, func(net.Addr) (string, []byte) {
+		return "forwarded-streamlocal@openssh.com", ssh.Marshal(struct {
+			SocketPath string
+			Reserved   string
+		}{payload.SocketPath, ""})
+	})
+}
+
+func (f *remoteForwards) add(key string, ln net.Listener) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listeners[key] = ln
+}
+
+func (f *remoteForwards) cancel(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ln, ok := f.listeners[key]
+	if ok {
+		_ = ln.Close()
+		delete(f.listeners, key)
+	}
+	return ok
+}
+
+func (f *remoteForwards) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, ln := range f.listeners {
+		_ = ln.Close()
+		delete(f.listeners, key)
+	}
+}
+
+// accept opens a channel back to the client for each connection the listener
+// takes and pipes the two together.
+func (f *remoteForwards) accept(ln net.Listener, channel func(remote net.Addr) (string, []byte)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			chanType, payload := channel(conn.RemoteAddr())
+			ch, reqs, err := f.conn.OpenChannel(chanType, payload)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, _ = io.Copy(ch, conn)
+				_ = ch.CloseWrite()
+			}()
+			_, _ = io.Copy(conn, ch)
+			closeWrite(conn)
+			<-done
+			_ = ch.Close()
+		}()
+	}
+}
@@ -2,7 +2,10 @@
 // server authenticates a generated key and services the channel types a local
 // forward opens ("direct-tcpip" and "direct-streamlocal@openssh.com", the server
 // side of `ssh -L`), so a tunnel can forward through it to an arbitrary local
-// target without any external SSH daemon.
+// target without any external SSH daemon. It also listens for remote forwards
+// (tcpip-forward and streamlocal-forward@openssh.com, the server side of
+// `ssh -R`) on loopback, and runs the commands of exec requests through
+// Config.Exec.
 package sshtest
 
 import (
@@ -14,6 +17,9 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"golang.org/x/crypto/ssh"
@@ -50,14 +56,141 @@ func GenerateClientKey(t testing.TB) (string, ssh.PublicKey) {
 	return string(pem.EncodeToMemory(block)), signer.PublicKey()
 }
 
+// Server is a running in-process bastion.
+type Server struct {
+	Port int
+	// HostKey is the key the server proves its identity with; a certificate
+	// when Config.HostSigner is a certificate signer.
+	HostKey ssh.PublicKey
+
+	listener   net.Listener
+	exec       Exec
+	handshakes atomic.Int32
+	mu         sync.Mutex
+	conns      map[*ssh.ServerConn]*remoteForwards
+	keys       []ssh.PublicKey
+}
+
+// Authorize accepts key from now on, next to Config.AuthorizedKey, as a key
+// pushed by EC2 Instance Connect would be.
+func (s *Server) Authorize(key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, key)
+}
+
+func (s *Server) authorized(key ssh.PublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handshakes counts the connections that authenticated.
+func (s *Server) Handshakes() int {
+	return int(s.handshakes.Load())
+}
+
+// DropConnections closes every established connection, as a bastion restart or
+// a broken network path would, while the server keeps accepting new ones.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// Close stops accepting connections and drops the established ones, as a
+// bastion being replaced would.
+func (s *Server) Close() {
+	_ = s.listener.Close()
+	s.DropConnections()
+}
+
+// StallConnections stops answering the global requests, keepalives included,
+// of every established connection while leaving it open, as a half-dead
+// network path would. New connections are served normally.
+func (s *Server) StallConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, forwards := range s.conns {
+		forwards.stalled.Store(true)
+	}
+}
+
+// Addr returns the server's dialable address.
+func (s *Server) Addr() string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Port))
+}
+
+// AuthorizedHostKey returns HostKey in authorized_keys format, the form the
+// provider's ssh_host_key takes.
+func (s *Server) AuthorizedHostKey() string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(s.HostKey)))
+}
+
+// Config describes a server for Start. Unset fields get the defaults
+// StartServer uses.
+type Config struct {
+	AuthorizedKey ssh.PublicKey
+	// UserCA signs the user certificates the server accepts for User, next
+	// to AuthorizedKey. Certificates are refused when nil.
+	UserCA ssh.PublicKey
+	// HostSigner is presented as the host key; a fresh ed25519 key when nil.
+	HostSigner ssh.Signer
+	// HandleChannel services forwarding channels; HandleChannel when nil.
+	HandleChannel func(ssh.NewChannel)
+	// Exec runs the commands of "session" channels, which are refused when
+	// it is nil.
+	Exec Exec
+	// Challenges, when set, are put to the client over keyboard-interactive
+	// after its key is accepted, as `AuthenticationMethods
+	// publickey,keyboard-interactive` does.
+	Challenges []Challenge
+}
+
+// Challenge is a keyboard-interactive prompt and the check for its answer.
+type Challenge struct {
+	Prompt string
+	Accept func(answer string) bool
+}
+
+// keyboardInteractive asks every challenge in a single round.
+func keyboardInteractive(challenges []Challenge) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		prompts := make([]string, len(challenges))
+		echos := make([]bool, len(challenges))
+		for i, c := range challenges {
+			prompts[i] = c.Prompt
+		}
+		answers, err := client(conn.User(), "second factor required", prompts, echos)
+		if err != nil {
+			return nil, err
+		}
+		if len(answers) != len(challenges) {
+			return nil, fmt.Errorf("got %d answers to %d prompts", len(answers), len(challenges))
+		}
+		for i, c := range challenges {
+			if !c.Accept(answers[i]) {
+				return nil, fmt.Errorf("wrong answer to %q", c.Prompt)
+			}
+		}
+		return &ssh.Permissions{}, nil
+	}
+}
+
 // StartServer starts a minimal SSH server on a random localhost port that
 // authenticates the given key and handles the channel types a local forward uses
 // ("direct-tcpip" for `ssh -L`, "direct-streamlocal@openssh.com" for a unix
-// socket target). It returns the listening port and tears the server down on test
-// cleanup.
-func StartServer(t testing.TB, authorizedKey ssh.PublicKey) int {
+// socket target). The server is torn down on test cleanup.
+func StartServer(t testing.TB, authorizedKey ssh.PublicKey) *Server {
 	t.Helper()
-	return StartServerWithChannelHandler(t, authorizedKey, handleChannel)
+	return Start(t, Config{AuthorizedKey: authorizedKey})
 }
 
 // StartServerWithChannelHandler starts a server whose forwarding channels are
@@ -66,18 +199,49 @@ func StartServerWithChannelHandler(
 	t testing.TB,
 	authorizedKey ssh.PublicKey,
 	handle func(ssh.NewChannel),
-) int {
+) *Server {
 	t.Helper()
+	return Start(t, Config{AuthorizedKey: authorizedKey, HandleChannel: handle})
+}
 
-	_, hostSigner := newEd25519Signer(t)
-	config := &ssh.ServerConfig{
-		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+// Start starts a server described by cfg.
+func Start(t testing.TB, cfg Config) *Server {
+	t.Helper()
+
+	var srv *Server
+	hostSigner := cfg.HostSigner
+	if hostSigner == nil {
+		_, hostSigner = newEd25519Signer(t)
+	}
+	handle := cfg.HandleChannel
+	if handle == nil {
+		handle = HandleChannel
+	}
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return cfg.UserCA != nil && bytes.Equal(auth.Marshal(), cfg.UserCA.Marshal())
+		},
+		UserKeyFallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if cfg.AuthorizedKey != nil && bytes.Equal(key.Marshal(), cfg.AuthorizedKey.Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+			if srv.authorized(key) {
 				return &ssh.Permissions{}, nil
 			}
 			return nil, fmt.Errorf("unauthorized public key")
 		},
 	}
+	config := &ssh.ServerConfig{PublicKeyCallback: checker.Authenticate}
+	if len(cfg.Challenges) > 0 {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if _, err := checker.Authenticate(conn, key); err != nil {
+				return nil, err
+			}
+			return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: keyboardInteractive(cfg.Challenges),
+			}}
+		}
+	}
 	config.AddHostKey(hostSigner)
 
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
@@ -86,38 +250,63 @@ func StartServerWithChannelHandler(
 	}
 	t.Cleanup(func() { _ = ln.Close() })
 
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("listener address is not TCP: %T", ln.Addr())
+	}
+	srv = &Server{
+		listener: ln,
+		exec:     cfg.Exec,
+		Port:     addr.Port,
+		HostKey:  hostSigner.PublicKey(),
+		conns:    make(map[*ssh.ServerConn]*remoteForwards),
+	}
+
 	go func() {
 		for {
 			conn, err := ln.Accept()
 			if err != nil {
 				return // listener closed during cleanup
 			}
-			go handleSSHConn(conn, config, handle)
+			go srv.handleSSHConn(conn, config, handle)
 		}
 	}()
 
-	addr, ok := ln.Addr().(*net.TCPAddr)
-	if !ok {
-		t.Fatalf("listener address is not TCP: %T", ln.Addr())
-	}
-	return addr.Port
+	return srv
 }
 
-func handleSSHConn(c net.Conn, config *ssh.ServerConfig, handle func(ssh.NewChannel)) {
+func (s *Server) handleSSHConn(c net.Conn, config *ssh.ServerConfig, handle func(ssh.NewChannel)) {
 	sshConn, chans, reqs, err := ssh.NewServerConn(c, config)
 	if err != nil {
 		return // handshake/auth failure
 	}
-	defer sshConn.Close()
+	s.handshakes.Add(1)
+	forwards := newRemoteForwards(sshConn)
+	defer forwards.closeAll()
+	s.mu.Lock()
+	s.conns[sshConn] = forwards
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, sshConn)
+		s.mu.Unlock()
+		_ = sshConn.Close()
+	}()
 
-	go ssh.DiscardRequests(reqs)
+	go forwards.serve(reqs)
 
 	for nc := range chans {
+		if nc.ChannelType() == "session" && s.exec != nil {
+			go handleSession(nc, s.exec)
+			continue
+		}
 		go handle(nc)
 	}
 }
 
-func handleChannel(nc ssh.NewChannel) {
+// HandleChannel services the forwarding channels StartServer supports. Custom
+// handlers can delegate to it after observing a channel.
+func HandleChannel(nc ssh.NewChannel) {
 	switch nc.ChannelType() {
 	case "direct-tcpip":
 		handleDirectTCPIP(nc)
@@ -0,0 +1,60 @@
+package sshtest
+
+import (
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Exec runs the command of an exec request, the server side of `ssh host
+// command`. It reads the client's stdin until EOF, writes the command's output
+// and returns its exit status. Done is closed when the client goes away or
+// signals the command.
+type Exec func(command string, stdin io.Reader, stdout, stderr io.Writer, done <-chan struct{}) uint32
+
+// handleSession serves a "session" channel's exec request and reports the
+// exit status back like sshd. Shells, PTYs and environment requests are
+// refused.
+func handleSession(nc ssh.NewChannel, exec Exec) {
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		return
+	}
+	defer func() { _ = ch.Close() }()
+
+	done := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(done) })
+	defer stop()
+	finished := make(chan uint32, 1)
+	started := false
+	for {
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				return
+			}
+			switch {
+			case req.Type == "exec" && !started:
+				var payload struct{ Command string }
+				if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				started = true
+				_ = req.Reply(true, nil)
+				go func() { finished <- exec(payload.Command, ch, ch, ch.Stderr(), done) }()
+			case req.Type == "signal" && started:
+				stop()
+			default:
+				if req.WantReply {
+					_ = req.Reply(false, nil)
+				}
+			}
+		case status := <-finished:
+			_, _ = ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			_ = ch.CloseWrite()
+			return
+		}
+	}
+}
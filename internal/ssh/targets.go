@@ -0,0 +1,151 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Strategies for spreading forwarded connections over target_hosts.
+const (
+	TargetStrategyFailover   = "failover"
+	TargetStrategyRoundRobin = "round_robin"
+)
+
+// A target that does not answer within this is given up on for the next one.
+const targetDialTimeout = 10 * time.Second
+
+// targets are where forwarded connections go: target_socket, target_host and
+// target_port, or each of target_hosts in turn. With a list, every connection
+// goes to the first target the bastion reaches, so a primary that goes away
+// leaves the connections to its replicas.
+type targets struct {
+	network    string
+	addrs      []string
+	roundRobin bool
+	cooldown   time.Duration
+
+	mu   sync.Mutex
+	next int
+	// failedAt records when each target last failed. Targets still cooling
+	// down are only tried once the others have failed too.
+	failedAt map[int]time.Time
+}
+
+func newTargets(cfg TunnelConfig) *targets {
+	t := &targets{
+		roundRobin: cfg.TargetHostsStrategy == TargetStrategyRoundRobin,
+		cooldown:   time.Duration(cfg.TargetHostsCooldown) * time.Second,
+		failedAt:   make(map[int]time.Time),
+	}
+	if t.cooldown == 0 {
+		t.cooldown = defaultHostCooldown
+	}
+	if len(cfg.TargetHosts) > 0 {
+		t.network, t.addrs = "tcp", cfg.TargetHosts
+		return t
+	}
+	network, address := targetEndpoint(cfg)
+	t.network, t.addrs = network, []string{address}
+	return t
+}
+
+func (t *targets) String() string {
+	if len(t.addrs) == 1 {
+		return t.addrs[0]
+	}
+	return "{" + strings.Join(t.addrs, " | ") + "}"
+}
+
+// dial opens a channel to the first target the bastion reaches. The bastion
+// refusing the target, or the target not answering, moves on to the next;
+// anything else is the bastion's failure and ends the attempt.
+func (t *targets) dial(ctx context.Context, clients *clientPool) (net.Conn, error) {
+	if len(t.addrs) == 1 {
+		return dialThrough(ctx, clients, t.network, t.addrs[0])
+	}
+
+	var errs []error
+	for _, i := range t.order() {
+		addr := t.addrs[i]
+		conn, err := dialThroughWithin(ctx, clients, t.network, addr, targetDialTimeout)
+		if err == nil {
+			t.mu.Lock()
+			delete(t.failedAt, i)
+			t.mu.Unlock()
+			log.Printf("forwarding to target %s", addr)
+			return conn, nil
+		}
+		var openErr *ssh.OpenChannelError
+		if ctx.Err() != nil || (!errors.As(err, &openErr) && !errors.Is(err, context.DeadlineExceeded)) {
+			return nil, err
+		}
+		log.Printf("target %s failed, trying the next one: %v", addr, err)
+		t.mu.Lock()
+		t.failedAt[i] = time.Now()
+		t.mu.Unlock()
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return nil, fmt.Errorf("every target failed: %w", errors.Join(errs...))
+}
+
+// order lists the targets to try: the available ones in the configured
+// order, or from the next one in turn for round_robin, then those cooling
+// down, oldest failure first.
+func (t *targets) order() []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	start := 0
+	if t.roundRobin {
+		start = t.next
+		t.next = (t.next + 1) % len(t.addrs)
+	}
+	now := time.Now()
+	var ready, cooling []int
+	for n := range t.addrs {
+		i := (start + n) % len(t.addrs)
+		if failed, ok := t.failedAt[i]; ok && now.Sub(failed) < t.cooldown {
+			cooling = append(cooling, i)
+		} else {
+			ready = append(ready, i)
+		}
+	}
+	slices.SortStableFunc(cooling, func(x, y int) int { return t.failedAt[x].Compare(t.failedAt[y]) })
+	return append(ready, cooling...)
+}
+
+func (cfg TunnelConfig) validateTargetHosts() error {
+	if len(cfg.TargetHosts) == 0 {
+		return nil
+	}
+	if cfg.TargetHost != "" || cfg.TargetPort != 0 || cfg.TargetSocket != "" {
+		return errors.New("target_hosts cannot be combined with target_host, target_port or target_socket")
+	}
+	for i, target := range cfg.TargetHosts {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil || host == "" {
+			return fmt.Errorf("target_hosts[%d]: %q is not a host:port pair", i, target)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("target_hosts[%d]: invalid port %q", i, port)
+		}
+	}
+	switch cfg.TargetHostsStrategy {
+	case "", TargetStrategyFailover, TargetStrategyRoundRobin:
+	default:
+		return fmt.Errorf("target_hosts_strategy must be %q or %q", TargetStrategyFailover, TargetStrategyRoundRobin)
+	}
+	if cfg.TargetHostsCooldown < 0 {
+		return errors.New("target_hosts_cooldown must not be negative")
+	}
+	return nil
+}
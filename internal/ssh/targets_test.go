@@ -0,0 +1,138 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+func closedTarget(t *testing.T) string {
+	t.Helper()
+	port, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// TestTargetsFailOverToReplica has the bastion refuse the primary: the
+// connection goes to the replica, and the log says so.
+func TestTargetsFailOverToReplica(t *testing.T) {
+	logs := captureLogs(t)
+	pool, handshakes, _ := testPool(t, sshtest.HandleChannel, 1)
+	primary := closedTarget(t)
+	replica := startTCPTarget(t, echoUntilEOF)
+	targets := newTargets(TunnelConfig{TargetHosts: []string{primary, replica}})
+
+	conn, err := targets.dial(context.Background(), pool)
+	if err != nil {
+		t.Fatalf("dial() = %v, want the replica", err)
+	}
+	assertEcho(t, conn, []byte("ping"))
+	_ = conn.Close()
+	if handshakes.Load() != 1 {
+		t.Fatalf("handshakes = %d, want the refused target to leave the SSH connection usable", handshakes.Load())
+	}
+	if want := "forwarding to target " + replica; !strings.Contains(logs.String(), want) {
+		t.Fatalf("logs = %q, want %q", logs.String(), want)
+	}
+	if got := targets.order(); !reflect.DeepEqual(got, []int{1, 0}) {
+		t.Fatalf("order() = %v, want the failed primary last", got)
+	}
+}
+
+func TestTargetsReportEveryFailure(t *testing.T) {
+	pool, _, _ := testPool(t, sshtest.HandleChannel, 1)
+	dead := []string{closedTarget(t), closedTarget(t)}
+	_, err := newTargets(TunnelConfig{TargetHosts: dead}).dial(context.Background(), pool)
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) || !strings.Contains(err.Error(), dead[0]) || !strings.Contains(err.Error(), dead[1]) {
+		t.Fatalf("dial() = %v, want both targets' failures", err)
+	}
+}
+
+// TestDialThroughWithinTimesOut gives up on a target the bastion never
+// answers for, without dropping the SSH connection.
+func TestDialThroughWithinTimesOut(t *testing.T) {
+	silent := closedTarget(t)
+	pool, handshakes, _ := testPool(t, func(nc ssh.NewChannel) {
+		var payload struct {
+			DestAddr string
+			DestPort uint32
+		}
+		_ = ssh.Unmarshal(nc.ExtraData(), &payload)
+		if net.JoinHostPort(payload.DestAddr, strconv.Itoa(int(payload.DestPort))) == silent {
+			return
+		}
+		sshtest.HandleChannel(nc)
+	}, 1)
+
+	_, err := dialThroughWithin(context.Background(), pool, "tcp", silent, 200*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dialThroughWithin() = %v, want the timeout", err)
+	}
+	conn, err := dialThrough(context.Background(), pool, "tcp", startTCPTarget(t, echoUntilEOF))
+	if err != nil {
+		t.Fatalf("dialThrough() after the timeout = %v", err)
+	}
+	_ = conn.Close()
+	if handshakes.Load() != 1 {
+		t.Fatalf("handshakes = %d, want the SSH connection kept", handshakes.Load())
+	}
+}
+
+func TestTargetsOrder(t *testing.T) {
+	tg := newTargets(TunnelConfig{TargetHosts: []string{"a:1", "b:1", "c:1"}, TargetHostsStrategy: TargetStrategyRoundRobin})
+	for _, want := range [][]int{{0, 1, 2}, {1, 2, 0}, {2, 0, 1}, {0, 1, 2}} {
+		if got := tg.order(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("round_robin order() = %v, want %v", got, want)
+		}
+	}
+
+	tg = newTargets(TunnelConfig{TargetHosts: []string{"a:1", "b:1", "c:1"}, TargetHostsCooldown: 60})
+	now := time.Now()
+	tg.failedAt[0] = now.Add(-10 * time.Second)
+	tg.failedAt[1] = now.Add(-20 * time.Second)
+	if got := tg.order(); !reflect.DeepEqual(got, []int{2, 1, 0}) {
+		t.Fatalf("order() = %v, want the available target, then the oldest failure", got)
+	}
+	tg.failedAt[1] = now.Add(-2 * time.Minute)
+	if got := tg.order(); !reflect.DeepEqual(got, []int{1, 2, 0}) {
+		t.Fatalf("order() = %v, want a cooled-down target back in line", got)
+	}
+}
+
+func TestTunnelConfigValidateTargetHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "hosts", cfg: TunnelConfig{TargetHosts: []string{"db-1:5432", "[fd00::2]:5432"}, TargetHostsStrategy: TargetStrategyRoundRobin}},
+		{name: "with target_host", cfg: TunnelConfig{TargetHost: "db", TargetHosts: []string{"db-1:5432"}}, wantErr: "cannot be combined"},
+		{name: "no port", cfg: TunnelConfig{TargetHosts: []string{"db-1"}}, wantErr: "target_hosts[0]"},
+		{name: "bad port", cfg: TunnelConfig{TargetHosts: []string{"db-1:5432", "db-2:0"}}, wantErr: "target_hosts[1]"},
+		{name: "bad strategy", cfg: TunnelConfig{TargetHosts: []string{"db-1:5432"}, TargetHostsStrategy: "random"}, wantErr: "target_hosts_strategy"},
+		{name: "negative cooldown", cfg: TunnelConfig{TargetHosts: []string{"db-1:5432"}, TargetHostsCooldown: -1}, wantErr: "target_hosts_cooldown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
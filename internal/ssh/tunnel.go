@@ -3,6 +3,7 @@ package ssh
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -11,33 +12,180 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dfns/terraform-provider-tunnel/internal/libs"
-	"golang.org/x/crypto/ssh"
 )
 
 var TunnelType string = "ssh"
 
 type TunnelConfig struct {
-	LocalHost        string
-	LocalPort        int
-	SSHHost          string
-	SSHKey           string
-	SSHKeyPassphrase string
-	SSHPassword      string
-	SSHPort          int
-	SSHUser          string
-	TargetHost       string
-	TargetPort       int
-	TargetSocket     string
+	EC2InstanceConnect       *EC2InstanceConnect `json:",omitempty"`
+	JumpHosts                []JumpHost
+	KeepaliveCountMax        int
+	KeepaliveInterval        int
+	KeyboardInteractive      []PromptAnswer
+	LocalHost                string
+	LocalPort                int
+	MaxConnections           int
+	SSHAgentIdentities       []string
+	SSHAgentSocket           string
+	SSHAlgorithmPreset       string
+	SSHCertificate           string
+	SSHCiphers               []string
+	SSHConfigFile            string
+	SSHHost                  string
+	SSHHostCAKeys            []string
+	SSHHostCooldown          int
+	SSHHostKeyAlgorithms     []string
+	SSHHostKeys              []string
+	SSHHostOrder             string
+	SSHHosts                 []string
+	SSHIdentitiesOnly        bool
+	SSHIdentityFiles         []string
+	SSHInsecureIgnoreHostKey bool
+	SSHKexAlgorithms         []string
+	SSHKey                   string
+	SSHKeyPassphrase         string
+	SSHKnownHostsFile        string
+	SSHMACs                  []string
+	SSHPassword              string
+	SSHPort                  int
+	SSHProxyURL              string
+	SSHUseAgent              *bool `json:",omitempty"`
+	SSHUser                  string
+	TargetHost               string
+	TargetPort               int
+	TargetHosts              []string
+	TargetHostsCooldown      int
+	TargetHostsStrategy      string
+	TargetSocket             string
+	VaultSSHSigner           *VaultSSHSigner `json:",omitempty"`
+
+	// vaultCert keeps the Vault certificate current in the child.
+	vaultCert *vaultCertificate
+}
+
+// JumpHost is an SSH server the connection to the bastion is relayed through,
+// like an OpenSSH ProxyJump entry. Unset credentials and user fall back to the
+// bastion's.
+type JumpHost struct {
+	Host     string
+	Port     int
+	User     string
+	Key      string
+	Password string
+	HostKeys []string
+}
+
+// Validate catches settings that would only fail once the tunnel child runs.
+func (cfg TunnelConfig) Validate() error {
+	if cfg.SSHInsecureIgnoreHostKey &&
+		(len(cfg.SSHHostKeys) > 0 || len(cfg.SSHHostCAKeys) > 0 || cfg.SSHKnownHostsFile != "") {
+		return errors.New("ssh_insecure_ignore_host_key cannot be combined with " +
+			"ssh_host_key, ssh_host_ca_key or ssh_known_hosts_file")
+	}
+	if cfg.SSHHost != "" && len(cfg.SSHHosts) > 0 {
+		return errors.New("ssh_host and ssh_hosts cannot be combined")
+	}
+	for i, host := range cfg.SSHHosts {
+		if strings.TrimSpace(host) == "" {
+			return fmt.Errorf("ssh_hosts[%d] is empty", i)
+		}
+		if _, port, err := net.SplitHostPort(host); err == nil {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("ssh_hosts[%d]: invalid port %q", i, port)
+			}
+		}
+	}
+	switch cfg.SSHHostOrder {
+	case "", HostOrderSequential, HostOrderRandom:
+	default:
+		return fmt.Errorf("ssh_hosts_order must be %q or %q", HostOrderSequential, HostOrderRandom)
+	}
+	if cfg.SSHHostCooldown < 0 {
+		return errors.New("ssh_hosts_cooldown must not be negative")
+	}
+	if cfg.MaxConnections < 0 {
+		return errors.New("max_connections must not be negative")
+	}
+	if cfg.KeepaliveInterval < 0 || cfg.KeepaliveCountMax < 0 {
+		return errors.New("keepalive_interval and keepalive_count_max must not be negative")
+	}
+	if err := cfg.validateAlgorithms(); err != nil {
+		return err
+	}
+	if cfg.EC2InstanceConnect != nil {
+		if err := cfg.EC2InstanceConnect.validate(cfg); err != nil {
+			return err
+		}
+	}
+	if err := cfg.validateTargetHosts(); err != nil {
+		return err
+	}
+	if err := cfg.validateAgent(); err != nil {
+		return err
+	}
+	if cfg.VaultSSHSigner != nil {
+		if err := cfg.VaultSSHSigner.validate(cfg); err != nil {
+			return err
+		}
+	}
+	if cfg.SSHProxyURL != "" {
+		if _, err := parseProxyURL(cfg.SSHProxyURL); err != nil {
+			return fmt.Errorf("ssh_proxy_url: %w", err)
+		}
+	}
+	if _, err := parsePublicKeys("ssh_host_key", cfg.SSHHostKeys); err != nil {
+		return err
+	}
+	if _, err := parsePublicKeys("ssh_host_ca_key", cfg.SSHHostCAKeys); err != nil {
+		return err
+	}
+	if cfg.SSHCertificate != "" {
+		if cfg.SSHKey == "" {
+			return errors.New("ssh_certificate requires ssh_key, the private key it certifies")
+		}
+		cert, err := parseCertificate(cfg.SSHCertificate)
+		if err != nil {
+			return err
+		}
+		if err := checkCertificateValidity(cert, time.Now()); err != nil {
+			return err
+		}
+	}
+	for i, answer := range cfg.KeyboardInteractive {
+		if err := answer.validate(fmt.Sprintf("keyboard_interactive[%d]", i)); err != nil {
+			return err
+		}
+	}
+	for i, jump := range cfg.JumpHosts {
+		if jump.Host == "" {
+			return fmt.Errorf("jump_hosts[%d]: host is required", i)
+		}
+		if cfg.SSHInsecureIgnoreHostKey && len(jump.HostKeys) > 0 {
+			return fmt.Errorf("jump_hosts[%d]: host_key cannot be combined with ssh_insecure_ignore_host_key", i)
+		}
+		if _, err := parsePublicKeys(fmt.Sprintf("jump_hosts[%d].host_key", i), jump.HostKeys); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ForkRemoteTunnel(ctx context.Context, cfg TunnelConfig) (*exec.Cmd, error) {
 	target := strconv.Itoa(cfg.TargetPort)
+	if len(cfg.TargetHosts) > 0 {
+		_, target, _ = net.SplitHostPort(cfg.TargetHosts[0])
+	}
 	if cfg.TargetSocket != "" {
 		target = strings.ReplaceAll(cfg.TargetSocket, string(os.PathSeparator), "_")
 	}
-	logName := fmt.Sprintf("ssh-tunnel-%s-%s.log", cfg.SSHHost, target)
+	logName := fmt.Sprintf("ssh-tunnel-%s-%s.log", cfg.bastionName(), target)
+	cfg, err := cfg.withGeneratedCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return libs.ForkTunnel(ctx, TunnelType, logName, cfg)
 }
 
@@ -55,50 +203,47 @@ func StartRemoteTunnel(ctx context.Context, cfgJson string, parentPid int) error
 }
 
 func runTunnel(ctx context.Context, cfg TunnelConfig) error {
-	clientCfg, err := clientConfig(cfg)
+	hops, err := newBastions(cfg)
 	if err != nil {
 		return err
 	}
 
-	sshPort := cfg.SSHPort
-	if sshPort == 0 {
-		sshPort = defaultSSHPort
-	}
 	localHost := cfg.LocalHost
 	if localHost == "" {
 		localHost = "localhost"
 	}
-	sshAddr := net.JoinHostPort(cfg.SSHHost, strconv.Itoa(sshPort))
+	sshAddr := hops.addr()
 	localAddr := net.JoinHostPort(localHost, strconv.Itoa(cfg.LocalPort))
-	network, target := targetEndpoint(cfg)
-	log.Printf("starting tunnel: %s - %s - %s", localAddr, sshAddr, target)
+	targets := newTargets(cfg)
+	log.Printf("starting tunnel: %s - %s - %s", localAddr, hops, targets)
 
 	runCtx, stop := signal.NotifyContext(ctx, os.Interrupt)
 	defer stop()
 
-	clients := &clientPool{dial: func(ctx context.Context) (*ssh.Client, error) {
-		return dialSSH(ctx, sshAddr, clientCfg)
-	}}
+	clients := &clientPool{
+		dial:       hops.dial,
+		keepalive:  newKeepalivePolicy(cfg),
+		maxClients: cfg.MaxConnections,
+	}
 	defer clients.close()
 
 	// Authenticate before reporting readiness.
 	if _, err := clients.get(runCtx); err != nil {
 		return fmt.Errorf("connect to SSH bastion %s: %w", sshAddr, err)
 	}
-	log.Printf("connected to %s", sshAddr)
 
 	listener, err := net.Listen("tcp", localAddr)
 	if err != nil {
 		return fmt.Errorf("listen on %s: %w", localAddr, err)
 	}
-	fwd := newForwarder(listener, clients, network, target)
+	fwd := newForwarder(listener, clients, targets)
 	defer fwd.Close()
 
 	// Preserve the readiness contract: the local listener is only useful once
 	// the bastion can also open a channel to the configured target.
 	probe, err := fwd.dialTarget(runCtx)
 	if err != nil {
-		return fmt.Errorf("connect to SSH target %s: %w", target, err)
+		return fmt.Errorf("connect to SSH target %s: %w", targets, err)
 	}
 	_ = probe.Close()
 
@@ -0,0 +1,301 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults for vault_ssh_signer.
+const (
+	defaultVaultMount        = "ssh"
+	defaultVaultAppRoleMount = "approle"
+)
+
+// A certificate that expires sooner than this is signed again before the next
+// connection, so the handshake never races its expiry.
+const vaultResignMargin = 30 * time.Second
+
+var vaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// VaultSSHSigner authenticates to the bastion with a key generated for the
+// tunnel and a short-lived certificate signed by a Vault SSH secrets engine.
+// Address and Token fall back to VAULT_ADDR and VAULT_TOKEN.
+type VaultSSHSigner struct {
+	Address   string
+	Namespace string
+	// Mount is where the SSH secrets engine is mounted, "ssh" by default.
+	Mount string
+	Role  string
+	Token string
+	// AppRoleID and AppRoleSecretID log in with AppRole instead of Token.
+	AppRoleID       string
+	AppRoleSecretID string
+	// AppRoleMount is where the AppRole auth method is mounted, "approle" by
+	// default.
+	AppRoleMount    string
+	ValidPrincipals []string
+	// TTL is requested for each certificate, as a Vault duration; the role's
+	// default when empty.
+	TTL string
+}
+
+func (v VaultSSHSigner) validate(cfg TunnelConfig) error {
+	if v.Role == "" {
+		return errors.New("vault_ssh_signer.role is required")
+	}
+	address := v.address()
+	if address == "" {
+		return errors.New("vault_ssh_signer.address is required when VAULT_ADDR is not set")
+	}
+	if u, err := url.Parse(address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("vault_ssh_signer.address %q is not an http or https URL", address)
+	}
+	if (v.AppRoleID == "") != (v.AppRoleSecretID == "") {
+		return errors.New("vault_ssh_signer.approle_role_id and approle_secret_id must be set together")
+	}
+	if v.AppRoleID == "" && v.token() == "" {
+		return errors.New("vault_ssh_signer needs a token, VAULT_TOKEN or an AppRole to log in with")
+	}
+	if v.TTL != "" {
+		if _, err := parseVaultDuration(v.TTL); err != nil {
+			return fmt.Errorf("vault_ssh_signer.ttl: %w", err)
+		}
+	}
+	if cfg.SSHKey != "" || cfg.SSHCertificate != "" || cfg.EC2InstanceConnect != nil {
+		return errors.New("vault_ssh_signer cannot be combined with ssh_key, ssh_certificate or ec2_instance_connect")
+	}
+	return nil
+}
+
+// parseVaultDuration reads a duration the way Vault does: integer seconds, a
+// number of days with a d suffix, or a Go duration.
+func parseVaultDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.ParseInt(days, 10, 64); err == nil {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+func (v VaultSSHSigner) address() string {
+	if v.Address != "" {
+		return strings.TrimSuffix(v.Address, "/")
+	}
+	return strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+}
+
+func (v VaultSSHSigner) token() string {
+	if v.Token != "" {
+		return v.Token
+	}
+	return os.Getenv("VAULT_TOKEN")
+}
+
+// vaultError reads the errors Vault reports in the body of a failed request.
+func vaultError(resp *http.Response) error {
+	var body struct {
+		Errors []string `json:"errors"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(raw, &body) == nil && len(body.Errors) > 0 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(body.Errors, "; "))
+	}
+	return errors.New(resp.Status)
+}
+
+// call posts request to the Vault API path and decodes the response into
+// response.
+func (v VaultSSHSigner) call(ctx context.Context, path, token string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.address()+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := vaultHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return vaultError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// login returns the token to sign with, logging in with AppRole when one is
+// configured.
+func (v VaultSSHSigner) login(ctx context.Context) (string, error) {
+	if v.AppRoleID == "" {
+		return v.token(), nil
+	}
+	mount := v.AppRoleMount
+	if mount == "" {
+		mount = defaultVaultAppRoleMount
+	}
+	var response struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err := v.call(ctx, "auth/"+mount+"/login", "", map[string]string{
+		"role_id":   v.AppRoleID,
+		"secret_id": v.AppRoleSecretID,
+	}, &response)
+	if err != nil {
+		return "", fmt.Errorf("log in to Vault with AppRole: %w", err)
+	}
+	if response.Auth.ClientToken == "" {
+		return "", errors.New("log in to Vault with AppRole: no client token in the response")
+	}
+	return response.Auth.ClientToken, nil
+}
+
+// sign has Vault certify publicKey.
+func (v VaultSSHSigner) sign(ctx context.Context, publicKey ssh.PublicKey) (*ssh.Certificate, error) {
+	token, err := v.login(ctx)
+	if err != nil {
+		return nil, err
+	}
+	mount := v.Mount
+	if mount == "" {
+		mount = defaultVaultMount
+	}
+	request := map[string]string{
+		"cert_type":  "user",
+		"public_key": string(ssh.MarshalAuthorizedKey(publicKey)),
+	}
+	if len(v.ValidPrincipals) > 0 {
+		request["valid_principals"] = strings.Join(v.ValidPrincipals, ",")
+	}
+	if v.TTL != "" {
+		request["ttl"] = v.TTL
+	}
+	var response struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}
+	path := mount + "/sign/" + v.Role
+	if err := v.call(ctx, path, token, request, &response); err != nil {
+		return nil, fmt.Errorf("sign SSH key with Vault %s: %w", path, err)
+	}
+	cert, err := parseCertificate(response.Data.SignedKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign SSH key with Vault %s: %w", path, err)
+	}
+	return cert, nil
+}
+
+// vaultCertificate keeps the tunnel's key certified, signing it again when
+// the certificate is about to expire.
+type vaultCertificate struct {
+	settings VaultSSHSigner
+	signer   ssh.Signer
+
+	mu   sync.Mutex
+	cert *ssh.Certificate
+}
+
+func newVaultCertificate(cfg TunnelConfig) (*vaultCertificate, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(cfg.SSHKey))
+	if err != nil {
+		return nil, fmt.Errorf("parse Vault signed key: %w", err)
+	}
+	v := &vaultCertificate{settings: *cfg.VaultSSHSigner, signer: signer}
+	if cfg.SSHCertificate != "" {
+		if v.cert, err = parseCertificate(cfg.SSHCertificate); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// refresh signs the key unless the current certificate outlasts the margin.
+func (v *vaultCertificate) refresh(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.cert != nil && checkCertificateValidity(v.cert, time.Now().Add(vaultResignMargin)) == nil {
+		return nil
+	}
+	cert, err := v.settings.sign(ctx, v.signer.PublicKey())
+	if err != nil {
+		return err
+	}
+	v.cert = cert
+	return nil
+}
+
+// signers presents the current certificate, whichever one that is when the
+// handshake happens.
+func (v *vaultCertificate) signers() ([]ssh.Signer, error) {
+	v.mu.Lock()
+	cert := v.cert
+	v.mu.Unlock()
+	if cert == nil {
+		return nil, errors.New("no certificate signed by Vault yet")
+	}
+	signed, err := certSigner(cert, v.signer)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{signed}, nil
+}
+
+// withVaultCertificate generates the tunnel's key and has Vault sign it, so
+// a denied role fails the apply rather than the child.
+func (cfg TunnelConfig) withVaultCertificate(ctx context.Context) (TunnelConfig, error) {
+	if cfg.VaultSSHSigner == nil {
+		return cfg, nil
+	}
+	key, err := ephemeralKey()
+	if err != nil {
+		return cfg, err
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(key))
+	if err != nil {
+		return cfg, err
+	}
+	cert, err := cfg.VaultSSHSigner.sign(ctx, signer.PublicKey())
+	if err != nil {
+		return cfg, err
+	}
+	// The child signs again with what the provider resolved, not with its
+	// own environment.
+	settings := *cfg.VaultSSHSigner
+	settings.Address = settings.address()
+	if settings.AppRoleID == "" {
+		settings.Token = settings.token()
+	}
+	cfg.VaultSSHSigner = &settings
+	cfg.SSHKey = key
+	cfg.SSHCertificate = string(ssh.MarshalAuthorizedKey(cert))
+	return cfg, nil
+}
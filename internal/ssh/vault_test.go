@@ -0,0 +1,226 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/ssh/sshtest"
+	"golang.org/x/crypto/ssh"
+)
+
+// vaultStandIn signs keys like a Vault SSH secrets engine mounted at "ssh"
+// with a role named "bastion", and logs AppRole "ci" in.
+type vaultStandIn struct {
+	url string
+	ca  ssh.Signer
+
+	mu       sync.Mutex
+	requests []map[string]string
+}
+
+func startVaultStandIn(t *testing.T) *vaultStandIn {
+	t.Helper()
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "")
+	standIn := &vaultStandIn{ca: newSigner(t)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input map[string]string
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&input) != nil {
+			http.Error(w, `{"errors":["unexpected request"]}`, http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			if input["role_id"] != "ci" || input["secret_id"] != "s3cret" {
+				http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+				return
+			}
+			_, _ = io.WriteString(w, `{"auth":{"client_token":"approle-token"}}`)
+		case "/v1/ssh/sign/bastion":
+			if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "approle-token" {
+				http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+				return
+			}
+			standIn.mu.Lock()
+			standIn.requests = append(standIn.requests, input)
+			standIn.mu.Unlock()
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(input["public_key"]))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cert := &ssh.Certificate{
+				Key:             key,
+				KeyId:           "vault-root",
+				CertType:        ssh.UserCert,
+				ValidPrincipals: strings.Split(input["valid_principals"], ","),
+				ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+				ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+			}
+			if err := cert.SignCert(rand.Reader, standIn.ca); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			signed, _ := json.Marshal(map[string]any{"data": map[string]string{
+				"signed_key": string(ssh.MarshalAuthorizedKey(cert)),
+			}})
+			_, _ = w.Write(signed)
+		default:
+			http.Error(w, `{"errors":["no handler for route"]}`, http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	standIn.url = server.URL
+	return standIn
+}
+
+func (s *vaultStandIn) signed() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.requests...)
+}
+
+func vaultConfig(bastion *sshtest.Server, standIn *vaultStandIn) TunnelConfig {
+	return TunnelConfig{
+		SSHHost:     "127.0.0.1",
+		SSHHostKeys: []string{bastion.AuthorizedHostKey()},
+		SSHPort:     bastion.Port,
+		SSHUser:     sshtest.User,
+		VaultSSHSigner: &VaultSSHSigner{
+			Address:         standIn.url,
+			Role:            "bastion",
+			Token:           "root",
+			ValidPrincipals: []string{sshtest.User},
+			TTL:             "5m",
+		},
+	}
+}
+
+func TestRunCommandWithVaultCertificate(t *testing.T) {
+	standIn := startVaultStandIn(t)
+	bastion := sshtest.Start(t, sshtest.Config{UserCA: standIn.ca.PublicKey(), Exec: func(string, io.Reader, io.Writer, io.Writer, <-chan struct{}) uint32 {
+		return 0
+	}})
+
+	for name, signer := range map[string]VaultSSHSigner{
+		"token":   {Role: "bastion", Token: "root"},
+		"approle": {Role: "bastion", AppRoleID: "ci", AppRoleSecretID: "s3cret"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := vaultConfig(bastion, standIn)
+			signer.Address = standIn.url
+			signer.ValidPrincipals = []string{sshtest.User}
+			cfg.VaultSSHSigner = &signer
+			if _, err := RunCommand(context.Background(), CommandConfig{TunnelConfig: cfg, Command: "true"}); err != nil {
+				t.Fatalf("RunCommand() = %v", err)
+			}
+		})
+	}
+	requests := standIn.signed()
+	if len(requests) != 2 {
+		t.Fatalf("signed %d keys, want 2", len(requests))
+	}
+	if requests[0]["cert_type"] != "user" || requests[0]["valid_principals"] != sshtest.User ||
+		!strings.HasPrefix(requests[0]["public_key"], ssh.KeyAlgoED25519+" ") {
+		t.Fatalf("sign request = %v", requests[0])
+	}
+}
+
+// TestVaultCertificateResignedOnReconnect is the child's side: the
+// certificate the provider had signed has expired by the time the connection
+// is re-established.
+func TestVaultCertificateResignedOnReconnect(t *testing.T) {
+	standIn := startVaultStandIn(t)
+	bastion := sshtest.Start(t, sshtest.Config{UserCA: standIn.ca.PublicKey()})
+
+	cfg, err := vaultConfig(bastion, standIn).withVaultCertificate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SSHKey == "" || cfg.SSHCertificate == "" {
+		t.Fatal("the generated key and certificate are not handed on")
+	}
+	hops, err := newBastions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := hops.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() = %v", err)
+	}
+	_ = client.Close()
+	if n := len(standIn.signed()); n != 1 {
+		t.Fatalf("signed %d keys, want the provider's certificate reused", n)
+	}
+
+	hops.vaultCert.mu.Lock()
+	hops.vaultCert.cert.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+	hops.vaultCert.mu.Unlock()
+	client, err = hops.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() after the certificate expired = %v", err)
+	}
+	_ = client.Close()
+	if n := len(standIn.signed()); n != 2 {
+		t.Fatalf("signed %d keys, want the key signed again", n)
+	}
+}
+
+func TestVaultSignFailure(t *testing.T) {
+	standIn := startVaultStandIn(t)
+	bastion := sshtest.Start(t, sshtest.Config{UserCA: standIn.ca.PublicKey()})
+	cfg := vaultConfig(bastion, standIn)
+	cfg.VaultSSHSigner.Token = "revoked"
+
+	_, err := cfg.withVaultCertificate(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "ssh/sign/bastion") || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("withVaultCertificate() = %v, want Vault's error for the role", err)
+	}
+}
+
+func TestTunnelConfigValidateVaultSSHSigner(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "")
+	tests := []struct {
+		name    string
+		cfg     TunnelConfig
+		wantErr string
+	}{
+		{name: "token", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", Token: "t", TTL: "10m"}}},
+		{name: "approle", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", AppRoleID: "id", AppRoleSecretID: "s"}}},
+		{name: "no role", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Token: "t"}}, wantErr: "role"},
+		{name: "no address", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Role: "r", Token: "t"}}, wantErr: "VAULT_ADDR"},
+		{name: "bad address", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "vault:8200", Role: "r", Token: "t"}}, wantErr: "http or https"},
+		{name: "no token", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r"}}, wantErr: "VAULT_TOKEN"},
+		{name: "half approle", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", AppRoleID: "id"}}, wantErr: "together"},
+		{name: "ttl in seconds", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", Token: "t", TTL: "3600"}}},
+		{name: "ttl in days", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", Token: "t", TTL: "1d"}}},
+		{name: "bad ttl", cfg: TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", Token: "t", TTL: "soon"}}, wantErr: "ttl"},
+		{name: "with key", cfg: TunnelConfig{SSHKey: "key", VaultSSHSigner: &VaultSSHSigner{Address: "https://vault:8200", Role: "r", Token: "t"}}, wantErr: "cannot be combined"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Setenv("VAULT_ADDR", "http://127.0.0.1:8200/")
+	t.Setenv("VAULT_TOKEN", "root")
+	if err := (TunnelConfig{VaultSSHSigner: &VaultSSHSigner{Role: "r"}}).Validate(); err != nil {
+		t.Fatalf("Validate() = %v, want VAULT_ADDR and VAULT_TOKEN used", err)
+	}
+}
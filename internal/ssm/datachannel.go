@@ -0,0 +1,643 @@
+package ssm
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// clientVersion is the session-manager-plugin release whose protocol the
+	// data channel speaks, reported to the agent during the handshake.
+	clientVersion        = "1.2.694.0"
+	messageSchemaVersion = "1.0"
+	// The plugin sends stream data in chunks of this size, and the agent
+	// sizes its buffers for them.
+	streamDataPayloadSize = 1024
+	handshakeTimeout      = 30 * time.Second
+	closeGrace            = 2 * time.Second
+	pingInterval          = 5 * time.Minute
+
+	// Retransmission follows the plugin: the oldest unacknowledged message is
+	// sent again once the timeout derived from the round trip time elapses,
+	// and a message the agent has not acknowledged for resendLimit ends the
+	// session.
+	resendInterval               = 100 * time.Millisecond
+	resendLimit                  = 5 * time.Minute
+	defaultRoundTripTime         = 100 * time.Millisecond
+	defaultRetransmissionTimeout = 200 * time.Millisecond
+	maxRetransmissionTimeout     = time.Second
+	clockGranularity             = 10 * time.Millisecond
+
+	// Output that arrives ahead of a gap is held, up to this many messages,
+	// until the gap is filled.
+	incomingBufferCapacity = 10000
+	// Output in sequence waits for the local client, up to this many
+	// messages, without holding up the acknowledgements and handshake that
+	// arrive behind it.
+	outputBufferCapacity = 1024
+)
+
+// Agent versions after which the port plugin behaves differently, from the
+// session-manager-plugin's config.
+const (
+	terminateSessionFlagAgentVersion = "2.3.722.0"
+	multiplexingAgentVersion         = "3.0.196.0"
+	smuxKeepAliveDisabledVersion     = "3.1.1511.0"
+)
+
+var errChannelClosed = errors.New("SSM data channel closed")
+
+// openDataChannelInput is the first frame on the websocket, authenticating
+// it with the session's token.
+type openDataChannelInput struct {
+	MessageSchemaVersion string
+	RequestID            string `json:"RequestId"`
+	TokenValue           string
+	ClientID             string `json:"ClientId"`
+	ClientVersion        string
+}
+
+type sentMessage struct {
+	sequence    int64
+	raw         []byte
+	firstSentAt time.Time
+	sentAt      time.Time
+}
+
+// dataChannel speaks the Session Manager data-channel protocol on the
+// websocket of a started session, as the session-manager-plugin does:
+// https://github.com/aws/session-manager-plugin/blob/mainline/src/datachannel/streaming.go
+// Stream data is numbered and acknowledged in both directions; what the
+// agent sends is delivered in order, and what it does not acknowledge is sent
+// again.
+type dataChannel struct {
+	sessionID string
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	// sendMu keeps messages going out in sequence order, without holding mu
+	// while the websocket write blocks.
+	sendMu sync.Mutex
+
+	mu       sync.Mutex
+	sequence int64
+	unacked  []*sentMessage
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+
+	// Owned by the read loop.
+	expected int64
+	early    map[int64]agentMessage
+
+	agentVersion string
+	handshaken   chan struct{}
+	output       chan []byte
+
+	// Output the read loop has processed, for the delivery loop to hand to
+	// the local client.
+	queueMu sync.Mutex
+	queue   [][]byte
+	queued  chan struct{}
+
+	done    chan struct{}
+	endOnce sync.Once
+	err     error
+}
+
+// openDataChannel connects to the session's stream and completes the
+// handshake with the agent.
+func openDataChannel(ctx context.Context, session SessionParams) (*dataChannel, error) {
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, session.StreamUrl, nil)
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect to the data channel of SSM session %s: %w", session.SessionId, err)
+	}
+	c := &dataChannel{
+		sessionID:  session.SessionId,
+		conn:       conn,
+		rtt:        defaultRoundTripTime,
+		rto:        defaultRetransmissionTimeout,
+		early:      make(map[int64]agentMessage),
+		handshaken: make(chan struct{}),
+		output:     make(chan []byte),
+		queued:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	open, err := json.Marshal(openDataChannelInput{
+		MessageSchemaVersion: messageSchemaVersion,
+		RequestID:            uuid.NewString(),
+		TokenValue:           session.TokenValue,
+		ClientID:             uuid.NewString(),
+		ClientVersion:        clientVersion,
+	})
+	if err == nil {
+		err = c.writeFrame(websocket.TextMessage, open)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("open the data channel of SSM session %s: %w", session.SessionId, err)
+	}
+	go c.readLoop()
+	go c.deliverLoop()
+	go c.resendLoop()
+	go c.pingLoop()
+
+	timer := time.NewTimer(handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.handshaken:
+		return c, nil
+	case <-c.done:
+		return nil, c.err
+	case <-timer.C:
+		err = fmt.Errorf("SSM session %s: no handshake from the agent within %s", c.sessionID, handshakeTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.end(err)
+	return nil, err
+}
+
+// end stops the channel for good, recording why.
+func (c *dataChannel) end(err error) {
+	c.endOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		_ = c.conn.Close()
+	})
+}
+
+// Err is why the channel ended, or nil while it is open or when it was
+// closed on our side.
+func (c *dataChannel) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// Close ends the session, asking the agent to terminate it when it knows
+// how.
+func (c *dataChannel) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	var err error
+	if agentVersionAfter(c.agentVersion, terminateSessionFlagAgentVersion) {
+		if err = c.sendFlag(flagTerminateSession); err == nil {
+			c.awaitAcknowledged(closeGrace)
+		}
+	}
+	_ = c.writeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.end(nil)
+	return err
+}
+
+// awaitAcknowledged waits, up to timeout, for the agent to acknowledge
+// everything sent, since closing the connection first could lose it.
+func (c *dataChannel) awaitAcknowledged(timeout time.Duration) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		c.mu.Lock()
+		pending := len(c.unacked)
+		c.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// multiplexes reports whether the agent carries several connections over the
+// session with smux, rather than one at a time.
+func (c *dataChannel) multiplexes() bool {
+	return agentVersionAfter(c.agentVersion, multiplexingAgentVersion)
+}
+
+func (c *dataChannel) writeFrame(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// send sends payload as the next message of the stream, keeping it until
+// the agent acknowledges it.
+func (c *dataChannel) send(typ payloadType, payload []byte) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.mu.Lock()
+	select {
+	case <-c.done:
+		c.mu.Unlock()
+		return c.closedErr()
+	default:
+	}
+	raw := newAgentMessage(inputStreamMessage, c.sequence, typ, payload).marshal()
+	now := time.Now()
+	c.unacked = append(c.unacked, &sentMessage{sequence: c.sequence, raw: raw, firstSentAt: now, sentAt: now})
+	c.sequence++
+	c.mu.Unlock()
+	// Should the write fail, the message is still sent again until the
+	// channel ends.
+	return c.writeFrame(websocket.BinaryMessage, raw)
+}
+
+// closedErr is what sending on an ended channel fails with.
+func (c *dataChannel) closedErr() error {
+	if c.err != nil {
+		return c.err
+	}
+	return errChannelClosed
+}
+
+func (c *dataChannel) sendFlag(flag portFlag) error {
+	return c.send(payloadFlag, binary.BigEndian.AppendUint32(nil, uint32(flag)))
+}
+
+// write sends p as stream data.
+func (c *dataChannel) write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), streamDataPayloadSize)
+		if err := c.send(payloadOutput, p[:chunk]); err != nil {
+			return written, err
+		}
+		written += chunk
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// acknowledged drops a message the agent has received from the resend queue
+// and updates the retransmission timeout with its round trip.
+func (c *dataChannel) acknowledged(sequence int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, m := range c.unacked {
+		if m.sequence != sequence {
+			continue
+		}
+		sample := time.Since(m.sentAt)
+		c.rttVar = (3*c.rttVar + (c.rtt - sample).Abs()) / 4
+		c.rtt = (7*c.rtt + sample) / 8
+		c.rto = min(c.rtt+max(clockGranularity, 4*c.rttVar), maxRetransmissionTimeout)
+		c.unacked = append(c.unacked[:i], c.unacked[i+1:]...)
+		return
+	}
+}
+
+func (c *dataChannel) resendLoop() {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if err := c.resend(); err != nil {
+			c.end(err)
+			return
+		}
+	}
+}
+
+func (c *dataChannel) resend() error {
+	c.mu.Lock()
+	if len(c.unacked) == 0 {
+		c.mu.Unlock()
+		return nil
+	}
+	m := c.unacked[0]
+	if time.Since(m.sentAt) < c.rto {
+		c.mu.Unlock()
+		return nil
+	}
+	if time.Since(m.firstSentAt) > resendLimit {
+		c.mu.Unlock()
+		return fmt.Errorf("SSM session %s: the agent has not acknowledged message %d for %s", c.sessionID, m.sequence, resendLimit)
+	}
+	m.sentAt = time.Now()
+	raw := m.raw
+	c.mu.Unlock()
+	return c.writeFrame(websocket.BinaryMessage, raw)
+}
+
+func (c *dataChannel) pingLoop() {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		if err := c.writeFrame(websocket.PingMessage, []byte("keepalive")); err != nil {
+			c.end(fmt.Errorf("ping the data channel of SSM session %s: %w", c.sessionID, err))
+			return
+		}
+	}
+}
+
+func (c *dataChannel) readLoop() {
+	for {
+		messageType, raw, err := c.conn.ReadMessage()
+		if err != nil {
+			c.end(fmt.Errorf("read the data channel of SSM session %s: %w", c.sessionID, err))
+			return
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+		if err := c.handle(raw); err != nil {
+			c.end(fmt.Errorf("SSM session %s: %w", c.sessionID, err))
+			return
+		}
+	}
+}
+
+func (c *dataChannel) handle(raw []byte) error {
+	m, err := unmarshalAgentMessage(raw)
+	if err != nil {
+		return err
+	}
+	switch m.MessageType {
+	case acknowledgeMessage:
+		var ack acknowledgeContent
+		if err := json.Unmarshal(m.Payload, &ack); err != nil {
+			return fmt.Errorf("decode acknowledgement: %w", err)
+		}
+		c.acknowledged(ack.SequenceNumber)
+	case outputStreamMessage:
+		return c.receive(m)
+	case channelClosedMessage:
+		var closed channelClosed
+		_ = json.Unmarshal(m.Payload, &closed)
+		if closed.Output == "" {
+			closed.Output = "no reason given"
+		}
+		return fmt.Errorf("closed by Session Manager: %s", closed.Output)
+	case startPublicationMessage, pausePublicationMessage:
+	default:
+		log.Printf("SSM session %s: ignoring %q message", c.sessionID, m.MessageType)
+	}
+	return nil
+}
+
+// receive processes output in sequence, holding messages that arrive ahead of
+// a gap. Every message is acknowledged, including those already processed,
+// whose acknowledgement may have been lost, but output is turned away while
+// the local client is outputBufferCapacity messages behind.
+func (c *dataChannel) receive(m agentMessage) error {
+	switch {
+	case m.SequenceNumber < c.expected:
+		return c.acknowledge(m)
+	case m.SequenceNumber > c.expected:
+		if len(c.early) >= incomingBufferCapacity {
+			// Not acknowledged, so the agent sends it again.
+			return nil
+		}
+		c.early[m.SequenceNumber] = m
+		return c.acknowledge(m)
+	case m.PayloadType == payloadOutput && c.queueFull():
+		// Not acknowledged either: the agent sends it again once the local
+		// client has caught up.
+		return nil
+	}
+	if err := c.process(m); err != nil {
+		return err
+	}
+	if err := c.acknowledge(m); err != nil {
+		return err
+	}
+	// Held messages were acknowledged as they arrived.
+	for c.expected++; ; c.expected++ {
+		held, ok := c.early[c.expected]
+		if !ok {
+			return nil
+		}
+		delete(c.early, c.expected)
+		if err := c.process(held); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *dataChannel) acknowledge(m agentMessage) error {
+	ack, err := acknowledgement(m)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(websocket.BinaryMessage, ack)
+}
+
+func (c *dataChannel) process(m agentMessage) error {
+	switch m.PayloadType {
+	case payloadOutput:
+		c.enqueue(m.Payload)
+	case payloadHandshakeRequest:
+		return c.handshake(m.Payload)
+	case payloadHandshakeComplete:
+		select {
+		case <-c.handshaken:
+		default:
+			close(c.handshaken)
+		}
+	case payloadFlag:
+		if len(m.Payload) == 4 && portFlag(binary.BigEndian.Uint32(m.Payload)) == flagConnectToPortError {
+			log.Printf("SSM session %s: the agent could not connect to the target port, see the SSM Agent logs", c.sessionID)
+		}
+	default:
+		return fmt.Errorf("unsupported payload type %d", m.PayloadType)
+	}
+	return nil
+}
+
+func (c *dataChannel) queueFull() bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+	return len(c.queue) >= outputBufferCapacity
+}
+
+func (c *dataChannel) enqueue(payload []byte) {
+	c.queueMu.Lock()
+	c.queue = append(c.queue, payload)
+	c.queueMu.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// deliverLoop hands queued output to the local client in order, so that a
+// slow client only holds up its own output.
+func (c *dataChannel) deliverLoop() {
+	for {
+		c.queueMu.Lock()
+		if len(c.queue) == 0 {
+			c.queueMu.Unlock()
+			select {
+			case <-c.queued:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		payload := c.queue[0]
+		c.queue[0] = nil
+		c.queue = c.queue[1:]
+		c.queueMu.Unlock()
+		select {
+		case c.output <- payload:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// handshake answers the agent's handshake request. Only port sessions are
+// accepted, and KMS encryption is not supported.
+func (c *dataChannel) handshake(payload []byte) error {
+	var request handshakeRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return fmt.Errorf("decode handshake request: %w", err)
+	}
+	c.agentVersion = request.AgentVersion
+
+	response := handshakeResponse{ClientVersion: clientVersion, ProcessedClientActions: []processedClientAction{}}
+	for _, action := range request.RequestedClientActions {
+		processed := processedClientAction{ActionType: action.ActionType, ActionStatus: actionSuccess}
+		switch action.ActionType {
+		case "SessionType":
+			var sessionType sessionTypeRequest
+			if err := json.Unmarshal(action.ActionParameters, &sessionType); err != nil || sessionType.SessionType != "Port" {
+				processed.ActionStatus = actionFailed
+				processed.Error = fmt.Sprintf("session type %q is not a port session", sessionType.SessionType)
+			}
+		case "KMSEncryption":
+			var kms kmsEncryptionRequest
+			_ = json.Unmarshal(action.ActionParameters, &kms)
+			processed.ActionStatus = actionFailed
+			processed.Error = fmt.Sprintf("the Session Manager preferences of this account and region turn on KMS encryption with key %q, "+
+				"which tunnel_ssm does not support; turn it off in the Session Manager preferences to use the tunnel", kms.KMSKeyID)
+		default:
+			processed.ActionStatus = actionUnsupported
+			processed.Error = fmt.Sprintf("unsupported action %s", action.ActionType)
+		}
+		if processed.Error != "" {
+			response.Errors = append(response.Errors, processed.Error)
+		}
+		response.ProcessedClientActions = append(response.ProcessedClientActions, processed)
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	if err := c.send(payloadHandshakeResponse, body); err != nil {
+		return err
+	}
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("handshake failed: %s", strings.Join(response.Errors, "; "))
+	}
+	return nil
+}
+
+// stream is the channel's stream data as a byte stream: for the whole
+// session with multiplexing, or for one local connection without. Closing
+// it runs onClose once, and leaves the channel open.
+type stream struct {
+	channel *dataChannel
+	pending []byte
+	onClose func() error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *dataChannel) stream(onClose func() error) *stream {
+	return &stream{channel: c, onClose: onClose, closed: make(chan struct{})}
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		select {
+		case s.pending = <-s.channel.output:
+		case <-s.channel.done:
+			return 0, io.EOF
+		case <-s.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	return s.channel.write(p)
+}
+
+func (s *stream) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		if s.onClose != nil {
+			err = s.onClose()
+		}
+	})
+	return err
+}
+
+// agentVersionAfter reports whether version is strictly after reference,
+// comparing dotted numbers. Unparsable versions are not after anything.
+func agentVersionAfter(version, reference string) bool {
+	v, r := strings.Split(version, "."), strings.Split(reference, ".")
+	if len(v) != len(r) {
+		return false
+	}
+	for i := range v {
+		a, err := strconv.Atoi(v[i])
+		if err != nil {
+			return false
+		}
+		b, err := strconv.Atoi(r[i])
+		if err != nil {
+			return false
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return false
+}
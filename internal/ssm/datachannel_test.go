@@ -0,0 +1,160 @@
+package ssm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDataChannelHandshake(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	channel, err := openDataChannel(context.Background(), agent.session())
+	if err != nil {
+		t.Fatalf("openDataChannel() = %v", err)
+	}
+	defer channel.Close()
+
+	waitFor(t, "the handshake acknowledged", func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return len(agent.acked) == 2
+	})
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if len(agent.opens) != 1 || agent.opens[0].MessageSchemaVersion != messageSchemaVersion || agent.opens[0].ClientID == "" {
+		t.Fatalf("opened with %+v", agent.opens)
+	}
+	response := agent.response
+	if response == nil || response.ClientVersion != clientVersion || len(response.ProcessedClientActions) != 1 ||
+		response.ProcessedClientActions[0].ActionStatus != actionSuccess || len(response.Errors) != 0 {
+		t.Fatalf("handshake response = %+v", response)
+	}
+	if !slices.Equal(agent.acked, []int64{0, 1}) {
+		t.Fatalf("acknowledged %v, want the handshake request and completion", agent.acked)
+	}
+	if !channel.multiplexes() {
+		t.Fatalf("agent %s does not multiplex", channel.agentVersion)
+	}
+}
+
+func TestDataChannelRejectsWrongToken(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	session := agent.session()
+	session.TokenValue = "expired"
+	if _, err := openDataChannel(context.Background(), session); err == nil || !strings.Contains(err.Error(), session.SessionId) {
+		t.Fatalf("openDataChannel() = %v, want the session's channel closed", err)
+	}
+}
+
+func TestDataChannelRefusesKMSEncryption(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion, func(a *fakeAgent) { a.kms = true })
+	_, err := openDataChannel(context.Background(), agent.session())
+	if err == nil || !strings.Contains(err.Error(), `Session Manager preferences of this account and region turn on KMS encryption with key "alias/ssm"`) {
+		t.Fatalf("openDataChannel() = %v, want KMS encryption refused", err)
+	}
+	waitFor(t, "the KMS action failed", func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		return agent.response != nil && agent.response.ProcessedClientActions[1].ActionStatus == actionFailed
+	})
+}
+
+// TestDataChannelResendsLostMessages has the agent lose stream data the
+// client sends: it arrives, in order, once sent again.
+func TestDataChannelResendsLostMessages(t *testing.T) {
+	agent := startFakeAgent(t, singleStreamVersion, func(a *fakeAgent) {
+		a.drop = func(sequence int64) bool { return sequence == 2 || sequence == 3 }
+	})
+	addr, _ := startServer(t, agent)
+
+	assertEcho(t, dial(t, addr), bytes.Repeat([]byte("0123456789abcdef"), 512))
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if agent.resent < 2 {
+		t.Fatalf("%d messages sent again, want the 2 lost", agent.resent)
+	}
+}
+
+// TestDataChannelReordersOutput has stream data from the agent arrive out of
+// order: it is delivered in sequence, and all of it acknowledged.
+func TestDataChannelReordersOutput(t *testing.T) {
+	agent := startFakeAgent(t, singleStreamVersion, func(a *fakeAgent) { a.scramble = true })
+	addr, _ := startServer(t, agent)
+
+	payload := bytes.Repeat([]byte("abcdefghijklmnop"), 256)
+	assertEcho(t, dial(t, addr), payload)
+	// The handshake's 2 messages, then 2 per chunk, each acknowledged once.
+	want := 2 + 2*len(payload)/streamDataPayloadSize
+	waitFor(t, "every message acknowledged", func() bool {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		acked := slices.Sorted(slices.Values(agent.acked))
+		return slices.Equal(slices.Compact(acked), acked) && len(acked) == want && acked[want-1] == int64(want-1)
+	})
+}
+
+// TestDataChannelAcknowledgedWhileReaderStalls keeps sending while nothing
+// reads the echo: the agent's acknowledgements still get through, and the
+// output is all there once the reader catches up.
+func TestDataChannelAcknowledgedWhileReaderStalls(t *testing.T) {
+	agent := startFakeAgent(t, singleStreamVersion)
+	channel, err := openDataChannel(context.Background(), agent.session())
+	if err != nil {
+		t.Fatalf("openDataChannel() = %v", err)
+	}
+	defer channel.Close()
+	s := channel.stream(nil)
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 256*streamDataPayloadSize/16)
+	if _, err := s.Write(payload); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	waitFor(t, "the input acknowledged", func() bool {
+		channel.mu.Lock()
+		defer channel.mu.Unlock()
+		return len(channel.unacked) == 0
+	})
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(s, got); err != nil {
+		t.Fatalf("ReadFull() = %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo differs from what was sent")
+	}
+}
+
+func TestDataChannelClosedBySessionManager(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	channel, err := openDataChannel(context.Background(), agent.session())
+	if err != nil {
+		t.Fatalf("openDataChannel() = %v", err)
+	}
+	agent.closeSessions("Session terminated by an administrator")
+	select {
+	case <-channel.done:
+	case <-time.After(testConnectionTimeout):
+		t.Fatal("the channel outlived its session")
+	}
+	if err := channel.Err(); err == nil || !strings.Contains(err.Error(), "terminated by an administrator") {
+		t.Fatalf("Err() = %v, want Session Manager's reason", err)
+	}
+}
+
+func TestDataChannelCloseTerminatesSession(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	channel, err := openDataChannel(context.Background(), agent.session())
+	if err != nil {
+		t.Fatalf("openDataChannel() = %v", err)
+	}
+	if err := channel.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := channel.Err(); err != nil {
+		t.Fatalf("Err() = %v after closing on our side", err)
+	}
+	waitFor(t, "TerminateSession sent", func() bool { return slices.Contains(agent.sentFlags(), flagTerminateSession) })
+}
@@ -0,0 +1,204 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// DescribeTasks takes at most this many tasks per call.
+const maxDescribeTasks = 100
+
+// ECSTask picks the container to connect to with ECS Exec. With a service,
+// the task is picked again whenever a session is started, so the tunnel
+// follows the service as it replaces its tasks.
+type ECSTask struct {
+	Cluster string
+	// Service picks among the service's running tasks; Task names one by ID
+	// or ARN.
+	Service string
+	Task    string
+	// Container may be left empty when the task runs a single container.
+	Container string
+}
+
+func (e ECSTask) Validate() error {
+	if e.Cluster == "" {
+		return errors.New("ecs_cluster must be set with ecs_service or ecs_task")
+	}
+	if (e.Service == "") == (e.Task == "") {
+		return errors.New("exactly one of ecs_service and ecs_task must be set with ecs_cluster")
+	}
+	return nil
+}
+
+func (e ECSTask) String() string {
+	if e.Service != "" {
+		return fmt.Sprintf("ECS service %s in cluster %s", e.Service, e.Cluster)
+	}
+	return fmt.Sprintf("ECS task %s in cluster %s", e.Task, e.Cluster)
+}
+
+// TaskNotRunningError is why no ECS task could take the session: none is
+// running, none has ECS Exec enabled, or the container's ECS Exec agent is not
+// running yet.
+type TaskNotRunningError struct {
+	// Target is the service or task.
+	Target string
+	// Pending lists the tasks found and their status.
+	Pending []string
+	// Failures lists the tasks ECS could not describe and why.
+	Failures []string
+	// Waited is how long the task was waited for.
+	Waited time.Duration
+}
+
+func (e *TaskNotRunningError) Error() string {
+	msg := fmt.Sprintf("%s has no running task", e.Target)
+	if len(e.Pending) > 0 {
+		msg = fmt.Sprintf("%s has no task ready for ECS Exec: %s", e.Target, strings.Join(e.Pending, ", "))
+	}
+	if len(e.Failures) > 0 {
+		msg += fmt.Sprintf("; ECS could not describe %s", strings.Join(e.Failures, ", "))
+	}
+	if e.Waited > 0 {
+		msg += fmt.Sprintf(" after waiting %s", e.Waited)
+	}
+	return msg
+}
+
+func (e *TaskNotRunningError) setWaited(d time.Duration) {
+	e.Waited = d
+}
+
+type ecsAPIClient interface {
+	ecs.ListTasksAPIClient
+	ecs.DescribeTasksAPIClient
+}
+
+// pickTask returns the ECS Exec target, ecs:<cluster>_<task>_<runtime ID>, of
+// the container in the running task with the lowest ID, so that every
+// resolution picks the same task while the service is unchanged.
+func pickTask(ctx context.Context, client ecsAPIClient, e ECSTask) (string, error) {
+	arns := []string{e.Task}
+	if e.Service != "" {
+		arns = nil
+		paginator := ecs.NewListTasksPaginator(client, &ecs.ListTasksInput{
+			Cluster:       aws.String(e.Cluster),
+			ServiceName:   aws.String(e.Service),
+			DesiredStatus: types.DesiredStatusRunning,
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return "", fmt.Errorf("list ECS tasks: %w", err)
+			}
+			arns = append(arns, page.TaskArns...)
+		}
+	}
+
+	var tasks []types.Task
+	var failures []string
+	for chunk := range slices.Chunk(arns, maxDescribeTasks) {
+		out, err := client.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+			Cluster: aws.String(e.Cluster),
+			Tasks:   chunk,
+		})
+		if err != nil {
+			return "", fmt.Errorf("describe ECS tasks: %w", err)
+		}
+		tasks = append(tasks, out.Tasks...)
+		for _, failure := range out.Failures {
+			reason := aws.ToString(failure.Reason)
+			if detail := aws.ToString(failure.Detail); detail != "" {
+				reason += ": " + detail
+			}
+			failures = append(failures, fmt.Sprintf("%s (%s)", aws.ToString(failure.Arn), reason))
+		}
+	}
+	// A task named outright that ECS does not know will not turn up.
+	if e.Task != "" && len(tasks) == 0 && len(failures) > 0 {
+		return "", fmt.Errorf("%s: ECS could not describe %s", e, strings.Join(failures, ", "))
+	}
+	slices.SortFunc(tasks, func(a, b types.Task) int {
+		return strings.Compare(lastSegment(aws.ToString(a.TaskArn)), lastSegment(aws.ToString(b.TaskArn)))
+	})
+
+	var pending []string
+	for _, task := range tasks {
+		id := lastSegment(aws.ToString(task.TaskArn))
+		if status := aws.ToString(task.LastStatus); status != string(types.DesiredStatusRunning) {
+			pending = append(pending, fmt.Sprintf("%s (%s)", id, status))
+			continue
+		}
+		// Tasks started before the service enabled ECS Exec are passed over
+		// for those replacing them.
+		if !task.EnableExecuteCommand {
+			pending = append(pending, fmt.Sprintf("%s (ECS Exec not enabled)", id))
+			continue
+		}
+		container, err := pickContainer(task.Containers, e.Container)
+		if err != nil {
+			return "", fmt.Errorf("ECS task %s: %w", id, err)
+		}
+		if container.RuntimeId == nil || !execAgentRunning(container) {
+			pending = append(pending, fmt.Sprintf("%s (ECS Exec agent not running in %s)", id, aws.ToString(container.Name)))
+			continue
+		}
+		cluster := lastSegment(aws.ToString(task.ClusterArn))
+		if cluster == "" {
+			cluster = lastSegment(e.Cluster)
+		}
+		return fmt.Sprintf("ecs:%s_%s_%s", cluster, id, aws.ToString(container.RuntimeId)), nil
+	}
+	return "", &TaskNotRunningError{Target: e.String(), Pending: pending, Failures: failures}
+}
+
+// pickContainer returns the container named name, or the only container
+// when name is empty.
+func pickContainer(containers []types.Container, name string) (types.Container, error) {
+	var names []string
+	for _, container := range containers {
+		if aws.ToString(container.Name) == name {
+			return container, nil
+		}
+		names = append(names, aws.ToString(container.Name))
+	}
+	if name == "" && len(containers) == 1 {
+		return containers[0], nil
+	}
+	if name == "" {
+		return types.Container{}, fmt.Errorf("ecs_container must be one of %s", strings.Join(names, ", "))
+	}
+	return types.Container{}, fmt.Errorf("no container %s, only %s", name, strings.Join(names, ", "))
+}
+
+func execAgentRunning(container types.Container) bool {
+	for _, agent := range container.ManagedAgents {
+		if agent.Name == types.ManagedAgentNameExecuteCommandAgent {
+			return aws.ToString(agent.LastStatus) == "RUNNING"
+		}
+	}
+	return false
+}
+
+// lastSegment is the name or ID at the end of an ARN, or s itself.
+func lastSegment(s string) string {
+	return s[strings.LastIndex(s, "/")+1:]
+}
+
+// newECSClient is the ECS client for cfg, at its endpoint override when set.
+func newECSClient(awsCfg aws.Config, cfg TunnelConfig) *ecs.Client {
+	return ecs.NewFromConfig(awsCfg, func(o *ecs.Options) {
+		if cfg.ECSEndpointURL != "" {
+			o.BaseEndpoint = aws.String(cfg.ECSEndpointURL)
+		}
+	})
+}
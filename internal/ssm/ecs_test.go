@@ -0,0 +1,188 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// TestResolveInstancePicksECSTask pages through the service's tasks and picks
+// the lowest task ID among those ready for ECS Exec.
+func TestResolveInstancePicksECSTask(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	provisioning := runningTask("0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	provisioning.LastStatus = aws.String("PROVISIONING")
+	noAgent := runningTask("0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	noAgent.Containers[0].ManagedAgents[0].LastStatus = aws.String("PENDING")
+	standIn.setTasks(runningTask("0ddddddddddddddddddddddddddddddd"), provisioning, runningTask("0ccccccccccccccccccccccccccccccc"), noAgent)
+	cfg := TunnelConfig{
+		ECSEndpointURL: standIn.url,
+		ECSTask:        &ECSTask{Cluster: "tunnel", Service: "api", Container: "app"},
+	}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResolveInstance(context.Background(), awsCfg, &cfg); err != nil {
+		t.Fatalf("ResolveInstance() = %v", err)
+	}
+	if want := "ecs:tunnel_0ccccccccccccccccccccccccccccccc_0ccccccccccccccccccccccccccccccc-1234567890"; cfg.SSMInstance != want {
+		t.Fatalf("SSMInstance = %q, want %q", cfg.SSMInstance, want)
+	}
+	want := map[string]string{"cluster": "tunnel", "service": "api", "status": "RUNNING"}
+	if got := standIn.lastListTasks(); !maps.Equal(got, want) {
+		t.Fatalf("ListTasks(%v), want %v", got, want)
+	}
+}
+
+// TestResolveInstanceSkipsTaskWithoutExec has the service enable ECS Exec
+// while its old task, with the lower ID, still runs: the new task is picked.
+func TestResolveInstanceSkipsTaskWithoutExec(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	old := runningTask("0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	old.EnableExecuteCommand = false
+	standIn.setTasks(old, runningTask("0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"))
+	cfg := TunnelConfig{
+		ECSEndpointURL: standIn.url,
+		ECSTask:        &ECSTask{Cluster: "tunnel", Service: "api"},
+	}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResolveInstance(context.Background(), awsCfg, &cfg); err != nil {
+		t.Fatalf("ResolveInstance() = %v", err)
+	}
+	if want := "ecs:tunnel_0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb_0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb-1234567890"; cfg.SSMInstance != want {
+		t.Fatalf("SSMInstance = %q, want %q", cfg.SSMInstance, want)
+	}
+
+	standIn.setTasks(old)
+	err = ResolveInstance(context.Background(), awsCfg, &cfg)
+	var notRunning *TaskNotRunningError
+	if !errors.As(err, &notRunning) || !strings.Contains(err.Error(), "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa (ECS Exec not enabled)") {
+		t.Fatalf("ResolveInstance() = %v, want the task reported without ECS Exec", err)
+	}
+}
+
+func TestResolveInstanceGivesUpOnPendingTask(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	pending := runningTask("0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	pending.LastStatus = aws.String("PENDING")
+	standIn.setTasks(pending)
+	cfg := TunnelConfig{
+		ECSEndpointURL: standIn.url,
+		ECSTask:        &ECSTask{Cluster: "tunnel", Task: "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		WaitForTarget:  1,
+	}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ResolveInstance(context.Background(), awsCfg, &cfg)
+	var notRunning *TaskNotRunningError
+	if !errors.As(err, &notRunning) {
+		t.Fatalf("ResolveInstance() = %v, want the task not running", err)
+	}
+	if want := "task 0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa in cluster tunnel has no task ready for ECS Exec: 0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa (PENDING) after waiting 1s"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("ResolveInstance() = %v, want %q", err, want)
+	}
+}
+
+// TestResolveInstanceReportsMissingTask names the task ECS does not know and
+// why, without waiting for it.
+func TestResolveInstanceReportsMissingTask(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	cfg := TunnelConfig{
+		ECSEndpointURL: standIn.url,
+		ECSTask:        &ECSTask{Cluster: "tunnel", Task: "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		WaitForTarget:  30,
+	}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ResolveInstance(context.Background(), awsCfg, &cfg)
+	var notRunning *TaskNotRunningError
+	if errors.As(err, &notRunning) || err == nil || !strings.Contains(err.Error(), "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa (MISSING)") {
+		t.Fatalf("ResolveInstance() = %v, want the task reported missing", err)
+	}
+}
+
+func TestResolveInstanceRejectsAmbiguousContainer(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	task := runningTask("0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	task.Containers = append(task.Containers, ecstypes.Container{Name: aws.String("sidecar")})
+	standIn.setTasks(task)
+	cfg := TunnelConfig{
+		ECSEndpointURL: standIn.url,
+		ECSTask:        &ECSTask{Cluster: "tunnel", Service: "api"},
+		WaitForTarget:  30,
+	}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ResolveInstance(context.Background(), awsCfg, &cfg)
+	if err == nil || !strings.Contains(err.Error(), "ecs_container must be one of app, sidecar") {
+		t.Fatalf("ResolveInstance() = %v, want the container to be named", err)
+	}
+}
+
+// TestSessionStarterFollowsECSService has the service replace its task while
+// the tunnel runs: the replacement session goes to the new task.
+func TestSessionStarterFollowsECSService(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	standIn := startSSMStandIn(t, agent)
+	standIn.setTasks(runningTask("0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"))
+	start := sessionStarterFor(TunnelConfig{
+		SSMInstance:    "ecs:tunnel_0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa_0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa-1234567890",
+		ECSTask:        &ECSTask{Cluster: "tunnel", Service: "api"},
+		SSMEndpointURL: standIn.url,
+		ECSEndpointURL: standIn.url,
+	})
+
+	if _, err := start(context.Background()); err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	want := []string{"ecs:tunnel_0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb_0bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb-1234567890"}
+	if targets := standIn.startedOn(); !slices.Equal(targets, want) {
+		t.Fatalf("sessions started on %v, want %v", targets, want)
+	}
+}
+
+func TestECSTaskValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    ECSTask
+		wantErr string
+	}{
+		{name: "service", task: ECSTask{Cluster: "tunnel", Service: "api"}},
+		{name: "task", task: ECSTask{Cluster: "tunnel", Task: "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", Container: "app"}},
+		{name: "no cluster", task: ECSTask{Service: "api"}, wantErr: "ecs_cluster must be set"},
+		{name: "no task", task: ECSTask{Cluster: "tunnel"}, wantErr: "exactly one of ecs_service and ecs_task"},
+		{name: "both", task: ECSTask{Cluster: "tunnel", Service: "api", Task: "0aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}, wantErr: "exactly one of ecs_service and ecs_task"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.task.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
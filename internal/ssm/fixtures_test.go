@@ -0,0 +1,625 @@
+package ssm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ecstypes "github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+const (
+	testToken             = "session-token"
+	multiplexingVersion   = "3.2.582.0"
+	singleStreamVersion   = "3.0.161.0"
+	testConnectionTimeout = 5 * time.Second
+)
+
+// fakeAgent stands in for the agent end of a session's data channel, as the
+// Session Manager service relays it. It checks the token, runs the handshake
+// as version, then echoes stream data: on every smux stream for a
+// multiplexing version, or as one stream otherwise.
+type fakeAgent struct {
+	url     string
+	version string
+	// kms has the handshake ask for KMS encryption.
+	kms bool
+	// drop loses the first copy of the input messages it picks, without
+	// acknowledging them, so the client has to send them again.
+	drop func(sequence int64) bool
+	// scramble sends the halves of each echoed chunk in reverse order.
+	scramble bool
+
+	// failStarts has startSession fail.
+	failStarts bool
+
+	mu       sync.Mutex
+	started  int
+	opens    []openDataChannelInput
+	response *handshakeResponse
+	flags    []portFlag
+	resent   int
+	acked    []int64
+	sessions []*agentSession
+}
+
+func startFakeAgent(t *testing.T, version string, configure ...func(*fakeAgent)) *fakeAgent {
+	t.Helper()
+	agent := &fakeAgent{version: version}
+	for _, c := range configure {
+		c(agent)
+	}
+	var upgrader websocket.Upgrader
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		agent.serve(conn)
+	}))
+	t.Cleanup(server.Close)
+	agent.url = "ws" + strings.TrimPrefix(server.URL, "http")
+	return agent
+}
+
+func (a *fakeAgent) session() SessionParams {
+	return SessionParams{SessionId: "session-1", TokenValue: testToken, StreamUrl: a.url}
+}
+
+// startSession stands in for StartSession, for a server that replaces ended
+// sessions.
+func (a *fakeAgent) startSession(context.Context) (SessionParams, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.failStarts {
+		return SessionParams{}, errors.New("AccessDeniedException")
+	}
+	a.started++
+	session := a.session()
+	session.SessionId = fmt.Sprintf("session-%d", a.started+1)
+	return session, nil
+}
+
+func (a *fakeAgent) openCount() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.opens)
+}
+
+func (a *fakeAgent) sentFlags() []portFlag {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.flags)
+}
+
+// closeSessions has Session Manager close every open data channel.
+func (a *fakeAgent) closeSessions(output string) {
+	a.mu.Lock()
+	sessions := slices.Clone(a.sessions)
+	a.mu.Unlock()
+	payload, _ := json.Marshal(channelClosed{Output: output})
+	for _, s := range sessions {
+		_ = s.write(newAgentMessage(channelClosedMessage, 0, 0, payload).marshal())
+	}
+}
+
+// agentSession is one data channel as the agent sees it.
+type agentSession struct {
+	agent   *fakeAgent
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	seqMu    sync.Mutex
+	sequence int64
+
+	expected int64
+	early    map[int64]agentMessage
+	seen     map[int64]bool
+	input    *io.PipeWriter
+}
+
+func (a *fakeAgent) serve(conn *websocket.Conn) {
+	defer conn.Close()
+	messageType, raw, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage {
+		return
+	}
+	var open openDataChannelInput
+	if json.Unmarshal(raw, &open) != nil || open.TokenValue != testToken {
+		return
+	}
+	reader, writer := io.Pipe()
+	defer writer.Close()
+	s := &agentSession{agent: a, conn: conn, early: make(map[int64]agentMessage), seen: make(map[int64]bool), input: writer}
+	a.mu.Lock()
+	a.opens = append(a.opens, open)
+	a.sessions = append(a.sessions, s)
+	a.mu.Unlock()
+
+	actions := []requestedClientAction{{ActionType: "SessionType", ActionParameters: json.RawMessage(
+		`{"SessionType":"Port","Properties":{"portNumber":"5432","type":"LocalPortForwarding"}}`,
+	)}}
+	if a.kms {
+		actions = append(actions, requestedClientAction{ActionType: "KMSEncryption", ActionParameters: json.RawMessage(`{"KMSKeyId":"alias/ssm"}`)})
+	}
+	request, _ := json.Marshal(handshakeRequest{AgentVersion: a.version, RequestedClientActions: actions})
+	if s.send(payloadHandshakeRequest, request) != nil {
+		return
+	}
+
+	go s.echo(reader)
+	for {
+		messageType, raw, err := conn.ReadMessage()
+		if err != nil {
+			_ = reader.Close()
+			return
+		}
+		if messageType != websocket.BinaryMessage || s.handle(raw) != nil {
+			_ = reader.Close()
+			return
+		}
+	}
+}
+
+func (s *agentSession) write(raw []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, raw)
+}
+
+func (s *agentSession) next() int64 {
+	s.seqMu.Lock()
+	defer s.seqMu.Unlock()
+	s.sequence++
+	return s.sequence - 1
+}
+
+func (s *agentSession) send(typ payloadType, payload []byte) error {
+	return s.write(newAgentMessage(outputStreamMessage, s.next(), typ, payload).marshal())
+}
+
+// Write echoes p back as stream data, in chunks the size the client sends.
+func (s *agentSession) Write(p []byte) (int, error) {
+	for chunk := range slices.Chunk(p, streamDataPayloadSize) {
+		if !s.agent.scramble || len(chunk) < 2 {
+			if err := s.send(payloadOutput, chunk); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		half := len(chunk) / 2
+		first := newAgentMessage(outputStreamMessage, s.next(), payloadOutput, chunk[:half])
+		second := newAgentMessage(outputStreamMessage, s.next(), payloadOutput, chunk[half:])
+		if err := s.write(second.marshal()); err != nil {
+			return 0, err
+		}
+		if err := s.write(first.marshal()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (s *agentSession) handle(raw []byte) error {
+	m, err := unmarshalAgentMessage(raw)
+	if err != nil {
+		return err
+	}
+	if m.MessageType == acknowledgeMessage {
+		var ack acknowledgeContent
+		if err := json.Unmarshal(m.Payload, &ack); err != nil {
+			return err
+		}
+		s.agent.mu.Lock()
+		s.agent.acked = append(s.agent.acked, ack.SequenceNumber)
+		s.agent.mu.Unlock()
+		return nil
+	}
+	if m.MessageType != inputStreamMessage {
+		return nil
+	}
+
+	s.agent.mu.Lock()
+	if s.seen[m.SequenceNumber] {
+		s.agent.resent++
+	}
+	first := !s.seen[m.SequenceNumber]
+	s.seen[m.SequenceNumber] = true
+	s.agent.mu.Unlock()
+	if first && s.agent.drop != nil && s.agent.drop(m.SequenceNumber) {
+		return nil
+	}
+	if m.SequenceNumber > s.expected {
+		s.early[m.SequenceNumber] = m
+	}
+	for held, ok := m, m.SequenceNumber == s.expected; ok; held, ok = s.early[s.expected] {
+		delete(s.early, s.expected)
+		s.expected++
+		if err := s.process(held); err != nil {
+			return err
+		}
+	}
+	ack, err := acknowledgement(m)
+	if err != nil {
+		return err
+	}
+	return s.write(ack)
+}
+
+func (s *agentSession) process(m agentMessage) error {
+	switch m.PayloadType {
+	case payloadHandshakeResponse:
+		var response handshakeResponse
+		if err := json.Unmarshal(m.Payload, &response); err != nil {
+			return err
+		}
+		s.agent.mu.Lock()
+		s.agent.response = &response
+		s.agent.mu.Unlock()
+		return s.send(payloadHandshakeComplete, []byte(`{"HandshakeTimeToComplete":1000000,"CustomerMessage":""}`))
+	case payloadFlag:
+		s.agent.mu.Lock()
+		s.agent.flags = append(s.agent.flags, portFlag(binary.BigEndian.Uint32(m.Payload)))
+		s.agent.mu.Unlock()
+	case payloadOutput:
+		_, err := s.input.Write(m.Payload)
+		return err
+	}
+	return nil
+}
+
+// echo sends back the stream data the client sends, over smux when the
+// agent multiplexes.
+func (s *agentSession) echo(input io.ReadCloser) {
+	if !agentVersionAfter(s.agent.version, multiplexingAgentVersion) {
+		_, _ = io.Copy(s, input)
+		return
+	}
+	mux, err := smux.Server(readWriteCloser{Reader: input, Writer: s, Closer: input}, smux.DefaultConfig())
+	if err != nil {
+		return
+	}
+	defer mux.Close()
+	for {
+		stream, err := mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			_, _ = io.Copy(stream, stream)
+		}()
+	}
+}
+
+type readWriteCloser struct {
+	io.Reader
+	io.Writer
+	io.Closer
+}
+
+// startServer opens a data channel to agent and serves it on a local port,
+// replacing the session through the agent once it ends.
+func startServer(t *testing.T, agent *fakeAgent) (addr string, channel *dataChannel) {
+	t.Helper()
+	channel, err := openDataChannel(t.Context(), agent.session())
+	if err != nil {
+		t.Fatalf("openDataChannel() = %v", err)
+	}
+	server, err := newServer(channel, agent.startSession)
+	if err != nil {
+		_ = channel.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.close() })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connServer := libs.NewConnServer(listener, server.handle)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = connServer.Serve(t.Context())
+	}()
+	t.Cleanup(func() {
+		connServer.Close()
+		<-done
+	})
+	return listener.Addr().String(), channel
+}
+
+// assertEcho writes payload on conn and expects it back.
+func assertEcho(t *testing.T, conn net.Conn, payload []byte) {
+	t.Helper()
+	_ = conn.SetDeadline(time.Now().Add(testConnectionTimeout))
+	go func() { _, _ = conn.Write(payload) }()
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("the echo differs from what was sent")
+	}
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, testConnectionTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testConnectionTimeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	captured := &logBuffer{}
+	previous := log.Writer()
+	log.SetOutput(captured)
+	t.Cleanup(func() { log.SetOutput(previous) })
+	return captured
+}
+
+// ssmStandIn answers the SSM, ECS and STS API calls the tunnel makes, through
+// the endpoint overrides, with the managed nodes and tasks it is given:
+// DescribeInstanceInformation one node per page, ListTasks one task per page,
+// StartSession on agent's data channel, and AssumeRole with the access key
+// AKIDROLE.
+type ssmStandIn struct {
+	url   string
+	agent *fakeAgent
+
+	mu    sync.Mutex
+	nodes []ssmtypes.InstanceInformation
+	// fleets replace nodes, one per DescribeInstanceInformation call, as
+	// nodes register and come online.
+	fleets [][]ssmtypes.InstanceInformation
+	// notConnected is how many StartSession calls fail with
+	// TargetNotConnected.
+	notConnected int
+	filters      []ssmtypes.InstanceInformationStringFilter
+	targets      []string
+	sessions     int
+	// tasks are the ECS tasks, all of the service listTasks records.
+	tasks     []ecstypes.Task
+	listTasks map[string]string
+	// assumed lists the AssumeRole calls, as the role and the access key
+	// that signed the call.
+	assumed []string
+}
+
+func startSSMStandIn(t *testing.T, agent *fakeAgent, nodes ...ssmtypes.InstanceInformation) *ssmStandIn {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(home, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(home, "credentials"))
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	standIn := &ssmStandIn{agent: agent, nodes: nodes}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		standIn.mu.Lock()
+		defer standIn.mu.Unlock()
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSSM.DescribeInstanceInformation":
+			var input struct {
+				Filters   []ssmtypes.InstanceInformationStringFilter
+				NextToken string
+			}
+			if json.NewDecoder(r.Body).Decode(&input) != nil {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			standIn.filters = input.Filters
+			if input.NextToken == "" && len(standIn.fleets) > 0 {
+				standIn.nodes, standIn.fleets = standIn.fleets[0], standIn.fleets[1:]
+			}
+			page, _ := strconv.Atoi(input.NextToken)
+			output := map[string]any{"InstanceInformationList": standIn.nodes[page:min(page+1, len(standIn.nodes))]}
+			if page+1 < len(standIn.nodes) {
+				output["NextToken"] = strconv.Itoa(page + 1)
+			}
+			_ = json.NewEncoder(w).Encode(output)
+		case "AmazonSSM.StartSession":
+			var input struct{ Target string }
+			if json.NewDecoder(r.Body).Decode(&input) != nil {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			standIn.targets = append(standIn.targets, input.Target)
+			if standIn.notConnected > 0 {
+				standIn.notConnected--
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, `{"__type":"TargetNotConnected","Message":"i-0aaaaaaaaaaaaaaaa is not connected."}`)
+				return
+			}
+			standIn.sessions++
+			session := standIn.agent.session()
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"SessionId":  fmt.Sprintf("started-%d", standIn.sessions),
+				"TokenValue": session.TokenValue,
+				"StreamUrl":  session.StreamUrl,
+			})
+		case "AmazonEC2ContainerServiceV20141113.ListTasks":
+			var input struct{ Cluster, ServiceName, DesiredStatus, NextToken string }
+			if json.NewDecoder(r.Body).Decode(&input) != nil {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			standIn.listTasks = map[string]string{"cluster": input.Cluster, "service": input.ServiceName, "status": input.DesiredStatus}
+			page, _ := strconv.Atoi(input.NextToken)
+			var arns []string
+			for _, task := range standIn.tasks[page:min(page+1, len(standIn.tasks))] {
+				arns = append(arns, aws.ToString(task.TaskArn))
+			}
+			output := map[string]any{"taskArns": arns}
+			if page+1 < len(standIn.tasks) {
+				output["nextToken"] = strconv.Itoa(page + 1)
+			}
+			_ = json.NewEncoder(w).Encode(output)
+		case "AmazonEC2ContainerServiceV20141113.DescribeTasks":
+			var input struct{ Tasks []string }
+			if json.NewDecoder(r.Body).Decode(&input) != nil {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			var tasks, failures []any
+			for _, requested := range input.Tasks {
+				i := slices.IndexFunc(standIn.tasks, func(task ecstypes.Task) bool {
+					arn := aws.ToString(task.TaskArn)
+					return requested == arn || requested == lastSegment(arn)
+				})
+				if i < 0 {
+					failures = append(failures, map[string]string{"arn": requested, "reason": "MISSING"})
+					continue
+				}
+				tasks = append(tasks, encodeTask(standIn.tasks[i]))
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"tasks": tasks, "failures": failures})
+		case "":
+			if r.ParseForm() != nil || r.PostForm.Get("Action") != "AssumeRole" {
+				http.Error(w, "unexpected request", http.StatusBadRequest)
+				return
+			}
+			_, signedBy, _ := strings.Cut(r.Header.Get("Authorization"), "Credential=")
+			signedBy, _, _ = strings.Cut(signedBy, "/")
+			standIn.assumed = append(standIn.assumed, r.PostForm.Get("RoleArn")+" by "+signedBy)
+			w.Header().Set("Content-Type", "text/xml")
+			_, _ = io.WriteString(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult>`+
+				`<Credentials><AccessKeyId>AKIDROLE</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>`+
+				`<SessionToken>token</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration></Credentials>`+
+				`<AssumedRoleUser><Arn>arn:aws:sts::123456789012:assumed-role/tunnel/session</Arn><AssumedRoleId>AROATEST:session</AssumedRoleId></AssumedRoleUser>`+
+				`</AssumeRoleResult></AssumeRoleResponse>`)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	standIn.url = server.URL
+	return standIn
+}
+
+func onlineNode(id string) ssmtypes.InstanceInformation {
+	return ssmtypes.InstanceInformation{InstanceId: aws.String(id), PingStatus: ssmtypes.PingStatusOnline}
+}
+
+// runningTask is a task in cluster tunnel whose app container has the ECS
+// Exec agent running.
+func runningTask(id string) ecstypes.Task {
+	return ecstypes.Task{
+		TaskArn:              aws.String("arn:aws:ecs:eu-west-1:123456789012:task/tunnel/" + id),
+		ClusterArn:           aws.String("arn:aws:ecs:eu-west-1:123456789012:cluster/tunnel"),
+		LastStatus:           aws.String("RUNNING"),
+		EnableExecuteCommand: true,
+		Containers: []ecstypes.Container{{
+			Name:      aws.String("app"),
+			RuntimeId: aws.String(id + "-1234567890"),
+			ManagedAgents: []ecstypes.ManagedAgent{{
+				Name:       ecstypes.ManagedAgentNameExecuteCommandAgent,
+				LastStatus: aws.String("RUNNING"),
+			}},
+		}},
+	}
+}
+
+// encodeTask is task as ECS sends it, with camel-case keys.
+func encodeTask(task ecstypes.Task) map[string]any {
+	var containers []any
+	for _, container := range task.Containers {
+		var agents []any
+		for _, agent := range container.ManagedAgents {
+			agents = append(agents, map[string]any{"name": agent.Name, "lastStatus": agent.LastStatus})
+		}
+		containers = append(containers, map[string]any{
+			"name":          container.Name,
+			"runtimeId":     container.RuntimeId,
+			"managedAgents": agents,
+		})
+	}
+	return map[string]any{
+		"taskArn":              task.TaskArn,
+		"clusterArn":           task.ClusterArn,
+		"lastStatus":           task.LastStatus,
+		"enableExecuteCommand": task.EnableExecuteCommand,
+		"containers":           containers,
+	}
+}
+
+func (s *ssmStandIn) setTasks(tasks ...ecstypes.Task) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks = tasks
+}
+
+func (s *ssmStandIn) lastListTasks() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.listTasks)
+}
+
+func (s *ssmStandIn) lastFilters() []ssmtypes.InstanceInformationStringFilter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.filters)
+}
+
+func (s *ssmStandIn) startedOn() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.targets)
+}
@@ -0,0 +1,221 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// Backoff between checks on a managed node that is not online yet.
+const (
+	targetPollInterval    = 500 * time.Millisecond
+	maxTargetPollInterval = 10 * time.Second
+)
+
+// InstanceFilters pick the managed node to connect to when its ID changes,
+// as it does for instances an Auto Scaling group replaces.
+type InstanceFilters struct {
+	// Tags the node must carry, by key.
+	Tags map[string]string
+	// Name is the node's Name tag.
+	Name string
+	// Platform is Linux, Windows or MacOS.
+	Platform string
+}
+
+func (f InstanceFilters) Validate() error {
+	if len(f.Tags) == 0 && f.Name == "" && f.Platform == "" {
+		return errors.New("ssm_instance_filters must set at least one of tags, name and platform")
+	}
+	if _, ok := f.Tags["Name"]; ok && f.Name != "" {
+		return errors.New("ssm_instance_filters.name cannot be combined with a Name tag in ssm_instance_filters.tags")
+	}
+	if f.Platform != "" && !slices.Contains(types.PlatformType("").Values(), types.PlatformType(f.Platform)) {
+		return fmt.Errorf("ssm_instance_filters.platform %q is not one of %v", f.Platform, types.PlatformType("").Values())
+	}
+	return nil
+}
+
+// describeFilters asks for the nodes the filters match, online or not, so
+// that a node that is offline can be told from one that never registered.
+func (f InstanceFilters) describeFilters() []types.InstanceInformationStringFilter {
+	var filters []types.InstanceInformationStringFilter
+	tags := maps.Clone(f.Tags)
+	if f.Name != "" {
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags["Name"] = f.Name
+	}
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		filters = append(filters, types.InstanceInformationStringFilter{
+			Key:    aws.String("tag:" + key),
+			Values: []string{tags[key]},
+		})
+	}
+	if f.Platform != "" {
+		filters = append(filters, types.InstanceInformationStringFilter{
+			Key:    aws.String(string(types.InstanceInformationFilterKeyPlatformTypes)),
+			Values: []string{f.Platform},
+		})
+	}
+	return filters
+}
+
+// TargetNotOnlineError is why no managed node could take the session: none
+// is registered with Systems Manager, or those that are are not online.
+type TargetNotOnlineError struct {
+	// Target is the instance ID, or the filters.
+	Target string
+	// Offline lists the registered nodes and their ping status.
+	Offline []string
+	// Waited is how long the node was waited for.
+	Waited time.Duration
+}
+
+// Registered reports whether the target registered but is not online.
+func (e *TargetNotOnlineError) Registered() bool {
+	return len(e.Offline) > 0
+}
+
+func (e *TargetNotOnlineError) Error() string {
+	msg := fmt.Sprintf("SSM managed node %s is not registered with Systems Manager", e.Target)
+	if e.Registered() {
+		msg = fmt.Sprintf("SSM managed node %s is registered but not online: %s", e.Target, strings.Join(e.Offline, ", "))
+	}
+	if e.Waited > 0 {
+		msg += fmt.Sprintf(" after waiting %s", e.Waited)
+	}
+	return msg
+}
+
+func (e *TargetNotOnlineError) setWaited(d time.Duration) {
+	e.Waited = d
+}
+
+// notReadyError is a target that may yet come up while it is waited for.
+type notReadyError interface {
+	error
+	setWaited(time.Duration)
+}
+
+// ResolveInstance sets cfg.SSMInstance to the node cfg.SSMInstanceFilters
+// pick, or to the ECS Exec target of cfg.ECSTask, when they are set, waiting
+// up to cfg.WaitForTarget seconds for the target to be online.
+func ResolveInstance(ctx context.Context, awsCfg aws.Config, cfg *TunnelConfig) error {
+	if cfg.SSMInstanceFilters == nil && cfg.ECSTask == nil && cfg.WaitForTarget <= 0 {
+		return nil
+	}
+	pick := func(ctx context.Context) (string, error) {
+		return pickInstance(ctx, newClient(awsCfg, *cfg), *cfg)
+	}
+	if cfg.ECSTask != nil {
+		pick = func(ctx context.Context) (string, error) {
+			return pickTask(ctx, newECSClient(awsCfg, *cfg), *cfg.ECSTask)
+		}
+	}
+	wait := time.Duration(cfg.WaitForTarget) * time.Second
+	deadline := time.Now().Add(wait)
+	interval := targetPollInterval
+	for {
+		id, err := pick(ctx)
+		if err == nil {
+			cfg.SSMInstance = id
+			return nil
+		}
+		var notReady notReadyError
+		if !errors.As(err, &notReady) {
+			return err
+		}
+		if time.Now().Add(interval).After(deadline) {
+			notReady.setWaited(wait)
+			return notReady
+		}
+		if err := sleepContext(ctx, interval); err != nil {
+			return err
+		}
+		interval = min(2*interval, maxTargetPollInterval)
+	}
+}
+
+// pickInstance returns the lowest ID among the online managed nodes that are
+// cfg.SSMInstance or match cfg.SSMInstanceFilters, so that every resolution
+// picks the same node while the fleet is unchanged.
+func pickInstance(ctx context.Context, client ssm.DescribeInstanceInformationAPIClient, cfg TunnelConfig) (string, error) {
+	input := &ssm.DescribeInstanceInformationInput{}
+	target := cfg.SSMInstance
+	if cfg.SSMInstanceFilters != nil {
+		input.Filters = cfg.SSMInstanceFilters.describeFilters()
+		target = "matching " + cfg.SSMInstanceFilters.String()
+	} else {
+		input.Filters = []types.InstanceInformationStringFilter{{
+			Key:    aws.String(string(types.InstanceInformationFilterKeyInstanceIds)),
+			Values: []string{cfg.SSMInstance},
+		}}
+	}
+
+	var online, offline []string
+	paginator := ssm.NewDescribeInstanceInformationPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return "", fmt.Errorf("describe SSM managed nodes: %w", err)
+		}
+		for _, node := range page.InstanceInformationList {
+			id := aws.ToString(node.InstanceId)
+			switch {
+			case id == "":
+			case node.PingStatus == types.PingStatusOnline:
+				online = append(online, id)
+			default:
+				offline = append(offline, fmt.Sprintf("%s (%s)", id, node.PingStatus))
+			}
+		}
+	}
+	if len(online) == 0 {
+		return "", &TargetNotOnlineError{Target: target, Offline: offline}
+	}
+	return slices.Min(online), nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f InstanceFilters) String() string {
+	var criteria []string
+	for _, key := range slices.Sorted(maps.Keys(f.Tags)) {
+		criteria = append(criteria, fmt.Sprintf("tag %s=%s", key, f.Tags[key]))
+	}
+	if f.Name != "" {
+		criteria = append(criteria, "name "+f.Name)
+	}
+	if f.Platform != "" {
+		criteria = append(criteria, "platform "+f.Platform)
+	}
+	return strings.Join(criteria, ", ")
+}
+
+// newClient is the SSM client for cfg, at its endpoint override when set.
+func newClient(awsCfg aws.Config, cfg TunnelConfig) *ssm.Client {
+	return ssm.NewFromConfig(awsCfg, func(o *ssm.Options) {
+		if cfg.SSMEndpointURL != "" {
+			o.BaseEndpoint = aws.String(cfg.SSMEndpointURL)
+		}
+	})
+}
@@ -0,0 +1,179 @@
+package ssm
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// TestResolveInstancePicksLowestOnlineID pages through the managed nodes the
+// filters match and picks the lowest online ID, through the endpoint override.
+func TestResolveInstancePicksLowestOnlineID(t *testing.T) {
+	offline := onlineNode("i-0000000000000000a")
+	offline.PingStatus = ssmtypes.PingStatusConnectionLost
+	standIn := startSSMStandIn(t, nil, onlineNode("i-0bbbbbbbbbbbbbbbb"), offline, onlineNode("i-0aaaaaaaaaaaaaaaa"))
+	cfg := TunnelConfig{
+		SSMEndpointURL:     standIn.url,
+		SSMInstanceFilters: &InstanceFilters{Tags: map[string]string{"Role": "bastion"}, Name: "bastion-a", Platform: "Linux"},
+	}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResolveInstance(context.Background(), awsCfg, &cfg); err != nil {
+		t.Fatalf("ResolveInstance() = %v", err)
+	}
+	if cfg.SSMInstance != "i-0aaaaaaaaaaaaaaaa" {
+		t.Fatalf("SSMInstance = %q, want the lowest online ID", cfg.SSMInstance)
+	}
+	var got []string
+	for _, f := range standIn.lastFilters() {
+		got = append(got, aws.ToString(f.Key)+"="+strings.Join(f.Values, ","))
+	}
+	want := []string{"tag:Name=bastion-a", "tag:Role=bastion", "PlatformTypes=Linux"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("filters = %v, want %v", got, want)
+	}
+}
+
+func TestResolveInstanceWithoutMatch(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	cfg := TunnelConfig{SSMEndpointURL: standIn.url, SSMInstanceFilters: &InstanceFilters{Name: "bastion"}}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ResolveInstance(context.Background(), awsCfg, &cfg)
+	var notOnline *TargetNotOnlineError
+	if !errors.As(err, &notOnline) || notOnline.Registered() || !strings.Contains(err.Error(), "matching name bastion is not registered") {
+		t.Fatalf("ResolveInstance() = %v, want no match", err)
+	}
+}
+
+// TestResolveInstanceWaitsForTarget has the node register while the tunnel
+// waits for it.
+func TestResolveInstanceWaitsForTarget(t *testing.T) {
+	standIn := startSSMStandIn(t, nil)
+	standIn.mu.Lock()
+	standIn.fleets = [][]ssmtypes.InstanceInformation{nil, {onlineNode("i-0aaaaaaaaaaaaaaaa")}}
+	standIn.mu.Unlock()
+	cfg := TunnelConfig{SSMEndpointURL: standIn.url, SSMInstance: "i-0aaaaaaaaaaaaaaaa", WaitForTarget: 30}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResolveInstance(context.Background(), awsCfg, &cfg); err != nil {
+		t.Fatalf("ResolveInstance() = %v", err)
+	}
+	got := standIn.lastFilters()
+	if len(got) != 1 || aws.ToString(got[0].Key) != "InstanceIds" || !slices.Equal(got[0].Values, []string{"i-0aaaaaaaaaaaaaaaa"}) {
+		t.Fatalf("filters = %v, want the instance ID", got)
+	}
+}
+
+func TestResolveInstanceGivesUpOnOfflineTarget(t *testing.T) {
+	offline := onlineNode("i-0aaaaaaaaaaaaaaaa")
+	offline.PingStatus = ssmtypes.PingStatusConnectionLost
+	standIn := startSSMStandIn(t, nil, offline)
+	cfg := TunnelConfig{SSMEndpointURL: standIn.url, SSMInstance: "i-0aaaaaaaaaaaaaaaa", WaitForTarget: 1}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ResolveInstance(context.Background(), awsCfg, &cfg)
+	var notOnline *TargetNotOnlineError
+	if !errors.As(err, &notOnline) || !notOnline.Registered() {
+		t.Fatalf("ResolveInstance() = %v, want the node offline", err)
+	}
+	if want := "i-0aaaaaaaaaaaaaaaa is registered but not online: i-0aaaaaaaaaaaaaaaa (ConnectionLost) after waiting 1s"; !strings.Contains(err.Error(), want) {
+		t.Fatalf("ResolveInstance() = %v, want %q", err, want)
+	}
+}
+
+func TestStartTunnelSessionRetriesTargetNotConnected(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	standIn := startSSMStandIn(t, agent)
+	standIn.mu.Lock()
+	standIn.notConnected = 1
+	standIn.mu.Unlock()
+	cfg := TunnelConfig{SSMEndpointURL: standIn.url, SSMInstance: "i-0aaaaaaaaaaaaaaaa", WaitForTarget: 30}
+	awsCfg, err := GetNewSDKConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := startTunnelSession(context.Background(), newClient(awsCfg, cfg), cfg)
+	if err != nil {
+		t.Fatalf("startTunnelSession() = %v", err)
+	}
+	if session.SessionId != "started-1" || len(standIn.startedOn()) != 2 {
+		t.Fatalf("startTunnelSession() = %+v after %d calls, want a retry", session, len(standIn.startedOn()))
+	}
+
+	standIn.mu.Lock()
+	standIn.notConnected = 1
+	standIn.mu.Unlock()
+	cfg.WaitForTarget = 0
+	var notConnected *ssmtypes.TargetNotConnected
+	if _, err := startTunnelSession(context.Background(), newClient(awsCfg, cfg), cfg); !errors.As(err, &notConnected) {
+		t.Fatalf("startTunnelSession() = %v without waiting, want TargetNotConnected", err)
+	}
+}
+
+// TestSessionStarterPicksReplacedNode has the node replaced while the tunnel
+// runs: the replacement session goes to the node the filters now pick.
+func TestSessionStarterPicksReplacedNode(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	standIn := startSSMStandIn(t, agent, onlineNode("i-0bbbbbbbbbbbbbbbb"))
+	start := sessionStarterFor(TunnelConfig{
+		SSMInstance:        "i-0aaaaaaaaaaaaaaaa",
+		SSMInstanceFilters: &InstanceFilters{Tags: map[string]string{"Role": "bastion"}},
+		SSMEndpointURL:     standIn.url,
+	})
+
+	session, err := start(context.Background())
+	if err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	if session.SessionId != "started-1" || session.StreamUrl != agent.url {
+		t.Fatalf("start() = %+v, want the stand-in's session", session)
+	}
+	if targets := standIn.startedOn(); !slices.Equal(targets, []string{"i-0bbbbbbbbbbbbbbbb"}) {
+		t.Fatalf("sessions started on %v, want the replacement node", targets)
+	}
+}
+
+func TestInstanceFiltersValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filters InstanceFilters
+		wantErr string
+	}{
+		{name: "tags", filters: InstanceFilters{Tags: map[string]string{"Role": "bastion"}}},
+		{name: "name and platform", filters: InstanceFilters{Name: "bastion", Platform: "Windows"}},
+		{name: "empty", wantErr: "at least one"},
+		{name: "name twice", filters: InstanceFilters{Tags: map[string]string{"Name": "a"}, Name: "b"}, wantErr: "Name tag"},
+		{name: "bad platform", filters: InstanceFilters{Platform: "linux"}, wantErr: "ssm_instance_filters.platform"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filters.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package ssm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message types of the data channel, as the SSM agent names them.
+const (
+	inputStreamMessage      = "input_stream_data"
+	outputStreamMessage     = "output_stream_data"
+	acknowledgeMessage      = "acknowledge"
+	channelClosedMessage    = "channel_closed"
+	startPublicationMessage = "start_publication"
+	pausePublicationMessage = "pause_publication"
+)
+
+type payloadType uint32
+
+const (
+	payloadOutput            payloadType = 1
+	payloadHandshakeRequest  payloadType = 5
+	payloadHandshakeResponse payloadType = 6
+	payloadHandshakeComplete payloadType = 7
+	payloadFlag              payloadType = 10
+)
+
+// portFlag is the payload of a payloadFlag message.
+type portFlag uint32
+
+const (
+	flagDisconnectToPort   portFlag = 1
+	flagTerminateSession   portFlag = 2
+	flagConnectToPortError portFlag = 3
+)
+
+// The header of an agent message, all big-endian: header length (4), message
+// type (32, space padded), schema version (4), created date in milliseconds
+// (8), sequence number (8), flags (8), message ID (16, low half first),
+// SHA-256 of the payload (32) and payload type (4). The payload length (4)
+// and the payload follow. The layout is the session-manager-plugin's, last
+// checked at
+// https://github.com/aws/session-manager-plugin/blob/mainline/src/message/clientmessage.go
+const (
+	messageTypeLength   = 32
+	schemaVersionOffset = 4 + messageTypeLength
+	createdDateOffset   = schemaVersionOffset + 4
+	sequenceOffset      = createdDateOffset + 8
+	flagsOffset         = sequenceOffset + 8
+	messageIDOffset     = flagsOffset + 8
+	digestOffset        = messageIDOffset + 16
+	payloadTypeOffset   = digestOffset + sha256.Size
+	headerLength        = payloadTypeOffset + 4
+)
+
+// agentMessage is the frame both ends of the data channel exchange.
+type agentMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    uint64
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      uuid.UUID
+	PayloadType    payloadType
+	Payload        []byte
+}
+
+func newAgentMessage(messageType string, sequence int64, typ payloadType, payload []byte) agentMessage {
+	return agentMessage{
+		MessageType:    messageType,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixMilli()),
+		SequenceNumber: sequence,
+		MessageID:      uuid.New(),
+		PayloadType:    typ,
+		Payload:        payload,
+	}
+}
+
+func (m agentMessage) marshal() []byte {
+	b := make([]byte, headerLength+4+len(m.Payload))
+	binary.BigEndian.PutUint32(b, headerLength)
+	copy(b[4:schemaVersionOffset], bytes.Repeat([]byte{' '}, messageTypeLength))
+	copy(b[4:schemaVersionOffset], m.MessageType)
+	binary.BigEndian.PutUint32(b[schemaVersionOffset:], m.SchemaVersion)
+	binary.BigEndian.PutUint64(b[createdDateOffset:], m.CreatedDate)
+	binary.BigEndian.PutUint64(b[sequenceOffset:], uint64(m.SequenceNumber))
+	binary.BigEndian.PutUint64(b[flagsOffset:], m.Flags)
+	copy(b[messageIDOffset:], m.MessageID[8:])
+	copy(b[messageIDOffset+8:], m.MessageID[:8])
+	digest := sha256.Sum256(m.Payload)
+	copy(b[digestOffset:], digest[:])
+	binary.BigEndian.PutUint32(b[payloadTypeOffset:], uint32(m.PayloadType))
+	binary.BigEndian.PutUint32(b[headerLength:], uint32(len(m.Payload)))
+	copy(b[headerLength+4:], m.Payload)
+	return b
+}
+
+func unmarshalAgentMessage(b []byte) (agentMessage, error) {
+	if len(b) < headerLength+4 {
+		return agentMessage{}, fmt.Errorf("agent message of %d bytes is shorter than its header", len(b))
+	}
+	hl := int(binary.BigEndian.Uint32(b))
+	if hl < headerLength || len(b) < hl+4 {
+		return agentMessage{}, fmt.Errorf("agent message header length %d does not fit %d bytes", hl, len(b))
+	}
+	m := agentMessage{
+		MessageType:    string(bytes.TrimSpace(bytes.Trim(b[4:schemaVersionOffset], "\x00"))),
+		SchemaVersion:  binary.BigEndian.Uint32(b[schemaVersionOffset:]),
+		CreatedDate:    binary.BigEndian.Uint64(b[createdDateOffset:]),
+		SequenceNumber: int64(binary.BigEndian.Uint64(b[sequenceOffset:])),
+		Flags:          binary.BigEndian.Uint64(b[flagsOffset:]),
+		PayloadType:    payloadType(binary.BigEndian.Uint32(b[payloadTypeOffset:])),
+	}
+	copy(m.MessageID[8:], b[messageIDOffset:])
+	copy(m.MessageID[:8], b[messageIDOffset+8:])
+	length := int(binary.BigEndian.Uint32(b[hl:]))
+	if len(b)-hl-4 < length {
+		return agentMessage{}, fmt.Errorf("agent message payload of %d bytes is shorter than the %d announced", len(b)-hl-4, length)
+	}
+	m.Payload = b[hl+4 : hl+4+length]
+
+	// Publication messages carry no digest.
+	if m.MessageType == startPublicationMessage || m.MessageType == pausePublicationMessage {
+		return m, nil
+	}
+	if digest := sha256.Sum256(m.Payload); length > 0 && !bytes.Equal(digest[:], b[digestOffset:payloadTypeOffset]) {
+		return agentMessage{}, errors.New("agent message payload does not match its digest")
+	}
+	return m, nil
+}
+
+type acknowledgeContent struct {
+	MessageType         string `json:"AcknowledgedMessageType"`
+	MessageID           string `json:"AcknowledgedMessageId"`
+	SequenceNumber      int64  `json:"AcknowledgedMessageSequenceNumber"`
+	IsSequentialMessage bool   `json:"IsSequentialMessage"`
+}
+
+// acknowledgement is the message acknowledging m. Acknowledgements are not
+// sequenced themselves.
+func acknowledgement(m agentMessage) ([]byte, error) {
+	content, err := json.Marshal(acknowledgeContent{
+		MessageType:         m.MessageType,
+		MessageID:           m.MessageID.String(),
+		SequenceNumber:      m.SequenceNumber,
+		IsSequentialMessage: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ack := newAgentMessage(acknowledgeMessage, 0, 0, content)
+	ack.Flags = 3
+	return ack.marshal(), nil
+}
+
+// Handshake payloads, with the agent's JSON names.
+type (
+	handshakeRequest struct {
+		AgentVersion           string
+		RequestedClientActions []requestedClientAction
+	}
+	requestedClientAction struct {
+		ActionType       string
+		ActionParameters json.RawMessage
+	}
+	handshakeResponse struct {
+		ClientVersion          string
+		ProcessedClientActions []processedClientAction
+		Errors                 []string
+	}
+	processedClientAction struct {
+		ActionType   string
+		ActionStatus actionStatus
+		Error        string
+	}
+	sessionTypeRequest struct {
+		SessionType string
+	}
+	kmsEncryptionRequest struct {
+		KMSKeyID string `json:"KMSKeyId"`
+	}
+	channelClosed struct {
+		Output string
+	}
+)
+
+type actionStatus int
+
+const (
+	actionSuccess     actionStatus = 1
+	actionFailed      actionStatus = 2
+	actionUnsupported actionStatus = 3
+)
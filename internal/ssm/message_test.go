@@ -0,0 +1,74 @@
+package ssm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAgentMessageLayout(t *testing.T) {
+	m := newAgentMessage(inputStreamMessage, 7, payloadFlag, []byte{0, 0, 0, 1})
+	m.MessageID = uuid.MustParse("00010203-0405-0607-0809-0a0b0c0d0e0f")
+	raw := m.marshal()
+
+	if len(raw) != 116+4+4 || binary.BigEndian.Uint32(raw) != 116 {
+		t.Fatalf("header length = %d in %d bytes, want 116 in 124", binary.BigEndian.Uint32(raw), len(raw))
+	}
+	if got := string(raw[4:36]); got != inputStreamMessage+strings.Repeat(" ", 32-len(inputStreamMessage)) {
+		t.Fatalf("message type = %q, want it space padded", got)
+	}
+	if got := binary.BigEndian.Uint64(raw[48:]); got != 7 {
+		t.Fatalf("sequence number = %d, want 7", got)
+	}
+	if want := []byte{8, 9, 10, 11, 12, 13, 14, 15, 0, 1, 2, 3, 4, 5, 6, 7}; !bytes.Equal(raw[64:80], want) {
+		t.Fatalf("message ID = %v, want the low half first", raw[64:80])
+	}
+
+	back, err := unmarshalAgentMessage(raw)
+	if err != nil {
+		t.Fatalf("unmarshalAgentMessage() = %v", err)
+	}
+	if back.MessageType != m.MessageType || back.SequenceNumber != 7 || back.MessageID != m.MessageID ||
+		back.PayloadType != payloadFlag || !bytes.Equal(back.Payload, m.Payload) {
+		t.Fatalf("unmarshalAgentMessage() = %+v, want %+v", back, m)
+	}
+}
+
+func TestUnmarshalAgentMessageRejectsDamage(t *testing.T) {
+	raw := newAgentMessage(outputStreamMessage, 0, payloadOutput, []byte("payload")).marshal()
+
+	corrupt := bytes.Clone(raw)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, err := unmarshalAgentMessage(corrupt); err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Fatalf("unmarshalAgentMessage(corrupt) = %v, want a digest error", err)
+	}
+	if _, err := unmarshalAgentMessage(raw[:len(raw)-1]); err == nil {
+		t.Fatal("unmarshalAgentMessage(truncated) succeeded")
+	}
+	if _, err := unmarshalAgentMessage(raw[:100]); err == nil {
+		t.Fatal("unmarshalAgentMessage(header only) succeeded")
+	}
+}
+
+func TestAgentVersionAfter(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"3.0.196.0", false},
+		{"3.0.196.1", true},
+		{"3.0.1000.0", true},
+		{"3.0.161.0", false},
+		{"10.0.0.0", true},
+		{"3.1", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := agentVersionAfter(tt.version, multiplexingAgentVersion); got != tt.want {
+			t.Errorf("agentVersionAfter(%q) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package ssm
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+	"github.com/xtaci/smux"
+)
+
+// Prevent an unresponsive local client from pinning session shutdown.
+const drainGrace = 5 * time.Second
+
+// sessionStarter starts a session to replace one that ended.
+type sessionStarter func(context.Context) (SessionParams, error)
+
+// server forwards local connections over the session. Agents that multiplex
+// get one smux stream per connection; older ones carry a single connection at
+// a time, and the others wait their turn. Once the session ends, on an idle
+// timeout, the maximum session duration or an agent restart, the next
+// connection starts a new one.
+type server struct {
+	// start is nil when an ended session is not replaced.
+	start sessionStarter
+
+	mu      sync.Mutex
+	current *session
+	renewal *renewal
+	closed  bool
+}
+
+// session is one data channel and what its connections share.
+type session struct {
+	channel *dataChannel
+	mux     *smux.Session
+	turn    chan struct{}
+}
+
+type renewal struct {
+	done chan struct{}
+	err  error
+}
+
+func newServer(channel *dataChannel, start sessionStarter) (*server, error) {
+	current, err := newSession(channel)
+	if err != nil {
+		return nil, err
+	}
+	return &server{start: start, current: current}, nil
+}
+
+func newSession(channel *dataChannel) (*session, error) {
+	s := &session{channel: channel, turn: make(chan struct{}, 1)}
+	if channel.multiplexes() {
+		config := smux.DefaultConfig()
+		config.KeepAliveDisabled = agentVersionAfter(channel.agentVersion, smuxKeepAliveDisabledVersion)
+		mux, err := smux.Client(channel.stream(nil), config)
+		if err != nil {
+			return nil, err
+		}
+		s.mux = mux
+	}
+	go func() {
+		<-channel.done
+		if err := channel.Err(); err != nil {
+			log.Printf("data channel ended: %v", err)
+		}
+	}()
+	return s, nil
+}
+
+// ended reports whether the session can no longer carry connections: its
+// data channel ended, or smux gave up on it.
+func (s *session) ended() bool {
+	select {
+	case <-s.channel.done:
+		return true
+	default:
+		return s.mux != nil && s.mux.IsClosed()
+	}
+}
+
+func (s *session) close() error {
+	if s.mux != nil {
+		_ = s.mux.Close()
+	}
+	return s.channel.Close()
+}
+
+// session returns the current session, replacing it first when it has ended.
+// Concurrent callers share one replacement.
+func (s *server) session(ctx context.Context) (*session, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		current := s.current
+		if !current.ended() || s.start == nil {
+			s.mu.Unlock()
+			return current, nil
+		}
+		if attempt := s.renewal; attempt != nil {
+			s.mu.Unlock()
+			select {
+			case <-attempt.done:
+				if attempt.err != nil {
+					return nil, attempt.err
+				}
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		attempt := &renewal{done: make(chan struct{})}
+		s.renewal = attempt
+		s.mu.Unlock()
+
+		log.Printf("starting a new SSM session to replace %s", current.channel.sessionID)
+		next, err := s.renew(ctx)
+
+		s.mu.Lock()
+		s.renewal = nil
+		if err == nil {
+			if s.closed {
+				_ = next.close()
+				err = net.ErrClosed
+			} else {
+				s.current = next
+				// A session smux gave up on may still be open.
+				go func() { _ = current.close() }()
+			}
+		}
+		s.mu.Unlock()
+
+		attempt.err = err
+		close(attempt.done)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *server) renew(ctx context.Context) (*session, error) {
+	params, err := s.start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("start a new SSM session: %w", err)
+	}
+	channel, err := openDataChannel(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	next, err := newSession(channel)
+	if err != nil {
+		_ = channel.Close()
+		return nil, err
+	}
+	log.Printf("SSM session %s replaces the one that ended", params.SessionId)
+	return next, nil
+}
+
+// close ends the current session.
+func (s *server) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if err := s.current.close(); err != nil {
+		return fmt.Errorf("SSM session %s: %w", s.current.channel.sessionID, err)
+	}
+	return nil
+}
+
+func (s *server) handle(ctx context.Context, local net.Conn) {
+	current, err := s.session(ctx)
+	if err != nil {
+		log.Printf("SSM connection failed: %v", err)
+		return
+	}
+	if current.mux != nil {
+		remote, err := current.mux.OpenStream()
+		if err != nil {
+			log.Printf("SSM connection failed: %v", err)
+			return
+		}
+		libs.RelayDrain(local, remote, drainGrace)
+		return
+	}
+
+	select {
+	case current.turn <- struct{}{}:
+	case <-ctx.Done():
+		return
+	case <-current.channel.done:
+		return
+	}
+	defer func() { <-current.turn }()
+	// The agent drops its connection to the target on DisconnectToPort, and
+	// opens a new one when the next connection sends data.
+	remote := current.channel.stream(func() error { return current.channel.sendFlag(flagDisconnectToPort) })
+	libs.RelayDrain(local, remote, drainGrace)
+}
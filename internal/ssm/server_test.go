@@ -0,0 +1,100 @@
+package ssm
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerMultiplexesConnections(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	addr, _ := startServer(t, agent)
+
+	var wg sync.WaitGroup
+	for i := range 3 {
+		conn := dial(t, addr)
+		wg.Go(func() { assertEcho(t, conn, bytes.Repeat([]byte{byte(i)}, 64<<10)) })
+	}
+	wg.Wait()
+
+	agent.mu.Lock()
+	defer agent.mu.Unlock()
+	if len(agent.opens) != 1 {
+		t.Fatalf("opened %d data channels, want every connection on the session's", len(agent.opens))
+	}
+}
+
+// TestServerTakesTurnsWithoutMultiplexing serves an agent too old for smux:
+// the second connection waits for the first, and the agent is told when the
+// first one ends.
+func TestServerTakesTurnsWithoutMultiplexing(t *testing.T) {
+	agent := startFakeAgent(t, singleStreamVersion)
+	addr, channel := startServer(t, agent)
+	if channel.multiplexes() {
+		t.Fatalf("agent %s multiplexes", channel.agentVersion)
+	}
+
+	first := dial(t, addr)
+	assertEcho(t, first, []byte("first"))
+	second := dial(t, addr)
+	_ = first.Close()
+	assertEcho(t, second, []byte("second"))
+
+	if flags := agent.sentFlags(); !slices.Equal(flags, []portFlag{flagDisconnectToPort}) {
+		t.Fatalf("flags = %v, want DisconnectToPort once the first connection ended", flags)
+	}
+}
+
+// TestServerReplacesEndedSession has Session Manager end the session: the
+// next connection starts a new one and goes through it.
+func TestServerReplacesEndedSession(t *testing.T) {
+	for _, version := range []string{multiplexingVersion, singleStreamVersion} {
+		t.Run(version, func(t *testing.T) {
+			logs := captureLogs(t)
+			agent := startFakeAgent(t, version)
+			addr, channel := startServer(t, agent)
+			assertEcho(t, dial(t, addr), []byte("before"))
+
+			agent.closeSessions("Session idle timeout")
+			<-channel.done
+			after := dial(t, addr)
+			assertEcho(t, after, []byte("after"))
+			// Without multiplexing the next connection waits for this one.
+			_ = after.Close()
+			assertEcho(t, dial(t, addr), []byte("again"))
+
+			if opens := agent.openCount(); opens != 2 {
+				t.Fatalf("opened %d data channels, want the ended session replaced once", opens)
+			}
+			if want := "data channel ended: SSM session session-1: closed by Session Manager: Session idle timeout"; !strings.Contains(logs.String(), want) {
+				t.Fatalf("logs = %q, want %q", logs.String(), want)
+			}
+		})
+	}
+}
+
+// TestServerRetriesFailedReplacement fails to start a new session: the
+// connection is dropped, and the next one tries again.
+func TestServerRetriesFailedReplacement(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	addr, channel := startServer(t, agent)
+	agent.mu.Lock()
+	agent.failStarts = true
+	agent.mu.Unlock()
+	agent.closeSessions("Session idle timeout")
+	<-channel.done
+
+	conn := dial(t, addr)
+	_ = conn.SetReadDeadline(time.Now().Add(testConnectionTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read through a session that could not be replaced")
+	}
+
+	agent.mu.Lock()
+	agent.failStarts = false
+	agent.mu.Unlock()
+	assertEcho(t, dial(t, addr), []byte("after"))
+}
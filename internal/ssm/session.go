@@ -2,29 +2,56 @@ package ssm
 
 import (
 	"context"
+	"errors"
+	"maps"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/dfns/terraform-provider-tunnel/internal/awsconfig"
 )
 
 // Default SSM document for port forwarding.
 const DefaultSSMDocument = "AWS-StartPortForwardingSessionToRemoteHost"
 
+// NodeSSMDocument forwards to a port on the managed node itself.
+const NodeSSMDocument = "AWS-StartPortForwardingSession"
+
 const sessionCleanupTimeout = 10 * time.Second
 
 type TunnelConfig struct {
-	LocalPort   string
+	LocalHost string
+	LocalPort string
+	// LocalSocket is a unix socket path to listen on instead of
+	// LocalHost:LocalPort.
+	LocalSocket string
 	SSMInstance string
+	// SSMInstanceFilters, when set, pick SSMInstance again whenever a
+	// session is started.
+	SSMInstanceFilters *InstanceFilters `json:",omitempty"`
+	// ECSTask, when set, picks the ECS Exec target SSMInstance is set to
+	// whenever a session is started.
+	ECSTask     *ECSTask `json:",omitempty"`
 	SSMDocument string
-	SSMProfile  string
-	SSMRoleARN  string
-	SSMRegion   string
-	TargetHost  string
-	TargetPort  string
+	// SSMDocumentParameters are passed to the document along with the
+	// parameters the tunnel sets.
+	SSMDocumentParameters map[string][]string `json:",omitempty"`
+	// Reason is recorded with the session.
+	Reason string
+	// SSMEndpointURL overrides the SSM endpoint.
+	SSMEndpointURL string
+	// ECSEndpointURL overrides the ECS endpoint.
+	ECSEndpointURL string
+	// WaitForTarget is how many seconds to wait for the managed node to be
+	// online and accept the session.
+	WaitForTarget int
+	SSMProfile    string
+	SSMRoleARN    string
+	SSMRegion     string
+	TargetHost    string
+	TargetPort    string
 
 	// SessionParams is set by the parent to hand the started session to the
 	// forked child, and is unset everywhere else.
@@ -38,28 +65,7 @@ type SessionParams struct {
 }
 
 func GetNewSDKConfig(ctx context.Context, cfg TunnelConfig) (aws.Config, error) {
-	loadOptions := []func(*config.LoadOptions) error{}
-	if cfg.SSMRegion != "" {
-		loadOptions = append(loadOptions, config.WithRegion(cfg.SSMRegion))
-	}
-	if cfg.SSMProfile != "" {
-		loadOptions = append(loadOptions, config.WithSharedConfigProfile(cfg.SSMProfile))
-	}
-
-	// Load base config first
-	awsCfg, err := config.LoadDefaultConfig(ctx, loadOptions...)
-	if err != nil {
-		return aws.Config{}, err
-	}
-
-	// If role assumption is required, create STS client and configure assume role
-	if cfg.SSMRoleARN != "" {
-		stsClient := sts.NewFromConfig(awsCfg)
-		assumeRoleProvider := stscreds.NewAssumeRoleProvider(stsClient, cfg.SSMRoleARN)
-		awsCfg.Credentials = aws.NewCredentialsCache(assumeRoleProvider)
-	}
-
-	return awsCfg, nil
+	return awsconfig.Load(ctx, cfg.SSMRegion, cfg.SSMProfile, cfg.SSMRoleARN)
 }
 
 func GetSDKConfigProfile(awsCfg aws.Config) string {
@@ -81,8 +87,14 @@ func GetSDKConfigRole(awsCfg aws.Config) string {
 }
 
 func CreateSessionInput(cfg TunnelConfig) ssm.StartSessionInput {
-	reqParams := make(map[string][]string)
-	reqParams["localPortNumber"] = []string{cfg.LocalPort}
+	reqParams := maps.Clone(cfg.SSMDocumentParameters)
+	if reqParams == nil {
+		reqParams = make(map[string][]string)
+	}
+	// A tunnel on a unix socket has no port and leaves the document's default.
+	if cfg.LocalPort != "" {
+		reqParams["localPortNumber"] = []string{cfg.LocalPort}
+	}
 
 	docName := cfg.SSMDocument
 	if docName == "" {
@@ -97,26 +109,43 @@ func CreateSessionInput(cfg TunnelConfig) ssm.StartSessionInput {
 		reqParams["portNumber"] = []string{cfg.TargetPort}
 	}
 
-	return ssm.StartSessionInput{
+	input := ssm.StartSessionInput{
 		Target:       aws.String(cfg.SSMInstance),
 		DocumentName: aws.String(docName),
 		Parameters:   reqParams,
 	}
+	if cfg.Reason != "" {
+		input.Reason = aws.String(cfg.Reason)
+	}
+	return input
 }
 
+// startTunnelSession starts the session, retrying for up to
+// cfg.WaitForTarget seconds while Session Manager reports the node not
+// connected: the agent can be online a moment before it takes sessions.
 func startTunnelSession(ctx context.Context, ssmClient *ssm.Client, cfg TunnelConfig) (SessionParams, error) {
-	// Make a request to start a session
 	sessionInput := CreateSessionInput(cfg)
-	sessionResponse, err := ssmClient.StartSession(ctx, &sessionInput)
-	if err != nil {
-		return SessionParams{}, err
+	deadline := time.Now().Add(time.Duration(cfg.WaitForTarget) * time.Second)
+	interval := targetPollInterval
+	for {
+		sessionResponse, err := ssmClient.StartSession(ctx, &sessionInput)
+		var notConnected *types.TargetNotConnected
+		if errors.As(err, &notConnected) && !time.Now().Add(interval).After(deadline) {
+			if err := sleepContext(ctx, interval); err != nil {
+				return SessionParams{}, err
+			}
+			interval = min(2*interval, maxTargetPollInterval)
+			continue
+		}
+		if err != nil {
+			return SessionParams{}, err
+		}
+		return SessionParams{
+			SessionId:  *sessionResponse.SessionId,
+			TokenValue: *sessionResponse.TokenValue,
+			StreamUrl:  *sessionResponse.StreamUrl,
+		}, nil
 	}
-
-	return SessionParams{
-		SessionId:  *sessionResponse.SessionId,
-		TokenValue: *sessionResponse.TokenValue,
-		StreamUrl:  *sessionResponse.StreamUrl,
-	}, nil
 }
 
 // terminateTunnelSession closes a session no plugin ever took over, which SSM
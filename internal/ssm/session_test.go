@@ -9,7 +9,8 @@ import (
 
 // TestCreateSessionInput verifies the AWS port-forwarding request is assembled
 // from the tunnel config: the document name defaults or follows SSMDocument,
-// localPort is always set, and host/port are included only when configured.
+// localPort is set unless the tunnel listens on a unix socket, and host/port
+// are included only when configured.
 func TestCreateSessionInput(t *testing.T) {
 	t.Run("default document when SSMDocument is empty", func(t *testing.T) {
 		cfg := TunnelConfig{
@@ -82,6 +83,46 @@ func TestCreateSessionInput(t *testing.T) {
 		in := CreateSessionInput(cfg)
 		assertPortForwardParams(t, in.Parameters, "", "")
 	})
+
+	t.Run("omits local port for a unix socket", func(t *testing.T) {
+		cfg := TunnelConfig{
+			LocalSocket: "/run/tunnel.sock",
+			SSMInstance: "i-0abc123",
+			TargetHost:  "db.internal",
+			TargetPort:  "5432",
+		}
+
+		in := CreateSessionInput(cfg)
+		if got, ok := in.Parameters["localPortNumber"]; ok {
+			t.Errorf("parameter %q = %v, want it unset", "localPortNumber", got)
+		}
+	})
+
+	t.Run("merges document parameters and reason", func(t *testing.T) {
+		cfg := TunnelConfig{
+			LocalPort:   "12345",
+			SSMInstance: "i-0abc123",
+			SSMDocument: "My-Custom-PortForwardDoc",
+			SSMDocumentParameters: map[string][]string{
+				"socketPath": {"/run/postgresql/.s.PGSQL.5432"},
+				"portNumber": {"80"},
+			},
+			Reason:     "CHG-1234",
+			TargetPort: "5432",
+		}
+
+		in := CreateSessionInput(cfg)
+		assertPortForwardParams(t, in.Parameters, "5432", "")
+		if got := in.Parameters["socketPath"]; len(got) != 1 || got[0] != "/run/postgresql/.s.PGSQL.5432" {
+			t.Errorf("parameter %q = %v, want the document parameter", "socketPath", got)
+		}
+		if in.Reason == nil || *in.Reason != "CHG-1234" {
+			t.Errorf("Reason = %v, want %q", in.Reason, "CHG-1234")
+		}
+		if len(cfg.SSMDocumentParameters["portNumber"]) != 1 || cfg.SSMDocumentParameters["portNumber"][0] != "80" {
+			t.Errorf("SSMDocumentParameters modified: %v", cfg.SSMDocumentParameters)
+		}
+	})
 }
 
 func assertPortForwardParams(t *testing.T, params map[string][]string, wantPort, wantHost string) {
@@ -6,49 +6,35 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	pluginSession "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session"
-	_ "github.com/aws/session-manager-plugin/src/sessionmanagerplugin/session/portsession"
-	"github.com/aws/smithy-go/ptr"
 	"github.com/dfns/terraform-provider-tunnel/internal/libs"
 )
 
 var TunnelType string = "ssm"
 
-func GetEndpoint(ctx context.Context, region string) (string, error) {
-	resolver := ssm.NewDefaultEndpointResolverV2()
-	endpoint, err := resolver.ResolveEndpoint(ctx, ssm.EndpointParameters{
-		Region: ptr.String(region),
-	})
-	if err != nil {
-		return "", err
-	}
-	return endpoint.URI.String(), nil
-}
+// DefaultLocalHost is where the tunnel listens when no local host is set.
+const DefaultLocalHost = "localhost"
 
 func ForkRemoteTunnel(ctx context.Context, awsCfg aws.Config, cfg TunnelConfig) (*exec.Cmd, error) {
 	// The session is started here rather than in the child so that credential
 	// resolution stays in the provider process, as the AWS CLI does before
 	// handing the response to the plugin, last checked at
 	// https://github.com/aws/aws-cli/blob/5ad8dc60682d72edf21be96f0a591402f91ee45e/awscli/customizations/sessionmanager.py
-	ssmClient := ssm.NewFromConfig(awsCfg)
+	ssmClient := newClient(awsCfg, cfg)
 	sessionParams, err := startTunnelSession(ctx, ssmClient, cfg)
 	if err != nil {
 		return nil, err
 	}
 	cfg.SessionParams = &sessionParams
 
-	logPort := cfg.TargetPort
-	if logPort == "" {
-		logPort = cfg.LocalPort
-	}
-	logName := fmt.Sprintf("ssm-tunnel-%s-%s.log", cfg.SSMInstance, logPort)
-
-	cmd, err := libs.ForkTunnel(ctx, TunnelType, logName, cfg)
+	cmd, err := libs.ForkTunnel(ctx, TunnelType, logName(cfg), cfg)
 	if err != nil {
 		if terr := terminateTunnelSession(ctx, ssmClient, sessionParams); terr != nil {
 			log.Printf("failed to terminate SSM session %s: %v", sessionParams.SessionId, terr)
@@ -57,7 +43,21 @@ func ForkRemoteTunnel(ctx context.Context, awsCfg aws.Config, cfg TunnelConfig)
 	return cmd, err
 }
 
-func StartRemoteTunnel(ctx context.Context, cfgJson string, parentPid int) (err error) {
+// logName names the child's log file after the target, whose ECS Exec form
+// holds characters file names cannot.
+func logName(cfg TunnelConfig) string {
+	logPort := cfg.TargetPort
+	if logPort == "" {
+		logPort = cfg.LocalPort
+	}
+	if logPort == "" {
+		logPort = filepath.Base(cfg.LocalSocket)
+	}
+	target := strings.NewReplacer(":", "_", "/", "_", `\`, "_").Replace(cfg.SSMInstance)
+	return fmt.Sprintf("ssm-tunnel-%s-%s.log", target, logPort)
+}
+
+func StartRemoteTunnel(ctx context.Context, cfgJson string, parentPid int) error {
 	var cfg TunnelConfig
 	if err := json.Unmarshal([]byte(cfgJson), &cfg); err != nil {
 		return err
@@ -67,51 +67,78 @@ func StartRemoteTunnel(ctx context.Context, cfgJson string, parentPid int) (err
 	}
 
 	// Watch parent process lifecycle ie. main terraform process
-	err = libs.WatchProcess(parentPid)
-	if err != nil {
+	if err := libs.WatchProcess(parentPid); err != nil {
 		return err
 	}
 
-	sessionParamsJson, err := json.Marshal(cfg.SessionParams)
+	return serveTunnel(ctx, cfg, sessionStarterFor(cfg))
+}
+
+// serveTunnel forwards the local end of the tunnel over the session cfg
+// carries, and over the sessions start replaces it with once it ends.
+func serveTunnel(ctx context.Context, cfg TunnelConfig, start sessionStarter) error {
+	channel, err := openDataChannel(ctx, *cfg.SessionParams)
 	if err != nil {
 		return err
 	}
-
-	sessionInput := CreateSessionInput(cfg)
-	sessionInputJson, err := json.Marshal(sessionInput)
+	server, err := newServer(channel, start)
 	if err != nil {
+		_ = channel.Close()
 		return err
 	}
+	defer func() {
+		if err := server.close(); err != nil {
+			log.Printf("failed to terminate %v", err)
+		}
+	}()
 
-	endpointUrl, err := GetEndpoint(ctx, cfg.SSMRegion)
+	listener, err := listen(cfg)
 	if err != nil {
-		return err
+		return fmt.Errorf("listen on local address: %w", err)
 	}
+	connServer := libs.NewConnServer(listener, server.handle)
+	defer connServer.Close()
 
-	// Positional layout copied from the AWS CLI, last checked at
-	// https://github.com/aws/aws-cli/blob/5ad8dc60682d72edf21be96f0a591402f91ee45e/awscli/customizations/sessionmanager.py
-	// Newer CLIs hand the plugin an env var name here instead, but the vendored
-	// plugin only reads the response itself from this argument.
-	args := []string{
-		"session-manager-plugin",
-		string(sessionParamsJson),
-		cfg.SSMRegion,
-		"StartSession",
-		cfg.SSMProfile,
-		string(sessionInputJson),
-		endpointUrl,
+	if err := libs.SignalReadyIfRequested(); err != nil {
+		return err
 	}
+	log.Printf("SSM tunnel for session %s listening on %s", cfg.SessionParams.SessionId, listener.Addr())
+	runCtx, cancel := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancel()
+	return connServer.Serve(runCtx)
+}
 
-	// The plugin blocks for the tunnel's lifetime and exposes no readiness hook,
-	// so readiness is reported from the outside once it binds the local port.
-	go func() {
-		if err := libs.SignalReadyWhenServing(ctx, "localhost", cfg.LocalPort); err != nil {
-			log.Printf("failed to signal tunnel readiness: %v", err)
+// sessionStarterFor starts replacement sessions with credentials resolved
+// the way the provider resolved them, from the profile, role and region it
+// recorded in cfg. With instance filters or an ECS service, the target is
+// picked again, since the session may have ended with the node or task it
+// was on.
+func sessionStarterFor(cfg TunnelConfig) sessionStarter {
+	return func(ctx context.Context) (SessionParams, error) {
+		awsCfg, err := GetNewSDKConfig(ctx, cfg)
+		if err != nil {
+			return SessionParams{}, err
 		}
-	}()
-
-	// call session-manager-plugin to start the tunnel
-	pluginSession.ValidateInputAndStartSession(args, os.Stdout)
+		previous := cfg.SSMInstance
+		if err := ResolveInstance(ctx, awsCfg, &cfg); err != nil {
+			return SessionParams{}, err
+		}
+		if cfg.SSMInstance != previous {
+			log.Printf("SSM target %s replaces %s", cfg.SSMInstance, previous)
+		}
+		return startTunnelSession(ctx, newClient(awsCfg, cfg), cfg)
+	}
+}
 
-	return
+// listen opens the tunnel's local end: cfg.LocalSocket when set, otherwise
+// cfg.LocalHost:cfg.LocalPort.
+func listen(cfg TunnelConfig) (net.Listener, error) {
+	if cfg.LocalSocket != "" {
+		return net.Listen("unix", cfg.LocalSocket)
+	}
+	host := strings.TrimSpace(cfg.LocalHost)
+	if host == "" {
+		host = DefaultLocalHost
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, cfg.LocalPort))
 }
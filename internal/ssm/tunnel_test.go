@@ -0,0 +1,164 @@
+package ssm
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dfns/terraform-provider-tunnel/internal/libs"
+)
+
+func startRemoteTunnel(t *testing.T, ctx context.Context, agent *fakeAgent) (addr string, done <-chan error) {
+	t.Helper()
+	port, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done = runRemoteTunnel(t, ctx, agent, TunnelConfig{LocalPort: strconv.Itoa(port)})
+	return "localhost:" + strconv.Itoa(port), done
+}
+
+// runRemoteTunnel starts the child end of a tunnel listening where cfg says,
+// with agent standing in for StartSession, and waits for it to be ready.
+func runRemoteTunnel(t *testing.T, ctx context.Context, agent *fakeAgent, cfg TunnelConfig) <-chan error {
+	t.Helper()
+	session := agent.session()
+	cfg.SSMInstance = "i-0abc123"
+	cfg.SessionParams = &session
+	ready := t.TempDir() + "/ready"
+	t.Setenv(libs.TunnelReadyEnv, ready)
+	errc := make(chan error, 1)
+	go func() { errc <- serveTunnel(ctx, cfg, agent.startSession) }()
+	waitFor(t, "the tunnel to be ready", func() bool {
+		_, err := os.Stat(ready)
+		return err == nil
+	})
+	return errc
+}
+
+func TestServeTunnelServesUntilCancelled(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, done := startRemoteTunnel(t, ctx, agent)
+
+	assertEcho(t, dial(t, addr), []byte("through the tunnel"))
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serveTunnel() = %v", err)
+		}
+	case <-time.After(testConnectionTimeout):
+		t.Fatal("the tunnel outlived its context")
+	}
+	waitFor(t, "TerminateSession sent", func() bool { return slices.Contains(agent.sentFlags(), flagTerminateSession) })
+}
+
+// TestServeTunnelOutlivesSession has Session Manager end the session:
+// the tunnel keeps its port and forwards over a new session.
+func TestServeTunnelOutlivesSession(t *testing.T) {
+	logs := captureLogs(t)
+	agent := startFakeAgent(t, multiplexingVersion)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, done := startRemoteTunnel(t, ctx, agent)
+
+	agent.closeSessions("Session idle timeout")
+	waitFor(t, "the session to end", func() bool { return strings.Contains(logs.String(), "data channel ended") })
+	select {
+	case err := <-done:
+		t.Fatalf("serveTunnel() = %v, want the tunnel kept", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assertEcho(t, dial(t, addr), []byte("through a new session"))
+	if opens := agent.openCount(); opens != 2 {
+		t.Fatalf("opened %d data channels, want the ended session replaced", opens)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serveTunnel() = %v", err)
+	}
+}
+
+// TestSessionStarterAssumesProfileRoleOnce starts a replacement session with
+// a profile that assumes a role: the role is assumed once, with the source
+// profile's key.
+func TestSessionStarterAssumesProfileRoleOnce(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	standIn := startSSMStandIn(t, agent)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	t.Setenv("AWS_ENDPOINT_URL_STS", standIn.url)
+	profiles := map[string]string{
+		"AWS_CONFIG_FILE":             "[profile tunnel]\nrole_arn = arn:aws:iam::123456789012:role/tunnel\nsource_profile = base\n",
+		"AWS_SHARED_CREDENTIALS_FILE": "[base]\naws_access_key_id = AKIDBASE\naws_secret_access_key = secret\n",
+	}
+	for env, content := range profiles {
+		if err := os.WriteFile(os.Getenv(env), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := sessionStarterFor(TunnelConfig{
+		SSMInstance:    "i-0aaaaaaaaaaaaaaaa",
+		SSMProfile:     "tunnel",
+		SSMRegion:      "eu-west-1",
+		SSMEndpointURL: standIn.url,
+	})
+
+	if _, err := start(context.Background()); err != nil {
+		t.Fatalf("start() = %v", err)
+	}
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	if want := []string{"arn:aws:iam::123456789012:role/tunnel by AKIDBASE"}; !slices.Equal(standIn.assumed, want) {
+		t.Fatalf("AssumeRole calls %v, want %v", standIn.assumed, want)
+	}
+}
+
+func TestServeTunnelListensOnLocalHost(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	port, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRemoteTunnel(t, t.Context(), agent, TunnelConfig{LocalHost: "127.0.0.1", LocalPort: strconv.Itoa(port)})
+
+	assertEcho(t, dial(t, "127.0.0.1:"+strconv.Itoa(port)), []byte("through the tunnel"))
+}
+
+func TestServeTunnelListensOnSocket(t *testing.T) {
+	agent := startFakeAgent(t, multiplexingVersion)
+	// Unix socket paths are short; the test's temporary directory may not be.
+	dir, err := os.MkdirTemp("", "ssm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "tunnel.sock")
+	runRemoteTunnel(t, t.Context(), agent, TunnelConfig{LocalSocket: socket})
+
+	conn, err := net.DialTimeout("unix", socket, testConnectionTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("through the socket"))
+}
+
+func TestLogNameSanitizesTarget(t *testing.T) {
+	cfg := TunnelConfig{SSMInstance: "ecs:tunnel_0aaa_0aaa-1234567890", TargetPort: "5432"}
+	if got, want := logName(cfg), "ssm-tunnel-ecs_tunnel_0aaa_0aaa-1234567890-5432.log"; got != want {
+		t.Fatalf("logName() = %q, want %q", got, want)
+	}
+	cfg = TunnelConfig{SSMInstance: "i-0abc", LocalSocket: "/run/tunnel.sock"}
+	if got, want := logName(cfg), "ssm-tunnel-i-0abc-tunnel.sock.log"; got != want {
+		t.Fatalf("logName() = %q, want %q", got, want)
+	}
+}
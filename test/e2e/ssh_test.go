@@ -32,7 +32,7 @@ func TestSSHTunnelE2E(t *testing.T) {
 
 	// Client key passed to the provider as PEM content, authorized on the server.
 	keyPEM, authorizedKey := sshtest.GenerateClientKey(t)
-	sshPort := sshtest.StartServer(t, authorizedKey)
+	bastion := sshtest.StartServer(t, authorizedKey)
 
 	moduleDir := t.TempDir()
 
@@ -46,13 +46,14 @@ terraform {
 }
 
 data "tunnel_ssh" "t" {
-  ssh_host    = "127.0.0.1"
-  ssh_port    = %d
-  ssh_user    = %q
-  ssh_key     = <<EOT
+  ssh_host     = "127.0.0.1"
+  ssh_port     = %d
+  ssh_user     = %q
+  ssh_host_key = [%q]
+  ssh_key      = <<EOT
 %sEOT
-  target_host = "127.0.0.1"
-  target_port = %d
+  target_host  = "127.0.0.1"
+  target_port  = %d
 }
 
 resource "terraform_data" "probe" {
@@ -65,7 +66,7 @@ resource "terraform_data" "probe" {
 output "local_port" {
   value = data.tunnel_ssh.t.local_port
 }
-`, sshPort, sshtest.User, keyPEM, targetPort)
+`, bastion.Port, sshtest.User, bastion.AuthorizedHostKey(), keyPEM, targetPort)
 
 	terraformApply(t, moduleDir, config)
 
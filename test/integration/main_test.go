@@ -37,6 +37,7 @@ const (
 
 	// Config passed down to the forker helper for the parent-exit teardown test.
 	sshKeyEnv        = "TUNNEL_IT_SSH_KEY"
+	sshHostKeyEnv    = "TUNNEL_IT_SSH_HOST_KEY"
 	sshPortEnv       = "TUNNEL_IT_SSH_PORT"
 	localPortEnv     = "TUNNEL_IT_LOCAL_PORT"
 	targetPortEnv    = "TUNNEL_IT_TARGET_PORT"
@@ -106,13 +107,14 @@ func runForker() {
 	targetPort, _ := strconv.Atoi(os.Getenv(targetPortEnv))
 
 	cmd, err := ssh.ForkRemoteTunnel(context.Background(), ssh.TunnelConfig{
-		LocalPort:  localPort,
-		SSHHost:    "127.0.0.1",
-		SSHPort:    sshPort,
-		SSHUser:    sshtest.User,
-		SSHKey:     os.Getenv(sshKeyEnv),
-		TargetHost: "127.0.0.1",
-		TargetPort: targetPort,
+		LocalPort:   localPort,
+		SSHHost:     "127.0.0.1",
+		SSHHostKeys: []string{os.Getenv(sshHostKeyEnv)},
+		SSHPort:     sshPort,
+		SSHUser:     sshtest.User,
+		SSHKey:      os.Getenv(sshKeyEnv),
+		TargetHost:  "127.0.0.1",
+		TargetPort:  targetPort,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "forker: ForkRemoteTunnel: %v\n", err)
@@ -25,9 +25,9 @@ import (
 const sshTargetBody = "tunnel-it-ok"
 
 // startSSHTarget stands up an in-process HTTP target and SSH bastion (both in
-// the test process), returning the bastion port, the target port, and the PEM
-// client key authorized on the bastion. Shared by the SSH fork tests.
-func startSSHTarget(t *testing.T) (sshPort, targetPort int, keyPEM string) {
+// the test process), returning the bastion, the target port, and the PEM client
+// key authorized on the bastion. Shared by the SSH fork tests.
+func startSSHTarget(t *testing.T) (bastion *sshtest.Server, targetPort int, keyPEM string) {
 	t.Helper()
 
 	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
@@ -56,7 +56,7 @@ func startSSHTarget(t *testing.T) (sshPort, targetPort int, keyPEM string) {
 // the tunnel down with libs.Interrupt — the exact call the provider's Close
 // uses — asserting the forked process releases its port.
 func TestSSHForkRemoteTunnelLifecycle(t *testing.T) {
-	sshPort, targetPort, keyPEM := startSSHTarget(t)
+	bastion, targetPort, keyPEM := startSSHTarget(t)
 
 	localPort, err := libs.GetFreePort()
 	if err != nil {
@@ -64,14 +64,15 @@ func TestSSHForkRemoteTunnelLifecycle(t *testing.T) {
 	}
 
 	cmd, err := ssh.ForkRemoteTunnel(context.Background(), ssh.TunnelConfig{
-		LocalHost:  "127.0.0.1", // exercise the configurable bind address
-		LocalPort:  localPort,
-		SSHHost:    "127.0.0.1",
-		SSHPort:    sshPort,
-		SSHUser:    sshtest.User,
-		SSHKey:     keyPEM,
-		TargetHost: "127.0.0.1",
-		TargetPort: targetPort,
+		LocalHost:   "127.0.0.1", // exercise the configurable bind address
+		LocalPort:   localPort,
+		SSHHost:     "127.0.0.1",
+		SSHHostKeys: []string{bastion.AuthorizedHostKey()},
+		SSHPort:     bastion.Port,
+		SSHUser:     sshtest.User,
+		SSHKey:      keyPEM,
+		TargetHost:  "127.0.0.1",
+		TargetPort:  targetPort,
 	})
 	if err != nil {
 		t.Fatalf("ForkRemoteTunnel: %v", err)
@@ -119,7 +120,7 @@ func TestSSHForkRemoteTunnelLifecycle(t *testing.T) {
 // WatchProcess (not a synthetic stand-in) must notice and self-terminate,
 // releasing the forwarded port. This is the production teardown path end-to-end.
 func TestSSHForkParentExitTeardown(t *testing.T) {
-	sshPort, targetPort, keyPEM := startSSHTarget(t)
+	bastion, targetPort, keyPEM := startSSHTarget(t)
 
 	localPort, err := libs.GetFreePort()
 	if err != nil {
@@ -129,7 +130,8 @@ func TestSSHForkParentExitTeardown(t *testing.T) {
 
 	parent := spawnHelper(t, modeForkParent,
 		sshKeyEnv+"="+keyPEM,
-		sshPortEnv+"="+strconv.Itoa(sshPort),
+		sshHostKeyEnv+"="+bastion.AuthorizedHostKey(),
+		sshPortEnv+"="+strconv.Itoa(bastion.Port),
 		localPortEnv+"="+strconv.Itoa(localPort),
 		targetPortEnv+"="+strconv.Itoa(targetPort),
 		forkerPidfileEnv+"="+pidfile,
@@ -171,3 +173,109 @@ func readPidfile(path string) int {
 	}
 	return pid
 }
+
+// TestSSHForkReverseTunnel runs the forked reverse tunnel: the bastion listens
+// on a port it chooses, which the child hands back with its readiness, and
+// relays to a service next to the test.
+func TestSSHForkReverseTunnel(t *testing.T) {
+	bastion, targetPort, keyPEM := startSSHTarget(t)
+
+	cmd, remotePort, err := ssh.ForkReverseTunnel(context.Background(), ssh.ReverseTunnelConfig{
+		TunnelConfig: ssh.TunnelConfig{
+			LocalHost:   "127.0.0.1",
+			LocalPort:   targetPort,
+			SSHHost:     "127.0.0.1",
+			SSHHostKeys: []string{bastion.AuthorizedHostKey()},
+			SSHPort:     bastion.Port,
+			SSHUser:     sshtest.User,
+			SSHKey:      keyPEM,
+		},
+	})
+	if err != nil {
+		t.Fatalf("ForkReverseTunnel: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = libs.Interrupt(cmd.Process.Pid)
+		_ = cmd.Wait()
+	})
+	if remotePort == 0 {
+		t.Fatal("ForkReverseTunnel returned port 0, want the port the bastion bound")
+	}
+
+	remoteAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(remotePort))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/", remoteAddr))
+	if err != nil {
+		t.Fatalf("request through the bastion's listener: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading tunneled response: %v", err)
+	}
+	if string(body) != sshTargetBody {
+		t.Fatalf("tunnel returned %q, want %q", body, sshTargetBody)
+	}
+
+	// Closing the tunnel cancels the forward, so the bastion stops listening.
+	if err := libs.Interrupt(cmd.Process.Pid); err != nil {
+		t.Fatalf("Interrupt: %v", err)
+	}
+	requireEventually(t, 15*time.Second, func() error { return checkPortClosed(remoteAddr) },
+		"bastion still listening after the reverse tunnel was interrupted")
+}
+
+// TestSSHForkSOCKSTunnel sends an HTTP request through the forked SOCKS5 proxy,
+// naming the target by host name the way clients leave resolution to the
+// proxy.
+func TestSSHForkSOCKSTunnel(t *testing.T) {
+	bastion, targetPort, keyPEM := startSSHTarget(t)
+
+	localPort, err := libs.GetFreePort()
+	if err != nil {
+		t.Fatalf("allocating local port: %v", err)
+	}
+	cmd, err := ssh.ForkSOCKSTunnel(context.Background(), ssh.SOCKSTunnelConfig{
+		TunnelConfig: ssh.TunnelConfig{
+			LocalHost:   "127.0.0.1",
+			LocalPort:   localPort,
+			SSHHost:     "127.0.0.1",
+			SSHHostKeys: []string{bastion.AuthorizedHostKey()},
+			SSHPort:     bastion.Port,
+			SSHUser:     sshtest.User,
+			SSHKey:      keyPEM,
+		},
+		AllowedDestinations: []string{"localhost"},
+	})
+	if err != nil {
+		t.Fatalf("ForkSOCKSTunnel: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = libs.Interrupt(cmd.Process.Pid)
+		_ = cmd.Wait()
+	})
+
+	proxyAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))
+	proxyURL := &url.URL{Scheme: "socks5", Host: proxyAddr}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/", targetPort))
+	if err != nil {
+		t.Fatalf("request through SOCKS5 proxy: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		t.Fatalf("reading proxied response: %v", err)
+	}
+	if string(body) != sshTargetBody {
+		t.Fatalf("proxy returned %q, want %q", body, sshTargetBody)
+	}
+
+	// The allowlist names localhost only, so its address is refused.
+	if _, err := client.Get(fmt.Sprintf("http://127.0.0.1:%d/", targetPort)); err == nil {
+		t.Fatal("request to a destination outside allowed_destinations succeeded")
+	}
+}